@@ -2,7 +2,16 @@ package api
 
 import (
 	apimethods "app/api/methods"
+	"app/pkg/bonuses"
+	"app/pkg/outbox"
+	"app/pkg/overdraft"
+	"app/pkg/pending"
+	"app/pkg/rates"
+	"app/pkg/scheduler"
+	"app/pkg/snapshots"
+	"app/pkg/webhooks"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
 )
 
 type api struct {
@@ -19,6 +28,75 @@ func CreateApi(pgxPool *pgxpool.Pool) Api {
 
 type Api interface {
 	GetBalance(id int) (int, float64, error)
+	GetBalances(ids []int) (map[int]float64, error)
+	GetWallets(id int, currency string) ([]apimethods.Wallet, error)
 	RefillAndWithdrawMoney(id int, sum float64) (int, float64, error)
+	RefillAndWithdrawWallet(id int, currency string, sum float64) (int, float64, error)
+	RefillAndWithdrawMember(id, member int, currency string, sum float64) (int, float64, error)
 	TransferMoney(from, to int, sum float64) (int, float64, int, float64, error)
+	TransferWallet(from, to int, currency, toCurrency string, sum float64) (int, float64, int, float64, error)
+	TransferMember(from, member, to int, currency, toCurrency string, sum float64) (int, float64, int, float64, error)
+	ExecuteBatch(ops []apimethods.Operation, atomic bool) ([]apimethods.OperationResult, error)
+	CreateWebhook(url string, eventTypes []string, secret string) (int, error)
+	ListWebhooks() ([]apimethods.Webhook, error)
+	DeleteWebhook(id int) error
+	ListDeadLetters() ([]apimethods.DeadLetter, error)
+	ReplayDeadLetter(id int64) error
+	TrialBalance() (apimethods.TrialBalance, error)
+	RefundTransaction(id int64, sum float64, reason, initiator string, force bool) (apimethods.Refund, error)
+	SetAccountStatus(id int, status, reason string, payout bool) (float64, error)
+	GetLimits(id int) ([]apimethods.Limit, error)
+	SetLimit(id int, operation, period string, amount float64) error
+	QuoteTransfer(from, to int, currency string, sum float64) (apimethods.Quote, error)
+	SetFeeRule(r apimethods.FeeRule) error
+	QuoteExchange(id int, from, to string, sum float64) (apimethods.ExchangeQuote, error)
+	ConfirmExchange(id int, quoteID string) (apimethods.Exchange, error)
+	ConvertBalance(id int, currency string, asOf time.Time) (apimethods.Conversion, error)
+	BalanceAt(id int, currency string, asOf time.Time) (float64, error)
+	WriteStatement(id int, currency string, from, to time.Time, w apimethods.StatementWriter) error
+	GrantBonus(id int, amount float64, expiresAt time.Time, services []string, comment string) (apimethods.BonusGrant, error)
+	PayService(id int, service string, sum float64) (apimethods.Payment, error)
+	CreateVoucherBatch(b apimethods.VoucherBatch) (apimethods.VoucherBatch, error)
+	ExportVouchers(batchID int64, write func(apimethods.Voucher) error) error
+	VoucherBatchStats(batchID int64) (apimethods.VoucherStats, error)
+	RedeemVoucher(id int, code string) (apimethods.Redemption, error)
+	SplitTransfer(s apimethods.Split) (apimethods.SplitResult, error)
+	HoldTransfer(from, to int, currency, toCurrency string, sum float64) (apimethods.PendingTransfer, error)
+	AcceptTransfer(id int64, user int) (apimethods.PendingTransfer, error)
+	DeclineTransfer(id int64, user int) (apimethods.PendingTransfer, error)
+	CancelTransfer(id int64, user int) (apimethods.PendingTransfer, error)
+	ListPendingTransfers(id int) ([]apimethods.PendingTransfer, error)
+	CreatePaymentRequest(r apimethods.PaymentRequest) (apimethods.PaymentRequest, error)
+	PayRequest(id int64, payer int) (apimethods.PaymentRequest, error)
+	DeclineRequest(id int64, payer int) (apimethods.PaymentRequest, error)
+	ListPaymentRequests(id int, f apimethods.RequestFilter) ([]apimethods.PaymentRequest, int64, error)
+	CreateSchedule(s apimethods.Schedule, startAt time.Time) (apimethods.Schedule, error)
+	GetSchedule(id int64) (apimethods.Schedule, error)
+	ListSchedules(id int) ([]apimethods.Schedule, error)
+	CancelSchedule(id int64) error
+	CreateDeal(d apimethods.Deal) (apimethods.Deal, error)
+	GetDeal(id int64) (apimethods.Deal, error)
+	ReleaseDeal(id int64, user int, reason string) (apimethods.Deal, error)
+	RefundDeal(id int64, user int, reason string) (apimethods.Deal, error)
+	DisputeDeal(id int64, user int, reason string) (apimethods.Deal, error)
+	ResolveDeal(id int64, toSeller float64, reason string) (apimethods.Deal, error)
+	CreateSharedAccount(owner int) (int, error)
+	SetMember(by int, m apimethods.Member) error
+	RemoveMember(account, by, user int) error
+	ListMembers(account int) ([]apimethods.Member, error)
+	CreateSubAccount(parent int, drawLimit float64, drawPeriod string) (int, error)
+	SetDrawLimit(parent, child int, drawLimit float64, drawPeriod string) error
+	Allocate(parent, child int, currency string, sum float64) (apimethods.Allocation, error)
+	DrawFromParent(child int, sum float64) (apimethods.Allocation, error)
+	Rollup(id int, currency string) ([]apimethods.RollupNode, error)
+	SetCreditLimit(id int, limit float64) error
+	GetOverdraft(id int) (apimethods.Overdraft, error)
+	webhooks.Store
+	outbox.Store
+	rates.Store
+	bonuses.Store
+	scheduler.Store
+	pending.Store
+	snapshots.Store
+	overdraft.Store
 }
@@ -0,0 +1,227 @@
+package methods
+
+import (
+	"app/pkg/events"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"sort"
+)
+
+var (
+	AccountFrozen = errors.New("Account is frozen")
+	AccountClosed = errors.New("Account is closed")
+	NonZeroBalance = errors.New("Account balance is not zero")
+)
+
+// Statuses of accounts.
+// A frozen account can receive money but can not send it, a closed account can do neither.
+const (
+	StatusActive	= "active"
+	StatusFrozen	= "frozen"
+	StatusClosed	= "closed"
+)
+
+// AccountExternalCashOut is the system account of the money paid out of the service
+// when accounts are closed
+const AccountExternalCashOut = "external_cash_out"
+
+// account is the locked row of a user.
+// Held is the part of the balance reserved by pending transfers.
+// CreditLimit is how far below zero the balance can go, only the BaseCurrency balance has it.
+type account struct {
+	ID			int
+	Balance		float64
+	Held		float64
+	CreditLimit	float64
+	Status		string
+	// Shared is true for an account of several members, see canSendAs
+	Shared		bool
+}
+
+// available is the money the user can spend: the balance with the credit line except the held part
+func (a account) available() float64 {
+	return a.Balance + a.CreditLimit - a.Held
+}
+
+// canSend checks that money can leave the account.
+// Money leaves a shared account only on behalf of its members, so it is never sent without one.
+func (a account) canSend() error {
+	err := a.statusAllowsSend()
+	if err == nil && a.Shared {
+		err = MemberForbidden
+	}
+	return err
+}
+
+// statusAllowsSend checks that the status of the account lets money leave it
+func (a account) statusAllowsSend() error {
+	switch a.Status {
+	case StatusFrozen:
+		return AccountFrozen
+	case StatusClosed:
+		return AccountClosed
+	}
+	return nil
+}
+
+// canReceive checks that money can come to the account
+func (a account) canReceive() error {
+	if a.Status == StatusClosed {
+		return AccountClosed
+	}
+	return nil
+}
+
+// lockAccount returns the account of the user and locks the user's row
+// until the end of the transaction tx
+func lockAccount(ctx context.Context, tx pgx.Tx, id int) (account, error) {
+	a := account{ ID: id }
+
+	const request = `SELECT balance, held, credit_limit, status, shared FROM user_balance WHERE id = $1 FOR UPDATE`
+
+	err := tx.QueryRow(ctx, request, id).Scan(&a.Balance, &a.Held, &a.CreditLimit, &a.Status, &a.Shared)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return a, UserNotFound
+	}
+	if err != nil {
+		return a, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	return a, nil
+}
+
+// lockAccounts locks the rows of the users until the end of the transaction tx
+// and returns their accounts. Rows are always locked in the order of IDs
+// to avoid deadlocks between transactions touching the same users.
+func lockAccounts(ctx context.Context, tx pgx.Tx, ids ...int) (map[int]account, error) {
+	sorted := append([]int(nil), ids...)
+	sort.Ints(sorted)
+
+	accounts := make(map[int]account, len(ids))
+	for _, id := range sorted {
+		if _, ok := accounts[id]; ok {
+			continue
+		}
+		a, err := lockAccount(ctx, tx, id)
+		if err != nil {
+			return nil, err
+		}
+		accounts[id] = a
+	}
+	return accounts, nil
+}
+
+// The SetAccountStatus method changes the status of the account and records the reason.
+// A closed account can not be reopened. An account can be closed only with a zero balance,
+// or, if payout is true, its positive balance is paid out first.
+// On success, the balance of the account is returned.
+func (db *Methods) SetAccountStatus(id int, status, reason string, payout bool) (float64, error) {
+	var balance float64
+
+	if id <= 0 || reason == "" || (status != StatusActive && status != StatusFrozen && status != StatusClosed) {
+		return 0, WrongData
+	}
+
+	err := db.pool.BeginFunc(context.Background(), func(tx pgx.Tx) (err error) {
+		balance, err = db.setAccountStatus(context.Background(), tx, id, status, reason, payout)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
+
+// setAccountStatus changes the status inside the transaction tx
+func (db *Methods) setAccountStatus(ctx context.Context, tx pgx.Tx, id int, status, reason string, payout bool) (float64, error) {
+	const (
+		update = `UPDATE user_balance SET status = $1 WHERE id = $2`
+		history = `INSERT INTO account_status_history (user_id, status, reason) VALUES ($1, $2, $3)`
+	)
+
+	a, err := lockAccount(ctx, tx, id)
+	if err != nil {
+		return 0, fmt.Errorf("lockAccount() error: %w", err)
+	}
+
+	if a.Status == StatusClosed {
+		return 0, AccountClosed
+	}
+	if a.Status == status {
+		return a.Balance, nil
+	}
+
+	// Every wallet of a closed account must be empty
+	if status == StatusClosed {
+		// Held money goes back to the senders before the wallets are checked
+		err = db.releasePendingTransfers(ctx, tx, id)
+		if err != nil {
+			return 0, fmt.Errorf("releasePendingTransfers() error: %w", err)
+		}
+
+		others, err := otherWallets(ctx, tx, id)
+		if err != nil {
+			return 0, fmt.Errorf("otherWallets() error: %w", err)
+		}
+
+		for _, w := range append([]Wallet{ { Currency: BaseCurrency, Balance: a.Balance } }, others...) {
+			if cents(w.Balance) == 0 {
+				continue
+			}
+			if !payout || cents(w.Balance) < 0 {
+				return 0, NonZeroBalance
+			}
+
+			balance, err := payOut(ctx, tx, id, w, reason)
+			if err != nil {
+				return 0, fmt.Errorf("payOut() error: %w", err)
+			}
+			if w.Currency == BaseCurrency {
+				a.Balance = balance
+			}
+		}
+
+		// Bonuses can not be paid out, they are lost with the account
+		err = forfeitBonuses(ctx, tx, id, reason)
+		if err != nil {
+			return 0, fmt.Errorf("forfeitBonuses() error: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, update, status, id)
+	if err != nil {
+		return 0, fmt.Errorf("Exec() error: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, history, id, status, reason)
+	if err != nil {
+		return 0, fmt.Errorf("Exec() error: %w", err)
+	}
+	return a.Balance, nil
+}
+
+// payOut pays the whole balance of the wallet out of the service inside the transaction tx
+// and returns the new balance of the wallet
+func payOut(ctx context.Context, tx pgx.Tx, id int, w Wallet, reason string) (float64, error) {
+	balance, err := updateWallet(ctx, tx, id, w.Currency, -w.Balance)
+	if err != nil {
+		return 0, fmt.Errorf("updateWallet() error: %w", err)
+	}
+
+	txID, err := recordTransaction(ctx, tx, transaction{ Type: TransactionPayout, From: id, Amount: w.Balance, Currency: w.Currency, Comment: reason })
+	if err != nil {
+		return 0, fmt.Errorf("recordTransaction() error: %w", err)
+	}
+
+	err = postEntries(ctx, tx, txID, w.Currency, entry{ userAccount(id), -w.Balance }, entry{ AccountExternalCashOut, w.Balance })
+	if err != nil {
+		return 0, fmt.Errorf("postEntries() error: %w", err)
+	}
+
+	err = publishEvent(ctx, tx, events.Event{ AccountID: id, Balance: balance, Currency: w.Currency, TransactionID: txID, Type: TransactionPayout })
+	if err != nil {
+		return 0, fmt.Errorf("publishEvent() error: %w", err)
+	}
+	return balance, nil
+}
@@ -1,15 +1,19 @@
 package methods
 
 import (
+	"app/pkg/events"
 	"context"
 	"errors"
 	"fmt"
+	"github.com/jackc/pgx/v4"
+	"math"
 )
 
 var (
 	UserNotFound = errors.New("User not found")
 	InsufficientFunds = errors.New("Insufficient funds")
 	WrongData = errors.New("Wrong data")
+	NotFound = errors.New("Not found")
 )
 
 // The GetBalance method, in successful, returns the amount of the (user's money, nil)
@@ -45,28 +49,33 @@ func (db *Methods) GetBalance(id int) (int, float64, error) {
 // otherwise, the amount of money is withdrawn from the user's account.
 // On success, nil is returned. Otherwise, an error is returned
 func (db *Methods) RefillAndWithdrawMoney(id int, sum float64) (int, float64, error) {
+	return db.RefillAndWithdrawWallet(id, BaseCurrency, sum)
+}
 
-	const transfer = `UPDATE user_balance SET balance = balance + $1 WHERE id = $2`
-
-	if id <= 0 {
-		return 0, 0, WrongData
-	}
+// The RefillAndWithdrawWallet method is RefillAndWithdrawMoney for the wallet of the user in the currency.
+// An empty currency means BaseCurrency.
+func (db *Methods) RefillAndWithdrawWallet(id int, currency string, sum float64) (int, float64, error) {
+	return db.RefillAndWithdrawMember(id, 0, currency, sum)
+}
 
-	_, balance, err := db.GetBalance(id)
-	if err != nil {
-		return 0, 0, fmt.Errorf("GetBalance() error: %w", err)
-	}
+// The RefillAndWithdrawMember method is RefillAndWithdrawWallet on behalf of the member of the shared account id,
+// who is recorded on the transaction. For a personal account member is 0 or the user.
+func (db *Methods) RefillAndWithdrawMember(id, member int, currency string, sum float64) (int, float64, error) {
+	var balance float64
 
-	if balance + sum < 0.00 {
-		return 0, 0, InsufficientFunds
+	if currency == "" {
+		currency = BaseCurrency
 	}
 
-	_, err = db.pool.Exec(context.Background(), transfer, sum, id)
+	err := db.pool.BeginFunc(context.Background(), func(tx pgx.Tx) (err error) {
+		balance, err = db.refillAndWithdrawMember(context.Background(), tx, id, member, currency, sum)
+		return err
+	})
 	if err != nil {
-		return 0, 0, fmt.Errorf("Exec() error: %w", err)
+		return 0, 0, err
 	}
 
-	return id, balance + sum, nil
+	return id, balance, nil
 }
 
 // The TransferMoney method takes three parameters:
@@ -76,47 +85,277 @@ func (db *Methods) RefillAndWithdrawMoney(id int, sum float64) (int, float64, er
 // The amount of money should be only positive. If the amount of money is negative, an error is returned.
 // On success, nil is returned.
 func (db *Methods) TransferMoney(from, to int, sum float64) (int, float64, int, float64, error) {
+	return db.TransferWallet(from, to, BaseCurrency, BaseCurrency, sum)
+}
+
+// The TransferWallet method is TransferMoney between the wallets of the users in the currency.
+// toCurrency is the currency the recipient expects, money is never converted by a transfer,
+// so CurrencyMismatch is returned if it differs from currency. Empty currencies mean BaseCurrency.
+func (db *Methods) TransferWallet(from, to int, currency, toCurrency string, sum float64) (int, float64, int, float64, error) {
+	return db.TransferMember(from, 0, to, currency, toCurrency, sum)
+}
+
+// The TransferMember method is TransferWallet on behalf of the member of the shared account "from",
+// who is recorded on the transaction. For a personal account member is 0 or the user.
+func (db *Methods) TransferMember(from, member, to int, currency, toCurrency string, sum float64) (int, float64, int, float64, error) {
+	var from_balance, to_balance float64
+
+	if currency == "" {
+		currency = BaseCurrency
+	}
+	if toCurrency == "" {
+		toCurrency = BaseCurrency
+	}
+	if toCurrency != currency {
+		return 0, 0, 0, 0, CurrencyMismatch
+	}
+
+	err := db.pool.BeginFunc(context.Background(), func(tx pgx.Tx) (err error) {
+		from_balance, to_balance, _, err = db.transferTransaction(context.Background(), tx, from, member, to, currency, sum, "")
+		return err
+	})
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+
+	return from, from_balance, to, to_balance, nil
+}
+
+// refillAndWithdraw changes the balance of the user's wallet in the currency by sum
+// inside the transaction tx and returns the new balance.
+func (db *Methods) refillAndWithdraw(ctx context.Context, tx pgx.Tx, id int, currency string, sum float64) (float64, error) {
+	return db.refillAndWithdrawMember(ctx, tx, id, 0, currency, sum)
+}
+
+// refillAndWithdrawMember is refillAndWithdraw on behalf of the member of the account
+func (db *Methods) refillAndWithdrawMember(ctx context.Context, tx pgx.Tx, id, member int, currency string, sum float64) (float64, error) {
+	if id <= 0 || member < 0 || !currencies[currency] {
+		return 0, WrongData
+	}
+
+	account, err := lockWallet(ctx, tx, id, currency)
+	if err != nil {
+		return 0, fmt.Errorf("lockWallet() error: %w", err)
+	}
+
+	if sum < 0.00 {
+		err = account.statusAllowsSend()
+	} else {
+		err = account.canReceive()
+	}
+	// Anyone can refill a shared account, a member is only checked if it is named
+	if err == nil && (sum < 0.00 || member != 0) {
+		err = checkMember(ctx, tx, account, member, TransactionWithdraw, currency, -sum)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if account.available() + sum < 0.00 {
+		return 0, InsufficientFunds
+	}
+
+	// Limits are set in BaseCurrency
+	if sum < 0.00 && currency == BaseCurrency {
+		err = checkLimits(ctx, tx, id, TransactionWithdraw, -sum)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	balance, err := updateWallet(ctx, tx, id, currency, sum)
+	if err != nil {
+		return 0, fmt.Errorf("updateWallet() error: %w", err)
+	}
+
+	if sum == 0.00 {
+		return balance, nil
+	}
+
+	kind, from, to := TransactionRefill, 0, id
+	if sum < 0.00 {
+		kind, from, to = TransactionWithdraw, id, 0
+	}
+
+	t := transaction{ Type: kind, From: from, To: to, Amount: math.Abs(sum), Currency: currency }
+	if account.Shared {
+		t.Member = member
+	}
+
+	txID, err := recordTransaction(ctx, tx, t)
+	if err != nil {
+		return 0, fmt.Errorf("recordTransaction() error: %w", err)
+	}
 
-	const (
-		withdraw = `UPDATE user_balance SET balance = balance - $1 WHERE id = $2`
-		refill = `UPDATE user_balance SET balance = balance + $1 WHERE id = $2`
-	)
+	// Refills come from outside of the service, withdrawals pay for its services
+	counterparty := AccountExternalCashIn
+	if sum < 0.00 {
+		counterparty = AccountRevenue
+	}
+
+	err = postEntries(ctx, tx, txID, currency, entry{ userAccount(id), sum }, entry{ counterparty, -sum })
+	if err != nil {
+		return 0, fmt.Errorf("postEntries() error: %w", err)
+	}
+
+	err = publishEvent(ctx, tx, events.Event{ AccountID: id, Balance: balance, Currency: currency, TransactionID: txID, Type: kind })
+	if err != nil {
+		return 0, fmt.Errorf("publishEvent() error: %w", err)
+	}
+
+	return balance, nil
+}
+
+// transfer moves sum from the wallet of the user "from" to the wallet of the user "to"
+// in the currency inside the transaction tx and returns the new balances of both wallets.
+func (db *Methods) transfer(ctx context.Context, tx pgx.Tx, from, to int, currency string, sum float64) (float64, float64, error) {
+	from_balance, to_balance, _, err := db.transferTransaction(ctx, tx, from, 0, to, currency, sum, "")
+	return from_balance, to_balance, err
+}
+
+// transferTransaction is transfer on behalf of the member of the account "from" recorded with the comment,
+// it also returns the ID of the transaction, 0 for a zero sum that is not recorded.
+func (db *Methods) transferTransaction(ctx context.Context, tx pgx.Tx, from, member, to int, currency string, sum float64, comment string) (float64, float64, int64, error) {
+	return db.transferWithFee(ctx, tx, from, member, to, currency, sum, comment, nil)
+}
 
-	if from <= 0 || to <= 0 || from == to || sum < 0.00 {
-		return 0, 0, 0, 0, WrongData
+// transferWithFee is transferTransaction charging the quoted fee instead of the fee of the rules
+// if quoted is not nil, e.g. the fee held by a pending transfer.
+func (db *Methods) transferWithFee(ctx context.Context, tx pgx.Tx, from, member, to int, currency string, sum float64, comment string, quoted *float64) (float64, float64, int64, error) {
+	if from <= 0 || member < 0 || to <= 0 || from == to || sum < 0.00 || !currencies[currency] {
+		return 0, 0, 0, WrongData
 	}
 
-	_, from_balance, err := db.GetBalance(from)
+	accounts, err := lockWallets(ctx, tx, currency, from, to)
 	if err != nil {
-		return 0, 0, 0, 0, fmt.Errorf("GetBalance() error: %w", err)
+		return 0, 0, 0, fmt.Errorf("lockWallets() error: %w", err)
 	}
 
-	_, _, err = db.GetBalance(to)
+	err = accounts[from].statusAllowsSend()
+	if err == nil {
+		err = accounts[to].canReceive()
+	}
 	if err != nil {
-		return 0, 0, 0, 0, fmt.Errorf("GetBalance() error: %w", err)
+		return 0, 0, 0, err
+	}
+
+	fee := 0.00
+	switch {
+	case quoted != nil:
+		fee = *quoted
+	case sum > 0.00:
+		fee, err = transferFee(ctx, tx, from, currency, sum)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("transferFee() error: %w", err)
+		}
 	}
 
-	if from_balance - sum < 0.00 {
-		return 0, 0, 0, 0, InsufficientFunds
+	// The sender pays the fee on top of the sum
+	if accounts[from].available() - sum - fee < 0.00 {
+		return 0, 0, 0, InsufficientFunds
 	}
 
-	// Withdraw amount of money from first user
-	_, err = db.pool.Exec(context.Background(), withdraw, sum, from)
+	err = checkMember(ctx, tx, accounts[from], member, TransactionTransfer, currency, sum + fee)
 	if err != nil {
-		return 0, 0, 0, 0, fmt.Errorf("Exec(..., first_id) error: %w", err)
+		return 0, 0, 0, err
+	}
+
+	// Limits are set in BaseCurrency
+	if currency == BaseCurrency {
+		err = checkLimits(ctx, tx, from, TransactionTransfer, sum)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	// Withdraw amount of money and the fee from first user
+	from_balance, err := updateWallet(ctx, tx, from, currency, -sum - fee)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("updateWallet(..., first_id) error: %w", err)
 	}
 
 	// Refill amount of money to second user
-	_, err = db.pool.Exec(context.Background(), refill, sum, to)
+	to_balance, err := updateWallet(ctx, tx, to, currency, sum)
 	if err != nil {
-		return 0, 0, 0, 0, fmt.Errorf("Exec(..., second_id) error: %w", err)
+		return 0, 0, 0, fmt.Errorf("updateWallet(..., second_id) error: %w", err)
 	}
 
-	_, from_balance, err1 := db.GetBalance(from)
-	_, to_balance, err2 := db.GetBalance(to)
-	if err1 != nil || err2 != nil {
-		return 0, 0, 0, 0, fmt.Errorf("GetBalance() error: %w", err)
+	if sum == 0.00 {
+		return from_balance, to_balance, 0, nil
 	}
 
-	return from, from_balance, to, to_balance, nil
-}
\ No newline at end of file
+	t := transaction{ Type: TransactionTransfer, From: from, To: to, Amount: sum, Fee: fee, Currency: currency, Comment: comment }
+	if accounts[from].Shared {
+		t.Member = member
+	}
+
+	txID, err := recordTransaction(ctx, tx, t)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("recordTransaction() error: %w", err)
+	}
+
+	entries := []entry{ { userAccount(from), -sum - fee }, { userAccount(to), sum } }
+	if fee > 0.00 {
+		entries = append(entries, entry{ AccountRevenue, fee })
+	}
+
+	err = postEntries(ctx, tx, txID, currency, entries...)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("postEntries() error: %w", err)
+	}
+
+	for _, e := range []events.Event{
+		{ AccountID: from, Balance: from_balance, Currency: currency, TransactionID: txID, Type: TransactionTransfer },
+		{ AccountID: to, Balance: to_balance, Currency: currency, TransactionID: txID, Type: TransactionTransfer },
+	} {
+		err = publishEvent(ctx, tx, e)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("publishEvent() error: %w", err)
+		}
+	}
+
+	return from_balance, to_balance, txID, nil
+}
+
+// The GetBalances method takes a list of user IDs and loads their balances with a single query.
+// On success, a map from user ID to balance is returned. IDs missing from the map do not exist.
+// IDs that are not valid (id <= 0) are never looked up.
+func (db *Methods) GetBalances(ids []int) (map[int]float64, error) {
+	const request = `SELECT id, balance FROM user_balance WHERE id = ANY($1)`
+
+	balances := make(map[int]float64, len(ids))
+
+	valid := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if id > 0 {
+			valid = append(valid, id)
+		}
+	}
+
+	if len(valid) == 0 {
+		return balances, nil
+	}
+
+	rows, err := db.pool.Query(context.Background(), request, valid)
+	if err != nil {
+		return nil, fmt.Errorf("pool.Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		var balance float64
+
+		err = rows.Scan(&id, &balance)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		balances[id] = balance
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err() error: %w", err)
+	}
+	return balances, nil
+}
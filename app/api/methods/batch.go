@@ -0,0 +1,206 @@
+package methods
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	RolledBack = errors.New("Operation rolled back")
+	// IdempotencyMismatch is returned if an idempotency key is reused for a different operation
+	IdempotencyMismatch = fmt.Errorf("%w: idempotency key is used by another operation", WrongData)
+)
+
+// Types of operations accepted by ExecuteBatch
+const (
+	OperationCredit		= "credit"
+	OperationDebit		= "debit"
+	OperationTransfer	= "transfer"
+)
+
+// Operation is a single item of a batch.
+// Credit and debit use ID, transfer uses From and To.
+// Sum is always positive, the type of the operation defines the direction.
+// Currency is the currency of the wallets, BaseCurrency if empty.
+type Operation struct {
+	Type			string
+	ID				int
+	From			int
+	To				int
+	Sum				float64
+	Currency		string
+	IdempotencyKey	string
+}
+
+// OperationResult is the outcome of a single operation of a batch.
+// For transfers ID and Balance belong to the sender, ToID and ToBalance to the recipient.
+type OperationResult struct {
+	ID			int
+	Balance		float64
+	ToID		int
+	ToBalance	float64
+	Err			error
+}
+
+// The ExecuteBatch method executes a list of operations.
+// If atomic is true, all operations are executed in one transaction:
+// the first failed operation rolls back the whole batch, its result holds the reason
+// and the results of all other operations hold RolledBack. The reason is also returned as the error.
+// Otherwise every operation is executed in its own transaction and fails independently,
+// the error is always nil.
+// An operation with an idempotency key that has already been executed is not executed again,
+// the stored result of the first execution is returned instead. Keys belong to the account of the operation
+// (ID, or From for transfers): another account can use the same key, while a different operation
+// of the account with the same key fails with IdempotencyMismatch.
+func (db *Methods) ExecuteBatch(ops []Operation, atomic bool) ([]OperationResult, error) {
+	ctx := context.Background()
+	results := make([]OperationResult, len(ops))
+
+	if !atomic {
+		for i, op := range ops {
+			err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) (err error) {
+				results[i], err = db.execute(ctx, tx, op)
+				return err
+			})
+			results[i].Err = err
+		}
+		return results, nil
+	}
+
+	failed := -1
+	err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		for i, op := range ops {
+			res, err := db.execute(ctx, tx, op)
+			if err != nil {
+				failed = i
+				return err
+			}
+			results[i] = res
+		}
+		return nil
+	})
+	if err != nil {
+		for i := range results {
+			results[i] = OperationResult{ Err: RolledBack }
+		}
+		// If no operation failed, the transaction itself could not be started or committed
+		if failed < 0 {
+			for i := range results {
+				results[i].Err = err
+			}
+		} else {
+			results[failed].Err = err
+		}
+	}
+	return results, err
+}
+
+// execute runs a single operation inside the transaction tx
+func (db *Methods) execute(ctx context.Context, tx pgx.Tx, op Operation) (OperationResult, error) {
+	var res OperationResult
+	var err error
+
+	if op.Sum <= 0.00 {
+		return res, WrongData
+	}
+
+	if op.Currency == "" {
+		op.Currency = BaseCurrency
+	}
+
+	if op.IdempotencyKey != "" {
+		res, found, err := claimIdempotencyKey(ctx, tx, op)
+		if err != nil || found {
+			return res, err
+		}
+	}
+
+	switch op.Type {
+	case OperationCredit:
+		res.ID = op.ID
+		res.Balance, err = db.refillAndWithdraw(ctx, tx, op.ID, op.Currency, op.Sum)
+	case OperationDebit:
+		res.ID = op.ID
+		res.Balance, err = db.refillAndWithdraw(ctx, tx, op.ID, op.Currency, -op.Sum)
+	case OperationTransfer:
+		res.ID, res.ToID = op.From, op.To
+		res.Balance, res.ToBalance, err = db.transfer(ctx, tx, op.From, op.To, op.Currency, op.Sum)
+	default:
+		err = WrongData
+	}
+	if err != nil {
+		return OperationResult{}, err
+	}
+
+	if op.IdempotencyKey != "" {
+		err = storeIdempotencyResult(ctx, tx, op, res)
+		if err != nil {
+			return OperationResult{}, fmt.Errorf("storeIdempotencyResult() error: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// operationAccount is the account the idempotency key of the operation belongs to
+func operationAccount(op Operation) int {
+	if op.Type == OperationTransfer {
+		return op.From
+	}
+	return op.ID
+}
+
+// operationHash identifies the operation: a reused key must come with the same operation
+func operationHash(op Operation) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d:%d:%d:%s", op.Type, op.ID, op.From, op.To, cents(op.Sum), op.Currency)))
+	return hex.EncodeToString(sum[:])
+}
+
+// claimIdempotencyKey reserves the idempotency key of the operation for its account.
+// If the key is already used, the stored result is returned and found is true.
+// A concurrent transaction holding the same key blocks the claim until it finishes.
+func claimIdempotencyKey(ctx context.Context, tx pgx.Tx, op Operation) (OperationResult, bool, error) {
+	var res OperationResult
+	var hash string
+
+	const (
+		claim = `INSERT INTO idempotency_keys (account_id, key, request_hash) VALUES ($1, $2, $3)
+			ON CONFLICT (account_id, key) DO NOTHING`
+		stored = `SELECT request_hash, id, balance, to_id, to_balance FROM idempotency_keys WHERE account_id = $1 AND key = $2`
+	)
+
+	account := operationAccount(op)
+	tag, err := tx.Exec(ctx, claim, account, op.IdempotencyKey, operationHash(op))
+	if err != nil {
+		return res, false, fmt.Errorf("Exec() error: %w", err)
+	}
+	if tag.RowsAffected() == 1 {
+		return res, false, nil
+	}
+
+	err = tx.QueryRow(ctx, stored, account, op.IdempotencyKey).Scan(&hash, &res.ID, &res.Balance, &res.ToID, &res.ToBalance)
+	if err != nil {
+		return res, false, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	// A retry must repeat the operation exactly, otherwise the stored result would answer another request
+	if hash != operationHash(op) {
+		return OperationResult{}, false, IdempotencyMismatch
+	}
+	return res, true, nil
+}
+
+// storeIdempotencyResult saves the result of the operation for its idempotency key
+func storeIdempotencyResult(ctx context.Context, tx pgx.Tx, op Operation, res OperationResult) error {
+	const update = `UPDATE idempotency_keys SET id = $3, balance = $4, to_id = $5, to_balance = $6
+		WHERE account_id = $1 AND key = $2`
+
+	_, err := tx.Exec(ctx, update, operationAccount(op), op.IdempotencyKey, res.ID, res.Balance, res.ToID, res.ToBalance)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,369 @@
+package methods
+
+import (
+	"app/pkg/events"
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"strconv"
+	"time"
+)
+
+// System accounts of bonuses.
+// Bonuses are granted from AccountPromo, expired bonuses are booked to AccountPromoExpired.
+const (
+	AccountPromo		= "promo"
+	AccountPromoExpired	= "promo_expired"
+)
+
+// Orders of spending the bonus balance on services
+const (
+	BonusFirst	= "first"
+	BonusLast	= "last"
+)
+
+// BonusGrant is promotional money granted to a user.
+// It can be spent only on services before it expires. An empty Services means any service.
+type BonusGrant struct {
+	ID			int64
+	UserID		int
+	Amount		float64
+	Remaining	float64
+	Services	[]string
+	Comment		string
+	ExpiresAt	time.Time
+}
+
+// Payment is a payment for a service split between the real and the bonus balance.
+// Balance and BonusBalance are the balances of the user after the payment.
+type Payment struct {
+	TransactionID	int64
+	ID				int
+	Service			string
+	Sum				float64
+	Real			float64
+	Bonus			float64
+	Balance			float64
+	BonusBalance	float64
+}
+
+// bonusAccount returns the ledger account of the user's bonus balance
+func bonusAccount(id int) string {
+	return "bonus:" + strconv.Itoa(id)
+}
+
+// bonusBalance returns the sum of the user's bonuses that have not expired
+func bonusBalance(ctx context.Context, q querier, id int) (float64, error) {
+	const request = `SELECT COALESCE(SUM(remaining), 0) FROM bonus_grants
+		WHERE user_id = $1 AND remaining > 0 AND expires_at > now()`
+
+	var balance float64
+
+	err := q.QueryRow(ctx, request, id).Scan(&balance)
+	if err != nil {
+		return 0, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	return balance, nil
+}
+
+// The GrantBonus method grants amount of bonuses in BaseCurrency to the user until expiresAt.
+// If services is empty, the bonuses can be spent on any service.
+func (db *Methods) GrantBonus(id int, amount float64, expiresAt time.Time, services []string, comment string) (BonusGrant, error) {
+	const insert = `INSERT INTO bonus_grants (user_id, amount, remaining, services, comment, expires_at)
+		VALUES ($1, $2, $2, $3, $4, $5) RETURNING id`
+
+	ctx := context.Background()
+	g := BonusGrant{ UserID: id, Amount: amount, Remaining: amount, Services: services, Comment: comment, ExpiresAt: expiresAt }
+
+	if id <= 0 || cents(amount) <= 0 || !expiresAt.After(time.Now()) {
+		return g, WrongData
+	}
+	if g.Services == nil {
+		g.Services = []string{}
+	}
+
+	err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		a, err := lockAccount(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if err = a.canReceive(); err != nil {
+			return err
+		}
+
+		err = tx.QueryRow(ctx, insert, id, amount, g.Services, comment, expiresAt).Scan(&g.ID)
+		if err != nil {
+			return fmt.Errorf("QueryRow() error: %w", err)
+		}
+
+		txID, err := recordTransaction(ctx, tx, transaction{ Type: TransactionBonus, To: id, Amount: amount, Comment: comment })
+		if err != nil {
+			return fmt.Errorf("recordTransaction() error: %w", err)
+		}
+
+		err = postEntries(ctx, tx, txID, BaseCurrency, entry{ bonusAccount(id), amount }, entry{ AccountPromo, -amount })
+		if err != nil {
+			return fmt.Errorf("postEntries() error: %w", err)
+		}
+		return nil
+	})
+	return g, err
+}
+
+// The PayService method pays sum in BaseCurrency for the service from the real and the bonus balance
+// of the user. Bonuses are spent before or after the real balance according to BonusOrder,
+// only bonuses eligible for the service are spent, those expiring first go first.
+func (db *Methods) PayService(id int, service string, sum float64) (Payment, error) {
+	var p Payment
+
+	if id <= 0 || service == "" || cents(sum) <= 0 {
+		return p, WrongData
+	}
+
+	err := db.pool.BeginFunc(context.Background(), func(tx pgx.Tx) (err error) {
+		p, err = db.payService(context.Background(), tx, id, service, sum)
+		return err
+	})
+	if err != nil {
+		return Payment{}, err
+	}
+	return p, nil
+}
+
+// payService pays for the service inside the transaction tx
+func (db *Methods) payService(ctx context.Context, tx pgx.Tx, id int, service string, sum float64) (Payment, error) {
+	const (
+		grants = `SELECT id, remaining FROM bonus_grants
+			WHERE user_id = $1 AND remaining > 0 AND expires_at > now() AND (services = '{}' OR $2 = ANY (services))
+			ORDER BY expires_at, id FOR UPDATE`
+		spend = `UPDATE bonus_grants SET remaining = remaining - $1 WHERE id = $2`
+	)
+
+	p := Payment{ ID: id, Service: service, Sum: sum }
+
+	a, err := lockAccount(ctx, tx, id)
+	if err != nil {
+		return p, err
+	}
+	if err = a.canSend(); err != nil {
+		return p, err
+	}
+
+	rows, err := tx.Query(ctx, grants, id, service)
+	if err != nil {
+		return p, fmt.Errorf("Query() error: %w", err)
+	}
+
+	type grant struct {
+		id			int64
+		remaining	int64
+	}
+
+	var eligible []grant
+	var available int64
+	for rows.Next() {
+		var g grant
+		var remaining float64
+
+		err = rows.Scan(&g.id, &remaining)
+		if err != nil {
+			rows.Close()
+			return p, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		g.remaining = cents(remaining)
+		available += g.remaining
+		eligible = append(eligible, g)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return p, fmt.Errorf("rows.Err() error: %w", err)
+	}
+
+	// The split is computed in kopecks. Bonuses go before the credit line:
+	// with BonusLast only the own money of the user is spent before them.
+	total, own := cents(sum), cents(a.Balance - a.Held)
+	var bonus int64
+	if db.BonusOrder == BonusLast {
+		bonus = min64(total - min64(total, max64(own, 0)), available)
+	} else {
+		bonus = min64(total, available)
+	}
+	spent := total - bonus
+
+	if spent > cents(a.available()) {
+		return p, InsufficientFunds
+	}
+	p.Real, p.Bonus = float64(spent) / 100, float64(bonus) / 100
+
+	// Paying for services is how money is spent in the service, the real part counts as a withdrawal
+	if p.Real > 0 {
+		err = checkLimits(ctx, tx, id, TransactionWithdraw, p.Real)
+		if err != nil {
+			return p, err
+		}
+	}
+
+	for _, g := range eligible {
+		if bonus == 0 {
+			break
+		}
+		part := min64(bonus, g.remaining)
+		_, err = tx.Exec(ctx, spend, float64(part) / 100, g.id)
+		if err != nil {
+			return p, fmt.Errorf("Exec() error: %w", err)
+		}
+		bonus -= part
+	}
+
+	p.Balance, err = updateWallet(ctx, tx, id, BaseCurrency, -p.Real)
+	if err != nil {
+		return p, fmt.Errorf("updateWallet() error: %w", err)
+	}
+
+	p.BonusBalance, err = bonusBalance(ctx, tx, id)
+	if err != nil {
+		return p, fmt.Errorf("bonusBalance() error: %w", err)
+	}
+
+	p.TransactionID, err = recordTransaction(ctx, tx, transaction{ Type: TransactionPayment, From: id, Amount: sum, Comment: service })
+	if err != nil {
+		return p, fmt.Errorf("recordTransaction() error: %w", err)
+	}
+
+	entries := []entry{ { AccountRevenue, sum } }
+	if p.Real > 0 {
+		entries = append(entries, entry{ userAccount(id), -p.Real })
+	}
+	if p.Bonus > 0 {
+		entries = append(entries, entry{ bonusAccount(id), -p.Bonus })
+	}
+	err = postEntries(ctx, tx, p.TransactionID, BaseCurrency, entries...)
+	if err != nil {
+		return p, fmt.Errorf("postEntries() error: %w", err)
+	}
+
+	if p.Real > 0 {
+		err = publishEvent(ctx, tx, events.Event{ AccountID: id, Balance: p.Balance, Currency: BaseCurrency, TransactionID: p.TransactionID, Type: TransactionPayment })
+		if err != nil {
+			return p, fmt.Errorf("publishEvent() error: %w", err)
+		}
+	}
+	return p, nil
+}
+
+// The ExpireBonuses method books the remaining bonuses of up to limit grants
+// expired by the time to AccountPromoExpired and returns the number of expired grants.
+// Grants locked by payments are skipped until the next run.
+func (db *Methods) ExpireBonuses(now time.Time, limit int) (int, error) {
+	const request = `SELECT id, user_id, remaining FROM bonus_grants
+		WHERE remaining > 0 AND expires_at <= $1 ORDER BY expires_at LIMIT $2 FOR UPDATE SKIP LOCKED`
+
+	var expired int
+
+	if limit <= 0 {
+		return 0, WrongData
+	}
+
+	ctx := context.Background()
+	err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		grants, err := lockGrants(ctx, tx, request, now, limit)
+		if err != nil {
+			return err
+		}
+
+		for _, g := range grants {
+			err = expireGrant(ctx, tx, g, "expired")
+			if err != nil {
+				return fmt.Errorf("expireGrant() error: %w", err)
+			}
+		}
+		expired = len(grants)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
+
+// forfeitBonuses expires all remaining bonuses of the user inside the transaction tx
+func forfeitBonuses(ctx context.Context, tx pgx.Tx, id int, reason string) error {
+	const request = `SELECT id, user_id, remaining FROM bonus_grants WHERE user_id = $1 AND remaining > 0 FOR UPDATE`
+
+	grants, err := lockGrants(ctx, tx, request, id)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range grants {
+		err = expireGrant(ctx, tx, g, reason)
+		if err != nil {
+			return fmt.Errorf("expireGrant() error: %w", err)
+		}
+	}
+	return nil
+}
+
+// lockGrants returns the grants selected by the request, the request locks them
+func lockGrants(ctx context.Context, tx pgx.Tx, request string, args ...interface{}) ([]BonusGrant, error) {
+	rows, err := tx.Query(ctx, request, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	var grants []BonusGrant
+	for rows.Next() {
+		var g BonusGrant
+
+		err = rows.Scan(&g.ID, &g.UserID, &g.Remaining)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		grants = append(grants, g)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err() error: %w", err)
+	}
+	return grants, nil
+}
+
+// expireGrant books the remaining bonuses of the locked grant to AccountPromoExpired
+// inside the transaction tx
+func expireGrant(ctx context.Context, tx pgx.Tx, g BonusGrant, reason string) error {
+	const update = `UPDATE bonus_grants SET remaining = 0, expired_at = now() WHERE id = $1`
+
+	_, err := tx.Exec(ctx, update, g.ID)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+
+	comment := fmt.Sprintf("grant %d %s", g.ID, reason)
+	txID, err := recordTransaction(ctx, tx, transaction{ Type: TransactionBonusExpiry, From: g.UserID, Amount: g.Remaining, Comment: comment })
+	if err != nil {
+		return fmt.Errorf("recordTransaction() error: %w", err)
+	}
+
+	err = postEntries(ctx, tx, txID, BaseCurrency, entry{ bonusAccount(g.UserID), -g.Remaining }, entry{ AccountPromoExpired, g.Remaining })
+	if err != nil {
+		return fmt.Errorf("postEntries() error: %w", err)
+	}
+	return nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
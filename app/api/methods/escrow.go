@@ -0,0 +1,396 @@
+package methods
+
+import (
+	"app/pkg/events"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"strconv"
+	"time"
+)
+
+var (
+	DealConflict = errors.New("Deal can not move to the state")
+)
+
+// States of escrow deals.
+// A deal is funded when it is created. The buyer releases it to the seller, the seller refunds it
+// to the buyer, either of them can dispute it. A disputed deal is resolved by an administrator:
+// released, refunded or split between the buyer and the seller.
+const (
+	DealFunded		= "funded"
+	DealDisputed	= "disputed"
+	DealReleased	= "released"
+	DealRefunded	= "refunded"
+	DealSplit		= "split"
+)
+
+// Parties acting on escrow deals
+const (
+	DealBuyer	= "buyer"
+	DealSeller	= "seller"
+	DealAdmin	= "admin"
+)
+
+// dealTransitions are the states a deal can move to from its current state
+var dealTransitions = map[string]map[string]bool{
+	DealFunded:		{ DealDisputed: true, DealReleased: true, DealRefunded: true },
+	DealDisputed:	{ DealReleased: true, DealRefunded: true, DealSplit: true },
+}
+
+// Deal is a purchase of Buyer from Seller: Amount is held on the escrow account of the deal
+// until it is paid to the seller, returned to the buyer or split between them.
+type Deal struct {
+	ID			int64
+	Buyer		int
+	Seller		int
+	Amount		float64
+	Currency	string
+	Comment		string
+	Status		string
+	CreatedAt	time.Time
+	UpdatedAt	time.Time
+	History		[]DealEvent
+}
+
+// DealEvent is a change of the state of a deal.
+// ToSeller and ToBuyer are the money paid out of escrow by the change,
+// the transactions are 0 if nothing was paid to the party.
+type DealEvent struct {
+	Status				string
+	Actor				string
+	Reason				string
+	ToSeller			float64
+	ToBuyer				float64
+	SellerTransactionID	int64
+	BuyerTransactionID	int64
+	CreatedAt			time.Time
+}
+
+// escrowAccount returns the ledger account holding the money of the deal
+func escrowAccount(id int64) string {
+	return "escrow:" + strconv.FormatInt(id, 10)
+}
+
+// The CreateDeal method moves d.Amount from the buyer's wallet in d.Currency to the escrow account
+// of a new deal and returns the funded deal. An empty currency means BaseCurrency.
+// Funding a deal is a transfer for the limits of the buyer, but no fee is charged for it.
+func (db *Methods) CreateDeal(d Deal) (Deal, error) {
+	if d.Currency == "" {
+		d.Currency = BaseCurrency
+	}
+	if d.Buyer <= 0 || d.Seller <= 0 || d.Buyer == d.Seller || cents(d.Amount) <= 0 || !currencies[d.Currency] {
+		return Deal{}, WrongData
+	}
+
+	err := db.pool.BeginFunc(context.Background(), func(tx pgx.Tx) (err error) {
+		d, err = db.createDeal(context.Background(), tx, d)
+		return err
+	})
+	if err != nil {
+		return Deal{}, err
+	}
+	return d, nil
+}
+
+// createDeal funds the deal inside the transaction tx
+func (db *Methods) createDeal(ctx context.Context, tx pgx.Tx, d Deal) (Deal, error) {
+	const insert = `INSERT INTO escrow_deals (buyer_id, seller_id, amount, currency, comment, status)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at, updated_at`
+
+	accounts, err := lockWallets(ctx, tx, d.Currency, d.Buyer, d.Seller)
+	if err != nil {
+		return d, fmt.Errorf("lockWallets() error: %w", err)
+	}
+
+	err = accounts[d.Buyer].canSend()
+	if err == nil {
+		err = accounts[d.Seller].canReceive()
+	}
+	if err != nil {
+		return d, err
+	}
+
+	if accounts[d.Buyer].available() - d.Amount < 0.00 {
+		return d, InsufficientFunds
+	}
+
+	// Limits are set in BaseCurrency
+	if d.Currency == BaseCurrency {
+		err = checkLimits(ctx, tx, d.Buyer, TransactionTransfer, d.Amount)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	d.Status = DealFunded
+	err = tx.QueryRow(ctx, insert, d.Buyer, d.Seller, d.Amount, d.Currency, d.Comment, d.Status).Scan(&d.ID, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return d, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	balance, err := updateWallet(ctx, tx, d.Buyer, d.Currency, -d.Amount)
+	if err != nil {
+		return d, fmt.Errorf("updateWallet() error: %w", err)
+	}
+
+	comment := fmt.Sprintf("escrow deal %d", d.ID)
+	txID, err := recordTransaction(ctx, tx, transaction{ Type: TransactionEscrow, From: d.Buyer, Amount: d.Amount, Currency: d.Currency, Comment: comment })
+	if err != nil {
+		return d, fmt.Errorf("recordTransaction() error: %w", err)
+	}
+
+	err = postEntries(ctx, tx, txID, d.Currency, entry{ userAccount(d.Buyer), -d.Amount }, entry{ escrowAccount(d.ID), d.Amount })
+	if err != nil {
+		return d, fmt.Errorf("postEntries() error: %w", err)
+	}
+
+	err = publishEvent(ctx, tx, events.Event{ AccountID: d.Buyer, Balance: balance, Currency: d.Currency, TransactionID: txID, Type: TransactionEscrow })
+	if err != nil {
+		return d, fmt.Errorf("publishEvent() error: %w", err)
+	}
+
+	e := DealEvent{ Status: d.Status, Actor: DealBuyer, BuyerTransactionID: txID }
+	err = recordDealEvent(ctx, tx, d.ID, e)
+	if err != nil {
+		return d, fmt.Errorf("recordDealEvent() error: %w", err)
+	}
+	return d, nil
+}
+
+// The ReleaseDeal method pays the money of the deal to the seller, only the buyer releases a deal
+func (db *Methods) ReleaseDeal(id int64, user int, reason string) (Deal, error) {
+	return db.changeDeal(id, user, DealReleased, reason, 0)
+}
+
+// The RefundDeal method returns the money of the deal to the buyer, only the seller refunds a deal
+func (db *Methods) RefundDeal(id int64, user int, reason string) (Deal, error) {
+	return db.changeDeal(id, user, DealRefunded, reason, 0)
+}
+
+// The DisputeDeal method stops the deal until an administrator resolves it,
+// the buyer or the seller disputes a deal
+func (db *Methods) DisputeDeal(id int64, user int, reason string) (Deal, error) {
+	return db.changeDeal(id, user, DealDisputed, reason, 0)
+}
+
+// The ResolveDeal method is the decision of an administrator on a disputed deal:
+// toSeller is paid to the seller and the rest of the amount is returned to the buyer.
+// The deal is released if the buyer gets nothing, refunded if the seller gets nothing and split otherwise.
+func (db *Methods) ResolveDeal(id int64, toSeller float64, reason string) (Deal, error) {
+	return db.changeDeal(id, 0, DealSplit, reason, toSeller)
+}
+
+// changeDeal moves the deal to the status on behalf of the user, 0 for an administrator.
+// For a user who is not a party allowed to make the change the deal does not exist.
+func (db *Methods) changeDeal(id int64, user int, status, reason string, toSeller float64) (Deal, error) {
+	var d Deal
+
+	// Only an administrator splits a deal and an administrator does nothing else
+	if id <= 0 || user < 0 || (user == 0) != (status == DealSplit) {
+		return d, WrongData
+	}
+
+	ctx := context.Background()
+	err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) (err error) {
+		d, err = lockDeal(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		e := DealEvent{ Status: status, Reason: reason }
+		switch {
+		case user == 0:
+			e.Actor = DealAdmin
+		case status == DealReleased && user == d.Buyer, status == DealDisputed && user == d.Buyer:
+			e.Actor = DealBuyer
+		case status == DealRefunded && user == d.Seller, status == DealDisputed && user == d.Seller:
+			e.Actor = DealSeller
+		default:
+			return NotFound
+		}
+
+		// The decision of an administrator is a split until the parts are known
+		if e.Actor == DealAdmin {
+			if d.Status != DealDisputed {
+				return DealConflict
+			}
+			if toSeller < 0 || cents(toSeller) > cents(d.Amount) {
+				return WrongData
+			}
+			e.ToSeller = toSeller
+			e.ToBuyer = float64(cents(d.Amount) - cents(toSeller)) / 100
+			switch {
+			case cents(e.ToBuyer) == 0:
+				e.Status = DealReleased
+			case cents(e.ToSeller) == 0:
+				e.Status = DealRefunded
+			}
+		} else if e.Status == DealReleased {
+			e.ToSeller = d.Amount
+		} else if e.Status == DealRefunded {
+			e.ToBuyer = d.Amount
+		}
+
+		if !dealTransitions[d.Status][e.Status] {
+			return DealConflict
+		}
+
+		d, err = db.moveDeal(ctx, tx, d, e)
+		return err
+	})
+	if err != nil {
+		return Deal{}, err
+	}
+	return d, nil
+}
+
+// moveDeal pays the parts of the event out of the escrow of the locked deal inside the transaction tx,
+// saves the new state and records the event
+func (db *Methods) moveDeal(ctx context.Context, tx pgx.Tx, d Deal, e DealEvent) (Deal, error) {
+	const update = `UPDATE escrow_deals SET status = $2, updated_at = now() WHERE id = $1 RETURNING updated_at`
+
+	var err error
+
+	if cents(e.ToSeller) > 0 {
+		e.SellerTransactionID, err = payOutOfEscrow(ctx, tx, d, d.Seller, e.ToSeller, TransactionEscrowRelease)
+		if err != nil {
+			return d, err
+		}
+	}
+	if cents(e.ToBuyer) > 0 {
+		e.BuyerTransactionID, err = payOutOfEscrow(ctx, tx, d, d.Buyer, e.ToBuyer, TransactionEscrowRefund)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	d.Status = e.Status
+	err = tx.QueryRow(ctx, update, d.ID, d.Status).Scan(&d.UpdatedAt)
+	if err != nil {
+		return d, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	err = recordDealEvent(ctx, tx, d.ID, e)
+	if err != nil {
+		return d, fmt.Errorf("recordDealEvent() error: %w", err)
+	}
+	return d, nil
+}
+
+// payOutOfEscrow moves sum from the escrow of the deal to the wallet of the user
+// inside the transaction tx and returns the ID of the transaction
+func payOutOfEscrow(ctx context.Context, tx pgx.Tx, d Deal, id int, sum float64, kind string) (int64, error) {
+	a, err := lockWallet(ctx, tx, id, d.Currency)
+	if err != nil {
+		return 0, fmt.Errorf("lockWallet() error: %w", err)
+	}
+	if err = a.canReceive(); err != nil {
+		return 0, err
+	}
+
+	balance, err := updateWallet(ctx, tx, id, d.Currency, sum)
+	if err != nil {
+		return 0, fmt.Errorf("updateWallet() error: %w", err)
+	}
+
+	comment := fmt.Sprintf("escrow deal %d", d.ID)
+	txID, err := recordTransaction(ctx, tx, transaction{ Type: kind, To: id, Amount: sum, Currency: d.Currency, Comment: comment })
+	if err != nil {
+		return 0, fmt.Errorf("recordTransaction() error: %w", err)
+	}
+
+	err = postEntries(ctx, tx, txID, d.Currency, entry{ escrowAccount(d.ID), -sum }, entry{ userAccount(id), sum })
+	if err != nil {
+		return 0, fmt.Errorf("postEntries() error: %w", err)
+	}
+
+	err = publishEvent(ctx, tx, events.Event{ AccountID: id, Balance: balance, Currency: d.Currency, TransactionID: txID, Type: kind })
+	if err != nil {
+		return 0, fmt.Errorf("publishEvent() error: %w", err)
+	}
+	return txID, nil
+}
+
+// recordDealEvent saves the event to the history of the deal inside the transaction tx
+func recordDealEvent(ctx context.Context, tx pgx.Tx, id int64, e DealEvent) error {
+	const insert = `INSERT INTO escrow_deal_history (deal_id, status, actor, reason, to_seller, to_buyer, seller_transaction_id, buyer_transaction_id)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, 0), NULLIF($8, 0))`
+
+	_, err := tx.Exec(ctx, insert, id, e.Status, e.Actor, e.Reason, e.ToSeller, e.ToBuyer, e.SellerTransactionID, e.BuyerTransactionID)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+	return nil
+}
+
+// dealColumns are the columns scanned by scanDeal
+const dealColumns = `id, buyer_id, seller_id, amount, currency, comment, status, created_at, updated_at`
+
+// scanDeal scans a row of dealColumns
+func scanDeal(row pgx.Row) (Deal, error) {
+	var d Deal
+
+	err := row.Scan(&d.ID, &d.Buyer, &d.Seller, &d.Amount, &d.Currency, &d.Comment, &d.Status, &d.CreatedAt, &d.UpdatedAt)
+	return d, err
+}
+
+// lockDeal returns the deal and locks it until the end of the transaction tx
+func lockDeal(ctx context.Context, tx pgx.Tx, id int64) (Deal, error) {
+	const request = `SELECT ` + dealColumns + ` FROM escrow_deals WHERE id = $1 FOR UPDATE`
+
+	d, err := scanDeal(tx.QueryRow(ctx, request, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return d, NotFound
+	}
+	if err != nil {
+		return d, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	return d, nil
+}
+
+// The GetDeal method returns the deal with its history, the oldest event first
+func (db *Methods) GetDeal(id int64) (Deal, error) {
+	const (
+		request = `SELECT ` + dealColumns + ` FROM escrow_deals WHERE id = $1`
+		history = `SELECT status, actor, reason, to_seller, to_buyer, COALESCE(seller_transaction_id, 0),
+				COALESCE(buyer_transaction_id, 0), created_at
+			FROM escrow_deal_history WHERE deal_id = $1 ORDER BY id`
+	)
+
+	if id <= 0 {
+		return Deal{}, WrongData
+	}
+
+	ctx := context.Background()
+	d, err := scanDeal(db.pool.QueryRow(ctx, request, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Deal{}, NotFound
+	}
+	if err != nil {
+		return Deal{}, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	rows, err := db.pool.Query(ctx, history, id)
+	if err != nil {
+		return Deal{}, fmt.Errorf("pool.Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var e DealEvent
+
+		err = rows.Scan(&e.Status, &e.Actor, &e.Reason, &e.ToSeller, &e.ToBuyer, &e.SellerTransactionID, &e.BuyerTransactionID, &e.CreatedAt)
+		if err != nil {
+			return Deal{}, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		d.History = append(d.History, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return Deal{}, fmt.Errorf("rows.Err() error: %w", err)
+	}
+	return d, nil
+}
@@ -0,0 +1,224 @@
+package methods
+
+import (
+	"app/pkg/events"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"math"
+	"time"
+)
+
+var (
+	QuoteExpired = errors.New("Quote is expired or already used")
+)
+
+// System accounts of currency exchanges.
+// AccountFX takes the money of one currency and gives the money of another at the market rate,
+// AccountFXSpread earns the difference between the market rate and the rate of the user.
+const (
+	AccountFX		= "fx"
+	AccountFXSpread	= "fx_spread"
+)
+
+// ExchangeQuote is an offer to exchange Sum of the currency From
+// to Amount of the currency To of the user's own wallets at Rate until ExpiresAt
+type ExchangeQuote struct {
+	ID			string
+	UserID		int
+	From		string
+	To			string
+	Sum			float64
+	Rate		float64
+	Amount		float64
+	ExpiresAt	time.Time
+}
+
+// Exchange is the result of a confirmed quote
+type Exchange struct {
+	Quote			ExchangeQuote
+	FromBalance		float64
+	ToBalance		float64
+	DebitTxID		int64
+	CreditTxID		int64
+}
+
+// The QuoteExchange method asks the rates provider for the rate of the currency pair,
+// applies the spread and saves the quote, which can be confirmed within QuoteTTL.
+func (db *Methods) QuoteExchange(id int, from, to string, sum float64) (ExchangeQuote, error) {
+	const insert = `INSERT INTO exchange_quotes (id, user_id, from_currency, to_currency, sum, market_rate, rate, amount, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, now() + $9::interval) RETURNING expires_at`
+
+	if id <= 0 || !currencies[from] || !currencies[to] || from == to || sum <= 0.00 {
+		return ExchangeQuote{}, WrongData
+	}
+
+	_, _, err := db.GetBalance(id)
+	if err != nil {
+		return ExchangeQuote{}, fmt.Errorf("GetBalance() error: %w", err)
+	}
+
+	market, err := db.Rates.Rate(context.Background(), from, to)
+	if err != nil {
+		return ExchangeQuote{}, fmt.Errorf("%w: %v", RateUnavailable, err)
+	}
+
+	// Every fetched rate is kept in the history
+	err = db.SaveRate(from, to, market, time.Now())
+	if err != nil {
+		return ExchangeQuote{}, fmt.Errorf("SaveRate() error: %w", err)
+	}
+
+	q := ExchangeQuote{
+		UserID:	id,
+		From:	from,
+		To:		to,
+		Sum:	sum,
+		// Rates are stored with 8 decimal places
+		Rate:	math.Round(market * (1 - db.Spread) * 1e8) / 1e8,
+	}
+	q.Amount = math.Round(sum * q.Rate * 100) / 100
+	if q.Amount <= 0.00 {
+		return ExchangeQuote{}, WrongData
+	}
+
+	q.ID, err = newQuoteID()
+	if err != nil {
+		return ExchangeQuote{}, fmt.Errorf("newQuoteID() error: %w", err)
+	}
+
+	err = db.pool.QueryRow(context.Background(), insert, q.ID, id, from, to, sum, market, q.Rate, q.Amount, db.QuoteTTL).Scan(&q.ExpiresAt)
+	if err != nil {
+		return ExchangeQuote{}, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	return q, nil
+}
+
+// The ConfirmExchange method executes the quote of the user in one transaction:
+// Sum is debited from the wallet in From, Amount is credited to the wallet in To.
+// Every leg is recorded as an exchange transaction with the rate of the quote.
+// A quote can be confirmed only once and before it expires, otherwise QuoteExpired is returned.
+func (db *Methods) ConfirmExchange(id int, quoteID string) (Exchange, error) {
+	var ex Exchange
+
+	if id <= 0 || quoteID == "" {
+		return ex, WrongData
+	}
+
+	err := db.pool.BeginFunc(context.Background(), func(tx pgx.Tx) (err error) {
+		ex, err = db.exchange(context.Background(), tx, id, quoteID)
+		return err
+	})
+	if err != nil {
+		return Exchange{}, err
+	}
+	return ex, nil
+}
+
+// exchange executes the quote inside the transaction tx
+func (db *Methods) exchange(ctx context.Context, tx pgx.Tx, id int, quoteID string) (Exchange, error) {
+	const (
+		request = `SELECT from_currency, to_currency, sum, market_rate, rate, amount, expires_at,
+				used_at IS NOT NULL OR expires_at <= now()
+			FROM exchange_quotes WHERE id = $1 AND user_id = $2 FOR UPDATE`
+		use = `UPDATE exchange_quotes SET used_at = now(), debit_tx = $2, credit_tx = $3 WHERE id = $1`
+	)
+
+	ex := Exchange{ Quote: ExchangeQuote{ ID: quoteID, UserID: id } }
+	q := &ex.Quote
+
+	var market float64
+	var expired bool
+
+	// The lock on the quote serializes concurrent confirmations of it
+	err := tx.QueryRow(ctx, request, quoteID, id).Scan(&q.From, &q.To, &q.Sum, &market, &q.Rate, &q.Amount, &q.ExpiresAt, &expired)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ex, NotFound
+	}
+	if err != nil {
+		return ex, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	if expired {
+		return ex, QuoteExpired
+	}
+
+	from, err := lockWallet(ctx, tx, id, q.From)
+	if err != nil {
+		return ex, fmt.Errorf("lockWallet() error: %w", err)
+	}
+
+	// Money leaves the wallet in From, so a frozen account can not exchange
+	err = from.canSend()
+	if err != nil {
+		return ex, err
+	}
+	if from.available() - q.Sum < 0.00 {
+		return ex, InsufficientFunds
+	}
+
+	ex.FromBalance, err = updateWallet(ctx, tx, id, q.From, -q.Sum)
+	if err != nil {
+		return ex, fmt.Errorf("updateWallet(..., from) error: %w", err)
+	}
+
+	ex.ToBalance, err = updateWallet(ctx, tx, id, q.To, q.Amount)
+	if err != nil {
+		return ex, fmt.Errorf("updateWallet(..., to) error: %w", err)
+	}
+
+	comment := "exchange " + quoteID
+
+	ex.DebitTxID, err = recordTransaction(ctx, tx, transaction{ Type: TransactionExchange, From: id, Amount: q.Sum, Currency: q.From, Rate: q.Rate, Comment: comment })
+	if err != nil {
+		return ex, fmt.Errorf("recordTransaction() error: %w", err)
+	}
+
+	ex.CreditTxID, err = recordTransaction(ctx, tx, transaction{ Type: TransactionExchange, To: id, Amount: q.Amount, Currency: q.To, Rate: q.Rate, Comment: comment })
+	if err != nil {
+		return ex, fmt.Errorf("recordTransaction() error: %w", err)
+	}
+
+	// AccountFX buys Sum at the market rate, the user gets Amount at the rate of the quote
+	// and the difference is booked to AccountFXSpread
+	marketAmount := math.Round(q.Sum * market * 100) / 100
+	spread := float64(cents(marketAmount) - cents(q.Amount)) / 100
+
+	err = postEntries(ctx, tx, ex.DebitTxID, q.From, entry{ userAccount(id), -q.Sum }, entry{ AccountFX, q.Sum })
+	if err != nil {
+		return ex, fmt.Errorf("postEntries() error: %w", err)
+	}
+
+	err = postEntries(ctx, tx, ex.CreditTxID, q.To, entry{ userAccount(id), q.Amount }, entry{ AccountFXSpread, spread }, entry{ AccountFX, -marketAmount })
+	if err != nil {
+		return ex, fmt.Errorf("postEntries() error: %w", err)
+	}
+
+	for _, e := range []events.Event{
+		{ AccountID: id, Balance: ex.FromBalance, Currency: q.From, TransactionID: ex.DebitTxID, Type: TransactionExchange },
+		{ AccountID: id, Balance: ex.ToBalance, Currency: q.To, TransactionID: ex.CreditTxID, Type: TransactionExchange },
+	} {
+		err = publishEvent(ctx, tx, e)
+		if err != nil {
+			return ex, fmt.Errorf("publishEvent() error: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(ctx, use, quoteID, ex.DebitTxID, ex.CreditTxID)
+	if err != nil {
+		return ex, fmt.Errorf("Exec() error: %w", err)
+	}
+	return ex, nil
+}
+
+// newQuoteID returns a random ID of a quote
+func newQuoteID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
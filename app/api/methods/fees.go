@@ -0,0 +1,127 @@
+package methods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"math"
+)
+
+// FeeRule is the commission charged to the sender of a transfer in the currency:
+// Fixed plus Percent of the sum, but not less than MinFee and not more than MaxFee
+// (MaxFee = 0 means no upper cap). The first FreePerMonth transfers
+// of the sender in the currency in a calendar month are free.
+type FeeRule struct {
+	Currency		string
+	Fixed			float64
+	Percent			float64
+	MinFee			float64
+	MaxFee			float64
+	FreePerMonth	int
+}
+
+// Quote is the cost of a transfer for the sender
+type Quote struct {
+	Sum			float64
+	Fee			float64
+	Total		float64
+	Currency	string
+}
+
+// fee applies the rule to sum, the result is rounded to kopecks
+func (r FeeRule) fee(sum float64) float64 {
+	fee := r.Fixed + sum * r.Percent / 100
+	if fee < r.MinFee {
+		fee = r.MinFee
+	}
+	if r.MaxFee > 0.00 && fee > r.MaxFee {
+		fee = r.MaxFee
+	}
+	return math.Round(fee * 100) / 100
+}
+
+// The QuoteTransfer method returns the fee and the total debit of the user "from"
+// for the transfer of sum in the currency to the user "to", as if the transfer was made now.
+// An empty currency means BaseCurrency.
+func (db *Methods) QuoteTransfer(from, to int, currency string, sum float64) (Quote, error) {
+	if currency == "" {
+		currency = BaseCurrency
+	}
+
+	if from <= 0 || to <= 0 || from == to || sum <= 0.00 || !currencies[currency] {
+		return Quote{}, WrongData
+	}
+
+	for _, id := range []int{ from, to } {
+		_, _, err := db.GetBalance(id)
+		if err != nil {
+			return Quote{}, fmt.Errorf("GetBalance() error: %w", err)
+		}
+	}
+
+	fee, err := transferFee(context.Background(), db.pool, from, currency, sum)
+	if err != nil {
+		return Quote{}, fmt.Errorf("transferFee() error: %w", err)
+	}
+	return Quote{ Sum: sum, Fee: fee, Total: sum + fee, Currency: currency }, nil
+}
+
+// The SetFeeRule method sets the fee rule of transfers in the currency of the rule
+func (db *Methods) SetFeeRule(r FeeRule) error {
+	const upsert = `INSERT INTO fee_rules (currency, fixed, percent, min_fee, max_fee, free_per_month)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (currency) DO UPDATE SET fixed = EXCLUDED.fixed, percent = EXCLUDED.percent,
+			min_fee = EXCLUDED.min_fee, max_fee = EXCLUDED.max_fee, free_per_month = EXCLUDED.free_per_month`
+
+	if r.Currency == "" {
+		r.Currency = BaseCurrency
+	}
+
+	if !currencies[r.Currency] || r.Fixed < 0.00 || r.Percent < 0.00 || r.Percent > 100.00 ||
+		r.MinFee < 0.00 || r.MaxFee < 0.00 || (r.MaxFee > 0.00 && r.MaxFee < r.MinFee) || r.FreePerMonth < 0 {
+		return WrongData
+	}
+
+	_, err := db.pool.Exec(context.Background(), upsert, r.Currency, r.Fixed, r.Percent, r.MinFee, r.MaxFee, r.FreePerMonth)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+	return nil
+}
+
+// transferFee returns the fee of the transfer of sum from the user "from" in the currency.
+// There is no fee if the currency has no rule.
+// Held transfers use up the free tier too, they are charged the fee quoted when they were held.
+// Inside a transfer it must be called after the sender is locked, so the free tier can not be overused.
+func transferFee(ctx context.Context, q querier, from int, currency string, sum float64) (float64, error) {
+	const (
+		request = `SELECT fixed, percent, min_fee, max_fee, free_per_month FROM fee_rules WHERE currency = $1`
+		transfers = `SELECT (SELECT count(*) FROM transactions
+				WHERE from_id = $1 AND type = $2 AND currency = $3 AND created_at >= date_trunc('month', now()))
+			+ (SELECT count(*) FROM pending_transfers
+				WHERE from_id = $1 AND status = 'pending' AND currency = $3 AND created_at >= date_trunc('month', now()))`
+	)
+
+	var r FeeRule
+	var used int
+
+	err := q.QueryRow(ctx, request, currency).Scan(&r.Fixed, &r.Percent, &r.MinFee, &r.MaxFee, &r.FreePerMonth)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	if r.FreePerMonth > 0 {
+		err = q.QueryRow(ctx, transfers, from, TransactionTransfer, currency).Scan(&used)
+		if err != nil {
+			return 0, fmt.Errorf("QueryRow() error: %w", err)
+		}
+		if used < r.FreePerMonth {
+			return 0, nil
+		}
+	}
+	return r.fee(sum), nil
+}
@@ -0,0 +1,319 @@
+package methods
+
+import (
+	"app/pkg/events"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"math"
+)
+
+// Allocation is money moved between a parent account and its sub-account:
+// an allocation by the parent, money taken back by it or a draw by the sub-account.
+type Allocation struct {
+	Parent			int
+	Child			int
+	ParentBalance	float64
+	ChildBalance	float64
+	Currency		string
+	TransactionID	int64
+}
+
+// RollupNode is an account of a tree of accounts.
+// Balance is the balance of the account, Total is the sum of the balances of its subtree including itself.
+type RollupNode struct {
+	ID			int
+	ParentID	int
+	Depth		int
+	Balance		float64
+	Total		float64
+}
+
+// The CreateSubAccount method opens a sub-account of the parent account and returns its ID.
+// The sub-account can draw drawLimit in BaseCurrency from the parent over drawPeriod (see limitPeriods),
+// an empty period means it can not draw.
+func (db *Methods) CreateSubAccount(parent int, drawLimit float64, drawPeriod string) (int, error) {
+	const insert = `INSERT INTO user_balance (parent_id, draw_limit, draw_period) VALUES ($1, $2, NULLIF($3, '')) RETURNING id`
+
+	var id int
+
+	if parent <= 0 || !validDrawLimit(drawLimit, drawPeriod) {
+		return 0, WrongData
+	}
+
+	ctx := context.Background()
+	err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		a, err := lockAccount(ctx, tx, parent)
+		if err != nil {
+			return err
+		}
+		if a.Status == StatusClosed {
+			return AccountClosed
+		}
+
+		err = tx.QueryRow(ctx, insert, parent, drawLimitValue(drawLimit, drawPeriod), drawPeriod).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("QueryRow() error: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// The SetDrawLimit method changes how much the sub-account child can draw from its parent,
+// an empty period means it can not draw
+func (db *Methods) SetDrawLimit(parent, child int, drawLimit float64, drawPeriod string) error {
+	const update = `UPDATE user_balance SET draw_limit = $3, draw_period = NULLIF($4, '') WHERE id = $2 AND parent_id = $1`
+
+	if parent <= 0 || child <= 0 || !validDrawLimit(drawLimit, drawPeriod) {
+		return WrongData
+	}
+
+	tag, err := db.pool.Exec(context.Background(), update, parent, child, drawLimitValue(drawLimit, drawPeriod), drawPeriod)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return NotFound
+	}
+	return nil
+}
+
+// validDrawLimit checks a draw limit: without a period there is no limit to set
+func validDrawLimit(drawLimit float64, drawPeriod string) bool {
+	_, ok := limitPeriods[drawPeriod]
+	return drawLimit >= 0.00 && (ok || (drawPeriod == "" && drawLimit == 0.00))
+}
+
+// drawLimitValue is the draw limit saved to the database, NULL without a period
+func drawLimitValue(drawLimit float64, drawPeriod string) interface{} {
+	if drawPeriod == "" {
+		return nil
+	}
+	return drawLimit
+}
+
+// The Allocate method moves sum from the parent account to its sub-account child in the currency,
+// a negative sum takes the money back from the sub-account. An empty currency means BaseCurrency.
+// Allocations are internal to the tree of accounts: they are not charged and not limited.
+func (db *Methods) Allocate(parent, child int, currency string, sum float64) (Allocation, error) {
+	var a Allocation
+
+	if currency == "" {
+		currency = BaseCurrency
+	}
+	if parent <= 0 || child <= 0 || cents(sum) == 0 || !currencies[currency] {
+		return a, WrongData
+	}
+
+	ctx := context.Background()
+	err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) (err error) {
+		_, err = subAccount(ctx, tx, parent, child)
+		if err != nil {
+			return err
+		}
+
+		a = Allocation{ Parent: parent, Child: child, Currency: currency }
+		if sum > 0.00 {
+			a.ParentBalance, a.ChildBalance, a.TransactionID, err = moveInTree(ctx, tx, parent, child, currency, sum, TransactionAllocation)
+		} else {
+			a.ChildBalance, a.ParentBalance, a.TransactionID, err = moveInTree(ctx, tx, child, parent, currency, -sum, TransactionAllocation)
+		}
+		return err
+	})
+	if err != nil {
+		return Allocation{}, err
+	}
+	return a, nil
+}
+
+// The DrawFromParent method moves sum in BaseCurrency from the parent of the sub-account child to it
+// within the draw limit of the sub-account
+func (db *Methods) DrawFromParent(child int, sum float64) (Allocation, error) {
+	const (
+		request = `SELECT parent_id FROM user_balance WHERE id = $1`
+		used = `SELECT COALESCE(SUM(amount), 0) FROM transactions
+			WHERE to_id = $1 AND from_id = $2 AND type = $3 AND currency = $5 AND created_at > now() - $4::interval`
+	)
+
+	var a Allocation
+
+	if child <= 0 || cents(sum) <= 0 {
+		return a, WrongData
+	}
+
+	ctx := context.Background()
+	err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var parent *int
+
+		err := tx.QueryRow(ctx, request, child).Scan(&parent)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return UserNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("QueryRow() error: %w", err)
+		}
+		if parent == nil {
+			return NotFound
+		}
+
+		l, err := subAccount(ctx, tx, *parent, child)
+		if err != nil {
+			return err
+		}
+
+		// A sub-account without a period can not draw at all
+		window, ok := limitPeriods[l.Period]
+		if ok && window != 0 {
+			err = tx.QueryRow(ctx, used, child, *parent, TransactionDraw, window, BaseCurrency).Scan(&l.Used)
+			if err != nil {
+				return fmt.Errorf("QueryRow() error: %w", err)
+			}
+		}
+		l.Remaining = math.Max(0, float64(cents(l.Amount) - cents(l.Used)) / 100)
+		if cents(sum) > cents(l.Remaining) {
+			return &LimitError{ Operation: TransactionDraw, Period: l.Period, Remaining: l.Remaining }
+		}
+
+		a = Allocation{ Parent: *parent, Child: child, Currency: BaseCurrency }
+		a.ParentBalance, a.ChildBalance, a.TransactionID, err = moveInTree(ctx, tx, *parent, child, BaseCurrency, sum, TransactionDraw)
+		return err
+	})
+	if err != nil {
+		return Allocation{}, err
+	}
+	return a, nil
+}
+
+// subAccount locks the parent and its sub-account child until the end of the transaction tx
+// and returns the draw limit of the sub-account. NotFound is returned if child is not a sub-account of parent.
+func subAccount(ctx context.Context, tx pgx.Tx, parent, child int) (Limit, error) {
+	const request = `SELECT COALESCE(draw_limit, 0), COALESCE(draw_period, '') FROM user_balance WHERE id = $2 AND parent_id = $1`
+
+	l := Limit{ Operation: TransactionDraw }
+
+	_, err := lockAccounts(ctx, tx, parent, child)
+	if err != nil {
+		return l, err
+	}
+
+	err = tx.QueryRow(ctx, request, parent, child).Scan(&l.Amount, &l.Period)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return l, NotFound
+	}
+	if err != nil {
+		return l, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	return l, nil
+}
+
+// moveInTree moves sum from the account "from" to the account "to" of the same tree in the currency
+// inside the transaction tx and returns their new balances and the ID of the transaction
+func moveInTree(ctx context.Context, tx pgx.Tx, from, to int, currency string, sum float64, kind string) (float64, float64, int64, error) {
+	accounts, err := lockWallets(ctx, tx, currency, from, to)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("lockWallets() error: %w", err)
+	}
+
+	err = accounts[from].canSend()
+	if err == nil {
+		err = accounts[to].canReceive()
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if accounts[from].available() - sum < 0.00 {
+		return 0, 0, 0, InsufficientFunds
+	}
+
+	fromBalance, err := updateWallet(ctx, tx, from, currency, -sum)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("updateWallet() error: %w", err)
+	}
+	toBalance, err := updateWallet(ctx, tx, to, currency, sum)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("updateWallet() error: %w", err)
+	}
+
+	txID, err := recordTransaction(ctx, tx, transaction{ Type: kind, From: from, To: to, Amount: sum, Currency: currency })
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("recordTransaction() error: %w", err)
+	}
+
+	err = postEntries(ctx, tx, txID, currency, entry{ userAccount(from), -sum }, entry{ userAccount(to), sum })
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("postEntries() error: %w", err)
+	}
+
+	for _, e := range []events.Event{
+		{ AccountID: from, Balance: fromBalance, Currency: currency, TransactionID: txID, Type: kind },
+		{ AccountID: to, Balance: toBalance, Currency: currency, TransactionID: txID, Type: kind },
+	} {
+		err = publishEvent(ctx, tx, e)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("publishEvent() error: %w", err)
+		}
+	}
+	return fromBalance, toBalance, txID, nil
+}
+
+// The Rollup method returns the tree of accounts under the account id in the currency, depth first:
+// every account is followed by its subtree. The tree is read with one recursive query.
+// Every account adds its balance to the totals of the accounts on its path from the root,
+// so the totals take one pass over the paths.
+// An empty currency means BaseCurrency.
+func (db *Methods) Rollup(id int, currency string) ([]RollupNode, error) {
+	const request = `WITH RECURSIVE tree AS (
+			SELECT id, parent_id, ARRAY[id] AS path, balance FROM user_balance WHERE id = $1
+			UNION ALL
+			SELECT u.id, u.parent_id, t.path || u.id, u.balance FROM user_balance u JOIN tree t ON u.parent_id = t.id
+		), balances AS (
+			SELECT id, parent_id, path,
+				CASE WHEN $2::VARCHAR = $3::VARCHAR THEN balance
+					ELSE COALESCE((SELECT w.balance FROM wallets w WHERE w.user_id = tree.id AND w.currency = $2::VARCHAR), 0) END AS balance
+			FROM tree
+		), totals AS (
+			SELECT ancestor, SUM(balance) AS total FROM balances, unnest(path) AS ancestor GROUP BY ancestor
+		)
+		SELECT b.id, COALESCE(b.parent_id, 0), cardinality(b.path) - 1, b.balance, t.total
+		FROM balances b JOIN totals t ON t.ancestor = b.id
+		ORDER BY b.path`
+
+	if currency == "" {
+		currency = BaseCurrency
+	}
+	if id <= 0 || !currencies[currency] {
+		return nil, WrongData
+	}
+
+	rows, err := db.pool.Query(context.Background(), request, id, currency, BaseCurrency)
+	if err != nil {
+		return nil, fmt.Errorf("pool.Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	var nodes []RollupNode
+	for rows.Next() {
+		var n RollupNode
+
+		err = rows.Scan(&n.ID, &n.ParentID, &n.Depth, &n.Balance, &n.Total)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		nodes = append(nodes, n)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err() error: %w", err)
+	}
+	if len(nodes) == 0 {
+		return nil, UserNotFound
+	}
+	return nodes, nil
+}
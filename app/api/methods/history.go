@@ -0,0 +1,92 @@
+package methods
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// The BalanceAt method returns the balance of the user's wallet in the currency at the moment asOf.
+// The balance is the last snapshot taken before asOf plus the journal entries booked after it,
+// so only the entries since the snapshot are replayed. An empty currency means BaseCurrency.
+func (db *Methods) BalanceAt(id int, currency string, asOf time.Time) (float64, error) {
+	if currency == "" {
+		currency = BaseCurrency
+	}
+	if !currencies[currency] || asOf.IsZero() {
+		return 0, WrongData
+	}
+
+	_, _, err := db.GetBalance(id)
+	if err != nil {
+		return 0, err
+	}
+
+	return balanceAt(context.Background(), db.pool, id, currency, asOf)
+}
+
+// balanceAt returns the balance of the user's wallet in the currency at the moment asOf
+func balanceAt(ctx context.Context, q querier, id int, currency string, asOf time.Time) (float64, error) {
+	const request = `WITH snapshot AS (
+			SELECT balance, last_entry_id FROM balance_snapshots
+			WHERE account = $1 AND currency = $2 AND taken_at <= $3
+			ORDER BY last_entry_id DESC LIMIT 1)
+		SELECT COALESCE((SELECT balance FROM snapshot), 0) + COALESCE(SUM(amount), 0) FROM journal_entries
+		WHERE account = $1 AND currency = $2 AND created_at <= $3
+			AND id > COALESCE((SELECT last_entry_id FROM snapshot), 0)`
+
+	var balance float64
+
+	err := q.QueryRow(ctx, request, userAccount(id), currency, asOf).Scan(&balance)
+	if err != nil {
+		return 0, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	return balance, nil
+}
+
+// The TakeSnapshots method records the balance of every user wallet with at least minEntries
+// journal entries since its last snapshot. The snapshots end at the last entry created before the time.
+// Entries of transactions still in progress would be skipped by the snapshot for good, so the cut is read
+// under the exclusive journal lock: no posting is in flight then and every entry below the cut is committed.
+// A snapshot is valid from the time of the latest of its entries.
+func (db *Methods) TakeSnapshots(before time.Time, minEntries int) (int, error) {
+	const lock = `SELECT pg_advisory_xact_lock($1)`
+	const insert = `WITH cut AS (
+			SELECT MAX(id) AS id FROM journal_entries WHERE created_at < $1),
+		last AS (
+			SELECT DISTINCT ON (account, currency) account, currency, balance, last_entry_id FROM balance_snapshots
+			ORDER BY account, currency, last_entry_id DESC)
+		INSERT INTO balance_snapshots (account, currency, balance, last_entry_id, taken_at)
+		SELECT j.account, j.currency, COALESCE(l.balance, 0) + SUM(j.amount), MAX(j.id), MAX(j.created_at)
+		FROM journal_entries j LEFT JOIN last l ON l.account = j.account AND l.currency = j.currency
+		WHERE j.account LIKE 'user:%' AND j.id > COALESCE(l.last_entry_id, 0) AND j.id <= (SELECT id FROM cut)
+		GROUP BY j.account, j.currency, l.balance
+		HAVING COUNT(*) >= $2`
+
+	if minEntries <= 0 {
+		return 0, WrongData
+	}
+
+	var taken int
+
+	ctx := context.Background()
+	err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, lock, journalLockKey)
+		if err != nil {
+			return fmt.Errorf("Exec() error: %w", err)
+		}
+
+		// The statement reads the journal after the lock is taken, so it sees every entry below the cut
+		tag, err := tx.Exec(ctx, insert, before, minEntries)
+		if err != nil {
+			return fmt.Errorf("Exec() error: %w", err)
+		}
+		taken = int(tag.RowsAffected())
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return taken, nil
+}
@@ -0,0 +1,148 @@
+package methods
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"math"
+	"strconv"
+)
+
+// System accounts of the ledger.
+// Money enters the service through AccountExternalCashIn, is earned on AccountRevenue
+// and is returned to users from AccountRefunds.
+const (
+	AccountExternalCashIn	= "external_cash_in"
+	AccountRevenue			= "revenue"
+	AccountRefunds			= "refunds"
+)
+
+// entry is one leg of a journal posting, positive amounts increase the account
+type entry struct {
+	Account		string
+	Amount		float64
+}
+
+// LedgerAccount is the sum of all journal entries of an account in a currency
+type LedgerAccount struct {
+	Account		string
+	Currency	string
+	Balance		float64
+}
+
+// TrialBalance proves that the ledger is consistent
+type TrialBalance struct {
+	// Accounts holds every system account, all user wallets are summed up as "users"
+	// all bonus balances as "bonuses" and the money of all escrow deals as "escrow"
+	Accounts			[]LedgerAccount
+	// Total is the sum of all journal entries, it is zero for a balanced ledger
+	Total				float64
+	// Totals are the sums of the journal entries per currency, every one is zero for a balanced ledger
+	Totals				map[string]float64
+	// MismatchedWallets is the number of wallets whose balance differs from the sum of their entries
+	MismatchedWallets	int
+}
+
+// userAccount returns the ledger account of the user's wallet
+func userAccount(id int) string {
+	return "user:" + strconv.Itoa(id)
+}
+
+// cents converts an amount of money to kopecks to compare amounts exactly
+func cents(sum float64) int64 {
+	return int64(math.Round(sum * 100))
+}
+
+// journalLockKey is the key of the advisory lock on the journal: postings share it until they commit,
+// snapshots of the balances take it exclusively
+const journalLockKey = 39
+
+// postEntries books the entries of the transaction txID in the currency inside the transaction tx.
+// Entries of one posting must sum up to zero.
+func postEntries(ctx context.Context, tx pgx.Tx, txID int64, currency string, entries ...entry) error {
+	const (
+		lock = `SELECT pg_advisory_xact_lock_shared($1)`
+		insert = `INSERT INTO journal_entries (transaction_id, account, amount, currency) VALUES ($1, $2, $3, $4)`
+	)
+
+	var total int64
+	for _, e := range entries {
+		total += cents(e.Amount)
+	}
+	if total != 0 {
+		return fmt.Errorf("unbalanced posting of transaction %d: %d kopecks", txID, total)
+	}
+
+	// The entries get their IDs only under the lock, so a snapshot never cuts the journal below them
+	// before they are committed
+	_, err := tx.Exec(ctx, lock, journalLockKey)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+
+	for _, e := range entries {
+		_, err = tx.Exec(ctx, insert, txID, e.Account, e.Amount, currency)
+		if err != nil {
+			return fmt.Errorf("Exec() error: %w", err)
+		}
+	}
+	return nil
+}
+
+// The TrialBalance method sums up the journal entries of all accounts
+// and checks the balances of users against their entries.
+func (db *Methods) TrialBalance() (TrialBalance, error) {
+	var tb TrialBalance
+
+	const (
+		request = `SELECT CASE WHEN account LIKE 'user:%' THEN 'users' WHEN account LIKE 'bonus:%' THEN 'bonuses'
+				WHEN account LIKE 'escrow:%' THEN 'escrow' ELSE account END,
+				currency, SUM(amount)
+			FROM journal_entries GROUP BY 1, 2 ORDER BY 2, 1`
+		mismatched = `SELECT count(*) FROM (
+				SELECT id AS user_id, $1::VARCHAR AS currency, balance FROM user_balance
+				UNION ALL
+				SELECT user_id, currency, balance FROM wallets
+			) w
+			WHERE w.balance <> COALESCE((SELECT SUM(amount) FROM journal_entries
+				WHERE account = 'user:' || w.user_id AND currency = w.currency), 0)`
+	)
+
+	rows, err := db.pool.Query(context.Background(), request)
+	if err != nil {
+		return tb, fmt.Errorf("pool.Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	var total int64
+	totals := make(map[string]int64)
+	tb.Accounts = []LedgerAccount{}
+	for rows.Next() {
+		var account LedgerAccount
+
+		err = rows.Scan(&account.Account, &account.Currency, &account.Balance)
+		if err != nil {
+			return tb, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		total += cents(account.Balance)
+		totals[account.Currency] += cents(account.Balance)
+		tb.Accounts = append(tb.Accounts, account)
+	}
+
+	if err = rows.Err(); err != nil {
+		return tb, fmt.Errorf("rows.Err() error: %w", err)
+	}
+	tb.Total = float64(total) / 100
+
+	tb.Totals = make(map[string]float64, len(totals))
+	for currency, sum := range totals {
+		tb.Totals[currency] = float64(sum) / 100
+	}
+
+	err = db.pool.QueryRow(context.Background(), mismatched, BaseCurrency).Scan(&tb.MismatchedWallets)
+	if err != nil {
+		return tb, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	return tb, nil
+}
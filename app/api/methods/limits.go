@@ -0,0 +1,219 @@
+package methods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"math"
+	"time"
+)
+
+var (
+	LimitExceeded = errors.New("Limit exceeded")
+)
+
+// Periods of spending limits. A "single" limit caps one operation,
+// the others cap the sum of operations over a rolling window.
+const (
+	PeriodSingle	= "single"
+	PeriodDay		= "day"
+	PeriodWeek		= "week"
+	PeriodMonth		= "month"
+)
+
+// limitPeriods are the rolling windows of the periods
+var limitPeriods = map[string]time.Duration{
+	PeriodSingle:	0,
+	PeriodDay:		24 * time.Hour,
+	PeriodWeek:		7 * 24 * time.Hour,
+	PeriodMonth:	30 * 24 * time.Hour,
+}
+
+// limitOperations are the types of transactions that can be limited
+var limitOperations = map[string]bool{
+	TransactionWithdraw:	true,
+	TransactionTransfer:	true,
+}
+
+// Limit is a spending limit applied to an account and its current usage
+type Limit struct {
+	Operation	string
+	Period		string
+	Amount		float64
+	Used		float64
+	Remaining	float64
+	// Default is false if the limit is an override for the account
+	Default		bool
+}
+
+// LimitError is returned when an operation breaks a spending limit.
+// Remaining is the amount the account can still spend on the operation.
+type LimitError struct {
+	Operation	string
+	Period		string
+	Remaining	float64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: %s limit of %s, %.2f remaining", LimitExceeded, e.Period, e.Operation, e.Remaining)
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == LimitExceeded
+}
+
+// querier is implemented both by the pool and by transactions
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// The GetLimits method returns the spending limits applied to the account
+// (its overrides and the defaults it does not override) together with their usage.
+func (db *Methods) GetLimits(id int) ([]Limit, error) {
+	if id <= 0 {
+		return nil, WrongData
+	}
+
+	_, _, err := db.GetBalance(id)
+	if err != nil {
+		return nil, fmt.Errorf("GetBalance() error: %w", err)
+	}
+
+	var limits []Limit
+	for _, operation := range []string{TransactionWithdraw, TransactionTransfer} {
+		l, err := limitsUsage(context.Background(), db.pool, id, operation)
+		if err != nil {
+			return nil, fmt.Errorf("limitsUsage() error: %w", err)
+		}
+		limits = append(limits, l...)
+	}
+	return limits, nil
+}
+
+// The SetLimit method sets the spending limit of the operation over the period for the account.
+// If id is 0, the default limit of all accounts is set.
+func (db *Methods) SetLimit(id int, operation, period string, amount float64) error {
+	const upsert = `INSERT INTO spending_limits (user_id, operation, period, amount) VALUES (NULLIF($1, 0), $2, $3, $4)
+		ON CONFLICT (COALESCE(user_id, 0), operation, period) DO UPDATE SET amount = EXCLUDED.amount`
+
+	_, ok := limitPeriods[period]
+	if id < 0 || !limitOperations[operation] || !ok || amount < 0.00 {
+		return WrongData
+	}
+
+	if id != 0 {
+		_, _, err := db.GetBalance(id)
+		if err != nil {
+			return fmt.Errorf("GetBalance() error: %w", err)
+		}
+	}
+
+	_, err := db.pool.Exec(context.Background(), upsert, id, operation, period, amount)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+	return nil
+}
+
+// checkLimits returns a LimitError if spending sum on the operation breaks a limit of the account.
+// Limits are set in BaseCurrency and apply to the wallet in BaseCurrency only.
+// It must be called after the account is locked, so concurrent operations can not overspend.
+func checkLimits(ctx context.Context, tx pgx.Tx, id int, operation string, sum float64) error {
+	limits, err := limitsUsage(ctx, tx, id, operation)
+	if err != nil {
+		return fmt.Errorf("limitsUsage() error: %w", err)
+	}
+
+	var broken *LimitError
+	remaining := math.Inf(1)
+	for _, l := range limits {
+		if cents(sum) > cents(l.Remaining) && broken == nil {
+			broken = &LimitError{ Operation: operation, Period: l.Period }
+		}
+		remaining = math.Min(remaining, l.Remaining)
+	}
+
+	if broken != nil {
+		broken.Remaining = remaining
+		return broken
+	}
+	return nil
+}
+
+// limitsUsage loads the limits of the operation applied to the account and sums up
+// the operations of the account over the window of every limit.
+// Withdrawals include the real money paid for services, transfers include the sums held by pending transfers.
+func limitsUsage(ctx context.Context, q querier, id int, operation string) ([]Limit, error) {
+	const (
+		request = `SELECT DISTINCT ON (period) period, amount, user_id IS NULL FROM spending_limits
+			WHERE operation = $2 AND (user_id = $1 OR user_id IS NULL)
+			ORDER BY period, user_id NULLS LAST`
+		used = `SELECT COALESCE(SUM(amount), 0) FROM transactions
+			WHERE from_id = $1 AND type = ANY($2) AND currency = $4 AND created_at > now() - $3::interval`
+		// Only the real money of payments for services is withdrawn, bonuses are not
+		paid = `SELECT COALESCE(-SUM(j.amount), 0) FROM journal_entries j JOIN transactions t ON t.id = j.transaction_id
+			WHERE t.from_id = $1 AND t.type = $2 AND t.currency = $4 AND t.created_at > now() - $3::interval AND j.account = $5`
+		held = `SELECT COALESCE(SUM(amount), 0) FROM pending_transfers
+			WHERE from_id = $1 AND status = 'pending' AND currency = $3 AND created_at > now() - $2::interval`
+	)
+
+	rows, err := q.Query(ctx, request, id, operation)
+	if err != nil {
+		return nil, fmt.Errorf("Query() error: %w", err)
+	}
+
+	var limits []Limit
+	for rows.Next() {
+		l := Limit{ Operation: operation }
+
+		err = rows.Scan(&l.Period, &l.Amount, &l.Default)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		limits = append(limits, l)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err() error: %w", err)
+	}
+
+	// Money paid into escrow deals is transferred too
+	types := []string{ operation }
+	if operation == TransactionTransfer {
+		types = append(types, TransactionEscrow)
+	}
+
+	for i, l := range limits {
+		window := limitPeriods[l.Period]
+		if window != 0 {
+			err = q.QueryRow(ctx, used, id, types, window, BaseCurrency).Scan(&limits[i].Used)
+			if err != nil {
+				return nil, fmt.Errorf("QueryRow() error: %w", err)
+			}
+			if operation == TransactionWithdraw {
+				var payments float64
+
+				err = q.QueryRow(ctx, paid, id, TransactionPayment, window, BaseCurrency, userAccount(id)).Scan(&payments)
+				if err != nil {
+					return nil, fmt.Errorf("QueryRow() error: %w", err)
+				}
+				limits[i].Used += payments
+			}
+			if operation == TransactionTransfer {
+				var pending float64
+
+				err = q.QueryRow(ctx, held, id, window, BaseCurrency).Scan(&pending)
+				if err != nil {
+					return nil, fmt.Errorf("QueryRow() error: %w", err)
+				}
+				limits[i].Used += pending
+			}
+		}
+		limits[i].Remaining = math.Max(0, float64(cents(l.Amount) - cents(limits[i].Used)) / 100)
+	}
+	return limits, nil
+}
@@ -1,13 +1,53 @@
 package methods
 
 import (
+	"app/pkg/rates"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"time"
 )
 
 type Methods struct {
-	pool	*pgxpool.Pool
+	pool				*pgxpool.Pool
+	// Rates provides the market rates of currency exchanges
+	Rates				rates.Provider
+	// Spread is the share of the market rate the service keeps on an exchange
+	Spread				float64
+	// QuoteTTL is how long an exchange quote can be confirmed
+	QuoteTTL			time.Duration
+	// RateMaxAge is the age after which a stored rate is reported as stale
+	RateMaxAge			time.Duration
+	// BonusOrder defines whether bonuses are spent on services before (BonusFirst)
+	// or after (BonusLast) the real balance
+	BonusOrder			string
+	// ScheduleMaxAttempts is how many times a scheduled operation is tried
+	// before the run is recorded as failed
+	ScheduleMaxAttempts	int
+	// ScheduleRetryDelay is the delay before the retry of a failed scheduled operation,
+	// it grows with every attempt
+	ScheduleRetryDelay	time.Duration
+	// PendingTimeout is how long a pending transfer waits for the recipient
+	// before the money goes back to the sender
+	PendingTimeout		time.Duration
+	// PaymentRequestTTL is how long a payment request can be paid if its expiry is not set
+	PaymentRequestTTL	time.Duration
+	// OverdraftDailyRate is the share of the overdraft charged as interest every day
+	OverdraftDailyRate	float64
+	// OverdraftDailyFee is the fixed fee in BaseCurrency charged every day an account is overdrawn
+	OverdraftDailyFee	float64
 }
 
 func New(pgxPool *pgxpool.Pool) *Methods {
-	return &Methods{ pool: pgxPool }
+	return &Methods{
+		pool:					pgxPool,
+		Rates:					rates.Default,
+		Spread:					0.005,
+		QuoteTTL:				30 * time.Second,
+		RateMaxAge:				2 * time.Hour,
+		BonusOrder:				BonusFirst,
+		ScheduleMaxAttempts:	3,
+		ScheduleRetryDelay:		time.Hour,
+		PendingTimeout:			72 * time.Hour,
+		PaymentRequestTTL:		7 * 24 * time.Hour,
+		OverdraftDailyRate:		0.0005,
+	}
 }
@@ -0,0 +1,108 @@
+package methods
+
+import (
+	"app/pkg/events"
+	"app/pkg/outbox"
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"strconv"
+)
+
+// outboxLockKey is the key of the advisory lock held by the relay processing the outbox
+const outboxLockKey = 30
+
+// writeOutbox saves the event to the outbox inside the transaction tx.
+// Transactions touching the same account are serialized by the lock on its row,
+// so outbox IDs of one account grow in the order of commits.
+func writeOutbox(ctx context.Context, tx pgx.Tx, e events.Event, payload []byte) error {
+	const insert = `INSERT INTO outbox (account_id, type, payload) VALUES ($1, $2, $3)`
+
+	_, err := tx.Exec(ctx, insert, e.AccountID, e.Type, payload)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+	return nil
+}
+
+// ProcessOutbox implements outbox.Store.
+// The relay holds a session advisory lock on its own connection instead of a transaction:
+// messages are read and marked as sent by short statements, no transaction stays open
+// while publish waits for the network.
+func (db *Methods) ProcessOutbox(limit int, publish func([]outbox.Message) []int64) error {
+	const (
+		lock = `SELECT pg_try_advisory_lock($1)`
+		unlock = `SELECT pg_advisory_unlock($1)`
+		request = `SELECT id, account_id, type, payload, created_at FROM outbox
+			WHERE sent_at IS NULL ORDER BY id LIMIT $1`
+		update = `UPDATE outbox SET sent_at = now() WHERE id = ANY($1)`
+	)
+
+	var locked bool
+
+	ctx := context.Background()
+
+	conn, err := db.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("pool.Acquire() error: %w", err)
+	}
+
+	defer conn.Release()
+
+	err = conn.QueryRow(ctx, lock, outboxLockKey).Scan(&locked)
+	if err != nil {
+		return fmt.Errorf("QueryRow() error: %w", err)
+	}
+	if !locked {
+		return nil
+	}
+
+	defer func() {
+		// A connection that could not release the lock must not go back to the pool holding it,
+		// closing it releases the lock
+		_, err := conn.Exec(ctx, unlock, outboxLockKey)
+		if err != nil {
+			conn.Conn().Close(ctx)
+		}
+	}()
+
+	rows, err := conn.Query(ctx, request, limit)
+	if err != nil {
+		return fmt.Errorf("Query() error: %w", err)
+	}
+
+	var messages []outbox.Message
+	for rows.Next() {
+		var msg outbox.Message
+		var accountID int
+
+		err = rows.Scan(&msg.ID, &accountID, &msg.Type, &msg.Payload, &msg.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		msg.Key = strconv.Itoa(accountID)
+		messages = append(messages, msg)
+	}
+	rows.Close()
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("rows.Err() error: %w", err)
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	sent := publish(messages)
+	if len(sent) == 0 {
+		return nil
+	}
+
+	_, err = conn.Exec(ctx, update, sent)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+	return nil
+}
+
+var _ outbox.Store = (*Methods)(nil)
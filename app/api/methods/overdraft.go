@@ -0,0 +1,216 @@
+package methods
+
+import (
+	"app/pkg/events"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"math"
+	"time"
+)
+
+// Overdraft is the credit line of an account.
+// Used is the part of the credit line the account has spent, Accrued is the interest and the fees
+// charged for it over all time.
+type Overdraft struct {
+	ID			int
+	CreditLimit	float64
+	Balance		float64
+	Used		float64
+	Available	float64
+	Accrued		float64
+}
+
+// The SetCreditLimit method lets the balance of the account in BaseCurrency go below zero down to -limit.
+// A limit below the current overdraft only stops new spending, the debt stays.
+func (db *Methods) SetCreditLimit(id int, limit float64) error {
+	const update = `UPDATE user_balance SET credit_limit = $2 WHERE id = $1`
+
+	if id <= 0 || limit < 0.00 {
+		return WrongData
+	}
+
+	ctx := context.Background()
+	return db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		a, err := lockAccount(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if a.Status == StatusClosed {
+			return AccountClosed
+		}
+
+		_, err = tx.Exec(ctx, update, id, limit)
+		if err != nil {
+			return fmt.Errorf("Exec() error: %w", err)
+		}
+		return nil
+	})
+}
+
+// The GetOverdraft method returns the credit line of the account and how much of it is used
+func (db *Methods) GetOverdraft(id int) (Overdraft, error) {
+	const request = `SELECT u.credit_limit, u.balance, u.held,
+			COALESCE((SELECT SUM(a.interest + a.fee) FROM overdraft_accruals a WHERE a.user_id = u.id), 0)
+		FROM user_balance u WHERE u.id = $1`
+
+	o := Overdraft{ ID: id }
+
+	if id <= 0 {
+		return o, WrongData
+	}
+
+	var held float64
+	err := db.pool.QueryRow(context.Background(), request, id).Scan(&o.CreditLimit, &o.Balance, &held, &o.Accrued)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Overdraft{}, UserNotFound
+	}
+	if err != nil {
+		return Overdraft{}, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	o.Used = math.Max(0, -o.Balance)
+	o.Available = account{ Balance: o.Balance, Held: held, CreditLimit: o.CreditLimit }.available()
+	return o, nil
+}
+
+// The AccrueOverdraft method charges up to limit accounts with a negative balance in BaseCurrency
+// for the day: OverdraftDailyRate of the overdraft and OverdraftDailyFee go to AccountRevenue.
+// Every account is charged once a day, so the method can run any number of times.
+// Days missed since the last charge of an account, e.g. while the service was down, are caught up:
+// each of them is charged for the overdraft at its end, days the account was not overdrawn are skipped.
+// An account overdrawn on its last charged day is caught up even if it has been topped up since,
+// the day is then recorded with a zero overdraft, so the account is not selected again until it goes negative.
+// The number of charged accounts is returned.
+func (db *Methods) AccrueOverdraft(day time.Time, limit int) (int, error) {
+	const (
+		request = `SELECT u.id, u.balance, COALESCE(l.day, $1::date - 1)
+			FROM user_balance u LEFT JOIN LATERAL (
+				SELECT a.day, a.overdraft FROM overdraft_accruals a WHERE a.user_id = u.id ORDER BY a.day DESC LIMIT 1) l ON true
+			WHERE (u.balance < 0 OR l.overdraft > 0)
+				AND NOT EXISTS (SELECT 1 FROM overdraft_accruals a WHERE a.user_id = u.id AND a.day = $1)
+			ORDER BY u.id LIMIT $2 FOR UPDATE OF u SKIP LOCKED`
+		insert = `INSERT INTO overdraft_accruals (user_id, day, overdraft, interest, fee, transaction_id)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0))`
+	)
+
+	type overdrawn struct {
+		account
+		last	time.Time
+	}
+
+	var accrued int
+
+	if limit <= 0 {
+		return 0, WrongData
+	}
+
+	// Days are counted in UTC, so the runs of all instances agree on them
+	day = day.UTC().Truncate(24 * time.Hour)
+
+	ctx := context.Background()
+	err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, request, day, limit)
+		if err != nil {
+			return fmt.Errorf("Query() error: %w", err)
+		}
+
+		var accounts []overdrawn
+		for rows.Next() {
+			var a overdrawn
+
+			err = rows.Scan(&a.ID, &a.Balance, &a.last)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("rows.Scan() error: %w", err)
+			}
+			accounts = append(accounts, a)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("rows.Err() error: %w", err)
+		}
+
+		for _, a := range accounts {
+			from := a.last.AddDate(0, 0, 1)
+			if from.After(day) {
+				from = day
+			}
+
+			// The charges of the missed days are not in the balances at their ends yet
+			var charged float64
+			for d := from; !d.After(day); d = d.AddDate(0, 0, 1) {
+				balance := a.Balance
+				if d.Before(day) {
+					balance, err = balanceAt(ctx, tx, a.ID, BaseCurrency, d.Add(24 * time.Hour - time.Microsecond))
+					if err != nil {
+						return fmt.Errorf("balanceAt() error: %w", err)
+					}
+				}
+				balance -= charged
+				if cents(balance) >= 0 {
+					if d.Equal(day) {
+						// The account has been topped up: nothing is charged, but the day is recorded
+						_, err = tx.Exec(ctx, insert, a.ID, d, 0, 0, 0, 0)
+						if err != nil {
+							return fmt.Errorf("Exec() error: %w", err)
+						}
+					}
+					continue
+				}
+
+				overdraft := -balance
+				interest := math.Round(overdraft * db.OverdraftDailyRate * 100) / 100
+				fee := math.Round(db.OverdraftDailyFee * 100) / 100
+
+				var txID int64
+				if cents(interest + fee) > 0 {
+					txID, err = chargeOverdraft(ctx, tx, a.ID, interest, fee)
+					if err != nil {
+						return fmt.Errorf("chargeOverdraft() error: %w", err)
+					}
+					charged += interest + fee
+				}
+
+				// The day is recorded even if nothing is charged, so the account is not selected again
+				_, err = tx.Exec(ctx, insert, a.ID, d, overdraft, interest, fee, txID)
+				if err != nil {
+					return fmt.Errorf("Exec() error: %w", err)
+				}
+			}
+		}
+		accrued = len(accounts)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return accrued, nil
+}
+
+// chargeOverdraft takes the interest and the fee of the overdraft from the account to AccountRevenue
+// inside the transaction tx and returns the ID of the transaction.
+// The charge is not limited by the credit line: the debt grows with it.
+func chargeOverdraft(ctx context.Context, tx pgx.Tx, id int, interest, fee float64) (int64, error) {
+	balance, err := updateWallet(ctx, tx, id, BaseCurrency, -interest - fee)
+	if err != nil {
+		return 0, fmt.Errorf("updateWallet() error: %w", err)
+	}
+
+	txID, err := recordTransaction(ctx, tx, transaction{ Type: TransactionOverdraft, From: id, Amount: interest, Fee: fee })
+	if err != nil {
+		return 0, fmt.Errorf("recordTransaction() error: %w", err)
+	}
+
+	err = postEntries(ctx, tx, txID, BaseCurrency, entry{ userAccount(id), -interest - fee }, entry{ AccountRevenue, interest + fee })
+	if err != nil {
+		return 0, fmt.Errorf("postEntries() error: %w", err)
+	}
+
+	err = publishEvent(ctx, tx, events.Event{ AccountID: id, Balance: balance, Currency: BaseCurrency, TransactionID: txID, Type: TransactionOverdraft })
+	if err != nil {
+		return 0, fmt.Errorf("publishEvent() error: %w", err)
+	}
+	return txID, nil
+}
@@ -0,0 +1,383 @@
+package methods
+
+import (
+	"app/pkg/events"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+var (
+	TransferNotPending = errors.New("Transfer is not pending")
+)
+
+// Statuses of pending transfers
+const (
+	TransferPending		= "pending"
+	TransferAccepted	= "accepted"
+	TransferDeclined	= "declined"
+	TransferCancelled	= "cancelled"
+	TransferExpired		= "expired"
+)
+
+// PendingTransfer is a transfer waiting for the recipient to accept it.
+// Sum and Fee are held in the sender's wallet: they stay in the balance,
+// but can not be spent until the transfer is resolved.
+// FromBalance and ToBalance are the balances of the wallets after the last action.
+type PendingTransfer struct {
+	ID			int64
+	From		int
+	To			int
+	Sum			float64
+	Fee			float64
+	Currency	string
+	Status		string
+	CreatedAt	time.Time
+	ExpiresAt	time.Time
+	FromBalance	float64
+	ToBalance	float64
+}
+
+// pendingColumns are the columns scanned by scanPendingTransfer
+const pendingColumns = `id, from_id, to_id, amount, fee, currency, status, created_at, expires_at`
+
+// scanPendingTransfer scans a row of pendingColumns
+func scanPendingTransfer(row pgx.Row) (PendingTransfer, error) {
+	var p PendingTransfer
+
+	err := row.Scan(&p.ID, &p.From, &p.To, &p.Sum, &p.Fee, &p.Currency, &p.Status, &p.CreatedAt, &p.ExpiresAt)
+	return p, err
+}
+
+// updateHeld adds sum to the money held in the wallet of the user in the currency
+// inside the transaction tx
+func updateHeld(ctx context.Context, tx pgx.Tx, id int, currency string, sum float64) error {
+	const (
+		base = `UPDATE user_balance SET held = held + $1 WHERE id = $2`
+		other = `UPDATE wallets SET held = held + $1 WHERE user_id = $2 AND currency = $3`
+	)
+
+	var err error
+	if currency == BaseCurrency {
+		_, err = tx.Exec(ctx, base, sum, id)
+	} else {
+		_, err = tx.Exec(ctx, other, sum, id, currency)
+	}
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+	return nil
+}
+
+// announceHeld publishes the event of the type with the balance, the held and the available money
+// of the wallet of the locked user in the currency inside the transaction tx
+func announceHeld(ctx context.Context, tx pgx.Tx, id int, currency, eventType string) error {
+	a, err := lockWallet(ctx, tx, id, currency)
+	if err != nil {
+		return fmt.Errorf("lockWallet() error: %w", err)
+	}
+
+	available := a.available()
+	err = publishEvent(ctx, tx, events.Event{ AccountID: id, Balance: a.Balance, Currency: currency, Type: eventType,
+		Held: &a.Held, Available: &available })
+	if err != nil {
+		return fmt.Errorf("publishEvent() error: %w", err)
+	}
+	return nil
+}
+
+// The HoldTransfer method is the first step of a transfer the recipient must accept:
+// sum and the transfer fee are held in the sender's wallet in the currency until the recipient
+// accepts or declines the transfer, the sender cancels it or it expires after PendingTimeout.
+// The checks of TransferWallet are done when the transfer is held and again when it is accepted.
+func (db *Methods) HoldTransfer(from, to int, currency, toCurrency string, sum float64) (PendingTransfer, error) {
+	var p PendingTransfer
+
+	if currency == "" {
+		currency = BaseCurrency
+	}
+	if toCurrency == "" {
+		toCurrency = BaseCurrency
+	}
+	if toCurrency != currency {
+		return p, CurrencyMismatch
+	}
+	if from <= 0 || to <= 0 || from == to || cents(sum) <= 0 || !currencies[currency] {
+		return p, WrongData
+	}
+
+	err := db.pool.BeginFunc(context.Background(), func(tx pgx.Tx) (err error) {
+		p, err = db.holdTransfer(context.Background(), tx, from, to, currency, sum)
+		return err
+	})
+	if err != nil {
+		return PendingTransfer{}, err
+	}
+	return p, nil
+}
+
+// holdTransfer holds the transfer inside the transaction tx
+func (db *Methods) holdTransfer(ctx context.Context, tx pgx.Tx, from, to int, currency string, sum float64) (PendingTransfer, error) {
+	const insert = `INSERT INTO pending_transfers (from_id, to_id, amount, fee, currency, expires_at)
+		VALUES ($1, $2, $3, $4, $5, now() + $6 * INTERVAL '1 second') RETURNING ` + pendingColumns
+
+	accounts, err := lockWallets(ctx, tx, currency, from, to)
+	if err != nil {
+		return PendingTransfer{}, fmt.Errorf("lockWallets() error: %w", err)
+	}
+
+	err = accounts[from].canSend()
+	if err == nil {
+		err = accounts[to].canReceive()
+	}
+	if err != nil {
+		return PendingTransfer{}, err
+	}
+
+	fee, err := transferFee(ctx, tx, from, currency, sum)
+	if err != nil {
+		return PendingTransfer{}, fmt.Errorf("transferFee() error: %w", err)
+	}
+
+	if accounts[from].available() - sum - fee < 0.00 {
+		return PendingTransfer{}, InsufficientFunds
+	}
+
+	// Limits are set in BaseCurrency
+	if currency == BaseCurrency {
+		err = checkLimits(ctx, tx, from, TransactionTransfer, sum)
+		if err != nil {
+			return PendingTransfer{}, err
+		}
+	}
+
+	err = updateHeld(ctx, tx, from, currency, sum + fee)
+	if err != nil {
+		return PendingTransfer{}, fmt.Errorf("updateHeld() error: %w", err)
+	}
+
+	err = announceHeld(ctx, tx, from, currency, TransactionHold)
+	if err != nil {
+		return PendingTransfer{}, fmt.Errorf("announceHeld() error: %w", err)
+	}
+
+	p, err := scanPendingTransfer(tx.QueryRow(ctx, insert, from, to, sum, fee, currency, db.PendingTimeout.Seconds()))
+	if err != nil {
+		return PendingTransfer{}, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	p.FromBalance, p.ToBalance = accounts[from].Balance, accounts[to].Balance
+	return p, nil
+}
+
+// The AcceptTransfer method executes the pending transfer addressed to the user
+func (db *Methods) AcceptTransfer(id int64, user int) (PendingTransfer, error) {
+	return db.resolveTransfer(id, user, TransferAccepted)
+}
+
+// The DeclineTransfer method returns the pending transfer addressed to the user to the sender
+func (db *Methods) DeclineTransfer(id int64, user int) (PendingTransfer, error) {
+	return db.resolveTransfer(id, user, TransferDeclined)
+}
+
+// The CancelTransfer method returns the pending transfer sent by the user
+func (db *Methods) CancelTransfer(id int64, user int) (PendingTransfer, error) {
+	return db.resolveTransfer(id, user, TransferCancelled)
+}
+
+// resolveTransfer moves the pending transfer to the status on behalf of the user.
+// Only the recipient accepts or declines a transfer, only the sender cancels it:
+// for anyone else the transfer does not exist. An expired transfer can not be accepted.
+func (db *Methods) resolveTransfer(id int64, user int, status string) (PendingTransfer, error) {
+	const request = `SELECT ` + pendingColumns + `, expires_at <= now() FROM pending_transfers WHERE id = $1 FOR UPDATE`
+
+	var p PendingTransfer
+
+	if id <= 0 || user <= 0 {
+		return p, WrongData
+	}
+
+	ctx := context.Background()
+	err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var expired bool
+
+		err := tx.QueryRow(ctx, request, id).Scan(&p.ID, &p.From, &p.To, &p.Sum, &p.Fee, &p.Currency, &p.Status,
+			&p.CreatedAt, &p.ExpiresAt, &expired)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NotFound
+		}
+		if err != nil {
+			return fmt.Errorf("QueryRow() error: %w", err)
+		}
+
+		if (status == TransferCancelled && p.From != user) || (status != TransferCancelled && p.To != user) {
+			return NotFound
+		}
+		if p.Status != TransferPending || (status == TransferAccepted && expired) {
+			return TransferNotPending
+		}
+
+		p, err = db.releaseTransfer(ctx, tx, p, status)
+		return err
+	})
+	if err != nil {
+		return PendingTransfer{}, err
+	}
+	return p, nil
+}
+
+// releaseTransfer releases the money held by the locked pending transfer inside the transaction tx,
+// executes the transfer if the status is TransferAccepted and saves the status
+func (db *Methods) releaseTransfer(ctx context.Context, tx pgx.Tx, p PendingTransfer, status string) (PendingTransfer, error) {
+	const update = `UPDATE pending_transfers SET status = $2, resolved_at = now() WHERE id = $1`
+
+	accounts, err := lockWallets(ctx, tx, p.Currency, p.From, p.To)
+	if err != nil {
+		return p, fmt.Errorf("lockWallets() error: %w", err)
+	}
+
+	err = updateHeld(ctx, tx, p.From, p.Currency, -p.Sum - p.Fee)
+	if err != nil {
+		return p, fmt.Errorf("updateHeld() error: %w", err)
+	}
+
+	err = announceHeld(ctx, tx, p.From, p.Currency, TransactionHoldRelease)
+	if err != nil {
+		return p, fmt.Errorf("announceHeld() error: %w", err)
+	}
+
+	// The transfer is resolved first, so its held sum is not counted by the limits and the fees twice
+	_, err = tx.Exec(ctx, update, p.ID, status)
+	if err != nil {
+		return p, fmt.Errorf("Exec() error: %w", err)
+	}
+
+	p.FromBalance, p.ToBalance = accounts[p.From].Balance, accounts[p.To].Balance
+	if status == TransferAccepted {
+		// The sender is charged the fee quoted and held, even if the fee rules have changed since
+		p.FromBalance, p.ToBalance, _, err = db.transferWithFee(ctx, tx, p.From, 0, p.To, p.Currency, p.Sum, "", &p.Fee)
+		if err != nil {
+			return p, err
+		}
+	}
+
+	p.Status = status
+	return p, nil
+}
+
+// The ListPendingTransfers method returns the pending transfers sent and received by the user
+func (db *Methods) ListPendingTransfers(id int) ([]PendingTransfer, error) {
+	const request = `SELECT ` + pendingColumns + ` FROM pending_transfers
+		WHERE (from_id = $1 OR to_id = $1) AND status = 'pending' ORDER BY id`
+
+	_, _, err := db.GetBalance(id)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.pool.Query(context.Background(), request, id)
+	if err != nil {
+		return nil, fmt.Errorf("pool.Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	transfers := []PendingTransfer{}
+	for rows.Next() {
+		p, err := scanPendingTransfer(rows)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		transfers = append(transfers, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err() error: %w", err)
+	}
+	return transfers, nil
+}
+
+// The ExpireTransfers method returns up to limit pending transfers expired by the time
+// to their senders and returns the number of expired transfers.
+// Transfers locked by the users are skipped until the next run.
+func (db *Methods) ExpireTransfers(now time.Time, limit int) (int, error) {
+	const request = `SELECT ` + pendingColumns + ` FROM pending_transfers
+		WHERE status = 'pending' AND expires_at <= $1 ORDER BY expires_at LIMIT $2 FOR UPDATE SKIP LOCKED`
+
+	var expired int
+
+	if limit <= 0 {
+		return 0, WrongData
+	}
+
+	ctx := context.Background()
+	err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		transfers, err := lockPendingTransfers(ctx, tx, request, now, limit)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range transfers {
+			_, err = db.releaseTransfer(ctx, tx, p, TransferExpired)
+			if err != nil {
+				return fmt.Errorf("releaseTransfer() error: %w", err)
+			}
+		}
+		expired = len(transfers)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
+
+// releasePendingTransfers returns all pending transfers of the user to their senders
+// inside the transaction tx: the transfers sent by the user are cancelled, the received ones are declined
+func (db *Methods) releasePendingTransfers(ctx context.Context, tx pgx.Tx, id int) error {
+	const request = `SELECT ` + pendingColumns + ` FROM pending_transfers
+		WHERE (from_id = $1 OR to_id = $1) AND status = 'pending' ORDER BY id FOR UPDATE`
+
+	transfers, err := lockPendingTransfers(ctx, tx, request, id)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range transfers {
+		status := TransferDeclined
+		if p.From == id {
+			status = TransferCancelled
+		}
+		_, err = db.releaseTransfer(ctx, tx, p, status)
+		if err != nil {
+			return fmt.Errorf("releaseTransfer() error: %w", err)
+		}
+	}
+	return nil
+}
+
+// lockPendingTransfers returns the pending transfers selected by the request, the request locks them
+func lockPendingTransfers(ctx context.Context, tx pgx.Tx, request string, args ...interface{}) ([]PendingTransfer, error) {
+	rows, err := tx.Query(ctx, request, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	var transfers []PendingTransfer
+	for rows.Next() {
+		p, err := scanPendingTransfer(rows)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		transfers = append(transfers, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err() error: %w", err)
+	}
+	return transfers, nil
+}
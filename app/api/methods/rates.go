@@ -0,0 +1,123 @@
+package methods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"math"
+	"sort"
+	"time"
+)
+
+var (
+	RateUnavailable = errors.New("Exchange rate is not available")
+)
+
+// Conversion is the balance of a user converted from BaseCurrency
+// at the rate fetched at RateAt. Stale is true if the rate is older than RateMaxAge
+// at the moment of the conversion.
+type Conversion struct {
+	ID			int
+	Balance		float64
+	Currency	string
+	Rate		float64
+	RateAt		time.Time
+	Stale		bool
+}
+
+// Currencies returns the currencies users can hold
+func Currencies() []string {
+	list := make([]string, 0, len(currencies))
+	for currency := range currencies {
+		list = append(list, currency)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// The SaveRate method records the rate of the currency pair fetched at the time
+func (db *Methods) SaveRate(from, to string, rate float64, at time.Time) error {
+	const insert = `INSERT INTO currency_rates (base, quote, rate, fetched_at) VALUES ($1, $2, $3, $4)`
+
+	if from == to || rate <= 0 {
+		return WrongData
+	}
+
+	_, err := db.pool.Exec(context.Background(), insert, from, to, rate, at)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+	return nil
+}
+
+// The ConvertBalance method converts the balance of the user from BaseCurrency to the currency
+// at the last rate fetched before asOf. If asOf is zero, the last known rate is used;
+// if no rate has ever been fetched, it is asked from the rates provider.
+// RateUnavailable is returned if there is no rate to use.
+func (db *Methods) ConvertBalance(id int, currency string, asOf time.Time) (Conversion, error) {
+	if !currencies[currency] {
+		return Conversion{}, WrongData
+	}
+
+	_, balance, err := db.GetBalance(id)
+	if err != nil {
+		return Conversion{}, err
+	}
+
+	c := Conversion{ ID: id, Balance: balance, Currency: currency, Rate: 1 }
+
+	now := time.Now()
+	at := asOf
+	if at.IsZero() {
+		at = now
+	}
+
+	if currency == BaseCurrency {
+		c.RateAt = at
+		return c, nil
+	}
+
+	c.Rate, c.RateAt, err = db.rateAt(context.Background(), BaseCurrency, currency, at)
+	if errors.Is(err, RateUnavailable) && asOf.IsZero() {
+		c.Rate, err = db.Rates.Rate(context.Background(), BaseCurrency, currency)
+		if err != nil {
+			return Conversion{}, fmt.Errorf("%w: %v", RateUnavailable, err)
+		}
+		c.RateAt = now
+
+		err = db.SaveRate(BaseCurrency, currency, c.Rate, now)
+	}
+	if err != nil {
+		return Conversion{}, err
+	}
+
+	c.Balance = math.Round(balance * c.Rate * 100) / 100
+	c.Stale = at.Sub(c.RateAt) > db.RateMaxAge
+	return c, nil
+}
+
+// rateAt returns the last rate of the currency pair fetched before at and the time it was fetched.
+// A rate saved for the reverse pair is inverted.
+func (db *Methods) rateAt(ctx context.Context, from, to string, at time.Time) (float64, time.Time, error) {
+	const request = `SELECT base, rate, fetched_at FROM currency_rates
+		WHERE ((base = $1 AND quote = $2) OR (base = $2 AND quote = $1)) AND fetched_at <= $3
+		ORDER BY fetched_at DESC LIMIT 1`
+
+	var base string
+	var rate float64
+	var fetched time.Time
+
+	err := db.pool.QueryRow(ctx, request, from, to, at).Scan(&base, &rate, &fetched)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, time.Time{}, RateUnavailable
+	}
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	if base != from {
+		rate = 1 / rate
+	}
+	return rate, fetched, nil
+}
@@ -0,0 +1,201 @@
+package methods
+
+import (
+	"app/pkg/events"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	OverRefund = errors.New("Refund exceeds the transaction amount")
+)
+
+// Refund is the result of a refund.
+// FromID is the user who returns the money, ToID is the user who gets it back.
+// One of them is 0 when the original transaction was a refill or a withdrawal.
+// Fee is the fee of the transfer returned to ToID by the refund that completes it.
+type Refund struct {
+	TransactionID	int64
+	RefundOf		int64
+	Sum				float64
+	Fee				float64
+	FromID			int
+	FromBalance		float64
+	ToID			int
+	ToBalance		float64
+}
+
+// The RefundTransaction method returns the money of a completed refill, withdrawal or transfer.
+// It takes the ID of the original transaction, the amount to refund (0 refunds all that is left),
+// the reason, the initiator of the refund and whether a refund may leave the payer with a negative balance.
+// All refunds of a transaction together can not exceed its amount, otherwise OverRefund is returned.
+// A transfer is reversed in one transaction: the money goes back from the recipient to the sender.
+// The refund that completes a transfer also returns its fee from the revenue of the service,
+// so a full refund costs the sender nothing.
+// If the payer has already spent the money or the payer's account is frozen,
+// the refund fails unless force is true. Closed accounts can not take part in refunds.
+func (db *Methods) RefundTransaction(id int64, sum float64, reason, initiator string, force bool) (Refund, error) {
+	var r Refund
+
+	if id <= 0 || sum < 0.00 || reason == "" || initiator == "" {
+		return r, WrongData
+	}
+
+	err := db.pool.BeginFunc(context.Background(), func(tx pgx.Tx) (err error) {
+		r, err = db.refund(context.Background(), tx, id, sum, reason, initiator, force)
+		return err
+	})
+	if err != nil {
+		return Refund{}, err
+	}
+	return r, nil
+}
+
+// refund books the refund inside the transaction tx
+func (db *Methods) refund(ctx context.Context, tx pgx.Tx, id int64, sum float64, reason, initiator string, force bool) (Refund, error) {
+	const (
+		original = `SELECT type, COALESCE(from_id, 0), COALESCE(to_id, 0), amount, fee, currency FROM transactions WHERE id = $1 FOR UPDATE`
+		refunded = `SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE refund_of = $1`
+	)
+
+	var orig transaction
+	var done float64
+
+	// The lock on the original transaction serializes concurrent refunds of it
+	err := tx.QueryRow(ctx, original, id).Scan(&orig.Type, &orig.From, &orig.To, &orig.Amount, &orig.Fee, &orig.Currency)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Refund{}, NotFound
+	}
+	if err != nil {
+		return Refund{}, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	// System account on the other side of refunded refills and withdrawals
+	var system string
+	switch orig.Type {
+	case TransactionRefill:
+		system = AccountExternalCashIn
+	case TransactionWithdraw:
+		system = AccountRefunds
+	case TransactionTransfer:
+		// A split has no single recipient to take the money back from
+		if orig.To == 0 {
+			return Refund{}, WrongData
+		}
+	default:
+		return Refund{}, WrongData
+	}
+
+	err = tx.QueryRow(ctx, refunded, id).Scan(&done)
+	if err != nil {
+		return Refund{}, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	left := float64(cents(orig.Amount) - cents(done)) / 100
+	if sum == 0.00 {
+		sum = left
+	}
+	if cents(sum) <= 0 || cents(sum) > cents(left) {
+		return Refund{}, OverRefund
+	}
+
+	r := Refund{ RefundOf: id, Sum: sum, FromID: orig.To, ToID: orig.From }
+	if orig.Type == TransactionTransfer && cents(done) + cents(sum) == cents(orig.Amount) {
+		r.Fee = orig.Fee
+	}
+
+	var ids []int
+	for _, uid := range []int{r.FromID, r.ToID} {
+		if uid != 0 {
+			ids = append(ids, uid)
+		}
+	}
+
+	// The money goes back to the wallets in the currency of the original transaction
+	accounts, err := lockWallets(ctx, tx, orig.Currency, ids...)
+	if err != nil {
+		return Refund{}, fmt.Errorf("lockWallets() error: %w", err)
+	}
+
+	if r.ToID != 0 {
+		err = accounts[r.ToID].canReceive()
+		if err != nil {
+			return Refund{}, err
+		}
+	}
+
+	if r.FromID != 0 {
+		payer := accounts[r.FromID]
+		if payer.Status == StatusClosed {
+			return Refund{}, AccountClosed
+		}
+
+		// A forced refund takes the money back from a frozen account too
+		if !force {
+			// A refund is taken back by the service, not spent by a member of a shared account
+			err = payer.statusAllowsSend()
+			if err != nil {
+				return Refund{}, err
+			}
+			if payer.available() - sum < 0.00 {
+				return Refund{}, InsufficientFunds
+			}
+		}
+	}
+
+	fromAccount, toAccount := system, system
+	if r.FromID != 0 {
+		fromAccount = userAccount(r.FromID)
+		r.FromBalance, err = updateWallet(ctx, tx, r.FromID, orig.Currency, -sum)
+		if err != nil {
+			return Refund{}, fmt.Errorf("updateWallet(..., from_id) error: %w", err)
+		}
+	}
+	if r.ToID != 0 {
+		toAccount = userAccount(r.ToID)
+		r.ToBalance, err = updateWallet(ctx, tx, r.ToID, orig.Currency, sum + r.Fee)
+		if err != nil {
+			return Refund{}, fmt.Errorf("updateWallet(..., to_id) error: %w", err)
+		}
+	}
+
+	r.TransactionID, err = recordTransaction(ctx, tx, transaction{
+		Type:		TransactionRefund,
+		From:		r.FromID,
+		To:			r.ToID,
+		Amount:		sum,
+		Currency:	orig.Currency,
+		Comment:	reason,
+		RefundOf:	id,
+		Initiator:	initiator,
+	})
+	if err != nil {
+		return Refund{}, fmt.Errorf("recordTransaction() error: %w", err)
+	}
+
+	entries := []entry{ { fromAccount, -sum }, { toAccount, sum + r.Fee } }
+	if r.Fee > 0.00 {
+		entries = append(entries, entry{ AccountRevenue, -r.Fee })
+	}
+
+	err = postEntries(ctx, tx, r.TransactionID, orig.Currency, entries...)
+	if err != nil {
+		return Refund{}, fmt.Errorf("postEntries() error: %w", err)
+	}
+
+	for _, e := range []events.Event{
+		{ AccountID: r.FromID, Balance: r.FromBalance, Currency: orig.Currency, TransactionID: r.TransactionID, Type: TransactionRefund },
+		{ AccountID: r.ToID, Balance: r.ToBalance, Currency: orig.Currency, TransactionID: r.TransactionID, Type: TransactionRefund },
+	} {
+		if e.AccountID == 0 {
+			continue
+		}
+		err = publishEvent(ctx, tx, e)
+		if err != nil {
+			return Refund{}, fmt.Errorf("publishEvent() error: %w", err)
+		}
+	}
+	return r, nil
+}
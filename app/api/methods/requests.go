@@ -0,0 +1,245 @@
+package methods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"strings"
+	"time"
+)
+
+var (
+	RequestNotPending = errors.New("Payment request is not pending")
+)
+
+// Statuses of payment requests.
+// A pending request is reported as expired once its time is up, it is never stored as expired.
+const (
+	RequestPending	= "pending"
+	RequestPaid		= "paid"
+	RequestDeclined	= "declined"
+	RequestExpired	= "expired"
+)
+
+// Roles of the user in the payment requests listed for them
+const (
+	RoleRequester	= "requester"
+	RolePayer		= "payer"
+)
+
+// MaxRequestsPage is the largest page of payment requests
+const MaxRequestsPage = 100
+
+// PaymentRequest is a request of Requester to Payer to transfer Amount in Currency.
+// Paying the request is a transfer from Payer to Requester with the ID TransactionID.
+type PaymentRequest struct {
+	ID					int64
+	Requester			int
+	Payer				int
+	Amount				float64
+	Currency			string
+	Comment				string
+	Status				string
+	CreatedAt			time.Time
+	ExpiresAt			time.Time
+	TransactionID		int64
+	// PayerBalance and RequesterBalance are the balances after the payment
+	PayerBalance		float64
+	RequesterBalance	float64
+}
+
+// RequestFilter selects a page of the payment requests of a user, the newest first.
+// Empty Statuses and Role select the requests in all statuses sent and received by the user.
+// Cursor is the ID of the last request of the previous page, 0 for the first page.
+type RequestFilter struct {
+	Statuses	[]string
+	Role		string
+	Limit		int
+	Cursor		int64
+}
+
+// requestColumns are the columns scanned by scanPaymentRequest
+const requestColumns = `id, requester_id, payer_id, amount, currency, comment,
+	CASE WHEN status = 'pending' AND expires_at <= now() THEN 'expired' ELSE status END,
+	created_at, expires_at, COALESCE(transaction_id, 0)`
+
+// scanPaymentRequest scans a row of requestColumns
+func scanPaymentRequest(row pgx.Row) (PaymentRequest, error) {
+	var r PaymentRequest
+
+	err := row.Scan(&r.ID, &r.Requester, &r.Payer, &r.Amount, &r.Currency, &r.Comment, &r.Status,
+		&r.CreatedAt, &r.ExpiresAt, &r.TransactionID)
+	return r, err
+}
+
+// The CreatePaymentRequest method saves the request of r.Requester to r.Payer.
+// An empty currency means BaseCurrency, a zero ExpiresAt means the request expires after PaymentRequestTTL.
+func (db *Methods) CreatePaymentRequest(r PaymentRequest) (PaymentRequest, error) {
+	const insert = `INSERT INTO payment_requests (requester_id, payer_id, amount, currency, comment, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING ` + requestColumns
+
+	if r.Currency == "" {
+		r.Currency = BaseCurrency
+	}
+	if r.ExpiresAt.IsZero() {
+		r.ExpiresAt = time.Now().Add(db.PaymentRequestTTL)
+	}
+	if r.Requester <= 0 || r.Payer <= 0 || r.Requester == r.Payer || cents(r.Amount) <= 0 ||
+		!currencies[r.Currency] || !r.ExpiresAt.After(time.Now()) {
+		return PaymentRequest{}, WrongData
+	}
+
+	for _, id := range []int{ r.Requester, r.Payer } {
+		_, _, err := db.GetBalance(id)
+		if err != nil {
+			return PaymentRequest{}, err
+		}
+	}
+
+	saved, err := scanPaymentRequest(db.pool.QueryRow(context.Background(), insert, r.Requester, r.Payer, r.Amount,
+		r.Currency, r.Comment, r.ExpiresAt))
+	if err != nil {
+		return PaymentRequest{}, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	return saved, nil
+}
+
+// The PayRequest method pays the pending request addressed to the payer with a transfer
+// to the requester. The transfer is checked like any other: the payer's account must be active,
+// have the money and stay within the limits.
+func (db *Methods) PayRequest(id int64, payer int) (PaymentRequest, error) {
+	return db.resolveRequest(id, payer, RequestPaid)
+}
+
+// The DeclineRequest method declines the pending request addressed to the payer
+func (db *Methods) DeclineRequest(id int64, payer int) (PaymentRequest, error) {
+	return db.resolveRequest(id, payer, RequestDeclined)
+}
+
+// resolveRequest moves the request to the status on behalf of the payer.
+// For anyone else than the payer the request does not exist.
+func (db *Methods) resolveRequest(id int64, payer int, status string) (PaymentRequest, error) {
+	const (
+		request = `SELECT ` + requestColumns + ` FROM payment_requests WHERE id = $1 FOR UPDATE`
+		update = `UPDATE payment_requests SET status = $2, transaction_id = NULLIF($3, 0), resolved_at = now() WHERE id = $1`
+	)
+
+	var r PaymentRequest
+
+	if id <= 0 || payer <= 0 {
+		return r, WrongData
+	}
+
+	ctx := context.Background()
+	err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) (err error) {
+		r, err = scanPaymentRequest(tx.QueryRow(ctx, request, id))
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NotFound
+		}
+		if err != nil {
+			return fmt.Errorf("QueryRow() error: %w", err)
+		}
+
+		if r.Payer != payer {
+			return NotFound
+		}
+		if r.Status != RequestPending {
+			return RequestNotPending
+		}
+
+		if status == RequestPaid {
+			comment := fmt.Sprintf("payment request %d", r.ID)
+			if r.Comment != "" {
+				comment += ": " + r.Comment
+			}
+			r.PayerBalance, r.RequesterBalance, r.TransactionID, err = db.transferTransaction(ctx, tx, r.Payer, 0, r.Requester,
+				r.Currency, r.Amount, comment)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(ctx, update, r.ID, status, r.TransactionID)
+		if err != nil {
+			return fmt.Errorf("Exec() error: %w", err)
+		}
+		r.Status = status
+		return nil
+	})
+	if err != nil {
+		return PaymentRequest{}, err
+	}
+	return r, nil
+}
+
+// The ListPaymentRequests method returns a page of the payment requests of the user selected by the filter
+// and the cursor of the next page, 0 if it is the last page.
+func (db *Methods) ListPaymentRequests(id int, f RequestFilter) ([]PaymentRequest, int64, error) {
+	var conditions []string
+
+	if f.Limit <= 0 || f.Limit > MaxRequestsPage || f.Cursor < 0 {
+		return nil, 0, WrongData
+	}
+	for _, s := range f.Statuses {
+		if s != RequestPending && s != RequestPaid && s != RequestDeclined && s != RequestExpired {
+			return nil, 0, WrongData
+		}
+	}
+
+	args := []interface{}{ id, f.Limit + 1 }
+	switch f.Role {
+	case "":
+		conditions = append(conditions, `(requester_id = $1 OR payer_id = $1)`)
+	case RoleRequester:
+		conditions = append(conditions, `requester_id = $1`)
+	case RolePayer:
+		conditions = append(conditions, `payer_id = $1`)
+	default:
+		return nil, 0, WrongData
+	}
+	if f.Cursor > 0 {
+		args = append(args, f.Cursor)
+		conditions = append(conditions, fmt.Sprintf(`id < $%d`, len(args)))
+	}
+	if len(f.Statuses) > 0 {
+		args = append(args, f.Statuses)
+		conditions = append(conditions, fmt.Sprintf(`CASE WHEN status = 'pending' AND expires_at <= now() THEN 'expired' ELSE status END = ANY($%d)`, len(args)))
+	}
+
+	_, _, err := db.GetBalance(id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	request := `SELECT ` + requestColumns + ` FROM payment_requests WHERE ` + strings.Join(conditions, " AND ") +
+		` ORDER BY id DESC LIMIT $2`
+
+	rows, err := db.pool.Query(context.Background(), request, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("pool.Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	requests := []PaymentRequest{}
+	for rows.Next() {
+		r, err := scanPaymentRequest(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		requests = append(requests, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("rows.Err() error: %w", err)
+	}
+
+	// One more request than the limit is read to know whether there is a next page
+	var next int64
+	if len(requests) > f.Limit {
+		requests = requests[:f.Limit]
+		next = requests[f.Limit - 1].ID
+	}
+	return requests, next, nil
+}
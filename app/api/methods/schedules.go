@@ -0,0 +1,369 @@
+package methods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// Types of scheduled operations
+const (
+	ScheduleTransfer	= "transfer"
+	ScheduleDebit		= "debit"
+)
+
+// Statuses of schedules
+const (
+	ScheduleActive		= "active"
+	ScheduleCompleted	= "completed"
+	ScheduleCancelled	= "cancelled"
+	ScheduleFailed		= "failed"
+)
+
+// Outcomes of runs of schedules
+const (
+	RunSucceeded	= "succeeded"
+	RunRetry		= "retry"
+	RunFailed		= "failed"
+)
+
+// MinScheduleInterval is the shortest interval of a recurring schedule
+const MinScheduleInterval = time.Minute
+
+// Schedule is an operation executed at DueAt and then repeated every Interval
+// or every month on DayOfMonth. A schedule with neither runs once.
+// A run failed with a temporary error is retried at NextRunAt, DueAt stays the same.
+type Schedule struct {
+	ID			int64
+	Type		string
+	From		int
+	To			int
+	Sum			float64
+	Currency	string
+	Comment		string
+	Interval	time.Duration
+	DayOfMonth	int
+	Status		string
+	DueAt		time.Time
+	NextRunAt	time.Time
+	Attempts	int
+	Runs		[]ScheduleRun
+}
+
+// ScheduleRun is an attempt to execute a scheduled operation
+type ScheduleRun struct {
+	Attempt		int
+	DueAt		time.Time
+	RunAt		time.Time
+	Status		string
+	Error		string
+	Balance		float64
+}
+
+// retryable reports whether a failed run can succeed later. Only the errors no retry can get past
+// fail a run for good, others, e.g. insufficient funds or a lock timeout of the database, are retried.
+func retryable(err error) bool {
+	return !errors.Is(err, WrongData) && !errors.Is(err, UserNotFound) && !errors.Is(err, AccountClosed) &&
+		!errors.Is(err, MemberForbidden)
+}
+
+// nextDue returns the occurrence of the schedule following due that is after now.
+// Missed occurrences are skipped, so a recurring operation is never executed twice to catch up.
+// ok is false for a schedule that runs once.
+func (s Schedule) nextDue(due, now time.Time) (time.Time, bool) {
+	switch {
+	case s.Interval > 0:
+		next := due.Add(s.Interval)
+		if !next.After(now) {
+			next = next.Add((now.Sub(next) / s.Interval + 1) * s.Interval)
+		}
+		return next, true
+	case s.DayOfMonth > 0:
+		next := monthDay(due, 1, s.DayOfMonth)
+		for i := 2; !next.After(now); i++ {
+			next = monthDay(due, i, s.DayOfMonth)
+		}
+		return next, true
+	}
+	return time.Time{}, false
+}
+
+// monthDay returns the time of t on the day of the month months after the month of t.
+// The day is moved to the last day of shorter months.
+func monthDay(t time.Time, months, day int) time.Time {
+	first := time.Date(t.Year(), t.Month() + time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), 0, t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day - 1)
+}
+
+// The CreateSchedule method saves the operation to be executed at startAt (now if zero)
+// and, if set, repeated every s.Interval or every month on s.DayOfMonth.
+// A monthly schedule starts on the first s.DayOfMonth at or after startAt, at the time of startAt.
+// A shared account can not be s.From: the runs have no member to spend it on behalf of.
+func (db *Methods) CreateSchedule(s Schedule, startAt time.Time) (Schedule, error) {
+	const (
+		shared = `SELECT shared FROM user_balance WHERE id = $1`
+		insert = `INSERT INTO schedules (type, from_id, to_id, amount, currency, comment, interval_seconds, day_of_month, due_at, next_run_at)
+			VALUES ($1, $2, NULLIF($3, 0), $4, $5, $6, $7, $8, $9, $9) RETURNING id`
+	)
+
+	if s.Currency == "" {
+		s.Currency = BaseCurrency
+	}
+	if startAt.IsZero() {
+		startAt = time.Now()
+	}
+	startAt = startAt.UTC().Truncate(time.Second)
+
+	switch {
+	case !currencies[s.Currency] || cents(s.Sum) <= 0 || s.From <= 0:
+		return Schedule{}, WrongData
+	case s.Type == ScheduleTransfer && (s.To <= 0 || s.To == s.From):
+		return Schedule{}, WrongData
+	case s.Type == ScheduleDebit && s.To != 0:
+		return Schedule{}, WrongData
+	case s.Type != ScheduleTransfer && s.Type != ScheduleDebit:
+		return Schedule{}, WrongData
+	case s.Interval != 0 && s.DayOfMonth != 0:
+		return Schedule{}, WrongData
+	case s.Interval != 0 && s.Interval < MinScheduleInterval:
+		return Schedule{}, WrongData
+	case s.DayOfMonth < 0 || s.DayOfMonth > 31:
+		return Schedule{}, WrongData
+	}
+
+	var isShared bool
+	err := db.pool.QueryRow(context.Background(), shared, s.From).Scan(&isShared)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Schedule{}, UserNotFound
+	}
+	if err != nil {
+		return Schedule{}, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	if isShared {
+		return Schedule{}, MemberForbidden
+	}
+
+	if s.To != 0 {
+		_, _, err = db.GetBalance(s.To)
+		if err != nil {
+			return Schedule{}, err
+		}
+	}
+
+	s.DueAt = startAt
+	if s.DayOfMonth > 0 {
+		s.DueAt = monthDay(startAt, 0, s.DayOfMonth)
+		if s.DueAt.Before(startAt) {
+			s.DueAt = monthDay(startAt, 1, s.DayOfMonth)
+		}
+	}
+	s.NextRunAt, s.Status, s.Attempts = s.DueAt, ScheduleActive, 0
+
+	err = db.pool.QueryRow(context.Background(), insert, s.Type, s.From, s.To, s.Sum, s.Currency, s.Comment,
+		int(s.Interval / time.Second), s.DayOfMonth, s.DueAt).Scan(&s.ID)
+	if err != nil {
+		return Schedule{}, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	return s, nil
+}
+
+// scheduleColumns are the columns scanned by scanSchedule
+const scheduleColumns = `id, type, from_id, COALESCE(to_id, 0), amount, currency, comment,
+	interval_seconds, day_of_month, status, due_at, next_run_at, attempts`
+
+// scanSchedule scans a row of scheduleColumns
+func scanSchedule(row pgx.Row) (Schedule, error) {
+	var s Schedule
+	var interval int
+
+	err := row.Scan(&s.ID, &s.Type, &s.From, &s.To, &s.Sum, &s.Currency, &s.Comment,
+		&interval, &s.DayOfMonth, &s.Status, &s.DueAt, &s.NextRunAt, &s.Attempts)
+	s.Interval = time.Duration(interval) * time.Second
+	return s, err
+}
+
+// The GetSchedule method returns the schedule with its last runs, the latest first
+func (db *Methods) GetSchedule(id int64) (Schedule, error) {
+	const (
+		request = `SELECT ` + scheduleColumns + ` FROM schedules WHERE id = $1`
+		runs = `SELECT attempt, due_at, run_at, status, error, balance FROM schedule_runs
+			WHERE schedule_id = $1 ORDER BY id DESC LIMIT 50`
+	)
+
+	ctx := context.Background()
+
+	if id <= 0 {
+		return Schedule{}, WrongData
+	}
+
+	s, err := scanSchedule(db.pool.QueryRow(ctx, request, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Schedule{}, NotFound
+	}
+	if err != nil {
+		return Schedule{}, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	rows, err := db.pool.Query(ctx, runs, id)
+	if err != nil {
+		return Schedule{}, fmt.Errorf("pool.Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	s.Runs = []ScheduleRun{}
+	for rows.Next() {
+		var r ScheduleRun
+
+		err = rows.Scan(&r.Attempt, &r.DueAt, &r.RunAt, &r.Status, &r.Error, &r.Balance)
+		if err != nil {
+			return Schedule{}, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		s.Runs = append(s.Runs, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return Schedule{}, fmt.Errorf("rows.Err() error: %w", err)
+	}
+	return s, nil
+}
+
+// The ListSchedules method returns the schedules paid by the user
+func (db *Methods) ListSchedules(id int) ([]Schedule, error) {
+	const request = `SELECT ` + scheduleColumns + ` FROM schedules WHERE from_id = $1 ORDER BY id`
+
+	_, _, err := db.GetBalance(id)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.pool.Query(context.Background(), request, id)
+	if err != nil {
+		return nil, fmt.Errorf("pool.Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	schedules := []Schedule{}
+	for rows.Next() {
+		s, err := scanSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		schedules = append(schedules, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err() error: %w", err)
+	}
+	return schedules, nil
+}
+
+// The CancelSchedule method stops an active schedule
+func (db *Methods) CancelSchedule(id int64) error {
+	const update = `UPDATE schedules SET status = $2 WHERE id = $1 AND status = $3`
+
+	_, err := db.GetSchedule(id)
+	if err != nil {
+		return err
+	}
+
+	tag, err := db.pool.Exec(context.Background(), update, id, ScheduleCancelled, ScheduleActive)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return WrongData
+	}
+	return nil
+}
+
+// The RunSchedules method executes up to limit due operations and returns the number of runs.
+// Every operation is claimed with FOR UPDATE SKIP LOCKED and executed in the same transaction
+// as its outcome is recorded, so replicas running concurrently never execute an operation twice.
+// A failed run is retried after ScheduleRetryDelay times the number of attempts, up to ScheduleMaxAttempts
+// attempts, unless it can never succeed: wrong data, a missing or closed account or a forbidden member.
+func (db *Methods) RunSchedules(limit int) (int, error) {
+	if limit <= 0 {
+		return 0, WrongData
+	}
+
+	for n := 0; n < limit; n++ {
+		found := false
+		err := db.pool.BeginFunc(context.Background(), func(tx pgx.Tx) (err error) {
+			found, err = db.runSchedule(context.Background(), tx)
+			return err
+		})
+		if err != nil || !found {
+			return n, err
+		}
+	}
+	return limit, nil
+}
+
+// runSchedule executes the earliest due operation inside the transaction tx.
+// found is false if no operation is due.
+func (db *Methods) runSchedule(ctx context.Context, tx pgx.Tx) (bool, error) {
+	const (
+		due = `SELECT ` + scheduleColumns + ` FROM schedules
+			WHERE status = 'active' AND next_run_at <= now() ORDER BY next_run_at LIMIT 1 FOR UPDATE SKIP LOCKED`
+		update = `UPDATE schedules SET status = $2, due_at = $3, next_run_at = $4, attempts = $5 WHERE id = $1`
+		record = `INSERT INTO schedule_runs (schedule_id, attempt, due_at, status, error, balance) VALUES ($1, $2, $3, $4, $5, $6)`
+	)
+
+	s, err := scanSchedule(tx.QueryRow(ctx, due))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	// The operation runs in a savepoint: if it fails, only its changes are rolled back
+	var balance float64
+	err = tx.BeginFunc(ctx, func(sp pgx.Tx) (err error) {
+		if s.Type == ScheduleTransfer {
+			balance, _, err = db.transfer(ctx, sp, s.From, s.To, s.Currency, s.Sum)
+		} else {
+			balance, err = db.refillAndWithdraw(ctx, sp, s.From, s.Currency, -s.Sum)
+		}
+		return err
+	})
+
+	now := time.Now()
+	run := ScheduleRun{ Attempt: s.Attempts + 1, DueAt: s.DueAt, Status: RunSucceeded, Balance: balance }
+	if err != nil {
+		run.Status, run.Error = RunFailed, err.Error()
+		if retryable(err) && run.Attempt < db.ScheduleMaxAttempts {
+			run.Status = RunRetry
+		}
+	}
+
+	if run.Status == RunRetry {
+		s.Attempts = run.Attempt
+		s.NextRunAt = now.Add(time.Duration(run.Attempt) * db.ScheduleRetryDelay)
+	} else if next, ok := s.nextDue(s.DueAt, now); ok {
+		s.Attempts, s.DueAt, s.NextRunAt = 0, next, next
+	} else {
+		s.Attempts, s.Status = run.Attempt, ScheduleCompleted
+		if run.Status == RunFailed {
+			s.Status = ScheduleFailed
+		}
+	}
+
+	_, err = tx.Exec(ctx, update, s.ID, s.Status, s.DueAt, s.NextRunAt, s.Attempts)
+	if err != nil {
+		return false, fmt.Errorf("Exec() error: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, record, s.ID, run.Attempt, run.DueAt, run.Status, run.Error, run.Balance)
+	if err != nil {
+		return false, fmt.Errorf("Exec() error: %w", err)
+	}
+	return true, nil
+}
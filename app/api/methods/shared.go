@@ -0,0 +1,361 @@
+package methods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"math"
+	"time"
+)
+
+var (
+	MemberForbidden = errors.New("Member is not allowed to act on the account")
+)
+
+// Roles of the members of shared accounts.
+// Owners spend and manage the members, spenders spend up to their limit, viewers only see the account.
+const (
+	MemberOwner		= "owner"
+	MemberSpender	= "spender"
+	MemberViewer	= "viewer"
+)
+
+// Member is a user of a shared account.
+// A spender with an empty Period has no limit, otherwise they can spend Limit in BaseCurrency
+// over the period (see limitPeriods), Used and Remaining are their current usage.
+type Member struct {
+	AccountID	int
+	UserID		int
+	Role		string
+	Limit		float64
+	Period		string
+	Used		float64
+	Remaining	float64
+	CreatedAt	time.Time
+}
+
+// memberColumns are the columns scanned by scanMember
+const memberColumns = `account_id, user_id, role, COALESCE(spend_limit, 0), COALESCE(period, ''), created_at`
+
+// scanMember scans a row of memberColumns
+func scanMember(row pgx.Row) (Member, error) {
+	var m Member
+
+	err := row.Scan(&m.AccountID, &m.UserID, &m.Role, &m.Limit, &m.Period, &m.CreatedAt)
+	return m, err
+}
+
+// The CreateSharedAccount method opens a shared account owned by the user and returns its ID.
+// Money leaves the account only on behalf of its members.
+func (db *Methods) CreateSharedAccount(owner int) (int, error) {
+	const (
+		insert = `INSERT INTO user_balance (shared) VALUES (true) RETURNING id`
+		member = `INSERT INTO account_members (account_id, user_id, role) VALUES ($1, $2, $3)`
+	)
+
+	var id int
+
+	if owner <= 0 {
+		return 0, WrongData
+	}
+
+	ctx := context.Background()
+	err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		// Members are personal accounts
+		a, err := lockAccount(ctx, tx, owner)
+		if err != nil {
+			return err
+		}
+		if a.Shared {
+			return WrongData
+		}
+
+		err = tx.QueryRow(ctx, insert).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("QueryRow() error: %w", err)
+		}
+
+		_, err = tx.Exec(ctx, member, id, owner, MemberOwner)
+		if err != nil {
+			return fmt.Errorf("Exec() error: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// The SetMember method adds the user m.UserID to the shared account m.AccountID or changes their role and limit
+// on behalf of the member "by", who must be an owner. The last owner can not become another role.
+func (db *Methods) SetMember(by int, m Member) error {
+	const upsert = `INSERT INTO account_members (account_id, user_id, role, spend_limit, period)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+		ON CONFLICT (account_id, user_id) DO UPDATE SET role = EXCLUDED.role, spend_limit = EXCLUDED.spend_limit,
+			period = EXCLUDED.period`
+
+	_, ok := limitPeriods[m.Period]
+	switch {
+	case by <= 0 || m.AccountID <= 0 || m.UserID <= 0 || m.UserID == m.AccountID || m.Limit < 0.00:
+		return WrongData
+	case m.Role != MemberOwner && m.Role != MemberSpender && m.Role != MemberViewer:
+		return WrongData
+	// Only spenders have limits
+	case m.Period != "" && (m.Role != MemberSpender || !ok):
+		return WrongData
+	case m.Period == "" && m.Limit != 0.00:
+		return WrongData
+	}
+
+	ctx := context.Background()
+	return db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		err := lockMembers(ctx, tx, m.AccountID, by)
+		if err != nil {
+			return err
+		}
+
+		a, err := lockAccount(ctx, tx, m.UserID)
+		if err != nil {
+			return err
+		}
+		if a.Shared {
+			return WrongData
+		}
+
+		if m.Role != MemberOwner {
+			err = keepOwner(ctx, tx, m.AccountID, m.UserID)
+			if err != nil {
+				return err
+			}
+		}
+
+		// A spender without a period has no limit
+		var limit interface{}
+		if m.Period != "" {
+			limit = m.Limit
+		}
+		_, err = tx.Exec(ctx, upsert, m.AccountID, m.UserID, m.Role, limit, m.Period)
+		if err != nil {
+			return fmt.Errorf("Exec() error: %w", err)
+		}
+		return nil
+	})
+}
+
+// The RemoveMember method removes the user from the shared account on behalf of the member "by",
+// who must be an owner or the user leaving the account. The last owner can not be removed.
+func (db *Methods) RemoveMember(account, by, user int) error {
+	const remove = `DELETE FROM account_members WHERE account_id = $1 AND user_id = $2`
+
+	if account <= 0 || by <= 0 || user <= 0 {
+		return WrongData
+	}
+
+	ctx := context.Background()
+	return db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var err error
+		if by == user {
+			_, err = lockSharedAccount(ctx, tx, account)
+		} else {
+			err = lockMembers(ctx, tx, account, by)
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = findMember(ctx, tx, account, user)
+		if err != nil {
+			return err
+		}
+
+		err = keepOwner(ctx, tx, account, user)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, remove, account, user)
+		if err != nil {
+			return fmt.Errorf("Exec() error: %w", err)
+		}
+		return nil
+	})
+}
+
+// The ListMembers method returns the members of the shared account, the oldest first,
+// with the usage of the limits of spenders
+func (db *Methods) ListMembers(account int) ([]Member, error) {
+	const request = `SELECT ` + memberColumns + ` FROM account_members WHERE account_id = $1 ORDER BY created_at, user_id`
+
+	if account <= 0 {
+		return nil, WrongData
+	}
+
+	ctx := context.Background()
+	rows, err := db.pool.Query(ctx, request, account)
+	if err != nil {
+		return nil, fmt.Errorf("pool.Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	members := []Member{}
+	for rows.Next() {
+		m, err := scanMember(rows)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		members = append(members, m)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err() error: %w", err)
+	}
+	rows.Close()
+
+	// A shared account always has an owner
+	if len(members) == 0 {
+		_, _, err = db.GetBalance(account)
+		if err != nil {
+			return nil, err
+		}
+		return nil, NotFound
+	}
+
+	for i := range members {
+		members[i], err = memberUsage(ctx, db.pool, members[i])
+		if err != nil {
+			return nil, fmt.Errorf("memberUsage() error: %w", err)
+		}
+	}
+	return members, nil
+}
+
+// checkMember checks that the member acts on the account a: the holder of a personal account, for whom
+// member may also be 0, or a member of a shared account. If sum is positive, the member spends it
+// on the operation: viewers spend nothing and spenders stay within their limit.
+// It must be called after the account is locked, so concurrent operations can not overspend.
+func checkMember(ctx context.Context, tx pgx.Tx, a account, member int, operation, currency string, sum float64) error {
+	if !a.Shared {
+		if member != 0 && member != a.ID {
+			return MemberForbidden
+		}
+		return nil
+	}
+
+	m, err := findMember(ctx, tx, a.ID, member)
+	if errors.Is(err, NotFound) {
+		return MemberForbidden
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case sum <= 0.00 || m.Role == MemberOwner:
+		return nil
+	case m.Role == MemberViewer:
+		return MemberForbidden
+	case m.Period == "":
+		return nil
+	// Limits of spenders are set in BaseCurrency, other wallets are not theirs to spend
+	case currency != BaseCurrency:
+		return MemberForbidden
+	}
+
+	m, err = memberUsage(ctx, tx, m)
+	if err != nil {
+		return fmt.Errorf("memberUsage() error: %w", err)
+	}
+	if cents(sum) > cents(m.Remaining) {
+		return &LimitError{ Operation: operation, Period: m.Period, Remaining: m.Remaining }
+	}
+	return nil
+}
+
+// memberUsage sums up the money the spender m spent from the shared account over the window of their limit
+func memberUsage(ctx context.Context, q querier, m Member) (Member, error) {
+	const used = `SELECT COALESCE(SUM(amount + fee), 0) FROM transactions
+		WHERE from_id = $1 AND member_id = $2 AND currency = $4 AND created_at > now() - $3::interval`
+
+	if m.Role != MemberSpender || m.Period == "" {
+		return m, nil
+	}
+
+	window := limitPeriods[m.Period]
+	if window != 0 {
+		err := q.QueryRow(ctx, used, m.AccountID, m.UserID, window, BaseCurrency).Scan(&m.Used)
+		if err != nil {
+			return m, fmt.Errorf("QueryRow() error: %w", err)
+		}
+	}
+	m.Remaining = math.Max(0, float64(cents(m.Limit) - cents(m.Used)) / 100)
+	return m, nil
+}
+
+// findMember returns the member of the shared account, NotFound if the user is not a member
+func findMember(ctx context.Context, q querier, account, user int) (Member, error) {
+	const request = `SELECT ` + memberColumns + ` FROM account_members WHERE account_id = $1 AND user_id = $2`
+
+	m, err := scanMember(q.QueryRow(ctx, request, account, user))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return m, NotFound
+	}
+	if err != nil {
+		return m, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	return m, nil
+}
+
+// lockSharedAccount locks the shared account until the end of the transaction tx,
+// so its members are changed one at a time. A personal account is NotFound.
+func lockSharedAccount(ctx context.Context, tx pgx.Tx, id int) (account, error) {
+	a, err := lockAccount(ctx, tx, id)
+	if err != nil {
+		return a, err
+	}
+	if !a.Shared {
+		return a, NotFound
+	}
+	return a, nil
+}
+
+// lockMembers locks the shared account to change its members on behalf of the member "by",
+// who must be an owner
+func lockMembers(ctx context.Context, tx pgx.Tx, id, by int) error {
+	_, err := lockSharedAccount(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	m, err := findMember(ctx, tx, id, by)
+	if errors.Is(err, NotFound) || (err == nil && m.Role != MemberOwner) {
+		return MemberForbidden
+	}
+	return err
+}
+
+// keepOwner returns WrongData if the user is the last owner of the shared account
+func keepOwner(ctx context.Context, tx pgx.Tx, account, user int) error {
+	const request = `SELECT count(*) FILTER (WHERE user_id <> $2) FROM account_members WHERE account_id = $1 AND role = $3`
+
+	var others int
+
+	m, err := findMember(ctx, tx, account, user)
+	if errors.Is(err, NotFound) || (err == nil && m.Role != MemberOwner) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(ctx, request, account, user, MemberOwner).Scan(&others)
+	if err != nil {
+		return fmt.Errorf("QueryRow() error: %w", err)
+	}
+	if others == 0 {
+		return WrongData
+	}
+	return nil
+}
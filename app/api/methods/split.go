@@ -0,0 +1,240 @@
+package methods
+
+import (
+	"app/pkg/events"
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"math"
+	"sort"
+)
+
+// MaxSplitRecipients is the largest number of recipients of a split transfer
+const MaxSplitRecipients = 100
+
+// SplitPart is a recipient of a split transfer and their part of it:
+// either Amount or Percent of the sum of the split is set, the same one for all parts.
+type SplitPart struct {
+	To			int
+	Amount		float64
+	Percent		float64
+}
+
+// Split is a transfer from one user to several recipients.
+// With amounts Sum is their total and can be omitted, with percentages Sum is split by them.
+type Split struct {
+	From		int
+	Sum			float64
+	Currency	string
+	Comment		string
+	Parts		[]SplitPart
+}
+
+// SplitShare is the money received by a recipient of a split transfer
+// and the new balance of the recipient
+type SplitShare struct {
+	To			int
+	Amount		float64
+	Balance		float64
+}
+
+// SplitResult is the outcome of a split transfer.
+// The split is one transaction: Fee is charged once on the sum of the shares.
+type SplitResult struct {
+	From			int
+	FromBalance		float64
+	Currency		string
+	Fee				float64
+	TransactionID	int64
+	Shares			[]SplitShare
+}
+
+// splitShares computes the shares of the parts in kopecks.
+// Percentages are applied to the sum with the largest remainder method: every part gets its share
+// rounded down and the kopecks left go one by one to the parts with the largest remainders, the first
+// parts first on ties. So the shares always add up to the sum exactly.
+func splitShares(sum float64, parts []SplitPart) ([]int64, error) {
+	if len(parts) == 0 || len(parts) > MaxSplitRecipients {
+		return nil, WrongData
+	}
+
+	shares := make([]int64, len(parts))
+	byPercent := parts[0].Percent != 0
+
+	if !byPercent {
+		var total int64
+		for i, p := range parts {
+			if p.Percent != 0 || cents(p.Amount) <= 0 {
+				return nil, WrongData
+			}
+			shares[i] = cents(p.Amount)
+			total += shares[i]
+		}
+		if sum != 0 && cents(sum) != total {
+			return nil, WrongData
+		}
+		return shares, nil
+	}
+
+	// Percentages are counted in hundredths of a percent
+	total := cents(sum)
+	remainders := make([]int64, len(parts))
+	var percents, allotted int64
+	for i, p := range parts {
+		percent := int64(math.Round(p.Percent * 100))
+		if p.Amount != 0 || percent <= 0 {
+			return nil, WrongData
+		}
+		percents += percent
+		shares[i], remainders[i] = total * percent / 10000, total * percent % 10000
+		allotted += shares[i]
+	}
+	if total <= 0 || percents != 10000 {
+		return nil, WrongData
+	}
+
+	order := make([]int, len(parts))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+	for i := int64(0); i < total - allotted; i++ {
+		shares[order[i]]++
+	}
+
+	for _, share := range shares {
+		if share == 0 {
+			return nil, WrongData
+		}
+	}
+	return shares, nil
+}
+
+// The SplitTransfer method transfers the shares of the split from s.From to the recipients in one database
+// transaction: either every recipient gets their share or nobody does. The split is a single transfer
+// of the sum of the shares: its fee and the limits of the sender are applied to the sum once,
+// the sender is debited once and every recipient is credited with their share.
+// An empty currency means BaseCurrency.
+func (db *Methods) SplitTransfer(s Split) (SplitResult, error) {
+	var res SplitResult
+
+	if s.Currency == "" {
+		s.Currency = BaseCurrency
+	}
+	if s.From <= 0 || !currencies[s.Currency] {
+		return res, WrongData
+	}
+
+	shares, err := splitShares(s.Sum, s.Parts)
+	if err != nil {
+		return res, err
+	}
+
+	var total int64
+	for _, share := range shares {
+		total += share
+	}
+	sum := float64(total) / 100
+
+	ids := []int{ s.From }
+	seen := map[int]bool{ s.From: true }
+	for _, p := range s.Parts {
+		if p.To <= 0 || seen[p.To] {
+			return res, WrongData
+		}
+		seen[p.To] = true
+		ids = append(ids, p.To)
+	}
+
+	ctx := context.Background()
+	err = db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		accounts, err := lockWallets(ctx, tx, s.Currency, ids...)
+		if err != nil {
+			return fmt.Errorf("lockWallets() error: %w", err)
+		}
+
+		// Money leaves a shared account only on behalf of a member, a split has none
+		err = accounts[s.From].canSend()
+		if err != nil {
+			return err
+		}
+		for _, p := range s.Parts {
+			err = accounts[p.To].canReceive()
+			if err != nil {
+				return err
+			}
+		}
+
+		fee, err := transferFee(ctx, tx, s.From, s.Currency, sum)
+		if err != nil {
+			return fmt.Errorf("transferFee() error: %w", err)
+		}
+
+		// The sender pays the fee on top of the sum
+		if accounts[s.From].available() - sum - fee < 0.00 {
+			return InsufficientFunds
+		}
+
+		// Limits are set in BaseCurrency
+		if s.Currency == BaseCurrency {
+			err = checkLimits(ctx, tx, s.From, TransactionTransfer, sum)
+			if err != nil {
+				return err
+			}
+		}
+
+		res = SplitResult{ From: s.From, Currency: s.Currency, Fee: fee, Shares: make([]SplitShare, len(shares)) }
+
+		res.FromBalance, err = updateWallet(ctx, tx, s.From, s.Currency, -sum - fee)
+		if err != nil {
+			return fmt.Errorf("updateWallet(..., from) error: %w", err)
+		}
+
+		entries := []entry{ { userAccount(s.From), -sum - fee } }
+		for i, p := range s.Parts {
+			share := SplitShare{ To: p.To, Amount: float64(shares[i]) / 100 }
+
+			share.Balance, err = updateWallet(ctx, tx, p.To, s.Currency, share.Amount)
+			if err != nil {
+				return fmt.Errorf("updateWallet(..., to) error: %w", err)
+			}
+			res.Shares[i] = share
+			entries = append(entries, entry{ userAccount(p.To), share.Amount })
+		}
+		if fee > 0.00 {
+			entries = append(entries, entry{ AccountRevenue, fee })
+		}
+
+		// The split is a transfer without a single recipient: the recipients find it by their journal entries
+		res.TransactionID, err = recordTransaction(ctx, tx, transaction{ Type: TransactionTransfer, From: s.From, Amount: sum, Fee: fee,
+			Currency: s.Currency, Comment: s.Comment })
+		if err != nil {
+			return fmt.Errorf("recordTransaction() error: %w", err)
+		}
+
+		err = postEntries(ctx, tx, res.TransactionID, s.Currency, entries...)
+		if err != nil {
+			return fmt.Errorf("postEntries() error: %w", err)
+		}
+
+		err = publishEvent(ctx, tx, events.Event{ AccountID: s.From, Balance: res.FromBalance, Currency: s.Currency,
+			TransactionID: res.TransactionID, Type: TransactionTransfer })
+		if err != nil {
+			return fmt.Errorf("publishEvent() error: %w", err)
+		}
+		for _, share := range res.Shares {
+			err = publishEvent(ctx, tx, events.Event{ AccountID: share.To, Balance: share.Balance, Currency: s.Currency,
+				TransactionID: res.TransactionID, Type: TransactionTransfer })
+			if err != nil {
+				return fmt.Errorf("publishEvent() error: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return SplitResult{}, err
+	}
+	return res, nil
+}
@@ -0,0 +1,119 @@
+package methods
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// Statement is the header of a statement of a user's wallet for the period [From, To).
+// Closing is known only when all lines have been written.
+type Statement struct {
+	ID			int
+	Currency	string
+	From		time.Time
+	To			time.Time
+	Opening		float64
+	Closing		float64
+}
+
+// StatementLine is a transaction of the statement.
+// Amount is the change of the wallet including the fee, Counterparty is 0 for money
+// coming from or leaving the service.
+type StatementLine struct {
+	TransactionID	int64
+	Type			string
+	CreatedAt		time.Time
+	Amount			float64
+	Balance			float64
+	Counterparty	int
+	Comment			string
+	// Member is the member of a shared account who made the transaction, 0 for other accounts
+	Member			int
+}
+
+// StatementWriter receives a statement as it is read from the database
+type StatementWriter interface {
+	// Begin is called once before the lines, the opening balance is set
+	Begin(s Statement) error
+	Line(l StatementLine) error
+	// End is called once after the lines, the closing balance is set
+	End(s Statement) error
+}
+
+// The WriteStatement method writes the statement of the user's wallet in the currency
+// for the period [from, to) to w. An empty currency means BaseCurrency.
+// The lines are passed to w one by one while they are read from the database,
+// so a statement of any length is never held in memory.
+// The statement is read in one repeatable read transaction: the closing balance is always
+// the opening balance plus the lines.
+func (db *Methods) WriteStatement(id int, currency string, from, to time.Time, w StatementWriter) error {
+	const request = `SELECT t.id, t.type, MIN(j.created_at), SUM(j.amount),
+			COALESCE(NULLIF(CASE WHEN t.from_id = $2 THEN t.to_id ELSE t.from_id END, $2), 0), t.comment,
+			COALESCE(t.member_id, 0)
+		FROM journal_entries j JOIN transactions t ON t.id = j.transaction_id
+		WHERE j.account = $1 AND j.currency = $3 AND j.created_at >= $4 AND j.created_at < $5
+		GROUP BY t.id ORDER BY MIN(j.id)`
+
+	ctx := context.Background()
+
+	if currency == "" {
+		currency = BaseCurrency
+	}
+	if !currencies[currency] || from.IsZero() || !from.Before(to) {
+		return WrongData
+	}
+
+	_, _, err := db.GetBalance(id)
+	if err != nil {
+		return err
+	}
+
+	s := Statement{ ID: id, Currency: currency, From: from, To: to }
+
+	return db.pool.BeginTxFunc(ctx, pgx.TxOptions{ IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly }, func(tx pgx.Tx) error {
+		// Timestamps of the database are precise to a microsecond
+		s.Opening, err = balanceAt(ctx, tx, id, currency, from.Add(-time.Microsecond))
+		if err != nil {
+			return fmt.Errorf("balanceAt() error: %w", err)
+		}
+
+		err = w.Begin(s)
+		if err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(ctx, request, userAccount(id), id, currency, from, to)
+		if err != nil {
+			return fmt.Errorf("Query() error: %w", err)
+		}
+
+		defer rows.Close()
+
+		balance := cents(s.Opening)
+		for rows.Next() {
+			var l StatementLine
+
+			err = rows.Scan(&l.TransactionID, &l.Type, &l.CreatedAt, &l.Amount, &l.Counterparty, &l.Comment, &l.Member)
+			if err != nil {
+				return fmt.Errorf("rows.Scan() error: %w", err)
+			}
+
+			balance += cents(l.Amount)
+			l.Balance = float64(balance) / 100
+
+			err = w.Line(l)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err = rows.Err(); err != nil {
+			return fmt.Errorf("rows.Err() error: %w", err)
+		}
+
+		s.Closing = float64(balance) / 100
+		return w.End(s)
+	})
+}
@@ -0,0 +1,126 @@
+package methods
+
+import (
+	"app/pkg/events"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+)
+
+// Types of transactions
+const (
+	TransactionRefill	= "refill"
+	TransactionWithdraw	= "withdraw"
+	TransactionTransfer	= "transfer"
+	TransactionRefund	= "refund"
+	TransactionPayout	= "payout"
+	TransactionExchange	= "exchange"
+	TransactionPayment	= "payment"
+	TransactionVoucher	= "voucher"
+	// Money of escrow deals goes from the buyer to the escrow account of the deal
+	// and from it to the seller or back to the buyer
+	TransactionEscrow			= "escrow"
+	TransactionEscrowRelease	= "escrow_release"
+	TransactionEscrowRefund		= "escrow_refund"
+	// Money moves between a parent account and its sub-accounts by allocations of the parent
+	// and draws of the sub-accounts
+	TransactionAllocation	= "allocation"
+	TransactionDraw			= "draw"
+	// Interest and fees charged daily on negative balances within the credit line
+	TransactionOverdraft	= "overdraft"
+	// Holds of pending transfers are not transactions, their events tell the new held
+	// and available money of the sender
+	TransactionHold			= "hold"
+	TransactionHoldRelease	= "hold_release"
+	// Bonuses are not a part of the balance, their transactions are not announced
+	TransactionBonus		= "bonus"
+	TransactionBonusExpiry	= "bonus_expiry"
+)
+
+// transactionTypes are the types of transactions events can be subscribed to
+var transactionTypes = map[string]bool{
+	TransactionRefill:		true,
+	TransactionWithdraw:	true,
+	TransactionTransfer:	true,
+	TransactionRefund:		true,
+	TransactionPayout:		true,
+	TransactionExchange:	true,
+	TransactionPayment:		true,
+	TransactionVoucher:		true,
+	TransactionEscrow:			true,
+	TransactionEscrowRelease:	true,
+	TransactionEscrowRefund:	true,
+	TransactionAllocation:		true,
+	TransactionDraw:			true,
+	TransactionOverdraft:		true,
+	TransactionHold:			true,
+	TransactionHoldRelease:		true,
+}
+
+// transaction is a row of the history.
+// From is 0 for money coming from outside of the service, To is 0 for money leaving it.
+type transaction struct {
+	Type		string
+	From		int
+	To			int
+	Amount		float64
+	// Fee is charged to From on top of Amount
+	Fee			float64
+	// Currency is BaseCurrency if empty
+	Currency	string
+	// Rate is the exchange rate applied to an exchange
+	Rate		float64
+	Comment		string
+	RefundOf	int64
+	Initiator	string
+	// Member is the member of the shared account From who made the transaction, 0 for other accounts
+	Member		int
+}
+
+// recordTransaction saves the transaction to the history inside the transaction tx
+// and returns its ID.
+func recordTransaction(ctx context.Context, tx pgx.Tx, t transaction) (int64, error) {
+	var id int64
+
+	const insert = `INSERT INTO transactions (type, from_id, to_id, amount, fee, currency, rate, comment, refund_of, initiator, member_id)
+		VALUES ($1, NULLIF($2, 0), NULLIF($3, 0), $4, $5, $6, NULLIF($7::DECIMAL, 0), $8, NULLIF($9, 0), $10, NULLIF($11, 0)) RETURNING id`
+
+	if t.Currency == "" {
+		t.Currency = BaseCurrency
+	}
+
+	err := tx.QueryRow(ctx, insert, t.Type, t.From, t.To, t.Amount, t.Fee, t.Currency, t.Rate, t.Comment, t.RefundOf, t.Initiator, t.Member).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	return id, nil
+}
+
+// publishEvent announces the new balance of the account when the transaction tx commits:
+// the event is sent to events.Channel, queued for the webhooks subscribed to its type
+// and written to the outbox.
+func publishEvent(ctx context.Context, tx pgx.Tx, e events.Event) error {
+	const notify = `SELECT pg_notify($1, $2)`
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("json.Marshal() error: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, notify, events.Channel, string(payload))
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+
+	err = enqueueWebhooks(ctx, tx, e, payload)
+	if err != nil {
+		return fmt.Errorf("enqueueWebhooks() error: %w", err)
+	}
+
+	err = writeOutbox(ctx, tx, e, payload)
+	if err != nil {
+		return fmt.Errorf("writeOutbox() error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package methods
+
+import (
+	"app/pkg/events"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"strings"
+	"time"
+)
+
+var (
+	VoucherUnavailable = errors.New("Voucher can not be redeemed")
+)
+
+// AccountVouchers is the system account of the money credited by vouchers
+const AccountVouchers = "vouchers"
+
+// MaxVoucherBatch is the largest number of codes generated in one batch
+const MaxVoucherBatch = 10000
+
+// voucherAlphabet has no characters that are easy to confuse: 0 and O, 1 and I
+const voucherAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// VoucherBatch is a batch of voucher codes with the same terms.
+// Every code credits Amount in Currency and can be redeemed up to MaxRedemptions times,
+// once per user, between ValidFrom and ValidUntil.
+type VoucherBatch struct {
+	ID				int64
+	Amount			float64
+	Currency		string
+	Count			int
+	MaxRedemptions	int
+	ValidFrom		time.Time
+	ValidUntil		time.Time
+	Comment			string
+	CreatedAt		time.Time
+}
+
+// Voucher is a code of a batch and the number of times it has been redeemed
+type Voucher struct {
+	Code		string
+	Redemptions	int
+}
+
+// VoucherStats are the redemptions of the codes of a batch
+type VoucherStats struct {
+	Batch			VoucherBatch
+	// RedeemedCodes is the number of codes redeemed at least once
+	RedeemedCodes	int
+	Redemptions		int
+	RedeemedAmount	float64
+}
+
+// Redemption is a voucher credited to a user
+type Redemption struct {
+	TransactionID	int64
+	ID				int
+	Code			string
+	Amount			float64
+	Currency		string
+	Balance			float64
+}
+
+// newVoucherCode returns a random code in the format XXXX-XXXX-XXXX
+func newVoucherCode() (string, error) {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	var code strings.Builder
+	for i, c := range b {
+		if i > 0 && i % 4 == 0 {
+			code.WriteByte('-')
+		}
+		code.WriteByte(voucherAlphabet[int(c) % len(voucherAlphabet)])
+	}
+	return code.String(), nil
+}
+
+// The CreateVoucherBatch method generates b.Count codes with the terms of the batch
+// and returns the saved batch. An empty currency means BaseCurrency,
+// a zero ValidFrom means the batch is valid right away.
+func (db *Methods) CreateVoucherBatch(b VoucherBatch) (VoucherBatch, error) {
+	const insert = `INSERT INTO voucher_batches (amount, currency, count, max_redemptions, valid_from, valid_until, comment)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`
+
+	ctx := context.Background()
+
+	if b.Currency == "" {
+		b.Currency = BaseCurrency
+	}
+	if b.ValidFrom.IsZero() {
+		b.ValidFrom = time.Now()
+	}
+	if !currencies[b.Currency] || cents(b.Amount) <= 0 || b.Count <= 0 || b.Count > MaxVoucherBatch ||
+		b.MaxRedemptions <= 0 || !b.ValidUntil.After(b.ValidFrom) {
+		return VoucherBatch{}, WrongData
+	}
+
+	// Codes are random, a duplicate only makes the set smaller and is generated again
+	codes := make(map[string]bool, b.Count)
+	for len(codes) < b.Count {
+		code, err := newVoucherCode()
+		if err != nil {
+			return VoucherBatch{}, fmt.Errorf("newVoucherCode() error: %w", err)
+		}
+		codes[code] = true
+	}
+
+	err := db.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		err := tx.QueryRow(ctx, insert, b.Amount, b.Currency, b.Count, b.MaxRedemptions, b.ValidFrom, b.ValidUntil, b.Comment).Scan(&b.ID, &b.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("QueryRow() error: %w", err)
+		}
+
+		rows := make([][]interface{}, 0, len(codes))
+		for code := range codes {
+			rows = append(rows, []interface{}{ code, b.ID })
+		}
+
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{ "vouchers" }, []string{ "code", "batch_id" }, pgx.CopyFromRows(rows))
+		if err != nil {
+			return fmt.Errorf("CopyFrom() error: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return VoucherBatch{}, err
+	}
+	return b, nil
+}
+
+// The ExportVouchers method passes the codes of the batch to write one by one
+// as they are read from the database
+func (db *Methods) ExportVouchers(batchID int64, write func(Voucher) error) error {
+	const request = `SELECT code, redemptions FROM vouchers WHERE batch_id = $1 ORDER BY code`
+
+	ctx := context.Background()
+
+	_, err := db.VoucherBatchStats(batchID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.pool.Query(ctx, request, batchID)
+	if err != nil {
+		return fmt.Errorf("pool.Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var v Voucher
+
+		err = rows.Scan(&v.Code, &v.Redemptions)
+		if err != nil {
+			return fmt.Errorf("rows.Scan() error: %w", err)
+		}
+
+		err = write(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("rows.Err() error: %w", err)
+	}
+	return nil
+}
+
+// The VoucherBatchStats method returns the batch with the statistics of its redemptions
+func (db *Methods) VoucherBatchStats(batchID int64) (VoucherStats, error) {
+	const request = `SELECT b.id, b.amount, b.currency, b.count, b.max_redemptions, b.valid_from, b.valid_until, b.comment, b.created_at,
+			COUNT(v.code) FILTER (WHERE v.redemptions > 0), COALESCE(SUM(v.redemptions), 0)
+		FROM voucher_batches b LEFT JOIN vouchers v ON v.batch_id = b.id
+		WHERE b.id = $1 GROUP BY b.id`
+
+	var s VoucherStats
+
+	if batchID <= 0 {
+		return s, WrongData
+	}
+
+	b := &s.Batch
+	err := db.pool.QueryRow(context.Background(), request, batchID).Scan(&b.ID, &b.Amount, &b.Currency, &b.Count,
+		&b.MaxRedemptions, &b.ValidFrom, &b.ValidUntil, &b.Comment, &b.CreatedAt, &s.RedeemedCodes, &s.Redemptions)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return s, NotFound
+	}
+	if err != nil {
+		return s, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	s.RedeemedAmount = float64(cents(b.Amount) * int64(s.Redemptions)) / 100
+	return s, nil
+}
+
+// The RedeemVoucher method credits the amount of the voucher to the user's wallet in its currency.
+// A code is redeemed at most MaxRedemptions times and once per user: the row of the code is locked,
+// so concurrent redemptions of the same code are executed one after another.
+// NotFound is returned for an unknown code, VoucherUnavailable for a code that can not be redeemed now.
+func (db *Methods) RedeemVoucher(id int, code string) (Redemption, error) {
+	var r Redemption
+
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if id <= 0 || code == "" {
+		return r, WrongData
+	}
+
+	err := db.pool.BeginFunc(context.Background(), func(tx pgx.Tx) (err error) {
+		r, err = db.redeemVoucher(context.Background(), tx, id, code)
+		return err
+	})
+	if err != nil {
+		return Redemption{}, err
+	}
+	return r, nil
+}
+
+// redeemVoucher redeems the voucher inside the transaction tx
+func (db *Methods) redeemVoucher(ctx context.Context, tx pgx.Tx, id int, code string) (Redemption, error) {
+	const (
+		voucher = `SELECT v.redemptions, b.amount, b.currency, b.max_redemptions, now() BETWEEN b.valid_from AND b.valid_until
+			FROM vouchers v JOIN voucher_batches b ON b.id = v.batch_id
+			WHERE v.code = $1 FOR UPDATE OF v`
+		redeem = `INSERT INTO voucher_redemptions (code, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+		update = `UPDATE vouchers SET redemptions = redemptions + 1 WHERE code = $1`
+		link = `UPDATE voucher_redemptions SET transaction_id = $3 WHERE code = $1 AND user_id = $2`
+	)
+
+	var redemptions, maxRedemptions int
+	var valid bool
+
+	r := Redemption{ ID: id, Code: code }
+
+	err := tx.QueryRow(ctx, voucher, code).Scan(&redemptions, &r.Amount, &r.Currency, &maxRedemptions, &valid)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return r, NotFound
+	}
+	if err != nil {
+		return r, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	if !valid || redemptions >= maxRedemptions {
+		return r, VoucherUnavailable
+	}
+
+	// The code is redeemed once per user
+	tag, err := tx.Exec(ctx, redeem, code, id)
+	if err != nil {
+		return r, fmt.Errorf("Exec() error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return r, VoucherUnavailable
+	}
+
+	_, err = tx.Exec(ctx, update, code)
+	if err != nil {
+		return r, fmt.Errorf("Exec() error: %w", err)
+	}
+
+	a, err := lockWallet(ctx, tx, id, r.Currency)
+	if err != nil {
+		return r, err
+	}
+	if err = a.canReceive(); err != nil {
+		return r, err
+	}
+
+	r.Balance, err = updateWallet(ctx, tx, id, r.Currency, r.Amount)
+	if err != nil {
+		return r, fmt.Errorf("updateWallet() error: %w", err)
+	}
+
+	r.TransactionID, err = recordTransaction(ctx, tx, transaction{ Type: TransactionVoucher, To: id, Amount: r.Amount, Currency: r.Currency, Comment: "voucher " + code })
+	if err != nil {
+		return r, fmt.Errorf("recordTransaction() error: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, link, code, id, r.TransactionID)
+	if err != nil {
+		return r, fmt.Errorf("Exec() error: %w", err)
+	}
+
+	err = postEntries(ctx, tx, r.TransactionID, r.Currency, entry{ userAccount(id), r.Amount }, entry{ AccountVouchers, -r.Amount })
+	if err != nil {
+		return r, fmt.Errorf("postEntries() error: %w", err)
+	}
+
+	err = publishEvent(ctx, tx, events.Event{ AccountID: id, Balance: r.Balance, Currency: r.Currency, TransactionID: r.TransactionID, Type: TransactionVoucher })
+	if err != nil {
+		return r, fmt.Errorf("publishEvent() error: %w", err)
+	}
+	return r, nil
+}
@@ -0,0 +1,157 @@
+package methods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	CurrencyMismatch = errors.New("Currencies of the wallets do not match")
+)
+
+// BaseCurrency is the currency of user balances
+const BaseCurrency = "RUB"
+
+// currencies are the currencies users can hold.
+// The wallet in BaseCurrency is the balance of user_balance, the others are stored in wallets.
+var currencies = map[string]bool{
+	"RUB":	true,
+	"USD":	true,
+	"EUR":	true,
+}
+
+// Wallet is the balance of a user in one currency.
+// Held is the part of the balance reserved by pending transfers.
+// Bonus is the bonus balance, only the wallet in BaseCurrency has one.
+type Wallet struct {
+	Currency	string
+	Balance		float64
+	Held		float64
+	Bonus		float64
+}
+
+// The GetWallets method returns the wallets of the user.
+// If currency is empty, all wallets are returned, the wallet in BaseCurrency first.
+// Otherwise only the wallet in the currency is returned, a wallet that has never been used has a zero balance.
+func (db *Methods) GetWallets(id int, currency string) ([]Wallet, error) {
+	const request = `SELECT balance, held FROM user_balance WHERE id = $1`
+
+	if id <= 0 || (currency != "" && !currencies[currency]) {
+		return nil, WrongData
+	}
+
+	base := Wallet{ Currency: BaseCurrency }
+	err := db.pool.QueryRow(context.Background(), request, id).Scan(&base.Balance, &base.Held)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, UserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("QueryRow() error: %w", err)
+	}
+
+	others, err := otherWallets(context.Background(), db.pool, id)
+	if err != nil {
+		return nil, fmt.Errorf("otherWallets() error: %w", err)
+	}
+	base.Bonus, err = bonusBalance(context.Background(), db.pool, id)
+	if err != nil {
+		return nil, fmt.Errorf("bonusBalance() error: %w", err)
+	}
+	wallets := append([]Wallet{ base }, others...)
+
+	if currency == "" {
+		return wallets, nil
+	}
+	for _, w := range wallets {
+		if w.Currency == currency {
+			return []Wallet{ w }, nil
+		}
+	}
+	return []Wallet{ { Currency: currency } }, nil
+}
+
+// otherWallets returns the wallets of the user in other currencies than BaseCurrency
+func otherWallets(ctx context.Context, q querier, id int) ([]Wallet, error) {
+	const request = `SELECT currency, balance, held FROM wallets WHERE user_id = $1 ORDER BY currency`
+
+	rows, err := q.Query(ctx, request, id)
+	if err != nil {
+		return nil, fmt.Errorf("Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	var wallets []Wallet
+	for rows.Next() {
+		var w Wallet
+
+		err = rows.Scan(&w.Currency, &w.Balance, &w.Held)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		wallets = append(wallets, w)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err() error: %w", err)
+	}
+	return wallets, nil
+}
+
+// lockWallets locks the accounts of the users like lockAccounts
+// and returns them with the balances of their wallets in the currency.
+// Wallets are protected by the lock of their account, they have no credit line.
+func lockWallets(ctx context.Context, tx pgx.Tx, currency string, ids ...int) (map[int]account, error) {
+	const request = `SELECT balance, held FROM wallets WHERE user_id = $1 AND currency = $2`
+
+	accounts, err := lockAccounts(ctx, tx, ids...)
+	if err != nil || currency == BaseCurrency {
+		return accounts, err
+	}
+
+	for id, a := range accounts {
+		a.Balance, a.Held, a.CreditLimit = 0, 0, 0
+		err = tx.QueryRow(ctx, request, id, currency).Scan(&a.Balance, &a.Held)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("QueryRow() error: %w", err)
+		}
+		accounts[id] = a
+	}
+	return accounts, nil
+}
+
+// lockWallet is lockWallets for a single user
+func lockWallet(ctx context.Context, tx pgx.Tx, id int, currency string) (account, error) {
+	accounts, err := lockWallets(ctx, tx, currency, id)
+	if err != nil {
+		return account{}, err
+	}
+	return accounts[id], nil
+}
+
+// updateWallet adds sum to the wallet of the user in the currency inside the transaction tx
+// and returns the new balance. A wallet in another currency than BaseCurrency is opened on first use.
+// The account of the user must be locked.
+func updateWallet(ctx context.Context, tx pgx.Tx, id int, currency string, sum float64) (float64, error) {
+	const (
+		base = `UPDATE user_balance SET balance = balance + $1 WHERE id = $2 RETURNING balance`
+		other = `INSERT INTO wallets (user_id, currency, balance) VALUES ($2, $3, $1)
+			ON CONFLICT (user_id, currency) DO UPDATE SET balance = wallets.balance + EXCLUDED.balance
+			RETURNING balance`
+	)
+
+	var balance float64
+	var err error
+
+	if currency == BaseCurrency {
+		err = tx.QueryRow(ctx, base, sum, id).Scan(&balance)
+	} else {
+		err = tx.QueryRow(ctx, other, sum, id, currency).Scan(&balance)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	return balance, nil
+}
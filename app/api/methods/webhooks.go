@@ -0,0 +1,282 @@
+package methods
+
+import (
+	"app/pkg/events"
+	"app/pkg/webhooks"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Webhook is a subscription of an external URL to events of the given types
+type Webhook struct {
+	ID			int
+	URL			string
+	EventTypes	[]string
+	CreatedAt	time.Time
+}
+
+// DeadLetter is a delivery that failed permanently
+type DeadLetter struct {
+	ID				int64
+	SubscriptionID	int
+	Payload			json.RawMessage
+	Attempts		int
+	LastError		string
+	FailedAt		time.Time
+}
+
+// The CreateWebhook method subscribes the URL to events of the given types.
+// Every delivery is signed with the secret. On success, the ID of the subscription is returned.
+func (db *Methods) CreateWebhook(rawURL string, eventTypes []string, secret string) (int, error) {
+	var id int
+
+	const insert = `INSERT INTO webhook_subscriptions (url, event_types, secret) VALUES ($1, $2, $3) RETURNING id`
+
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || secret == "" || len(eventTypes) == 0 {
+		return 0, WrongData
+	}
+	for _, t := range eventTypes {
+		if !transactionTypes[t] {
+			return 0, WrongData
+		}
+	}
+
+	err = db.pool.QueryRow(context.Background(), insert, rawURL, eventTypes, secret).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("QueryRow() error: %w", err)
+	}
+	return id, nil
+}
+
+// The ListWebhooks method returns all subscriptions without their secrets
+func (db *Methods) ListWebhooks() ([]Webhook, error) {
+	const request = `SELECT id, url, event_types, created_at FROM webhook_subscriptions ORDER BY id`
+
+	rows, err := db.pool.Query(context.Background(), request)
+	if err != nil {
+		return nil, fmt.Errorf("pool.Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var hook Webhook
+
+		err = rows.Scan(&hook.ID, &hook.URL, &hook.EventTypes, &hook.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		hooks = append(hooks, hook)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err() error: %w", err)
+	}
+	return hooks, nil
+}
+
+// The DeleteWebhook method removes the subscription together with its pending deliveries
+func (db *Methods) DeleteWebhook(id int) error {
+	const request = `DELETE FROM webhook_subscriptions WHERE id = $1`
+
+	if id <= 0 {
+		return WrongData
+	}
+
+	tag, err := db.pool.Exec(context.Background(), request, id)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return NotFound
+	}
+	return nil
+}
+
+// The ListDeadLetters method returns the deliveries that failed permanently, oldest first
+func (db *Methods) ListDeadLetters() ([]DeadLetter, error) {
+	const request = `SELECT id, subscription_id, payload, attempts, last_error, failed_at
+		FROM webhook_dead_letters ORDER BY failed_at`
+
+	rows, err := db.pool.Query(context.Background(), request)
+	if err != nil {
+		return nil, fmt.Errorf("pool.Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	letters := []DeadLetter{}
+	for rows.Next() {
+		var letter DeadLetter
+
+		err = rows.Scan(&letter.ID, &letter.SubscriptionID, &letter.Payload, &letter.Attempts, &letter.LastError, &letter.FailedAt)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		letters = append(letters, letter)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err() error: %w", err)
+	}
+	return letters, nil
+}
+
+// The ReplayDeadLetter method moves the dead letter back to the pending deliveries
+// with a fresh number of attempts. The delivery keeps its ID and attempt history.
+func (db *Methods) ReplayDeadLetter(id int64) error {
+	const (
+		replay = `INSERT INTO webhook_deliveries (id, subscription_id, event_key, payload)
+			SELECT id, subscription_id, event_key, payload FROM webhook_dead_letters WHERE id = $1`
+		remove = `DELETE FROM webhook_dead_letters WHERE id = $1`
+	)
+
+	if id <= 0 {
+		return WrongData
+	}
+
+	return db.pool.BeginFunc(context.Background(), func(tx pgx.Tx) error {
+		tag, err := tx.Exec(context.Background(), replay, id)
+		if err != nil {
+			return fmt.Errorf("Exec() error: %w", err)
+		}
+		if tag.RowsAffected() == 0 {
+			return NotFound
+		}
+
+		_, err = tx.Exec(context.Background(), remove, id)
+		if err != nil {
+			return fmt.Errorf("Exec() error: %w", err)
+		}
+		return nil
+	})
+}
+
+// ClaimDeliveries implements webhooks.Store
+func (db *Methods) ClaimDeliveries(limit int, lease time.Duration) ([]webhooks.Delivery, error) {
+	const request = `WITH due AS (
+			SELECT id FROM webhook_deliveries
+			WHERE delivered_at IS NULL AND next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED),
+		claimed AS (
+			UPDATE webhook_deliveries d SET next_attempt_at = now() + $2::interval
+			FROM due WHERE d.id = due.id
+			RETURNING d.id, d.subscription_id, d.payload, d.attempts)
+		SELECT c.id, s.url, s.secret, c.payload, c.attempts
+		FROM claimed c JOIN webhook_subscriptions s ON s.id = c.subscription_id`
+
+	rows, err := db.pool.Query(context.Background(), request, limit, lease)
+	if err != nil {
+		return nil, fmt.Errorf("pool.Query() error: %w", err)
+	}
+
+	defer rows.Close()
+
+	var deliveries []webhooks.Delivery
+	for rows.Next() {
+		var delivery webhooks.Delivery
+
+		err = rows.Scan(&delivery.ID, &delivery.URL, &delivery.Secret, &delivery.Payload, &delivery.Attempts)
+		if err != nil {
+			return nil, fmt.Errorf("rows.Scan() error: %w", err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err() error: %w", err)
+	}
+	return deliveries, nil
+}
+
+// CompleteDelivery implements webhooks.Store
+func (db *Methods) CompleteDelivery(id int64, statusCode int) error {
+	const update = `UPDATE webhook_deliveries SET attempts = attempts + 1, delivered_at = now(), last_error = '' WHERE id = $1`
+
+	return db.pool.BeginFunc(context.Background(), func(tx pgx.Tx) error {
+		err := recordAttempt(context.Background(), tx, id, statusCode, "")
+		if err != nil {
+			return fmt.Errorf("recordAttempt() error: %w", err)
+		}
+
+		_, err = tx.Exec(context.Background(), update, id)
+		if err != nil {
+			return fmt.Errorf("Exec() error: %w", err)
+		}
+		return nil
+	})
+}
+
+// FailDelivery implements webhooks.Store
+func (db *Methods) FailDelivery(id int64, statusCode int, reason string, retryAt time.Time, dead bool) error {
+	const (
+		retry = `UPDATE webhook_deliveries SET attempts = attempts + 1, next_attempt_at = $2, last_error = $3 WHERE id = $1`
+		bury = `INSERT INTO webhook_dead_letters (id, subscription_id, event_key, payload, attempts, last_error)
+			SELECT id, subscription_id, event_key, payload, attempts + 1, $2 FROM webhook_deliveries WHERE id = $1`
+		remove = `DELETE FROM webhook_deliveries WHERE id = $1`
+	)
+
+	return db.pool.BeginFunc(context.Background(), func(tx pgx.Tx) error {
+		err := recordAttempt(context.Background(), tx, id, statusCode, reason)
+		if err != nil {
+			return fmt.Errorf("recordAttempt() error: %w", err)
+		}
+
+		if !dead {
+			_, err = tx.Exec(context.Background(), retry, id, retryAt, reason)
+			if err != nil {
+				return fmt.Errorf("Exec() error: %w", err)
+			}
+			return nil
+		}
+
+		_, err = tx.Exec(context.Background(), bury, id, reason)
+		if err != nil {
+			return fmt.Errorf("Exec() error: %w", err)
+		}
+
+		_, err = tx.Exec(context.Background(), remove, id)
+		if err != nil {
+			return fmt.Errorf("Exec() error: %w", err)
+		}
+		return nil
+	})
+}
+
+// recordAttempt saves one attempt of the delivery to its history
+func recordAttempt(ctx context.Context, tx pgx.Tx, id int64, statusCode int, reason string) error {
+	const insert = `INSERT INTO webhook_attempts (delivery_id, status_code, error) VALUES ($1, $2, $3)`
+
+	_, err := tx.Exec(ctx, insert, id, statusCode, reason)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+	return nil
+}
+
+// enqueueWebhooks queues the event for every subscription to its type inside the transaction tx.
+// An event is queued at most once per subscription.
+func enqueueWebhooks(ctx context.Context, tx pgx.Tx, e events.Event, payload []byte) error {
+	const insert = `INSERT INTO webhook_deliveries (subscription_id, event_key, payload)
+		SELECT id, $1, $2 FROM webhook_subscriptions WHERE $3 = ANY(event_types)
+		ON CONFLICT (subscription_id, event_key) DO NOTHING`
+
+	key := strconv.FormatInt(e.TransactionID, 10) + ":" + strconv.Itoa(e.AccountID)
+
+	_, err := tx.Exec(ctx, insert, key, payload, e.Type)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+	return nil
+}
+
+var _ webhooks.Store = (*Methods)(nil)
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+type RequestAccountStatus struct {
+	Status		string	`json:"status"`
+	Reason		string	`json:"reason"`
+	Payout		bool	`json:"payout"`
+}
+
+type ResponseAccountStatus struct {
+	Status			int		`json:"status"`
+	ID				int		`json:"id"`
+	AccountStatus	string	`json:"account_status"`
+	Balance			float64	`json:"balance"`
+}
+
+// SetAccountStatusHandler method:
+// 1. Input data:
+//		POST /admin/accounts/{id}/status
+//		Content-Type: application/json
+//		request body: {"status":status,"reason":reason,"payout":payout}
+//		---
+//		id - user id
+//		status - "active", "frozen" or "closed"
+//		reason - not empty
+//		payout - pay out the positive balance when closing the account
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id,"account_status":account_status,"balance":balance}
+//		---
+//		If successful:
+//			status = 0, id > 0, balance - balance after the payout
+//		If data is not a valid:
+//			status = 1, id = 0
+//		If user ID does not exist:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+//		If the account is already closed:
+//			status = 8, id = 0
+//		If the account has a non-zero balance and can not be paid out:
+//			status = 9, id = 0
+func SetAccountStatusHandler(SetAccountStatus func(int, string, string, bool) (float64, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestAccountStatus
+		var response	ResponseAccountStatus
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+		id, errID := strconv.Atoi(chi.URLParam(r, "id"))
+
+		switch {
+		case err != nil || errID != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseAccountStatus{ Status: 1 }
+		default:
+			balance, err := SetAccountStatus(id, request.Status, request.Reason, request.Payout)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseAccountStatus{ Status: status }
+				break
+			}
+			response = ResponseAccountStatus{
+				Status:			0,
+				ID:				id,
+				AccountStatus:	request.Status,
+				Balance:		math.Round(balance * 100) / 100,
+			}
+		}
+		render.JSON(w, r, response)
+	}
+}
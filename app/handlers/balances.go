@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/go-chi/render"
+	"log"
+	"math"
+	"net/http"
+)
+
+type RequestBatchGetBalance struct {
+	IDs			[]int	`json:"ids"`
+}
+
+type ResponseBatchBalance struct {
+	Status		int					`json:"status"`
+	Balances	[]ResponseToUser	`json:"balances"`
+}
+
+// BatchGetBalanceHandler method:
+// 1. Input data:
+//		Content-Type: application/json
+//		request body: {"ids":[id1,id2,...]}
+//		---
+//		ids - list of user ids
+//		0 < len(ids) <= limit
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"balances":[{"status":status,"id":id,"balance":balance},...]}
+//		---
+//		status - response status
+//		balances - one item per requested id, in the order of the request
+//		---
+//		If successful:
+//			status = 0, every item has its own status:
+//				status = 0, id > 0, balance >= 0.00 - balance found
+//				status = 1, id, balance = 0.00 - id is not a valid
+//				status = 2, id, balance = 0.00 - user ID does not exist
+//		If data is not a valid or there are too many ids:
+//			status = 1, balances = []
+//		If server error:
+//			status = 4, balances = []
+func BatchGetBalanceHandler(GetBalances func([]int) (map[int]float64, error), limit int) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestBatchGetBalance
+		var response	ResponseBatchBalance
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		switch {
+		case err != nil || p != "application/json" || len(request.IDs) == 0 || len(request.IDs) > limit:
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseBatchBalance{ Status: 1, Balances: []ResponseToUser{} }
+		default:
+			balances, err := GetBalances(request.IDs)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				response = ResponseBatchBalance{ Status: 4, Balances: []ResponseToUser{} }
+				log.Println(err)
+				break
+			}
+
+			items := make([]ResponseToUser, 0, len(request.IDs))
+			for _, id := range request.IDs {
+				ub, ok := balances[id]
+				switch {
+				case id <= 0:
+					items = append(items, ResponseToUser{ Status: 1, ID: id, Balance: 0.00 })
+				case !ok:
+					items = append(items, ResponseToUser{ Status: 2, ID: id, Balance: 0.00 })
+				default:
+					items = append(items, ResponseToUser{ Status: 0, ID: id, Balance: math.Round(ub * 100) / 100 })
+				}
+			}
+			w.WriteHeader(http.StatusOK)
+			response = ResponseBatchBalance{ Status: 0, Balances: items }
+		}
+		render.JSON(w, r, response)
+	}
+}
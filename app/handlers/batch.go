@@ -0,0 +1,133 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"github.com/go-chi/render"
+	"log"
+	"math"
+	"net/http"
+)
+
+// Modes of the batch execution
+const (
+	BatchModeAtomic		= "atomic"
+	BatchModeBestEffort	= "best_effort"
+)
+
+type RequestOperation struct {
+	Type			string	`json:"type"`
+	ID				int		`json:"id"`
+	From			int		`json:"from"`
+	To				int		`json:"to"`
+	Sum				float64	`json:"sum"`
+	Currency		string	`json:"currency"`
+	IdempotencyKey	string	`json:"idempotency_key"`
+}
+
+type RequestBatch struct {
+	Mode		string				`json:"mode"`
+	Operations	[]RequestOperation	`json:"operations"`
+}
+
+type ResponseOperation struct {
+	Status		int		`json:"status"`
+	ID			int		`json:"id"`
+	Balance		float64	`json:"balance"`
+	ToID		int		`json:"to_id,omitempty"`
+	ToBalance	float64	`json:"to_balance,omitempty"`
+}
+
+type ResponseBatch struct {
+	Status		int					`json:"status"`
+	Results		[]ResponseOperation	`json:"results"`
+}
+
+// BatchHandler method:
+// 1. Input data:
+//		Content-Type: application/json
+//		request body: {"mode":mode,"operations":[operation,...]}
+//		---
+//		mode - "atomic" or "best_effort"
+//		operation - one of:
+//			{"type":"credit","id":id,"sum":sum,"idempotency_key":key}
+//			{"type":"debit","id":id,"sum":sum,"idempotency_key":key}
+//			{"type":"transfer","from":from,"to":to,"sum":sum,"idempotency_key":key}
+//		currency (RUB if not set) and idempotency_key are optional, sum > 0
+//		0 < len(operations) <= limit
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"results":[{"status":status,"id":id,"balance":balance,"to_id":to_id,"to_balance":to_balance},...]}
+//		---
+//		status - response status
+//		results - one item per operation, in the order of the request,
+//			statuses of the items are the same as in the other methods
+//		---
+//		If successful ("best_effort" is always successful, every item has its own status):
+//			status = 0
+//		If data is not a valid:
+//			status = 1, results = []
+//		If an operation of an "atomic" batch fails:
+//			status of the failed operation, the failed item holds its status,
+//			all other items hold status = 5
+//		If server error:
+//			status = 4
+func BatchHandler(ExecuteBatch func([]apimethods.Operation, bool) ([]apimethods.OperationResult, error), limit int) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestBatch
+		var response	ResponseBatch
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+		mode := request.Mode == BatchModeAtomic || request.Mode == BatchModeBestEffort
+
+		switch {
+		case err != nil || p != "application/json" || !mode || len(request.Operations) == 0 || len(request.Operations) > limit:
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseBatch{ Status: 1, Results: []ResponseOperation{} }
+		default:
+			ops := make([]apimethods.Operation, len(request.Operations))
+			for i, op := range request.Operations {
+				ops[i] = apimethods.Operation{
+					Type:			op.Type,
+					ID:				op.ID,
+					From:			op.From,
+					To:				op.To,
+					Sum:			op.Sum,
+					Currency:		op.Currency,
+					IdempotencyKey:	op.IdempotencyKey,
+				}
+			}
+
+			results, err := ExecuteBatch(ops, request.Mode == BatchModeAtomic)
+
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+
+			response = ResponseBatch{ Status: status, Results: make([]ResponseOperation, len(results)) }
+			for i, res := range results {
+				_, s := errorStatus(res.Err)
+				if s == 4 && err == nil {
+					log.Println(res.Err)
+				}
+				if s != 0 {
+					response.Results[i] = ResponseOperation{ Status: s }
+					continue
+				}
+				response.Results[i] = ResponseOperation{
+					Status:		0,
+					ID:			res.ID,
+					Balance:	math.Round(res.Balance * 100) / 100,
+					ToID:		res.ToID,
+					ToBalance:	math.Round(res.ToBalance * 100) / 100,
+				}
+			}
+			w.WriteHeader(code)
+		}
+		render.JSON(w, r, response)
+	}
+}
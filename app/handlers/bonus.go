@@ -0,0 +1,180 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type RequestBonusGrant struct {
+	Amount		float64		`json:"amount"`
+	ExpiresAt	time.Time	`json:"expires_at"`
+	Services	[]string	`json:"services"`
+	Comment		string		`json:"comment"`
+}
+
+type ResponseBonusGrant struct {
+	Status		int			`json:"status"`
+	GrantID		int64		`json:"grant_id"`
+	ID			int			`json:"id"`
+	Amount		float64		`json:"amount"`
+	Services	[]string	`json:"services"`
+	ExpiresAt	time.Time	`json:"expires_at"`
+}
+
+type RequestPayService struct {
+	ID			int		`json:"id"`
+	Service		string	`json:"service"`
+	Sum			float64	`json:"sum"`
+}
+
+type ResponsePayment struct {
+	Status			int		`json:"status"`
+	TransactionID	int64	`json:"transaction_id"`
+	ID				int		`json:"id"`
+	Service			string	`json:"service"`
+	Sum				float64	`json:"sum"`
+	Real			float64	`json:"real"`
+	Bonus			float64	`json:"bonus"`
+	Balance			float64	`json:"balance"`
+	BonusBalance	float64	`json:"bonus_balance"`
+}
+
+// GrantBonusHandler method:
+// 1. Input data:
+//		POST /admin/accounts/{id}/bonuses
+//		Content-Type: application/json
+//		request body: {"amount":amount,"expires_at":expires_at,"services":[service,...],"comment":comment}
+//		---
+//		id - user id
+//		amount - bonuses in RUB, amount > 0
+//		expires_at - time in RFC 3339 when the bonuses expire, in the future
+//		services - services the bonuses can be spent on, any service if empty
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"grant_id":grant_id,"id":id,"amount":amount,"services":[service,...],"expires_at":expires_at}
+//		---
+//		If successful:
+//			status = 0, grant_id > 0
+//		If data is not a valid:
+//			status = 1, grant_id = 0
+//		If user ID does not exist:
+//			status = 2, grant_id = 0
+//		If server error:
+//			status = 4, grant_id = 0
+//		If the account is closed:
+//			status = 8, grant_id = 0
+func GrantBonusHandler(GrantBonus func(int, float64, time.Time, []string, string) (apimethods.BonusGrant, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestBonusGrant
+		var response	ResponseBonusGrant
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		id, errID := strconv.Atoi(chi.URLParam(r, "id"))
+
+		switch {
+		case err != nil || errID != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseBonusGrant{ Status: 1, Services: []string{} }
+		default:
+			g, err := GrantBonus(id, request.Amount, request.ExpiresAt, request.Services, request.Comment)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseBonusGrant{ Status: status, Services: []string{} }
+				break
+			}
+			response = ResponseBonusGrant{
+				Status:		0,
+				GrantID:	g.ID,
+				ID:			g.UserID,
+				Amount:		money(g.Amount),
+				Services:	g.Services,
+				ExpiresAt:	g.ExpiresAt,
+			}
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// PayServiceHandler method:
+// 1. Input data:
+//		POST /services/pay
+//		Content-Type: application/json
+//		request body: {"id":id,"service":service,"sum":sum}
+//		---
+//		id - user id
+//		service - name of the service
+//		sum - price of the service in RUB
+//		id > 0, sum > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"transaction_id":transaction_id,"id":id,"service":service,"sum":sum,"real":real,"bonus":bonus,"balance":balance,"bonus_balance":bonus_balance}
+//		---
+//		real, bonus - parts of the sum paid from the balance and from the bonuses
+//		balance, bonus_balance - balances of the user after the payment
+//		---
+//		If successful:
+//			status = 0
+//		If data is not a valid:
+//			status = 1, id = 0
+//		If user ID does not exist:
+//			status = 2, id = 0
+//		If insufficient funds:
+//			status = 3, id = 0
+//		If server error:
+//			status = 4, id = 0
+//		If the account is frozen or closed:
+//			status = 7 or 8, id = 0
+func PayServiceHandler(PayService func(int, string, float64) (apimethods.Payment, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestPayService
+		var response	ResponsePayment
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		switch {
+		case err != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponsePayment{ Status: 1 }
+		default:
+			payment, err := PayService(request.ID, request.Service, request.Sum)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponsePayment{ Status: status }
+				break
+			}
+			response = ResponsePayment{
+				Status:			0,
+				TransactionID:	payment.TransactionID,
+				ID:				payment.ID,
+				Service:		payment.Service,
+				Sum:			money(payment.Sum),
+				Real:			money(payment.Real),
+				Bonus:			money(payment.Bonus),
+				Balance:		money(payment.Balance),
+				BonusBalance:	money(payment.BonusBalance),
+			}
+		}
+		render.JSON(w, r, response)
+	}
+}
@@ -0,0 +1,321 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type RequestDeal struct {
+	Buyer		int		`json:"buyer"`
+	Seller		int		`json:"seller"`
+	Amount		float64	`json:"amount"`
+	Currency	string	`json:"currency"`
+	Comment		string	`json:"comment"`
+}
+
+type RequestDealAction struct {
+	ID			int		`json:"id"`
+	Reason		string	`json:"reason"`
+}
+
+type RequestResolveDeal struct {
+	ToSeller	*float64	`json:"to_seller"`
+	Reason		string		`json:"reason"`
+}
+
+type ResponseDealEvent struct {
+	State				string		`json:"state"`
+	Actor				string		`json:"actor"`
+	Reason				string		`json:"reason"`
+	ToSeller			float64		`json:"to_seller"`
+	ToBuyer				float64		`json:"to_buyer"`
+	SellerTransactionID	int64		`json:"seller_transaction_id"`
+	BuyerTransactionID	int64		`json:"buyer_transaction_id"`
+	CreatedAt			time.Time	`json:"created_at"`
+}
+
+type ResponseDeal struct {
+	Status		int					`json:"status"`
+	DealID		int64				`json:"deal_id"`
+	Buyer		int					`json:"buyer"`
+	Seller		int					`json:"seller"`
+	Amount		float64				`json:"amount"`
+	Currency	string				`json:"currency"`
+	Comment		string				`json:"comment"`
+	State		string				`json:"state"`
+	CreatedAt	time.Time			`json:"created_at"`
+	UpdatedAt	time.Time			`json:"updated_at"`
+	History		[]ResponseDealEvent	`json:"history,omitempty"`
+	Remaining	*float64			`json:"remaining,omitempty"`
+}
+
+// dealResponse converts the deal to the response
+func dealResponse(d apimethods.Deal) ResponseDeal {
+	response := ResponseDeal{
+		Status:		0,
+		DealID:		d.ID,
+		Buyer:		d.Buyer,
+		Seller:		d.Seller,
+		Amount:		money(d.Amount),
+		Currency:	d.Currency,
+		Comment:	d.Comment,
+		State:		d.Status,
+		CreatedAt:	d.CreatedAt,
+		UpdatedAt:	d.UpdatedAt,
+	}
+	for _, e := range d.History {
+		response.History = append(response.History, ResponseDealEvent{
+			State:					e.Status,
+			Actor:					e.Actor,
+			Reason:					e.Reason,
+			ToSeller:				money(e.ToSeller),
+			ToBuyer:				money(e.ToBuyer),
+			SellerTransactionID:	e.SellerTransactionID,
+			BuyerTransactionID:		e.BuyerTransactionID,
+			CreatedAt:				e.CreatedAt,
+		})
+	}
+	return response
+}
+
+// CreateDealHandler method:
+// 1. Input data:
+//		POST /escrow/deals
+//		Content-Type: application/json
+//		request body: {"buyer":buyer,"seller":seller,"amount":amount,"currency":currency,"comment":comment}
+//		---
+//		buyer - user id who pays, the amount is moved from their wallet to the escrow of the deal.
+//			A deal is fee-free, but the amount counts towards the transfer limits of the buyer.
+//		seller - user id who gets the money when the deal is released
+//		currency - currency of the wallets, RUB if not set
+//		buyer > 0, seller > 0, buyer != seller, amount > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"deal_id":deal_id,"buyer":buyer,"seller":seller,"amount":amount,"currency":currency,
+//			"comment":comment,"state":state,"created_at":created_at,"updated_at":updated_at}
+//		---
+//		state - "funded", "disputed", "released" (paid to the seller), "refunded" (returned to the buyer)
+//			or "split" (shared between them by an administrator)
+//		---
+//		If successful:
+//			status = 0, deal_id > 0
+//		If data is not a valid:
+//			status = 1, deal_id = 0
+//		If user ID does not exist:
+//			status = 2, deal_id = 0
+//		If insufficient funds:
+//			status = 3, deal_id = 0
+//		If server error:
+//			status = 4, deal_id = 0
+//		If the account of the buyer is frozen or one of the accounts is closed:
+//			status = 7 or 8, deal_id = 0
+//		If the amount exceeds a transfer limit of the buyer:
+//			status = 10, deal_id = 0, remaining - amount the buyer could still transfer
+func CreateDealHandler(CreateDeal func(apimethods.Deal) (apimethods.Deal, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestDeal
+		var response	ResponseDeal
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		switch {
+		case err != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseDeal{ Status: 1 }
+		default:
+			d, err := CreateDeal(apimethods.Deal{
+				Buyer:		request.Buyer,
+				Seller:		request.Seller,
+				Amount:		request.Amount,
+				Currency:	request.Currency,
+				Comment:	request.Comment,
+			})
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseDeal{ Status: status, Remaining: limitRemaining(err) }
+				break
+			}
+			response = dealResponse(d)
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// GetDealHandler method:
+// 1. Input data:
+//		GET /escrow/deals/{id}
+// 2. Output:
+//		Content-Type: application/json
+//		response body: as of CreateDealHandler with the history of the deal, the oldest change first:
+//			"history":[{"state":state,"actor":actor,"reason":reason,"to_seller":to_seller,"to_buyer":to_buyer,
+//				"seller_transaction_id":seller_transaction_id,"buyer_transaction_id":buyer_transaction_id,"created_at":created_at},...]
+//		---
+//		actor - "buyer", "seller" or "admin"
+//		to_seller, to_buyer - money paid out of escrow by the change
+//		seller_transaction_id, buyer_transaction_id - transactions of the change with the seller and the buyer, 0 if none
+//		---
+//		If successful:
+//			status = 0, deal_id > 0
+//		If data is not a valid:
+//			status = 1, deal_id = 0
+//		If the deal does not exist:
+//			status = 2, deal_id = 0
+//		If server error:
+//			status = 4, deal_id = 0
+func GetDealHandler(GetDeal func(int64) (apimethods.Deal, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			id = 0
+		}
+
+		d, err := GetDeal(id)
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		w.WriteHeader(code)
+		if status != 0 {
+			render.JSON(w, r, ResponseDeal{ Status: status })
+			return
+		}
+		render.JSON(w, r, dealResponse(d))
+	}
+}
+
+// DealActionHandler method:
+// 1. Input data:
+//		POST /escrow/deals/{id}/release
+//		POST /escrow/deals/{id}/refund
+//		POST /escrow/deals/{id}/dispute
+//		Content-Type: application/json
+//		request body: {"id":id,"reason":reason}
+//		---
+//		id - user id of the party: the buyer releases the deal to the seller, the seller refunds it
+//			to the buyer, either of them disputes it. A disputed deal can still be released by the buyer
+//			or refunded by the seller.
+//		The same handler serves all actions, Action is the method of the action.
+// 2. Output:
+//		Content-Type: application/json
+//		response body: as of CreateDealHandler
+//		---
+//		If successful:
+//			status = 0, deal_id > 0
+//		If data is not a valid:
+//			status = 1, deal_id = 0
+//		If the deal does not exist or the user can not take the action:
+//			status = 2, deal_id = 0
+//		If server error:
+//			status = 4, deal_id = 0
+//		If the account receiving the money is closed:
+//			status = 8, deal_id = 0
+//		If the deal can not take the action in its state:
+//			status = 17, deal_id = 0
+func DealActionHandler(Action func(int64, int, string) (apimethods.Deal, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestDealAction
+		var response	ResponseDeal
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		id, errID := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+
+		switch {
+		case err != nil || errID != nil || p != "application/json" || request.ID <= 0:
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseDeal{ Status: 1 }
+		default:
+			d, err := Action(id, request.ID, request.Reason)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseDeal{ Status: status, Remaining: limitRemaining(err) }
+				break
+			}
+			response = dealResponse(d)
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// ResolveDealHandler method:
+// 1. Input data:
+//		POST /admin/escrow/deals/{id}/resolve
+//		Content-Type: application/json
+//		request body: {"to_seller":to_seller,"reason":reason}
+//		---
+//		to_seller - part of the amount paid to the seller, the rest is returned to the buyer,
+//			0 <= to_seller <= amount
+//		reason - decision on the dispute, saved to the history
+// 2. Output:
+//		Content-Type: application/json
+//		response body: as of CreateDealHandler
+//		---
+//		The deal becomes "released" if the buyer gets nothing, "refunded" if the seller gets nothing
+//		and "split" otherwise.
+//		---
+//		If successful:
+//			status = 0, deal_id > 0
+//		If data is not a valid:
+//			status = 1, deal_id = 0
+//		If the deal does not exist:
+//			status = 2, deal_id = 0
+//		If server error:
+//			status = 4, deal_id = 0
+//		If an account receiving the money is closed:
+//			status = 8, deal_id = 0
+//		If the deal is not disputed:
+//			status = 17, deal_id = 0
+func ResolveDealHandler(ResolveDeal func(int64, float64, string) (apimethods.Deal, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestResolveDeal
+		var response	ResponseDeal
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		id, errID := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+
+		switch {
+		case err != nil || errID != nil || p != "application/json" || request.ToSeller == nil:
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseDeal{ Status: 1 }
+		default:
+			d, err := ResolveDeal(id, *request.ToSeller, request.Reason)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseDeal{ Status: status, Remaining: limitRemaining(err) }
+				break
+			}
+			response = dealResponse(d)
+		}
+		render.JSON(w, r, response)
+	}
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"app/pkg/events"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// heartbeatInterval is how often a comment is sent to keep an idle stream open
+const heartbeatInterval = 15 * time.Second
+
+// AccountEventsHandler method:
+// 1. Input data:
+//		GET /accounts/{id}/events
+//		---
+//		id - user id
+//		id > 0
+// 2. Output:
+//		Content-Type: text/event-stream
+//		event: balance_changed
+//		id: transaction_id
+//		data: {"account_id":id,"balance":balance,"currency":currency,"transaction_id":transaction_id,"type":type}
+//		---
+//		type - type of the transaction which changed the balance (refill, withdraw, transfer)
+//		The stream stays open until the client disconnects or the server shuts down.
+//		---
+//		If data is not a valid:
+//			Content-Type: application/json, {"status":1,"id":0,"balance":0.00}
+//		If user ID does not exist:
+//			Content-Type: application/json, {"status":2,"id":0,"balance":0.00}
+//		If server error:
+//			Content-Type: application/json, {"status":4,"id":0,"balance":0.00}
+func AccountEventsHandler(GetBalance func(int) (int, float64, error), Subscribe func(int) (<-chan events.Event, func())) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			id = 0
+		}
+
+		_, _, err = GetBalance(id)
+
+		flusher, ok := w.(http.Flusher)
+		if err == nil && !ok {
+			err = fmt.Errorf("streaming is not supported by %T", w)
+		}
+
+		if err != nil {
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			render.JSON(w, r, ResponseToUser{ Status: status, ID: 0, Balance: 0.00 })
+			return
+		}
+
+		ch, unsubscribe := Subscribe(id)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+			case e, ok := <-ch:
+				// The broker is closed when the server shuts down
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(e)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				fmt.Fprintf(w, "event: balance_changed\nid: %d\ndata: %s\n\n", e.TransactionID, data)
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+type RequestExchange struct {
+	ID			int		`json:"id"`
+	From		string	`json:"from"`
+	To			string	`json:"to"`
+	Sum			float64	`json:"sum"`
+}
+
+type RequestConfirmExchange struct {
+	ID			int		`json:"id"`
+}
+
+type ResponseExchange struct {
+	Status			int			`json:"status"`
+	QuoteID			string		`json:"quote_id"`
+	ID				int			`json:"id"`
+	From			string		`json:"from"`
+	To				string		`json:"to"`
+	Sum				float64		`json:"sum"`
+	Rate			float64		`json:"rate"`
+	Amount			float64		`json:"amount"`
+	ExpiresAt		*time.Time	`json:"expires_at,omitempty"`
+	FromBalance		*float64	`json:"from_balance,omitempty"`
+	ToBalance		*float64	`json:"to_balance,omitempty"`
+}
+
+// exchangeResponse converts the quote to the response
+func exchangeResponse(q apimethods.ExchangeQuote) ResponseExchange {
+	return ResponseExchange{
+		Status:		0,
+		QuoteID:	q.ID,
+		ID:			q.UserID,
+		From:		q.From,
+		To:			q.To,
+		Sum:		math.Round(q.Sum * 100) / 100,
+		Rate:		q.Rate,
+		Amount:		math.Round(q.Amount * 100) / 100,
+	}
+}
+
+// QuoteExchangeHandler method:
+// 1. Input data:
+//		POST /exchange
+//		Content-Type: application/json
+//		request body: {"id":id,"from":from,"to":to,"sum":sum}
+//		---
+//		id - user id
+//		from, to - currencies of the user's wallets, from != to
+//		sum - amount of money in "from" to exchange, sum > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"quote_id":quote_id,"id":id,"from":from,"to":to,"sum":sum,"rate":rate,"amount":amount,"expires_at":expires_at}
+//		---
+//		quote_id - id of the quote to confirm
+//		rate - rate of the exchange, amount of "to" for one unit of "from"
+//		amount - amount of money in "to" the user gets
+//		expires_at - the quote can not be confirmed after this time
+//		---
+//		If successful:
+//			status = 0
+//		If data is not a valid:
+//			status = 1
+//		If user ID does not exist:
+//			status = 2
+//		If server error:
+//			status = 4
+//		If the rate is not available:
+//			status = 13
+func QuoteExchangeHandler(QuoteExchange func(int, string, string, float64) (apimethods.ExchangeQuote, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestExchange
+		var response	ResponseExchange
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		switch {
+		case err != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseExchange{ Status: 1 }
+		default:
+			quote, err := QuoteExchange(request.ID, request.From, request.To, request.Sum)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseExchange{ Status: status }
+				break
+			}
+			response = exchangeResponse(quote)
+			response.ExpiresAt = &quote.ExpiresAt
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// ConfirmExchangeHandler method:
+// 1. Input data:
+//		POST /exchange/{quote_id}/confirm
+//		Content-Type: application/json
+//		request body: {"id":id}
+//		---
+//		quote_id - id of the quote
+//		id - user id the quote was given to
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"quote_id":quote_id,"id":id,"from":from,"to":to,"sum":sum,"rate":rate,"amount":amount,"from_balance":from_balance,"to_balance":to_balance}
+//		---
+//		from_balance, to_balance - balances of the user's wallets after the exchange
+//		---
+//		If successful:
+//			status = 0
+//		If data is not a valid:
+//			status = 1
+//		If the quote of the user does not exist:
+//			status = 2
+//		If insufficient funds:
+//			status = 3
+//		If server error:
+//			status = 4
+//		If the account is frozen or closed:
+//			status = 7 or status = 8
+//		If the quote is expired or already confirmed:
+//			status = 12
+func ConfirmExchangeHandler(ConfirmExchange func(int, string) (apimethods.Exchange, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestConfirmExchange
+		var response	ResponseExchange
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		switch {
+		case err != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseExchange{ Status: 1 }
+		default:
+			ex, err := ConfirmExchange(request.ID, chi.URLParam(r, "quote_id"))
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseExchange{ Status: status }
+				break
+			}
+			fromBalance := math.Round(ex.FromBalance * 100) / 100
+			toBalance := math.Round(ex.ToBalance * 100) / 100
+
+			response = exchangeResponse(ex.Quote)
+			response.FromBalance = &fromBalance
+			response.ToBalance = &toBalance
+		}
+		render.JSON(w, r, response)
+	}
+}
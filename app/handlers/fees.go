@@ -0,0 +1,138 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"github.com/go-chi/render"
+	"log"
+	"math"
+	"net/http"
+)
+
+type RequestFeeRule struct {
+	Currency		string	`json:"currency"`
+	Fixed			float64	`json:"fixed"`
+	Percent			float64	`json:"percent"`
+	MinFee			float64	`json:"min_fee"`
+	MaxFee			float64	`json:"max_fee"`
+	FreePerMonth	int		`json:"free_per_month"`
+}
+
+type ResponseQuote struct {
+	Status		int		`json:"status"`
+	Sum			float64	`json:"sum"`
+	Fee			float64	`json:"fee"`
+	Total		float64	`json:"total"`
+	Currency	string	`json:"currency"`
+}
+
+// QuoteTransferHandler method:
+// 1. Input data:
+//		POST /transfers:quote
+//		Content-Type: application/json
+//		request body: {"from":from,"to":to,"sum":sum,"currency":currency}
+//		---
+//		currency - currency of the transfer, RUB if not set
+//		from > 0, to > 0, sum > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"sum":sum,"fee":fee,"total":total,"currency":currency}
+//		---
+//		fee - fee the transfer would cost "from" now
+//		total - sum + fee, the amount debited from "from"
+//		---
+//		If successful:
+//			status = 0
+//		If data is not a valid:
+//			status = 1, sum = 0.00, fee = 0.00, total = 0.00
+//		If user ID does not exist:
+//			status = 2, sum = 0.00, fee = 0.00, total = 0.00
+//		If server error:
+//			status = 4, sum = 0.00, fee = 0.00, total = 0.00
+func QuoteTransferHandler(QuoteTransfer func(int, int, string, float64) (apimethods.Quote, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestTransfer
+		var response	ResponseQuote
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		switch {
+		case err != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseQuote{ Status: 1 }
+		default:
+			quote, err := QuoteTransfer(request.From, request.To, request.Currency, request.Sum)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseQuote{ Status: status }
+				break
+			}
+			response = ResponseQuote{
+				Status:		0,
+				Sum:		math.Round(quote.Sum * 100) / 100,
+				Fee:		math.Round(quote.Fee * 100) / 100,
+				Total:		math.Round(quote.Total * 100) / 100,
+				Currency:	quote.Currency,
+			}
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// SetFeeRuleHandler method:
+// 1. Input data:
+//		PUT /admin/fees
+//		Content-Type: application/json
+//		request body: {"currency":currency,"fixed":fixed,"percent":percent,"min_fee":min_fee,"max_fee":max_fee,"free_per_month":free_per_month}
+//		---
+//		currency - currency of transfers the rule applies to, "RUB" if empty
+//		fee = fixed + sum * percent / 100, but min_fee <= fee <= max_fee (max_fee = 0 - no upper cap)
+//		free_per_month - number of free transfers of every user in a calendar month
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":0,"balance":0.00}
+//		---
+//		If successful:
+//			status = 0
+//		If data is not a valid:
+//			status = 1
+//		If server error:
+//			status = 4
+func SetFeeRuleHandler(SetFeeRule func(apimethods.FeeRule) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestFeeRule
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		if err != nil || p != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			render.JSON(w, r, ResponseToUser{ Status: 1, ID: 0, Balance: 0.00 })
+			return
+		}
+
+		err = SetFeeRule(apimethods.FeeRule{
+			Currency:		request.Currency,
+			Fixed:			request.Fixed,
+			Percent:		request.Percent,
+			MinFee:			request.MinFee,
+			MaxFee:			request.MaxFee,
+			FreePerMonth:	request.FreePerMonth,
+		})
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		w.WriteHeader(code)
+		render.JSON(w, r, ResponseToUser{ Status: status, ID: 0, Balance: 0.00 })
+	}
+}
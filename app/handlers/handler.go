@@ -8,51 +8,79 @@ import (
 	"log"
 	"math"
 	"net/http"
+	"time"
 )
 
 type RequestGetBalance struct {
 	ID			int		`json:"id"`
+	Currency	string	`json:"currency"`
 }
 
 type RequestRefillWithdraw struct {
 	ID			int		`json:"id"`
 	Sum			float64	`json:"sum"`
+	Currency	string	`json:"currency"`
+	Member		int		`json:"member"`
 }
 
 type RequestTransfer struct {
 	From		int		`json:"from"`
 	To			int		`json:"to"`
 	Sum			float64	`json:"sum"`
+	Currency	string	`json:"currency"`
+	ToCurrency	string	`json:"to_currency"`
+	Pending		bool	`json:"pending"`
+	Member		int		`json:"member"`
 }
 
-type ResponseToUser struct {
-	Status		int		`json:"status"`
-	ID			int		`json:"id"`
+type ResponseWallet struct {
+	Currency	string	`json:"currency"`
 	Balance		float64	`json:"balance"`
+	Held		float64	`json:"held,omitempty"`
+}
+
+type ResponseToUser struct {
+	Status		int					`json:"status"`
+	ID			int					`json:"id"`
+	Balance		float64				`json:"balance"`
+	Held		float64				`json:"held,omitempty"`
+	Currency	string				`json:"currency,omitempty"`
+	Bonus		*float64			`json:"bonus,omitempty"`
+	Wallets		[]ResponseWallet	`json:"wallets,omitempty"`
+	Remaining	*float64			`json:"remaining,omitempty"`
 }
 
 type ResponseTransfer struct {
-	Status		int		`json:"status"`
-	FromID		int		`json:"from_id"`
-	FromBalance	float64	`json:"from_balance"`
-	ToID		int		`json:"to_id"`
-	ToBalance	float64	`json:"to_balance"`
+	Status		int			`json:"status"`
+	FromID		int			`json:"from_id"`
+	FromBalance	float64		`json:"from_balance"`
+	ToID		int			`json:"to_id"`
+	ToBalance	float64		`json:"to_balance"`
+	Remaining	*float64	`json:"remaining,omitempty"`
 }
 
 // GetBalanceHandler method:
 // 1. Input data:
 //		Content-Type: application/json
-//		request body: {"id":id}
+//		request body: {"id":id,"currency":currency}
 //		---
 //		id - user id
+//		currency - currency of the wallet, optional
 //		id > 0
+//		---
+//		GET /balance?currency=currency&as_of=as_of
+//		The balance in RUB is converted to the currency of the query (see ConvertedBalance),
+//		the currency of the request body is ignored.
 // 2. Output:
 //		Content-Type: application/json
-//		response body: {"status":status,"id":id,"balance":balance}
+//		response body: {"status":status,"id":id,"balance":balance,"held":held,"currency":currency,"bonus":bonus,"wallets":[{"currency":currency,"balance":balance,"held":held},...]}
 //		---
 //		status - response status
 //		id - user id
-//		balance - user balance
+//		balance - user balance in the currency, in RUB if the currency is not set
+//		held - part of the balance held by pending transfers, omitted if zero
+//		bonus - bonus balance which can be spent only on services, only for RUB
+//		wallets - all wallets of the user, only if the currency is not set
 //		---
 //		If successful:
 //			status = 0, id > 0, balance >= 0.00
@@ -62,7 +90,7 @@ type ResponseTransfer struct {
 //			status = 2, id = 0, balance = 0.00
 //		If server error:
 //			status = 3, id = 0, balance = 0.00
-func GetBalanceHandler(GetBalance func(int) (int, float64, error)) func(w http.ResponseWriter, r *http.Request) {
+func GetBalanceHandler(GetWallets func(int, string) ([]apimethods.Wallet, error), ConvertBalance func(int, string, time.Time) (apimethods.Conversion, error)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var request		RequestGetBalance
 		var response	ResponseToUser
@@ -76,13 +104,27 @@ func GetBalanceHandler(GetBalance func(int) (int, float64, error)) func(w http.R
 		case err != nil || p != "application/json":
 			w.WriteHeader(http.StatusBadRequest)
 			response = ResponseToUser{ Status: 1, ID: 0, Balance: 0.00 }
+		case r.URL.Query().Get("currency") != "":
+			ConvertedBalance(w, r, request.ID, ConvertBalance)
+			return
 		default:
-			uid, ub, err := GetBalance(request.ID)
+			wallets, err := GetWallets(request.ID, request.Currency)
 			switch {
 			case err == nil:
-				ub = math.Round(ub * 100) / 100
+				items := make([]ResponseWallet, 0, len(wallets))
+				for _, wallet := range wallets {
+					items = append(items, ResponseWallet{ Currency: wallet.Currency, Balance: money(wallet.Balance), Held: money(wallet.Held) })
+				}
 				w.WriteHeader(http.StatusOK)
-				response = ResponseToUser{ Status: 0, ID: uid, Balance: ub }
+				// The first wallet is the requested one or the wallet in RUB
+				response = ResponseToUser{ Status: 0, ID: request.ID, Balance: items[0].Balance, Held: items[0].Held, Currency: items[0].Currency }
+				if items[0].Currency == apimethods.BaseCurrency {
+					bonus := math.Round(wallets[0].Bonus * 100) / 100
+					response.Bonus = &bonus
+				}
+				if request.Currency == "" {
+					response.Wallets = items
+				}
 			case errors.Is(err, apimethods.WrongData):
 				w.WriteHeader(http.StatusBadRequest)
 				response = ResponseToUser{ Status: 1, ID: 0, Balance: 0.00 }
@@ -102,10 +144,13 @@ func GetBalanceHandler(GetBalance func(int) (int, float64, error)) func(w http.R
 // RefillAndWithdrawHandler method:
 // 1. Input data:
 //		Content-Type: application/json
-//		request body: {"id":id,"sum":sum}
+//		request body: {"id":id,"sum":sum,"currency":currency,"member":member}
 //		---
 //		id - user id
 //		sum - amount of money to refill or withdraw
+//		currency - currency of the wallet, RUB if not set
+//		member - user id of the member of the shared account id who withdraws the money, required to withdraw
+//			from a shared account, recorded on the transaction
 //		id > 0, sum != 0
 // 2. Output:
 //		Content-Type: application/json
@@ -125,7 +170,15 @@ func GetBalanceHandler(GetBalance func(int) (int, float64, error)) func(w http.R
 //			status = 4, id = 0, balance = 0.00
 //		If server error:
 //			status = 3, id = 0, balance = 0.00
-func RefillAndWithdrawHandler(RefillAndWithdrawMoney func(int, float64) (int, float64, error)) func(w http.ResponseWriter, r *http.Request) {
+//		If the account is frozen (withdraw only):
+//			status = 7, id = 0, balance = 0.00
+//		If the account is closed:
+//			status = 8, id = 0, balance = 0.00
+//		If the withdrawal exceeds a spending limit or the limit of the member:
+//			status = 10, id = 0, balance = 0.00, remaining - amount the user can still withdraw
+//		If the member can not withdraw from the account:
+//			status = 18, id = 0, balance = 0.00
+func RefillAndWithdrawHandler(RefillAndWithdrawMember func(int, int, string, float64) (int, float64, error)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var request		RequestRefillWithdraw
 		var response	ResponseToUser
@@ -140,7 +193,7 @@ func RefillAndWithdrawHandler(RefillAndWithdrawMoney func(int, float64) (int, fl
 			w.WriteHeader(http.StatusBadRequest)
 			response = ResponseToUser{ Status: 1, ID: 0, Balance: 0.00 }
 		default:
-			uid, ub, err := RefillAndWithdrawMoney(request.ID, request.Sum)
+			uid, ub, err := RefillAndWithdrawMember(request.ID, request.Member, request.Currency, request.Sum)
 			switch {
 			case err == nil:
 				ub = math.Round(ub * 100) / 100
@@ -155,6 +208,18 @@ func RefillAndWithdrawHandler(RefillAndWithdrawMoney func(int, float64) (int, fl
 			case errors.Is(err, apimethods.InsufficientFunds):
 				w.WriteHeader(http.StatusBadRequest)
 				response = ResponseToUser{ Status: 3, ID: 0, Balance: 0.00 }
+			case errors.Is(err, apimethods.AccountFrozen):
+				w.WriteHeader(http.StatusBadRequest)
+				response = ResponseToUser{ Status: 7, ID: 0, Balance: 0.00 }
+			case errors.Is(err, apimethods.AccountClosed):
+				w.WriteHeader(http.StatusBadRequest)
+				response = ResponseToUser{ Status: 8, ID: 0, Balance: 0.00 }
+			case errors.Is(err, apimethods.LimitExceeded):
+				w.WriteHeader(http.StatusBadRequest)
+				response = ResponseToUser{ Status: 10, ID: 0, Balance: 0.00, Remaining: limitRemaining(err) }
+			case errors.Is(err, apimethods.MemberForbidden):
+				w.WriteHeader(http.StatusBadRequest)
+				response = ResponseToUser{ Status: 18, ID: 0, Balance: 0.00 }
 			default:
 				w.WriteHeader(http.StatusInternalServerError)
 				response = ResponseToUser{ Status: 4, ID: 0, Balance: 0.00 }
@@ -168,11 +233,17 @@ func RefillAndWithdrawHandler(RefillAndWithdrawMoney func(int, float64) (int, fl
 // TransferHandler method:
 // 1. Input data:
 //		Content-Type: application/json
-//		request body: {"from":from,"to":to,"sum":sum}
+//		request body: {"from":from,"to":to,"sum":sum,"currency":currency,"to_currency":to_currency,"pending":pending,"member":member}
 //		---
 //		from - user id who transfer money
 //		to - user id to whom money is transferred
 //		sum - amount of money to transfer
+//		currency - currency of the wallets, RUB if not set
+//		to_currency - currency the recipient expects, it must be equal to currency if set
+//		pending - if true, the money is held until the recipient accepts the transfer (see PendingTransfer),
+//			shared accounts can not make pending transfers
+//		member - user id of the member of the shared account "from" who transfers the money, required to transfer
+//			from a shared account, recorded on the transaction
 //		from > 0, to > 0, sum > 0
 // 2. Output
 //		Content-Type: application/json
@@ -192,7 +263,17 @@ func RefillAndWithdrawHandler(RefillAndWithdrawMoney func(int, float64) (int, fl
 //			status = 4, id = 0, balance = 0.00
 //		If server error:
 //			status = 3, id = 0, balance = 0.00
-func TransferHandler(TransferMoney func(int, int, float64)(int, float64, int, float64, error)) func(w http.ResponseWriter, r *http.Request) {
+//		If the account of "from" is frozen:
+//			status = 7, id = 0, balance = 0.00
+//		If one of the accounts is closed:
+//			status = 8, id = 0, balance = 0.00
+//		If the transfer exceeds a spending limit of "from" or the limit of the member:
+//			status = 10, id = 0, balance = 0.00, remaining - amount "from" can still transfer
+//		If to_currency differs from currency:
+//			status = 11, id = 0, balance = 0.00
+//		If the member can not transfer from the account:
+//			status = 18, id = 0, balance = 0.00
+func TransferHandler(TransferMember func(int, int, int, string, string, float64)(int, float64, int, float64, error), HoldTransfer func(int, int, string, string, float64) (apimethods.PendingTransfer, error)) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var request		RequestTransfer
 		var response	ResponseTransfer
@@ -206,8 +287,11 @@ func TransferHandler(TransferMoney func(int, int, float64)(int, float64, int, fl
 		case err != nil || p != "application/json":
 			w.WriteHeader(http.StatusBadRequest)
 			response = ResponseTransfer{ Status: 1, FromID: 0, FromBalance: 0.00, ToID: 0, ToBalance: 0.00 }
+		case request.Pending:
+			PendingTransfer(w, r, request, HoldTransfer)
+			return
 		default:
-			from_id, from_balance, to_id, to_balance, err := TransferMoney(request.From, request.To, request.Sum)
+			from_id, from_balance, to_id, to_balance, err := TransferMember(request.From, request.Member, request.To, request.Currency, request.ToCurrency, request.Sum)
 			switch {
 			case err == nil:
 				from_balance = math.Round(from_balance * 100) / 100
@@ -223,6 +307,21 @@ func TransferHandler(TransferMoney func(int, int, float64)(int, float64, int, fl
 			case errors.Is(err, apimethods.InsufficientFunds):
 				w.WriteHeader(http.StatusBadRequest)
 				response = ResponseTransfer{ Status: 3, FromID: 0, FromBalance: 0.00, ToID: 0, ToBalance: 0.00 }
+			case errors.Is(err, apimethods.AccountFrozen):
+				w.WriteHeader(http.StatusBadRequest)
+				response = ResponseTransfer{ Status: 7, FromID: 0, FromBalance: 0.00, ToID: 0, ToBalance: 0.00 }
+			case errors.Is(err, apimethods.AccountClosed):
+				w.WriteHeader(http.StatusBadRequest)
+				response = ResponseTransfer{ Status: 8, FromID: 0, FromBalance: 0.00, ToID: 0, ToBalance: 0.00 }
+			case errors.Is(err, apimethods.LimitExceeded):
+				w.WriteHeader(http.StatusBadRequest)
+				response = ResponseTransfer{ Status: 10, FromID: 0, FromBalance: 0.00, ToID: 0, ToBalance: 0.00, Remaining: limitRemaining(err) }
+			case errors.Is(err, apimethods.CurrencyMismatch):
+				w.WriteHeader(http.StatusBadRequest)
+				response = ResponseTransfer{ Status: 11, FromID: 0, FromBalance: 0.00, ToID: 0, ToBalance: 0.00 }
+			case errors.Is(err, apimethods.MemberForbidden):
+				w.WriteHeader(http.StatusBadRequest)
+				response = ResponseTransfer{ Status: 18, FromID: 0, FromBalance: 0.00, ToID: 0, ToBalance: 0.00 }
 			default:
 				w.WriteHeader(http.StatusInternalServerError)
 				response = ResponseTransfer{ Status: 4, FromID: 0, FromBalance: 0.00, ToID: 0, ToBalance: 0.00 }
@@ -0,0 +1,353 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type RequestSubAccount struct {
+	DrawLimit	float64	`json:"draw_limit"`
+	DrawPeriod	string	`json:"draw_period"`
+}
+
+type RequestAllocate struct {
+	To			int		`json:"to"`
+	Sum			float64	`json:"sum"`
+	Currency	string	`json:"currency"`
+}
+
+type RequestDraw struct {
+	Sum			float64	`json:"sum"`
+}
+
+type ResponseAllocation struct {
+	Status			int			`json:"status"`
+	ParentID		int			`json:"parent_id"`
+	ParentBalance	float64		`json:"parent_balance"`
+	ChildID			int			`json:"child_id"`
+	ChildBalance	float64		`json:"child_balance"`
+	Currency		string		`json:"currency"`
+	TransactionID	int64		`json:"transaction_id"`
+	Remaining		*float64	`json:"remaining,omitempty"`
+}
+
+type ResponseRollupNode struct {
+	ID			int		`json:"id"`
+	ParentID	int		`json:"parent_id"`
+	Depth		int		`json:"depth"`
+	Balance		float64	`json:"balance"`
+	Total		float64	`json:"total"`
+}
+
+type ResponseRollup struct {
+	Status		int						`json:"status"`
+	Currency	string					`json:"currency"`
+	Accounts	[]ResponseRollupNode	`json:"accounts"`
+}
+
+// allocationResponse converts the allocation to the response
+func allocationResponse(a apimethods.Allocation) ResponseAllocation {
+	return ResponseAllocation{
+		Status:			0,
+		ParentID:		a.Parent,
+		ParentBalance:	money(a.ParentBalance),
+		ChildID:		a.Child,
+		ChildBalance:	money(a.ChildBalance),
+		Currency:		a.Currency,
+		TransactionID:	a.TransactionID,
+	}
+}
+
+// CreateSubAccountHandler method:
+// 1. Input data:
+//		POST /accounts/{id}/sub-accounts
+//		Content-Type: application/json
+//		request body: {"draw_limit":draw_limit,"draw_period":draw_period}
+//		---
+//		id - user id of the parent account
+//		draw_limit, draw_period - the sub-account can draw draw_limit in RUB from the parent over the period:
+//			"single", "day", "week" or "month". Without a period the sub-account can not draw.
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id}
+//		---
+//		id - user id of the sub-account
+//		---
+//		If successful:
+//			status = 0, id > 0
+//		If data is not a valid:
+//			status = 1, id = 0
+//		If user ID does not exist:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+//		If the parent account is closed:
+//			status = 8, id = 0
+func CreateSubAccountHandler(CreateSubAccount func(int, float64, string) (int, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestSubAccount
+		var response	ResponseID
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		parent, errID := strconv.Atoi(chi.URLParam(r, "id"))
+
+		switch {
+		case err != nil || errID != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseID{ Status: 1 }
+		default:
+			id, err := CreateSubAccount(parent, request.DrawLimit, request.DrawPeriod)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			response = ResponseID{ Status: status, ID: int64(id) }
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// SetDrawLimitHandler method:
+// 1. Input data:
+//		PUT /accounts/{id}/sub-accounts/{child_id}
+//		Content-Type: application/json
+//		request body: {"draw_limit":draw_limit,"draw_period":draw_period}
+//		---
+//		id - user id of the parent account
+//		child_id - user id of the sub-account
+//		draw_limit, draw_period - as of CreateSubAccountHandler
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id}
+//		---
+//		id - child_id
+//		---
+//		If successful:
+//			status = 0, id > 0
+//		If data is not a valid:
+//			status = 1, id = 0
+//		If child_id is not a sub-account of id:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+func SetDrawLimitHandler(SetDrawLimit func(int, int, float64, string) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestSubAccount
+		var response	ResponseID
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		parent, errID := strconv.Atoi(chi.URLParam(r, "id"))
+		child, errChild := strconv.Atoi(chi.URLParam(r, "child_id"))
+
+		switch {
+		case err != nil || errID != nil || errChild != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseID{ Status: 1 }
+		default:
+			err = SetDrawLimit(parent, child, request.DrawLimit, request.DrawPeriod)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			if status != 0 {
+				child = 0
+			}
+			w.WriteHeader(code)
+			response = ResponseID{ Status: status, ID: int64(child) }
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// AllocateHandler method:
+// 1. Input data:
+//		POST /accounts/{id}/allocate
+//		Content-Type: application/json
+//		request body: {"to":to,"sum":sum,"currency":currency}
+//		---
+//		id - user id of the parent account
+//		to - user id of its sub-account
+//		sum - money moved to the sub-account, a negative sum takes the money back to the parent
+//		currency - currency of the wallets, RUB if not set
+//		Allocations are not charged and not limited.
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"parent_id":parent_id,"parent_balance":parent_balance,"child_id":child_id,
+//			"child_balance":child_balance,"currency":currency,"transaction_id":transaction_id}
+//		---
+//		If successful:
+//			status = 0, parent_id > 0
+//		If data is not a valid:
+//			status = 1, parent_id = 0
+//		If user ID does not exist or "to" is not a sub-account of id:
+//			status = 2, parent_id = 0
+//		If insufficient funds:
+//			status = 3, parent_id = 0
+//		If server error:
+//			status = 4, parent_id = 0
+//		If the paying account is frozen or one of the accounts is closed:
+//			status = 7 or 8, parent_id = 0
+func AllocateHandler(Allocate func(int, int, string, float64) (apimethods.Allocation, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestAllocate
+		var response	ResponseAllocation
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		parent, errID := strconv.Atoi(chi.URLParam(r, "id"))
+
+		switch {
+		case err != nil || errID != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseAllocation{ Status: 1 }
+		default:
+			a, err := Allocate(parent, request.To, request.Currency, request.Sum)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseAllocation{ Status: status }
+				break
+			}
+			response = allocationResponse(a)
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// DrawHandler method:
+// 1. Input data:
+//		POST /accounts/{id}/draw
+//		Content-Type: application/json
+//		request body: {"sum":sum}
+//		---
+//		id - user id of the sub-account
+//		sum - money in RUB moved from the parent account to the sub-account, sum > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: as of AllocateHandler
+//		---
+//		If successful:
+//			status = 0, parent_id > 0
+//		If data is not a valid:
+//			status = 1, parent_id = 0
+//		If user ID does not exist or it is not a sub-account:
+//			status = 2, parent_id = 0
+//		If the parent has insufficient funds:
+//			status = 3, parent_id = 0
+//		If server error:
+//			status = 4, parent_id = 0
+//		If the parent account is frozen or one of the accounts is closed:
+//			status = 7 or 8, parent_id = 0
+//		If the draw exceeds the draw limit of the sub-account:
+//			status = 10, parent_id = 0, remaining - amount the sub-account can still draw
+func DrawHandler(DrawFromParent func(int, float64) (apimethods.Allocation, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestDraw
+		var response	ResponseAllocation
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		child, errID := strconv.Atoi(chi.URLParam(r, "id"))
+
+		switch {
+		case err != nil || errID != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseAllocation{ Status: 1 }
+		default:
+			a, err := DrawFromParent(child, request.Sum)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseAllocation{ Status: status, Remaining: limitRemaining(err) }
+				break
+			}
+			response = allocationResponse(a)
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// RollupHandler method:
+// 1. Input data:
+//		GET /accounts/{id}/rollup?currency=currency
+//		---
+//		id - user id of the root of the tree, id > 0
+//		currency - currency of the wallets, RUB if not set
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"currency":currency,"accounts":[{"id":id,"parent_id":parent_id,"depth":depth,"balance":balance,"total":total},...]}
+//		---
+//		accounts - the root and all its sub-accounts, depth first: every account is followed by its subtree
+//		depth - 0 for the root
+//		balance - balance of the account, total - sum of the balances of its subtree including the account
+//		---
+//		If successful:
+//			status = 0
+//		If data is not a valid:
+//			status = 1, accounts = []
+//		If user ID does not exist:
+//			status = 2, accounts = []
+//		If server error:
+//			status = 4, accounts = []
+func RollupHandler(Rollup func(int, string) ([]apimethods.RollupNode, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var nodes []apimethods.RollupNode
+
+		w.Header().Set("Content-Type", "application/json")
+
+		currency := r.URL.Query().Get("currency")
+		if currency == "" {
+			currency = apimethods.BaseCurrency
+		}
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			err = apimethods.WrongData
+		} else {
+			nodes, err = Rollup(id, currency)
+		}
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+
+		response := ResponseRollup{ Status: status, Currency: currency, Accounts: []ResponseRollupNode{} }
+		for _, n := range nodes {
+			response.Accounts = append(response.Accounts, ResponseRollupNode{
+				ID:			n.ID,
+				ParentID:	n.ParentID,
+				Depth:		n.Depth,
+				Balance:	money(n.Balance),
+				Total:		money(n.Total),
+			})
+		}
+		w.WriteHeader(code)
+		render.JSON(w, r, response)
+	}
+}
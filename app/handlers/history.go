@@ -0,0 +1,86 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type ResponseBalanceAt struct {
+	Status		int			`json:"status"`
+	ID			int			`json:"id"`
+	Balance		float64		`json:"balance"`
+	Currency	string		`json:"currency"`
+	AsOf		time.Time	`json:"as_of"`
+}
+
+// BalanceAtHandler method:
+// 1. Input data:
+//		GET /accounts/{id}/balance?as_of=as_of&currency=currency
+//		---
+//		id - user id
+//		as_of - time in RFC 3339, optional, the current time by default
+//		currency - currency of the wallet, optional, RUB by default
+//		id > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id,"balance":balance,"currency":currency,"as_of":as_of}
+//		---
+//		balance - balance of the wallet at the moment as_of
+//		---
+//		If successful:
+//			status = 0, id > 0
+//		If data is not a valid:
+//			status = 1, id = 0, balance = 0.00
+//		If user ID does not exist:
+//			status = 2, id = 0, balance = 0.00
+//		If server error:
+//			status = 4, id = 0, balance = 0.00
+func BalanceAtHandler(BalanceAt func(int, string, time.Time) (float64, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			id = 0
+		}
+
+		asOf := time.Now()
+		if v := r.URL.Query().Get("as_of"); v != "" {
+			asOf, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				render.JSON(w, r, ResponseToUser{ Status: 1, ID: 0, Balance: 0.00 })
+				return
+			}
+		}
+
+		currency := r.URL.Query().Get("currency")
+		balance, err := BalanceAt(id, currency, asOf)
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		w.WriteHeader(code)
+		if status != 0 {
+			render.JSON(w, r, ResponseToUser{ Status: status, ID: 0, Balance: 0.00 })
+			return
+		}
+
+		if currency == "" {
+			currency = apimethods.BaseCurrency
+		}
+		render.JSON(w, r, ResponseBalanceAt{
+			Status:		0,
+			ID:			id,
+			Balance:	math.Round(balance * 100) / 100,
+			Currency:	currency,
+			AsOf:		asOf,
+		})
+	}
+}
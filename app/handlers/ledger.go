@@ -0,0 +1,80 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"github.com/go-chi/render"
+	"log"
+	"math"
+	"net/http"
+)
+
+type ResponseLedgerAccount struct {
+	Account		string	`json:"account"`
+	Currency	string	`json:"currency"`
+	Balance		float64	`json:"balance"`
+}
+
+type ResponseTrialBalance struct {
+	Status				int						`json:"status"`
+	Accounts			[]ResponseLedgerAccount	`json:"accounts"`
+	Total				float64					`json:"total"`
+	Totals				map[string]float64		`json:"totals"`
+	Balanced			bool					`json:"balanced"`
+	MismatchedWallets	int						`json:"mismatched_wallets"`
+}
+
+// TrialBalanceHandler method:
+// 1. Input data:
+//		GET /ledger/trial-balance
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"accounts":[{"account":account,"currency":currency,"balance":balance},...],
+//			"total":total,"totals":{currency:total,...},"balanced":balanced,"mismatched_wallets":mismatched_wallets}
+//		---
+//		accounts - sums of the journal entries of the system accounts per currency, user wallets are summed up as "users"
+//		total - sum of all journal entries
+//		totals - sums of the journal entries per currency
+//		balanced - true if the sum of every currency is 0.00
+//		mismatched_wallets - number of wallets whose balance differs from the sum of their entries
+//		---
+//		If successful:
+//			status = 0
+//		If server error:
+//			status = 4, accounts = []
+func TrialBalanceHandler(TrialBalance func() (apimethods.TrialBalance, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		tb, err := TrialBalance()
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			render.JSON(w, r, ResponseTrialBalance{ Status: 4, Accounts: []ResponseLedgerAccount{} })
+			return
+		}
+
+		response := ResponseTrialBalance{
+			Status:				0,
+			Accounts:			make([]ResponseLedgerAccount, 0, len(tb.Accounts)),
+			Total:				math.Round(tb.Total * 100) / 100,
+			Totals:				make(map[string]float64, len(tb.Totals)),
+			Balanced:			true,
+			MismatchedWallets:	tb.MismatchedWallets,
+		}
+		for _, account := range tb.Accounts {
+			response.Accounts = append(response.Accounts, ResponseLedgerAccount{
+				Account:	account.Account,
+				Currency:	account.Currency,
+				Balance:	math.Round(account.Balance * 100) / 100,
+			})
+		}
+		for currency, total := range tb.Totals {
+			response.Totals[currency] = math.Round(total * 100) / 100
+			if math.Round(total * 100) != 0 {
+				response.Balanced = false
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		render.JSON(w, r, response)
+	}
+}
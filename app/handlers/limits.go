@@ -0,0 +1,164 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+type RequestLimit struct {
+	Operation	string	`json:"operation"`
+	Period		string	`json:"period"`
+	Amount		float64	`json:"amount"`
+}
+
+type ResponseLimit struct {
+	Operation	string	`json:"operation"`
+	Period		string	`json:"period"`
+	Amount		float64	`json:"amount"`
+	Used		float64	`json:"used"`
+	Remaining	float64	`json:"remaining"`
+	Default		bool	`json:"default"`
+}
+
+type ResponseLimits struct {
+	Status		int				`json:"status"`
+	ID			int				`json:"id"`
+	Limits		[]ResponseLimit	`json:"limits"`
+}
+
+// limitRemaining returns the remaining allowance of the spending limit broken by err
+func limitRemaining(err error) *float64 {
+	var limitErr *apimethods.LimitError
+	if !errors.As(err, &limitErr) {
+		return nil
+	}
+	remaining := math.Round(limitErr.Remaining * 100) / 100
+	return &remaining
+}
+
+// GetLimitsHandler method:
+// 1. Input data:
+//		GET /accounts/{id}/limits
+//		---
+//		id - user id
+//		id > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id,"limits":[{"operation":operation,"period":period,"amount":amount,"used":used,"remaining":remaining,"default":default},...]}
+//		---
+//		operation - "withdraw" or "transfer"
+//		period - "single" (one operation), "day", "week" or "month" (rolling window of 24 hours, 7 and 30 days)
+//		used - amount spent on the operation over the period, always 0.00 for "single"
+//		default - false if the limit is set for this account
+//		---
+//		If successful:
+//			status = 0, id > 0
+//		If data is not a valid:
+//			status = 1, id = 0, limits = []
+//		If user ID does not exist:
+//			status = 2, id = 0, limits = []
+//		If server error:
+//			status = 4, id = 0, limits = []
+func GetLimitsHandler(GetLimits func(int) ([]apimethods.Limit, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			id = 0
+		}
+
+		limits, err := GetLimits(id)
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		w.WriteHeader(code)
+		if status != 0 {
+			render.JSON(w, r, ResponseLimits{ Status: status, ID: 0, Limits: []ResponseLimit{} })
+			return
+		}
+
+		items := make([]ResponseLimit, 0, len(limits))
+		for _, l := range limits {
+			items = append(items, ResponseLimit{
+				Operation:	l.Operation,
+				Period:		l.Period,
+				Amount:		math.Round(l.Amount * 100) / 100,
+				Used:		math.Round(l.Used * 100) / 100,
+				Remaining:	math.Round(l.Remaining * 100) / 100,
+				Default:	l.Default,
+			})
+		}
+		render.JSON(w, r, ResponseLimits{ Status: 0, ID: id, Limits: items })
+	}
+}
+
+// SetLimitHandler method:
+// 1. Input data:
+//		PUT /admin/accounts/{id}/limits
+//		PUT /admin/limits
+//		Content-Type: application/json
+//		request body: {"operation":operation,"period":period,"amount":amount}
+//		---
+//		id - user id, the default limit of all accounts is set without it
+//		operation - "withdraw" or "transfer"
+//		period - "single", "day", "week" or "month"
+//		amount >= 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id,"balance":0.00}
+//		---
+//		If successful:
+//			status = 0, id - user id or 0 for the default limit
+//		If data is not a valid:
+//			status = 1, id = 0
+//		If user ID does not exist:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+func SetLimitHandler(SetLimit func(int, string, string, float64) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestLimit
+		var response	ResponseToUser
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		id, errID := 0, error(nil)
+		if param := chi.URLParam(r, "id"); param != "" {
+			id, errID = strconv.Atoi(param)
+			if errID == nil && id <= 0 {
+				errID = apimethods.WrongData
+			}
+		}
+
+		switch {
+		case err != nil || errID != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseToUser{ Status: 1, ID: 0, Balance: 0.00 }
+		default:
+			err = SetLimit(id, request.Operation, request.Period, request.Amount)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseToUser{ Status: status, ID: 0, Balance: 0.00 }
+				break
+			}
+			response = ResponseToUser{ Status: 0, ID: id, Balance: 0.00 }
+		}
+		render.JSON(w, r, response)
+	}
+}
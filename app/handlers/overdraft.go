@@ -0,0 +1,136 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+type RequestCreditLimit struct {
+	CreditLimit	float64	`json:"credit_limit"`
+}
+
+type ResponseOverdraft struct {
+	Status		int		`json:"status"`
+	ID			int		`json:"id"`
+	CreditLimit	float64	`json:"credit_limit"`
+	Balance		float64	`json:"balance"`
+	Used		float64	`json:"used"`
+	Available	float64	`json:"available"`
+	Accrued		float64	`json:"accrued"`
+}
+
+// SetCreditLimitHandler method:
+// 1. Input data:
+//		PUT /admin/accounts/{id}/credit-limit
+//		Content-Type: application/json
+//		request body: {"credit_limit":credit_limit}
+//		---
+//		id - user id
+//		credit_limit - the balance in RUB can go below zero down to -credit_limit, credit_limit >= 0.
+//			A limit below the current overdraft only stops new spending.
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id}
+//		---
+//		If successful:
+//			status = 0, id > 0
+//		If data is not a valid:
+//			status = 1, id = 0
+//		If user ID does not exist:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+//		If the account is closed:
+//			status = 8, id = 0
+func SetCreditLimitHandler(SetCreditLimit func(int, float64) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestCreditLimit
+		var response	ResponseID
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		id, errID := strconv.Atoi(chi.URLParam(r, "id"))
+
+		switch {
+		case err != nil || errID != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseID{ Status: 1 }
+		default:
+			err = SetCreditLimit(id, request.CreditLimit)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			if status != 0 {
+				id = 0
+			}
+			w.WriteHeader(code)
+			response = ResponseID{ Status: status, ID: int64(id) }
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// OverdraftHandler method:
+// 1. Input data:
+//		GET /accounts/{id}/overdraft
+//		---
+//		id - user id, id > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id,"credit_limit":credit_limit,"balance":balance,
+//			"used":used,"available":available,"accrued":accrued}
+//		---
+//		credit_limit - how far below zero the balance in RUB can go
+//		used - the overdraft: the part of the credit line spent, 0 for a positive balance
+//		available - money the user can spend: balance + credit_limit - money held by pending transfers
+//		accrued - interest and fees charged on the overdraft over all time
+//		---
+//		If successful:
+//			status = 0, id > 0
+//		If data is not a valid:
+//			status = 1, id = 0
+//		If user ID does not exist:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+func OverdraftHandler(GetOverdraft func(int) (apimethods.Overdraft, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var o apimethods.Overdraft
+
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			err = apimethods.WrongData
+		} else {
+			o, err = GetOverdraft(id)
+		}
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		w.WriteHeader(code)
+		if status != 0 {
+			render.JSON(w, r, ResponseOverdraft{ Status: status })
+			return
+		}
+		render.JSON(w, r, ResponseOverdraft{
+			Status:			0,
+			ID:				o.ID,
+			CreditLimit:	money(o.CreditLimit),
+			Balance:		money(o.Balance),
+			Used:			money(o.Used),
+			Available:		money(o.Available),
+			Accrued:		money(o.Accrued),
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type RequestResolveTransfer struct {
+	ID			int		`json:"id"`
+}
+
+type ResponsePendingTransfer struct {
+	Status		int			`json:"status"`
+	TransferID	int64		`json:"transfer_id"`
+	FromID		int			`json:"from_id"`
+	FromBalance	float64		`json:"from_balance"`
+	ToID		int			`json:"to_id"`
+	ToBalance	float64		`json:"to_balance"`
+	Sum			float64		`json:"sum"`
+	Fee			float64		`json:"fee"`
+	Currency	string		`json:"currency"`
+	State		string		`json:"state"`
+	CreatedAt	time.Time	`json:"created_at"`
+	ExpiresAt	time.Time	`json:"expires_at"`
+	Remaining	*float64	`json:"remaining,omitempty"`
+}
+
+type ResponsePendingTransfers struct {
+	Status		int							`json:"status"`
+	Transfers	[]ResponsePendingTransfer	`json:"transfers"`
+}
+
+// pendingTransferResponse converts the pending transfer to the response
+func pendingTransferResponse(p apimethods.PendingTransfer) ResponsePendingTransfer {
+	return ResponsePendingTransfer{
+		Status:			0,
+		TransferID:		p.ID,
+		FromID:			p.From,
+		FromBalance:	money(p.FromBalance),
+		ToID:			p.To,
+		ToBalance:		money(p.ToBalance),
+		Sum:			money(p.Sum),
+		Fee:			money(p.Fee),
+		Currency:		p.Currency,
+		State:			p.Status,
+		CreatedAt:		p.CreatedAt,
+		ExpiresAt:		p.ExpiresAt,
+	}
+}
+
+// PendingTransfer method:
+// 1. Input data:
+//		POST /transfer
+//		Content-Type: application/json
+//		request body: {"from":from,"to":to,"sum":sum,"currency":currency,"to_currency":to_currency,"pending":true}
+//		---
+//		sum and the transfer fee are held in the wallet of "from": they stay in the balance,
+//		but can not be spent until the recipient accepts or declines the transfer,
+//		the sender cancels it or it expires and the money goes back to the sender
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"transfer_id":transfer_id,"from_id":from_id,"from_balance":from_balance,"to_id":to_id,"to_balance":to_balance,
+//			"sum":sum,"fee":fee,"currency":currency,"state":"pending","created_at":created_at,"expires_at":expires_at}
+//		---
+//		If successful:
+//			status = 0, transfer_id > 0
+//		If data is not a valid:
+//			status = 1, transfer_id = 0
+//		If user ID does not exist:
+//			status = 2, transfer_id = 0
+//		If insufficient funds:
+//			status = 3, transfer_id = 0
+//		If server error:
+//			status = 4, transfer_id = 0
+//		If the account of "from" is frozen or one of the accounts is closed:
+//			status = 7 or 8, transfer_id = 0
+//		If the transfer exceeds a spending limit of "from":
+//			status = 10, transfer_id = 0, remaining - amount "from" can still transfer
+//		If to_currency differs from currency:
+//			status = 11, transfer_id = 0
+func PendingTransfer(w http.ResponseWriter, r *http.Request, request RequestTransfer, HoldTransfer func(int, int, string, string, float64) (apimethods.PendingTransfer, error)) {
+	p, err := HoldTransfer(request.From, request.To, request.Currency, request.ToCurrency, request.Sum)
+	code, status := errorStatus(err)
+	if status == 4 {
+		log.Println(err)
+	}
+	w.WriteHeader(code)
+	if status != 0 {
+		render.JSON(w, r, ResponsePendingTransfer{ Status: status, Remaining: limitRemaining(err) })
+		return
+	}
+	render.JSON(w, r, pendingTransferResponse(p))
+}
+
+// ResolveTransferHandler method:
+// 1. Input data:
+//		POST /pending-transfers/{id}/accept
+//		POST /pending-transfers/{id}/decline
+//		POST /pending-transfers/{id}/cancel
+//		Content-Type: application/json
+//		request body: {"id":id}
+//		---
+//		id - user id: the recipient accepts or declines the transfer, the sender cancels it
+//		The same handler serves the three actions, Resolve is the method of the action.
+// 2. Output:
+//		Content-Type: application/json
+//		response body: as of PendingTransfer, state is "accepted", "declined" or "cancelled"
+//		---
+//		from_balance, to_balance - balances after the action
+//		---
+//		If successful:
+//			status = 0, transfer_id > 0
+//		If data is not a valid:
+//			status = 1, transfer_id = 0
+//		If the transfer does not exist or the user can not resolve it:
+//			status = 2, transfer_id = 0
+//		If the transfer is accepted, but "from" no longer has the money:
+//			status = 3, transfer_id = 0
+//		If server error:
+//			status = 4, transfer_id = 0
+//		If the transfer is accepted, but one of the accounts is frozen or closed:
+//			status = 7 or 8, transfer_id = 0
+//		If the transfer is accepted, but exceeds a spending limit of "from":
+//			status = 10, transfer_id = 0, remaining - amount "from" can still transfer
+//		If the transfer is already accepted, declined, cancelled or expired:
+//			status = 15, transfer_id = 0
+func ResolveTransferHandler(Resolve func(int64, int) (apimethods.PendingTransfer, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestResolveTransfer
+		var response	ResponsePendingTransfer
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		id, errID := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+
+		switch {
+		case err != nil || errID != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponsePendingTransfer{ Status: 1 }
+		default:
+			transfer, err := Resolve(id, request.ID)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponsePendingTransfer{ Status: status, Remaining: limitRemaining(err) }
+				break
+			}
+			response = pendingTransferResponse(transfer)
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// ListPendingTransfersHandler method:
+// 1. Input data:
+//		GET /accounts/{id}/pending-transfers
+//		---
+//		id - user id, id > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"transfers":[...]}
+//		---
+//		transfers - pending transfers sent and received by the user, as of PendingTransfer
+//		---
+//		If successful:
+//			status = 0
+//		If data is not a valid:
+//			status = 1, transfers = []
+//		If user ID does not exist:
+//			status = 2, transfers = []
+//		If server error:
+//			status = 4, transfers = []
+func ListPendingTransfersHandler(ListPendingTransfers func(int) ([]apimethods.PendingTransfer, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			id = 0
+		}
+
+		transfers, err := ListPendingTransfers(id)
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+
+		response := ResponsePendingTransfers{ Status: status, Transfers: []ResponsePendingTransfer{} }
+		for _, p := range transfers {
+			response.Transfers = append(response.Transfers, pendingTransferResponse(p))
+		}
+		w.WriteHeader(code)
+		render.JSON(w, r, response)
+	}
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"github.com/go-chi/render"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+type ResponseConvertedBalance struct {
+	Status		int			`json:"status"`
+	ID			int			`json:"id"`
+	Balance		float64		`json:"balance"`
+	Currency	string		`json:"currency"`
+	Rate		float64		`json:"rate"`
+	RateAt		time.Time	`json:"rate_at"`
+	Stale		bool		`json:"stale"`
+}
+
+// ConvertedBalance method:
+// 1. Input data:
+//		GET /balance?currency=currency&as_of=as_of
+//		Content-Type: application/json
+//		request body: {"id":id}
+//		---
+//		currency - currency to convert the balance in RUB to
+//		as_of - time in RFC 3339, optional: the rate valid at this moment is used instead of the last one
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id,"balance":balance,"currency":currency,"rate":rate,"rate_at":rate_at,"stale":stale}
+//		---
+//		balance - balance in RUB converted to the currency
+//		rate - rate of the conversion, rate_at - time the rate was fetched
+//		stale - true if the rate is too old, e.g. the rates service has been down
+//		---
+//		If successful:
+//			status = 0
+//		If data is not a valid:
+//			status = 1, id = 0, balance = 0.00
+//		If user ID does not exist:
+//			status = 2, id = 0, balance = 0.00
+//		If server error:
+//			status = 4, id = 0, balance = 0.00
+//		If there is no rate for the currency at the time:
+//			status = 13, id = 0, balance = 0.00
+func ConvertedBalance(w http.ResponseWriter, r *http.Request, id int, ConvertBalance func(int, string, time.Time) (apimethods.Conversion, error)) {
+	var asOf time.Time
+	var err error
+
+	if v := r.URL.Query().Get("as_of"); v != "" {
+		asOf, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			render.JSON(w, r, ResponseToUser{ Status: 1, ID: 0, Balance: 0.00 })
+			return
+		}
+	}
+
+	c, err := ConvertBalance(id, r.URL.Query().Get("currency"), asOf)
+	code, status := errorStatus(err)
+	if status == 4 {
+		log.Println(err)
+	}
+	w.WriteHeader(code)
+	if status != 0 {
+		render.JSON(w, r, ResponseToUser{ Status: status, ID: 0, Balance: 0.00 })
+		return
+	}
+
+	render.JSON(w, r, ResponseConvertedBalance{
+		Status:		0,
+		ID:			c.ID,
+		Balance:	math.Round(c.Balance * 100) / 100,
+		Currency:	c.Currency,
+		Rate:		c.Rate,
+		RateAt:		c.RateAt,
+		Stale:		c.Stale,
+	})
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+type RequestRefund struct {
+	Sum			float64	`json:"sum"`
+	Reason		string	`json:"reason"`
+	Initiator	string	`json:"initiator"`
+	Force		bool	`json:"force"`
+}
+
+type ResponseRefund struct {
+	Status			int		`json:"status"`
+	TransactionID	int64	`json:"transaction_id"`
+	RefundOf		int64	`json:"refund_of"`
+	Sum				float64	`json:"sum"`
+	Fee				float64	`json:"fee,omitempty"`
+	FromID			int		`json:"from_id"`
+	FromBalance		float64	`json:"from_balance"`
+	ToID			int		`json:"to_id"`
+	ToBalance		float64	`json:"to_balance"`
+}
+
+// RefundHandler method:
+// 1. Input data:
+//		POST /transactions/{id}/refund
+//		Content-Type: application/json
+//		request body: {"sum":sum,"reason":reason,"initiator":initiator,"force":force}
+//		---
+//		id - id of the refill, withdrawal or transfer to refund
+//		sum - amount of money to refund, sum >= 0, sum = 0 refunds all that is left
+//		reason, initiator - not empty
+//		force - refund even if the payer does not have enough money,
+//			accepted only if allowForce is true (the admin route)
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"transaction_id":transaction_id,"refund_of":refund_of,"sum":sum,"fee":fee,
+//			"from_id":from_id,"from_balance":from_balance,"to_id":to_id,"to_balance":to_balance}
+//		---
+//		transaction_id - id of the refund
+//		fee - the fee of the transfer returned to the sender, only by the refund that completes the transfer
+//		from_id, from_balance - user who returns the money, 0 for refunded withdrawals
+//		to_id, to_balance - user who gets the money back, 0 for refunded refills
+//		---
+//		If successful:
+//			status = 0
+//		If data is not a valid:
+//			status = 1
+//		If the transaction or a user does not exist:
+//			status = 2
+//		If the payer has already spent the money:
+//			status = 3
+//		If server error:
+//			status = 4
+//		If the refund exceeds what is left of the transaction:
+//			status = 6
+func RefundHandler(RefundTransaction func(int64, float64, string, string, bool) (apimethods.Refund, error), allowForce bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestRefund
+		var response	ResponseRefund
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+		id, errID := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+
+		switch {
+		case err != nil || errID != nil || p != "application/json" || (request.Force && !allowForce):
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseRefund{ Status: 1 }
+		default:
+			refund, err := RefundTransaction(id, request.Sum, request.Reason, request.Initiator, request.Force)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseRefund{ Status: status }
+				break
+			}
+			response = ResponseRefund{
+				Status:			0,
+				TransactionID:	refund.TransactionID,
+				RefundOf:		refund.RefundOf,
+				Sum:			math.Round(refund.Sum * 100) / 100,
+				Fee:			math.Round(refund.Fee * 100) / 100,
+				FromID:			refund.FromID,
+				FromBalance:	math.Round(refund.FromBalance * 100) / 100,
+				ToID:			refund.ToID,
+				ToBalance:		math.Round(refund.ToBalance * 100) / 100,
+			}
+		}
+		render.JSON(w, r, response)
+	}
+}
@@ -0,0 +1,264 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRequestsPage is the page size of payment requests if the limit is not set
+const defaultRequestsPage = 20
+
+type RequestPaymentRequest struct {
+	Requester	int			`json:"requester"`
+	Payer		int			`json:"payer"`
+	Amount		float64		`json:"amount"`
+	Currency	string		`json:"currency"`
+	Comment		string		`json:"comment"`
+	ExpiresAt	time.Time	`json:"expires_at"`
+}
+
+type RequestResolvePaymentRequest struct {
+	ID			int		`json:"id"`
+}
+
+type ResponsePaymentRequest struct {
+	Status				int			`json:"status"`
+	RequestID			int64		`json:"request_id"`
+	Requester			int			`json:"requester"`
+	Payer				int			`json:"payer"`
+	Amount				float64		`json:"amount"`
+	Currency			string		`json:"currency"`
+	Comment				string		`json:"comment"`
+	State				string		`json:"state"`
+	CreatedAt			time.Time	`json:"created_at"`
+	ExpiresAt			time.Time	`json:"expires_at"`
+	TransactionID		int64		`json:"transaction_id"`
+	PayerBalance		*float64	`json:"payer_balance,omitempty"`
+	RequesterBalance	*float64	`json:"requester_balance,omitempty"`
+	Remaining			*float64	`json:"remaining,omitempty"`
+}
+
+type ResponsePaymentRequests struct {
+	Status		int							`json:"status"`
+	Requests	[]ResponsePaymentRequest	`json:"requests"`
+	NextCursor	int64						`json:"next_cursor"`
+}
+
+// paymentRequestResponse converts the payment request to the response
+func paymentRequestResponse(p apimethods.PaymentRequest) ResponsePaymentRequest {
+	return ResponsePaymentRequest{
+		Status:			0,
+		RequestID:		p.ID,
+		Requester:		p.Requester,
+		Payer:			p.Payer,
+		Amount:			money(p.Amount),
+		Currency:		p.Currency,
+		Comment:		p.Comment,
+		State:			p.Status,
+		CreatedAt:		p.CreatedAt,
+		ExpiresAt:		p.ExpiresAt,
+		TransactionID:	p.TransactionID,
+	}
+}
+
+// CreatePaymentRequestHandler method:
+// 1. Input data:
+//		POST /payment-requests
+//		Content-Type: application/json
+//		request body: {"requester":requester,"payer":payer,"amount":amount,"currency":currency,"comment":comment,"expires_at":expires_at}
+//		---
+//		requester - user id who requests the money
+//		payer - user id who is asked to pay
+//		currency - currency of the amount, RUB if not set
+//		expires_at - time in RFC 3339 after which the request can not be paid, in 7 days if not set
+//		requester > 0, payer > 0, amount > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"request_id":request_id,"requester":requester,"payer":payer,"amount":amount,"currency":currency,
+//			"comment":comment,"state":state,"created_at":created_at,"expires_at":expires_at,"transaction_id":transaction_id}
+//		---
+//		state - "pending", "paid", "declined" or "expired"
+//		transaction_id - transfer paying the request, 0 if it is not paid
+//		---
+//		If successful:
+//			status = 0, request_id > 0
+//		If data is not a valid:
+//			status = 1, request_id = 0
+//		If user ID does not exist:
+//			status = 2, request_id = 0
+//		If server error:
+//			status = 4, request_id = 0
+func CreatePaymentRequestHandler(CreatePaymentRequest func(apimethods.PaymentRequest) (apimethods.PaymentRequest, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestPaymentRequest
+		var response	ResponsePaymentRequest
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		switch {
+		case err != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponsePaymentRequest{ Status: 1 }
+		default:
+			saved, err := CreatePaymentRequest(apimethods.PaymentRequest{
+				Requester:	request.Requester,
+				Payer:		request.Payer,
+				Amount:		request.Amount,
+				Currency:	request.Currency,
+				Comment:	request.Comment,
+				ExpiresAt:	request.ExpiresAt,
+			})
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponsePaymentRequest{ Status: status }
+				break
+			}
+			response = paymentRequestResponse(saved)
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// ResolvePaymentRequestHandler method:
+// 1. Input data:
+//		POST /payment-requests/{id}/pay
+//		POST /payment-requests/{id}/decline
+//		Content-Type: application/json
+//		request body: {"id":id}
+//		---
+//		id - user id of the payer
+//		The same handler serves both actions, Resolve is the method of the action.
+// 2. Output:
+//		Content-Type: application/json
+//		response body: as of CreatePaymentRequestHandler, for a paid request with "payer_balance" and "requester_balance"
+//		---
+//		If successful:
+//			status = 0, request_id > 0
+//		If data is not a valid:
+//			status = 1, request_id = 0
+//		If the request does not exist or is addressed to another user:
+//			status = 2, request_id = 0
+//		If the request is paid, but the payer has insufficient funds:
+//			status = 3, request_id = 0
+//		If server error:
+//			status = 4, request_id = 0
+//		If the request is paid, but one of the accounts is frozen or closed:
+//			status = 7 or 8, request_id = 0
+//		If the request is paid, but exceeds a spending limit of the payer:
+//			status = 10, request_id = 0, remaining - amount the payer can still transfer
+//		If the request is already paid, declined or expired:
+//			status = 16, request_id = 0
+func ResolvePaymentRequestHandler(Resolve func(int64, int) (apimethods.PaymentRequest, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestResolvePaymentRequest
+		var response	ResponsePaymentRequest
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		id, errID := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+
+		switch {
+		case err != nil || errID != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponsePaymentRequest{ Status: 1 }
+		default:
+			resolved, err := Resolve(id, request.ID)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponsePaymentRequest{ Status: status, Remaining: limitRemaining(err) }
+				break
+			}
+			response = paymentRequestResponse(resolved)
+			if resolved.Status == apimethods.RequestPaid {
+				payer, requester := money(resolved.PayerBalance), money(resolved.RequesterBalance)
+				response.PayerBalance, response.RequesterBalance = &payer, &requester
+			}
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// ListPaymentRequestsHandler method:
+// 1. Input data:
+//		GET /accounts/{id}/payment-requests?status=status,...&role=role&limit=limit&cursor=cursor
+//		---
+//		id - user id, id > 0
+//		status - states of the requests, comma separated, all states if not set
+//		role - "requester" for the requests sent by the user, "payer" for the received ones, both if not set
+//		limit - page size, 0 < limit <= 100, 20 if not set
+//		cursor - next_cursor of the previous page, the first page if not set
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"requests":[...],"next_cursor":next_cursor}
+//		---
+//		requests - payment requests as of CreatePaymentRequestHandler, the newest first
+//		next_cursor - cursor of the next page, 0 if it is the last page
+//		---
+//		If successful:
+//			status = 0
+//		If data is not a valid:
+//			status = 1, requests = []
+//		If user ID does not exist:
+//			status = 2, requests = []
+//		If server error:
+//			status = 4, requests = []
+func ListPaymentRequestsHandler(ListPaymentRequests func(int, apimethods.RequestFilter) ([]apimethods.PaymentRequest, int64, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var requests	[]apimethods.PaymentRequest
+		var next		int64
+
+		w.Header().Set("Content-Type", "application/json")
+
+		query := r.URL.Query()
+		f := apimethods.RequestFilter{ Role: query.Get("role"), Limit: defaultRequestsPage }
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err == nil && query.Get("limit") != "" {
+			f.Limit, err = strconv.Atoi(query.Get("limit"))
+		}
+		if err == nil && query.Get("cursor") != "" {
+			f.Cursor, err = strconv.ParseInt(query.Get("cursor"), 10, 64)
+		}
+		if v := query.Get("status"); v != "" {
+			f.Statuses = strings.Split(v, ",")
+		}
+
+		if err != nil {
+			err = apimethods.WrongData
+		} else {
+			requests, next, err = ListPaymentRequests(id, f)
+		}
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+
+		response := ResponsePaymentRequests{ Status: status, Requests: []ResponsePaymentRequest{}, NextCursor: next }
+		for _, p := range requests {
+			response.Requests = append(response.Requests, paymentRequestResponse(p))
+		}
+		w.WriteHeader(code)
+		render.JSON(w, r, response)
+	}
+}
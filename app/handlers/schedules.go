@@ -0,0 +1,283 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type RequestSchedule struct {
+	Type			string		`json:"type"`
+	From			int			`json:"from"`
+	To				int			`json:"to"`
+	Sum				float64		`json:"sum"`
+	Currency		string		`json:"currency"`
+	Comment			string		`json:"comment"`
+	StartAt			time.Time	`json:"start_at"`
+	IntervalSeconds	int			`json:"interval_seconds"`
+	DayOfMonth		int			`json:"day_of_month"`
+}
+
+type ResponseScheduleRun struct {
+	Attempt		int			`json:"attempt"`
+	DueAt		time.Time	`json:"due_at"`
+	RunAt		time.Time	`json:"run_at"`
+	Status		string		`json:"status"`
+	Error		string		`json:"error,omitempty"`
+	Balance		float64		`json:"balance"`
+}
+
+type ResponseSchedule struct {
+	Status			int						`json:"status"`
+	ID				int64					`json:"id"`
+	Type			string					`json:"type"`
+	From			int						`json:"from"`
+	To				int						`json:"to"`
+	Sum				float64					`json:"sum"`
+	Currency		string					`json:"currency"`
+	Comment			string					`json:"comment"`
+	IntervalSeconds	int						`json:"interval_seconds"`
+	DayOfMonth		int						`json:"day_of_month"`
+	State			string					`json:"state"`
+	DueAt			time.Time				`json:"due_at"`
+	NextRunAt		time.Time				`json:"next_run_at"`
+	Attempts		int						`json:"attempts"`
+	Runs			[]ResponseScheduleRun	`json:"runs,omitempty"`
+}
+
+type ResponseSchedules struct {
+	Status		int					`json:"status"`
+	Schedules	[]ResponseSchedule	`json:"schedules"`
+}
+
+// scheduleResponse converts the schedule to the response
+func scheduleResponse(s apimethods.Schedule) ResponseSchedule {
+	response := ResponseSchedule{
+		Status:				0,
+		ID:					s.ID,
+		Type:				s.Type,
+		From:				s.From,
+		To:					s.To,
+		Sum:				money(s.Sum),
+		Currency:			s.Currency,
+		Comment:			s.Comment,
+		IntervalSeconds:	int(s.Interval / time.Second),
+		DayOfMonth:			s.DayOfMonth,
+		State:				s.Status,
+		DueAt:				s.DueAt,
+		NextRunAt:			s.NextRunAt,
+		Attempts:			s.Attempts,
+	}
+	for _, run := range s.Runs {
+		response.Runs = append(response.Runs, ResponseScheduleRun{
+			Attempt:	run.Attempt,
+			DueAt:		run.DueAt,
+			RunAt:		run.RunAt,
+			Status:		run.Status,
+			Error:		run.Error,
+			Balance:	money(run.Balance),
+		})
+	}
+	return response
+}
+
+// CreateScheduleHandler method:
+// 1. Input data:
+//		POST /schedules
+//		Content-Type: application/json
+//		request body: {"type":type,"from":from,"to":to,"sum":sum,"currency":currency,"comment":comment,
+//			"start_at":start_at,"interval_seconds":interval_seconds,"day_of_month":day_of_month}
+//		---
+//		type - "transfer" from "from" to "to" or "debit" of "from"
+//		currency - currency of the operation, RUB if not set
+//		start_at - time of the first run in RFC 3339, now if not set
+//		interval_seconds - the operation is repeated every interval_seconds, interval_seconds >= 60
+//		day_of_month - the operation is repeated every month on this day (the last day of shorter months),
+//			at the time of start_at, 1 <= day_of_month <= 31
+//		without interval_seconds and day_of_month the operation runs once
+//		from > 0, sum > 0, "from" is not a shared account
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id,"type":type,"from":from,"to":to,"sum":sum,"currency":currency,"comment":comment,
+//			"interval_seconds":interval_seconds,"day_of_month":day_of_month,"state":state,"due_at":due_at,"next_run_at":next_run_at,"attempts":attempts}
+//		---
+//		state - "active", "completed", "cancelled" or "failed"
+//		due_at - time of the next occurrence of the operation
+//		next_run_at - time of the next attempt, later than due_at while a failed run is retried
+//		---
+//		If successful:
+//			status = 0, id > 0
+//		If data is not a valid:
+//			status = 1, id = 0
+//		If user ID does not exist:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+//		If "from" is a shared account, which the runs can not spend without a member:
+//			status = 18, id = 0
+func CreateScheduleHandler(CreateSchedule func(apimethods.Schedule, time.Time) (apimethods.Schedule, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestSchedule
+		var response	ResponseSchedule
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		switch {
+		case err != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseSchedule{ Status: 1 }
+		default:
+			s, err := CreateSchedule(apimethods.Schedule{
+				Type:		request.Type,
+				From:		request.From,
+				To:			request.To,
+				Sum:		request.Sum,
+				Currency:	request.Currency,
+				Comment:	request.Comment,
+				Interval:	time.Duration(request.IntervalSeconds) * time.Second,
+				DayOfMonth:	request.DayOfMonth,
+			}, request.StartAt)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseSchedule{ Status: status }
+				break
+			}
+			response = scheduleResponse(s)
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// GetScheduleHandler method:
+// 1. Input data:
+//		GET /schedules/{id}
+// 2. Output:
+//		Content-Type: application/json
+//		response body: as of CreateScheduleHandler with the last 50 runs, the latest first:
+//			"runs":[{"attempt":attempt,"due_at":due_at,"run_at":run_at,"status":status,"error":error,"balance":balance},...]
+//		---
+//		status of a run - "succeeded", "retry" (failed, will be retried) or "failed"
+//		balance - balance of "from" after a successful run
+//		---
+//		If successful:
+//			status = 0, id > 0
+//		If data is not a valid:
+//			status = 1, id = 0
+//		If the schedule does not exist:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+func GetScheduleHandler(GetSchedule func(int64) (apimethods.Schedule, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			id = 0
+		}
+
+		s, err := GetSchedule(id)
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		w.WriteHeader(code)
+		if status != 0 {
+			render.JSON(w, r, ResponseSchedule{ Status: status })
+			return
+		}
+		render.JSON(w, r, scheduleResponse(s))
+	}
+}
+
+// ListSchedulesHandler method:
+// 1. Input data:
+//		GET /accounts/{id}/schedules
+//		---
+//		id - user id, id > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"schedules":[...]}
+//		---
+//		schedules - operations paid by the user, as of CreateScheduleHandler
+//		---
+//		If successful:
+//			status = 0
+//		If data is not a valid:
+//			status = 1, schedules = []
+//		If user ID does not exist:
+//			status = 2, schedules = []
+//		If server error:
+//			status = 4, schedules = []
+func ListSchedulesHandler(ListSchedules func(int) ([]apimethods.Schedule, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			id = 0
+		}
+
+		schedules, err := ListSchedules(id)
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+
+		response := ResponseSchedules{ Status: status, Schedules: []ResponseSchedule{} }
+		for _, s := range schedules {
+			response.Schedules = append(response.Schedules, scheduleResponse(s))
+		}
+		w.WriteHeader(code)
+		render.JSON(w, r, response)
+	}
+}
+
+// CancelScheduleHandler method:
+// 1. Input data:
+//		DELETE /schedules/{id}
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id}
+//		---
+//		If successful:
+//			status = 0, id > 0
+//		If data is not a valid or the schedule is not active:
+//			status = 1, id = 0
+//		If the schedule does not exist:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+func CancelScheduleHandler(CancelSchedule func(int64) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			id = 0
+		}
+
+		err = CancelSchedule(id)
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		if status != 0 {
+			id = 0
+		}
+		w.WriteHeader(code)
+		render.JSON(w, r, ResponseID{ Status: status, ID: id })
+	}
+}
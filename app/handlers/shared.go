@@ -0,0 +1,256 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type RequestSharedAccount struct {
+	Owner		int		`json:"owner"`
+}
+
+type RequestMember struct {
+	By			int		`json:"by"`
+	Role		string	`json:"role"`
+	Limit		float64	`json:"limit"`
+	Period		string	`json:"period"`
+}
+
+type ResponseMember struct {
+	UserID		int			`json:"user_id"`
+	Role		string		`json:"role"`
+	Limit		*float64	`json:"limit,omitempty"`
+	Period		string		`json:"period,omitempty"`
+	Used		*float64	`json:"used,omitempty"`
+	Remaining	*float64	`json:"remaining,omitempty"`
+	CreatedAt	time.Time	`json:"created_at"`
+}
+
+type ResponseMembers struct {
+	Status		int					`json:"status"`
+	Members		[]ResponseMember	`json:"members"`
+}
+
+// CreateSharedAccountHandler method:
+// 1. Input data:
+//		POST /shared-accounts
+//		Content-Type: application/json
+//		request body: {"owner":owner}
+//		---
+//		owner - user id of the first owner of the account, owner > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id}
+//		---
+//		id - id of the shared account, it is used as a user id in all other methods.
+//		Money leaves the account only on behalf of its members: "member" of /withdraw and /transfer.
+//		---
+//		If successful:
+//			status = 0, id > 0
+//		If data is not a valid:
+//			status = 1, id = 0
+//		If user ID does not exist:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+func CreateSharedAccountHandler(CreateSharedAccount func(int) (int, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestSharedAccount
+		var response	ResponseID
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		switch {
+		case err != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseID{ Status: 1 }
+		default:
+			id, err := CreateSharedAccount(request.Owner)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			response = ResponseID{ Status: status, ID: int64(id) }
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// SetMemberHandler method:
+// 1. Input data:
+//		PUT /shared-accounts/{id}/members/{user_id}
+//		Content-Type: application/json
+//		request body: {"by":by,"role":role,"limit":limit,"period":period}
+//		---
+//		id - id of the shared account
+//		user_id - user id of the member to add or change
+//		by - user id of an owner of the account who makes the change
+//		role - "owner" (spends and manages the members), "spender" (spends up to the limit) or "viewer" (only sees the account)
+//		limit, period - limit of a spender in RUB over the period: "single", "day", "week" or "month".
+//			A spender without a period has no limit.
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id}
+//		---
+//		id - user_id of the member
+//		---
+//		If successful:
+//			status = 0, id > 0
+//		If data is not a valid or the last owner would become another role:
+//			status = 1, id = 0
+//		If the account or the user does not exist:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+//		If "by" is not an owner of the account:
+//			status = 18, id = 0
+func SetMemberHandler(SetMember func(int, apimethods.Member) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestMember
+		var response	ResponseID
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		id, errID := strconv.Atoi(chi.URLParam(r, "id"))
+		user, errUser := strconv.Atoi(chi.URLParam(r, "user_id"))
+
+		switch {
+		case err != nil || errID != nil || errUser != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseID{ Status: 1 }
+		default:
+			err = SetMember(request.By, apimethods.Member{
+				AccountID:	id,
+				UserID:		user,
+				Role:		request.Role,
+				Limit:		request.Limit,
+				Period:		request.Period,
+			})
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			if status != 0 {
+				user = 0
+			}
+			w.WriteHeader(code)
+			response = ResponseID{ Status: status, ID: int64(user) }
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// RemoveMemberHandler method:
+// 1. Input data:
+//		DELETE /shared-accounts/{id}/members/{user_id}?by=by
+//		---
+//		id - id of the shared account
+//		user_id - user id of the member to remove
+//		by - user id of an owner of the account or of the member leaving it
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id}
+//		---
+//		id - user_id of the removed member
+//		---
+//		If successful:
+//			status = 0, id > 0
+//		If data is not a valid or the member is the last owner:
+//			status = 1, id = 0
+//		If the account does not exist or the user is not its member:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+//		If "by" is not an owner of the account:
+//			status = 18, id = 0
+func RemoveMemberHandler(RemoveMember func(int, int, int) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, errID := strconv.Atoi(chi.URLParam(r, "id"))
+		user, errUser := strconv.Atoi(chi.URLParam(r, "user_id"))
+		by, errBy := strconv.Atoi(r.URL.Query().Get("by"))
+
+		var err error
+		if errID != nil || errUser != nil || errBy != nil {
+			err = apimethods.WrongData
+		} else {
+			err = RemoveMember(id, by, user)
+		}
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		if status != 0 {
+			user = 0
+		}
+		w.WriteHeader(code)
+		render.JSON(w, r, ResponseID{ Status: status, ID: int64(user) })
+	}
+}
+
+// ListMembersHandler method:
+// 1. Input data:
+//		GET /shared-accounts/{id}/members
+//		---
+//		id - id of the shared account, id > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"members":[{"user_id":user_id,"role":role,"limit":limit,"period":period,
+//			"used":used,"remaining":remaining,"created_at":created_at},...]}
+//		---
+//		members - the oldest first
+//		limit, period, used, remaining - only for spenders with a limit: the money they spent
+//			over the period and the money they can still spend
+//		---
+//		If successful:
+//			status = 0
+//		If data is not a valid:
+//			status = 1, members = []
+//		If the account does not exist or is not shared:
+//			status = 2, members = []
+//		If server error:
+//			status = 4, members = []
+func ListMembersHandler(ListMembers func(int) ([]apimethods.Member, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var members []apimethods.Member
+
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			err = apimethods.WrongData
+		} else {
+			members, err = ListMembers(id)
+		}
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+
+		response := ResponseMembers{ Status: status, Members: []ResponseMember{} }
+		for _, m := range members {
+			member := ResponseMember{ UserID: m.UserID, Role: m.Role, Period: m.Period, CreatedAt: m.CreatedAt }
+			if m.Period != "" {
+				limit, used, remaining := money(m.Limit), money(m.Used), money(m.Remaining)
+				member.Limit, member.Used, member.Remaining = &limit, &used, &remaining
+			}
+			response.Members = append(response.Members, member)
+		}
+		w.WriteHeader(code)
+		render.JSON(w, r, response)
+	}
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"github.com/go-chi/render"
+	"log"
+	"net/http"
+)
+
+type RequestSplitPart struct {
+	To			int		`json:"to"`
+	Amount		float64	`json:"amount"`
+	Percent		float64	`json:"percent"`
+}
+
+type RequestSplit struct {
+	From		int					`json:"from"`
+	Sum			float64				`json:"sum"`
+	Currency	string				`json:"currency"`
+	Comment		string				`json:"comment"`
+	Recipients	[]RequestSplitPart	`json:"recipients"`
+}
+
+type ResponseSplitShare struct {
+	ToID		int		`json:"to_id"`
+	Amount		float64	`json:"amount"`
+	ToBalance	float64	`json:"to_balance"`
+}
+
+type ResponseSplit struct {
+	Status			int						`json:"status"`
+	FromID			int						`json:"from_id"`
+	FromBalance		float64					`json:"from_balance"`
+	Currency		string					`json:"currency"`
+	Fee				float64					`json:"fee"`
+	TransactionID	int64					`json:"transaction_id"`
+	Recipients		[]ResponseSplitShare	`json:"recipients"`
+	Remaining		*float64				`json:"remaining,omitempty"`
+}
+
+// SplitTransferHandler method:
+// 1. Input data:
+//		POST /transfers:split
+//		Content-Type: application/json
+//		request body: {"from":from,"sum":sum,"currency":currency,"comment":comment,
+//			"recipients":[{"to":to,"amount":amount},...] or [{"to":to,"percent":percent},...]}
+//		---
+//		from - user id who pays
+//		recipients - users who receive the money and their parts: amounts or percentages for all of them
+//		sum - total amount, optional for amounts, required for percentages
+//		percent - percentage of sum with up to two decimals, the percentages add up to 100.
+//			Every recipient gets their percentage rounded down to a kopeck, the kopecks left go
+//			to the recipients with the largest rounded off parts, so the amounts always add up to sum.
+//		currency - currency of the wallets, RUB if not set
+//		from > 0, 0 < len(recipients) <= 100, recipients are different users other than "from"
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"from_id":from_id,"from_balance":from_balance,"currency":currency,
+//			"fee":fee,"transaction_id":transaction_id,"recipients":[{"to_id":to_id,"amount":amount,"to_balance":to_balance},...]}
+//		---
+//		The split is one transfer of the sum of the parts: "from" pays one fee on top of it and the limits
+//		of "from" apply to the sum. If one of the recipients can not get the money, nobody does.
+//		A split transaction can not be refunded.
+//		---
+//		If successful:
+//			status = 0, from_id > 0
+//		If data is not a valid:
+//			status = 1, from_id = 0, recipients = []
+//		If user ID does not exist:
+//			status = 2, from_id = 0, recipients = []
+//		If insufficient funds:
+//			status = 3, from_id = 0, recipients = []
+//		If server error:
+//			status = 4, from_id = 0, recipients = []
+//		If the account of "from" is frozen or one of the accounts is closed:
+//			status = 7 or 8, from_id = 0, recipients = []
+//		If the split exceeds a spending limit of "from":
+//			status = 10, from_id = 0, recipients = [], remaining - amount "from" could still transfer
+func SplitTransferHandler(SplitTransfer func(apimethods.Split) (apimethods.SplitResult, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestSplit
+		var response	ResponseSplit
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		switch {
+		case err != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseSplit{ Status: 1, Recipients: []ResponseSplitShare{} }
+		default:
+			split := apimethods.Split{ From: request.From, Sum: request.Sum, Currency: request.Currency, Comment: request.Comment }
+			for _, part := range request.Recipients {
+				split.Parts = append(split.Parts, apimethods.SplitPart{ To: part.To, Amount: part.Amount, Percent: part.Percent })
+			}
+
+			res, err := SplitTransfer(split)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseSplit{ Status: status, Recipients: []ResponseSplitShare{}, Remaining: limitRemaining(err) }
+				break
+			}
+
+			response = ResponseSplit{ Status: 0, FromID: res.From, FromBalance: money(res.FromBalance), Currency: res.Currency,
+				Fee: money(res.Fee), TransactionID: res.TransactionID }
+			for _, share := range res.Shares {
+				response.Recipients = append(response.Recipients, ResponseSplitShare{
+					ToID:		share.To,
+					Amount:		money(share.Amount),
+					ToBalance:	money(share.Balance),
+				})
+			}
+		}
+		render.JSON(w, r, response)
+	}
+}
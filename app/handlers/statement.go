@@ -0,0 +1,207 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type ResponseStatementLine struct {
+	TransactionID	int64		`json:"transaction_id"`
+	Type			string		`json:"type"`
+	CreatedAt		time.Time	`json:"created_at"`
+	Amount			float64		`json:"amount"`
+	Balance			float64		`json:"balance"`
+	Counterparty	int			`json:"counterparty"`
+	Comment			string		`json:"comment"`
+	Member			int			`json:"member,omitempty"`
+}
+
+// statementWriter is a format of statements.
+// Once the statement is started, the status of the response can not be changed.
+type statementWriter interface {
+	apimethods.StatementWriter
+	isStarted() bool
+}
+
+// jsonStatement streams a statement as a JSON object, the transactions are written one by one
+type jsonStatement struct {
+	w			http.ResponseWriter
+	started		bool
+	lines		int
+}
+
+func (s *jsonStatement) isStarted() bool {
+	return s.started
+}
+
+func (s *jsonStatement) Begin(st apimethods.Statement) error {
+	s.started = true
+	s.w.Header().Set("Content-Type", "application/json")
+	s.w.WriteHeader(http.StatusOK)
+	_, err := fmt.Fprintf(s.w, `{"status":0,"id":%d,"currency":"%s","from":"%s","to":"%s","opening_balance":%v,"transactions":[`,
+		st.ID, st.Currency, st.From.Format(time.RFC3339Nano), st.To.Format(time.RFC3339Nano), money(st.Opening))
+	return err
+}
+
+func (s *jsonStatement) Line(l apimethods.StatementLine) error {
+	data, err := json.Marshal(ResponseStatementLine{
+		TransactionID:	l.TransactionID,
+		Type:			l.Type,
+		CreatedAt:		l.CreatedAt,
+		Amount:			money(l.Amount),
+		Balance:		money(l.Balance),
+		Counterparty:	l.Counterparty,
+		Comment:		l.Comment,
+		Member:			l.Member,
+	})
+	if err != nil {
+		return err
+	}
+	if s.lines > 0 {
+		_, err = s.w.Write([]byte(","))
+		if err != nil {
+			return err
+		}
+	}
+	s.lines++
+	_, err = s.w.Write(data)
+	return err
+}
+
+func (s *jsonStatement) End(st apimethods.Statement) error {
+	_, err := fmt.Fprintf(s.w, `],"closing_balance":%v}`+"\n", money(st.Closing))
+	return err
+}
+
+// csvStatement streams a statement as CSV: a header, the opening balance,
+// a row per transaction and the closing balance
+type csvStatement struct {
+	w			http.ResponseWriter
+	csv			*csv.Writer
+	started		bool
+}
+
+func (s *csvStatement) isStarted() bool {
+	return s.started
+}
+
+func (s *csvStatement) Begin(st apimethods.Statement) error {
+	s.started = true
+	s.w.Header().Set("Content-Type", "text/csv")
+	s.w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%d-%s.csv"`, st.ID, st.Currency))
+	s.w.WriteHeader(http.StatusOK)
+
+	s.csv = csv.NewWriter(s.w)
+	s.csv.Write([]string{ "created_at", "transaction_id", "type", "amount", "balance", "counterparty", "comment" })
+	return s.csv.Write([]string{ st.From.Format(time.RFC3339), "", "opening_balance", "", formatMoney(st.Opening), "", "" })
+}
+
+func (s *csvStatement) Line(l apimethods.StatementLine) error {
+	return s.csv.Write([]string{
+		l.CreatedAt.Format(time.RFC3339Nano),
+		strconv.FormatInt(l.TransactionID, 10),
+		l.Type,
+		formatMoney(l.Amount),
+		formatMoney(l.Balance),
+		strconv.Itoa(l.Counterparty),
+		l.Comment,
+	})
+}
+
+func (s *csvStatement) End(st apimethods.Statement) error {
+	s.csv.Write([]string{ st.To.Format(time.RFC3339), "", "closing_balance", "", formatMoney(st.Closing), "", "" })
+	s.csv.Flush()
+	return s.csv.Error()
+}
+
+// money rounds an amount to kopecks
+func money(sum float64) float64 {
+	return math.Round(sum * 100) / 100
+}
+
+// formatMoney formats an amount with two decimal places
+func formatMoney(sum float64) string {
+	return strconv.FormatFloat(sum, 'f', 2, 64)
+}
+
+// StatementHandler method:
+// 1. Input data:
+//		GET /accounts/{id}/statement?from=from&to=to&format=format&currency=currency
+//		---
+//		id - user id
+//		from, to - period of the statement in RFC 3339, from < to, to is not included
+//		format - "json" (by default) or "csv"
+//		currency - currency of the wallet, optional, RUB by default
+//		id > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id,"currency":currency,"from":from,"to":to,"opening_balance":opening_balance,
+//			"transactions":[{"transaction_id":transaction_id,"type":type,"created_at":created_at,"amount":amount,"balance":balance,"counterparty":counterparty,"comment":comment},...],
+//			"closing_balance":closing_balance}
+//		---
+//		or Content-Type: text/csv with the columns created_at,transaction_id,type,amount,balance,counterparty,comment,
+//		the first row after the header is the opening balance, the last one is the closing balance
+//		---
+//		amount - change of the balance including the fee, negative for debits
+//		balance - balance after the transaction
+//		counterparty - the other user of the transaction, 0 if there is none
+//		member - member of the shared account who made the transaction, only in JSON, omitted for other accounts
+//		The statement is streamed as it is read: if it fails in the middle, the response is cut off.
+//		---
+//		If successful:
+//			status = 0
+//		If data is not a valid:
+//			status = 1, id = 0, balance = 0.00
+//		If user ID does not exist:
+//			status = 2, id = 0, balance = 0.00
+//		If server error:
+//			status = 4, id = 0, balance = 0.00
+func StatementHandler(WriteStatement func(int, string, time.Time, time.Time, apimethods.StatementWriter) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			id = 0
+		}
+
+		query := r.URL.Query()
+		from, errFrom := time.Parse(time.RFC3339, query.Get("from"))
+		to, errTo := time.Parse(time.RFC3339, query.Get("to"))
+
+		var writer statementWriter
+		switch query.Get("format") {
+		case "", "json":
+			writer = &jsonStatement{ w: w }
+		case "csv":
+			writer = &csvStatement{ w: w }
+		}
+
+		err = apimethods.WrongData
+		if errFrom == nil && errTo == nil && writer != nil {
+			err = WriteStatement(id, query.Get("currency"), from, to, writer)
+		}
+		if err == nil {
+			return
+		}
+		if writer != nil && writer.isStarted() {
+			log.Println(fmt.Errorf("statement of %d is cut off: %w", id, err))
+			return
+		}
+
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		render.JSON(w, r, ResponseToUser{ Status: status, ID: 0, Balance: 0.00 })
+	}
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"errors"
+	"net/http"
+)
+
+// errorStatus converts an error returned by api methods
+// to the HTTP status code and the response status:
+//		status = 0 - success
+//		status = 1 - data is not a valid
+//		status = 2 - user ID (or other requested object) does not exist
+//		status = 3 - insufficient funds
+//		status = 4 - server error
+//		status = 5 - operation rolled back together with its batch
+//		status = 6 - refund exceeds what is left of the transaction
+//		status = 7 - account is frozen
+//		status = 8 - account is closed
+//		status = 9 - account can not be closed with a non-zero balance
+//		status = 10 - spending limit exceeded
+//		status = 11 - currencies of the wallets do not match
+//		status = 12 - exchange quote is expired or already used
+//		status = 13 - exchange rate is not available
+//		status = 14 - voucher is expired, used up or already redeemed by the user
+//		status = 15 - transfer is no longer pending
+//		status = 16 - payment request is already paid, declined or expired
+//		status = 17 - escrow deal can not move to the requested state
+//		status = 18 - member is not allowed to act on the shared account
+func errorStatus(err error) (int, int) {
+	switch {
+	case err == nil:
+		return http.StatusOK, 0
+	case errors.Is(err, apimethods.WrongData):
+		return http.StatusBadRequest, 1
+	case errors.Is(err, apimethods.UserNotFound):
+		return http.StatusBadRequest, 2
+	case errors.Is(err, apimethods.NotFound):
+		return http.StatusNotFound, 2
+	case errors.Is(err, apimethods.InsufficientFunds):
+		return http.StatusBadRequest, 3
+	case errors.Is(err, apimethods.RolledBack):
+		return http.StatusBadRequest, 5
+	case errors.Is(err, apimethods.OverRefund):
+		return http.StatusBadRequest, 6
+	case errors.Is(err, apimethods.AccountFrozen):
+		return http.StatusBadRequest, 7
+	case errors.Is(err, apimethods.AccountClosed):
+		return http.StatusBadRequest, 8
+	case errors.Is(err, apimethods.NonZeroBalance):
+		return http.StatusBadRequest, 9
+	case errors.Is(err, apimethods.LimitExceeded):
+		return http.StatusBadRequest, 10
+	case errors.Is(err, apimethods.CurrencyMismatch):
+		return http.StatusBadRequest, 11
+	case errors.Is(err, apimethods.QuoteExpired):
+		return http.StatusBadRequest, 12
+	case errors.Is(err, apimethods.RateUnavailable):
+		return http.StatusServiceUnavailable, 13
+	case errors.Is(err, apimethods.VoucherUnavailable):
+		return http.StatusBadRequest, 14
+	case errors.Is(err, apimethods.TransferNotPending):
+		return http.StatusBadRequest, 15
+	case errors.Is(err, apimethods.RequestNotPending):
+		return http.StatusBadRequest, 16
+	case errors.Is(err, apimethods.DealConflict):
+		return http.StatusBadRequest, 17
+	case errors.Is(err, apimethods.MemberForbidden):
+		return http.StatusBadRequest, 18
+	default:
+		return http.StatusInternalServerError, 4
+	}
+}
@@ -0,0 +1,300 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type RequestVoucherBatch struct {
+	Amount			float64		`json:"amount"`
+	Currency		string		`json:"currency"`
+	Count			int			`json:"count"`
+	MaxRedemptions	int			`json:"max_redemptions"`
+	ValidFrom		time.Time	`json:"valid_from"`
+	ValidUntil		time.Time	`json:"valid_until"`
+	Comment			string		`json:"comment"`
+}
+
+type ResponseVoucherBatch struct {
+	Status			int			`json:"status"`
+	BatchID			int64		`json:"batch_id"`
+	Amount			float64		`json:"amount"`
+	Currency		string		`json:"currency"`
+	Count			int			`json:"count"`
+	MaxRedemptions	int			`json:"max_redemptions"`
+	ValidFrom		time.Time	`json:"valid_from"`
+	ValidUntil		time.Time	`json:"valid_until"`
+	Comment			string		`json:"comment"`
+	RedeemedCodes	int			`json:"redeemed_codes"`
+	Redemptions		int			`json:"redemptions"`
+	RedeemedAmount	float64		`json:"redeemed_amount"`
+}
+
+type RequestRedeemVoucher struct {
+	ID			int		`json:"id"`
+	Code		string	`json:"code"`
+}
+
+type ResponseRedemption struct {
+	Status			int		`json:"status"`
+	TransactionID	int64	`json:"transaction_id"`
+	ID				int		`json:"id"`
+	Code			string	`json:"code"`
+	Amount			float64	`json:"amount"`
+	Currency		string	`json:"currency"`
+	Balance			float64	`json:"balance"`
+}
+
+// voucherBatchResponse converts the statistics of a batch to the response
+func voucherBatchResponse(s apimethods.VoucherStats) ResponseVoucherBatch {
+	return ResponseVoucherBatch{
+		Status:			0,
+		BatchID:		s.Batch.ID,
+		Amount:			money(s.Batch.Amount),
+		Currency:		s.Batch.Currency,
+		Count:			s.Batch.Count,
+		MaxRedemptions:	s.Batch.MaxRedemptions,
+		ValidFrom:		s.Batch.ValidFrom,
+		ValidUntil:		s.Batch.ValidUntil,
+		Comment:		s.Batch.Comment,
+		RedeemedCodes:	s.RedeemedCodes,
+		Redemptions:	s.Redemptions,
+		RedeemedAmount:	money(s.RedeemedAmount),
+	}
+}
+
+// CreateVoucherBatchHandler method:
+// 1. Input data:
+//		POST /admin/voucher-batches
+//		Content-Type: application/json
+//		request body: {"amount":amount,"currency":currency,"count":count,"max_redemptions":max_redemptions,"valid_from":valid_from,"valid_until":valid_until,"comment":comment}
+//		---
+//		amount - amount credited by every code, amount > 0
+//		currency - currency of the amount, RUB if not set
+//		count - number of codes, 0 < count <= 10000
+//		max_redemptions - how many users can redeem every code, max_redemptions > 0
+//		valid_from, valid_until - validity window in RFC 3339, valid_from is the current time if not set
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"batch_id":batch_id,"amount":amount,"currency":currency,"count":count,"max_redemptions":max_redemptions,
+//			"valid_from":valid_from,"valid_until":valid_until,"comment":comment,"redeemed_codes":0,"redemptions":0,"redeemed_amount":0}
+//		---
+//		The codes are exported by GET /admin/voucher-batches/{batch_id}/codes
+//		---
+//		If successful:
+//			status = 0, batch_id > 0
+//		If data is not a valid:
+//			status = 1, batch_id = 0
+//		If server error:
+//			status = 4, batch_id = 0
+func CreateVoucherBatchHandler(CreateVoucherBatch func(apimethods.VoucherBatch) (apimethods.VoucherBatch, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestVoucherBatch
+		var response	ResponseVoucherBatch
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		switch {
+		case err != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseVoucherBatch{ Status: 1 }
+		default:
+			b, err := CreateVoucherBatch(apimethods.VoucherBatch{
+				Amount:			request.Amount,
+				Currency:		request.Currency,
+				Count:			request.Count,
+				MaxRedemptions:	request.MaxRedemptions,
+				ValidFrom:		request.ValidFrom,
+				ValidUntil:		request.ValidUntil,
+				Comment:		request.Comment,
+			})
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseVoucherBatch{ Status: status }
+				break
+			}
+			response = voucherBatchResponse(apimethods.VoucherStats{ Batch: b })
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// VoucherBatchStatsHandler method:
+// 1. Input data:
+//		GET /admin/voucher-batches/{batch_id}
+// 2. Output:
+//		Content-Type: application/json
+//		response body: as of CreateVoucherBatchHandler
+//		---
+//		redeemed_codes - number of codes redeemed at least once
+//		redemptions - number of redemptions of all codes
+//		redeemed_amount - amount credited by all redemptions
+//		---
+//		If successful:
+//			status = 0, batch_id > 0
+//		If data is not a valid:
+//			status = 1, batch_id = 0
+//		If the batch does not exist:
+//			status = 2, batch_id = 0
+//		If server error:
+//			status = 4, batch_id = 0
+func VoucherBatchStatsHandler(VoucherBatchStats func(int64) (apimethods.VoucherStats, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "batch_id"), 10, 64)
+		if err != nil {
+			id = 0
+		}
+
+		s, err := VoucherBatchStats(id)
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		w.WriteHeader(code)
+		if status != 0 {
+			render.JSON(w, r, ResponseVoucherBatch{ Status: status })
+			return
+		}
+		render.JSON(w, r, voucherBatchResponse(s))
+	}
+}
+
+// ExportVouchersHandler method:
+// 1. Input data:
+//		GET /admin/voucher-batches/{batch_id}/codes
+// 2. Output:
+//		Content-Type: text/csv
+//		columns: code,redemptions
+//		---
+//		The codes are streamed as they are read: if the export fails in the middle, the response is cut off.
+//		---
+//		If data is not a valid:
+//			Content-Type: application/json, {"status":1,"id":0,"balance":0.00}
+//		If the batch does not exist:
+//			Content-Type: application/json, {"status":2,"id":0,"balance":0.00}
+//		If server error:
+//			Content-Type: application/json, {"status":4,"id":0,"balance":0.00}
+func ExportVouchersHandler(ExportVouchers func(int64, func(apimethods.Voucher) error) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var out *csv.Writer
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "batch_id"), 10, 64)
+		if err != nil {
+			id = 0
+		}
+
+		err = ExportVouchers(id, func(v apimethods.Voucher) error {
+			if out == nil {
+				w.Header().Set("Content-Type", "text/csv")
+				w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="vouchers-%d.csv"`, id))
+				w.WriteHeader(http.StatusOK)
+
+				out = csv.NewWriter(w)
+				out.Write([]string{ "code", "redemptions" })
+			}
+			return out.Write([]string{ v.Code, strconv.Itoa(v.Redemptions) })
+		})
+		if out != nil {
+			out.Flush()
+			if err == nil {
+				err = out.Error()
+			}
+			if err != nil {
+				log.Println(fmt.Errorf("export of voucher batch %d is cut off: %w", id, err))
+			}
+			return
+		}
+
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		render.JSON(w, r, ResponseToUser{ Status: status, ID: 0, Balance: 0.00 })
+	}
+}
+
+// RedeemVoucherHandler method:
+// 1. Input data:
+//		POST /vouchers/redeem
+//		Content-Type: application/json
+//		request body: {"id":id,"code":code}
+//		---
+//		id - user id
+//		code - voucher code
+//		id > 0
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"transaction_id":transaction_id,"id":id,"code":code,"amount":amount,"currency":currency,"balance":balance}
+//		---
+//		amount - amount credited to the wallet in the currency of the voucher
+//		balance - new balance of the wallet
+//		---
+//		If successful:
+//			status = 0
+//		If data is not a valid:
+//			status = 1, id = 0
+//		If user ID or the code does not exist:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+//		If the account is closed:
+//			status = 8, id = 0
+//		If the voucher is not valid now, is used up or has already been redeemed by the user:
+//			status = 14, id = 0
+func RedeemVoucherHandler(RedeemVoucher func(int, string) (apimethods.Redemption, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestRedeemVoucher
+		var response	ResponseRedemption
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		switch {
+		case err != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseRedemption{ Status: 1 }
+		default:
+			redemption, err := RedeemVoucher(request.ID, request.Code)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			if status != 0 {
+				response = ResponseRedemption{ Status: status }
+				break
+			}
+			response = ResponseRedemption{
+				Status:			0,
+				TransactionID:	redemption.TransactionID,
+				ID:				redemption.ID,
+				Code:			redemption.Code,
+				Amount:			money(redemption.Amount),
+				Currency:		redemption.Currency,
+				Balance:		money(redemption.Balance),
+			}
+		}
+		render.JSON(w, r, response)
+	}
+}
@@ -0,0 +1,244 @@
+package handler
+
+import (
+	apimethods "app/api/methods"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type RequestCreateWebhook struct {
+	URL			string		`json:"url"`
+	EventTypes	[]string	`json:"event_types"`
+	Secret		string		`json:"secret"`
+}
+
+type ResponseID struct {
+	Status		int		`json:"status"`
+	ID			int64	`json:"id"`
+}
+
+type ResponseWebhook struct {
+	ID			int			`json:"id"`
+	URL			string		`json:"url"`
+	EventTypes	[]string	`json:"event_types"`
+	CreatedAt	time.Time	`json:"created_at"`
+}
+
+type ResponseWebhooks struct {
+	Status		int					`json:"status"`
+	Webhooks	[]ResponseWebhook	`json:"webhooks"`
+}
+
+type ResponseDeadLetter struct {
+	ID				int64			`json:"id"`
+	SubscriptionID	int				`json:"subscription_id"`
+	Payload			json.RawMessage	`json:"payload"`
+	Attempts		int				`json:"attempts"`
+	LastError		string			`json:"last_error"`
+	FailedAt		time.Time		`json:"failed_at"`
+}
+
+type ResponseDeadLetters struct {
+	Status		int						`json:"status"`
+	DeadLetters	[]ResponseDeadLetter	`json:"dead_letters"`
+}
+
+// CreateWebhookHandler method:
+// 1. Input data:
+//		Content-Type: application/json
+//		request body: {"url":url,"event_types":[type,...],"secret":secret}
+//		---
+//		url - http(s) URL events are posted to
+//		event_types - types of transactions to subscribe to (refill, withdraw, transfer)
+//		secret - key of the HMAC-SHA256 signature of every delivery
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id}
+//		---
+//		If successful:
+//			status = 0, id > 0 - id of the subscription
+//		If data is not a valid:
+//			status = 1, id = 0
+//		If server error:
+//			status = 4, id = 0
+func CreateWebhookHandler(CreateWebhook func(string, []string, string) (int, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request		RequestCreateWebhook
+		var response	ResponseID
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewDecoder(r.Body).Decode(&request)
+		p := r.Header.Get("Content-Type")
+
+		switch {
+		case err != nil || p != "application/json":
+			w.WriteHeader(http.StatusBadRequest)
+			response = ResponseID{ Status: 1, ID: 0 }
+		default:
+			id, err := CreateWebhook(request.URL, request.EventTypes, request.Secret)
+			code, status := errorStatus(err)
+			if status == 4 {
+				log.Println(err)
+			}
+			w.WriteHeader(code)
+			response = ResponseID{ Status: status, ID: int64(id) }
+		}
+		render.JSON(w, r, response)
+	}
+}
+
+// ListWebhooksHandler method:
+// 1. Input data:
+//		GET /webhooks
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"webhooks":[{"id":id,"url":url,"event_types":[type,...],"created_at":created_at},...]}
+//		---
+//		Secrets are never returned.
+//		If successful:
+//			status = 0
+//		If server error:
+//			status = 4, webhooks = []
+func ListWebhooksHandler(ListWebhooks func() ([]apimethods.Webhook, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		response := ResponseWebhooks{ Status: 0, Webhooks: []ResponseWebhook{} }
+
+		hooks, err := ListWebhooks()
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		response.Status = status
+
+		for _, hook := range hooks {
+			response.Webhooks = append(response.Webhooks, ResponseWebhook{
+				ID:			hook.ID,
+				URL:		hook.URL,
+				EventTypes:	hook.EventTypes,
+				CreatedAt:	hook.CreatedAt,
+			})
+		}
+		w.WriteHeader(code)
+		render.JSON(w, r, response)
+	}
+}
+
+// DeleteWebhookHandler method:
+// 1. Input data:
+//		DELETE /webhooks/{id}
+//		---
+//		id - id of the subscription
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id}
+//		---
+//		If successful:
+//			status = 0, id > 0
+//		If data is not a valid:
+//			status = 1, id = 0
+//		If the subscription does not exist:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+func DeleteWebhookHandler(DeleteWebhook func(int) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			id = 0
+		}
+
+		err = DeleteWebhook(id)
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		if status != 0 {
+			id = 0
+		}
+		w.WriteHeader(code)
+		render.JSON(w, r, ResponseID{ Status: status, ID: int64(id) })
+	}
+}
+
+// ListDeadLettersHandler method:
+// 1. Input data:
+//		GET /admin/webhooks/dead-letters
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"dead_letters":[{"id":id,"subscription_id":subscription_id,"payload":payload,
+//			"attempts":attempts,"last_error":last_error,"failed_at":failed_at},...]}
+//		---
+//		If successful:
+//			status = 0
+//		If server error:
+//			status = 4, dead_letters = []
+func ListDeadLettersHandler(ListDeadLetters func() ([]apimethods.DeadLetter, error)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		response := ResponseDeadLetters{ Status: 0, DeadLetters: []ResponseDeadLetter{} }
+
+		letters, err := ListDeadLetters()
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		response.Status = status
+
+		for _, letter := range letters {
+			response.DeadLetters = append(response.DeadLetters, ResponseDeadLetter(letter))
+		}
+		w.WriteHeader(code)
+		render.JSON(w, r, response)
+	}
+}
+
+// ReplayDeadLetterHandler method:
+// 1. Input data:
+//		POST /admin/webhooks/dead-letters/{id}/replay
+//		---
+//		id - id of the dead letter
+// 2. Output:
+//		Content-Type: application/json
+//		response body: {"status":status,"id":id}
+//		---
+//		The delivery is queued again with a fresh number of attempts.
+//		If successful:
+//			status = 0, id > 0
+//		If data is not a valid:
+//			status = 1, id = 0
+//		If the dead letter does not exist:
+//			status = 2, id = 0
+//		If server error:
+//			status = 4, id = 0
+func ReplayDeadLetterHandler(ReplayDeadLetter func(int64) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			id = 0
+		}
+
+		err = ReplayDeadLetter(id)
+		code, status := errorStatus(err)
+		if status == 4 {
+			log.Println(err)
+		}
+		if status != 0 {
+			id = 0
+		}
+		w.WriteHeader(code)
+		render.JSON(w, r, ResponseID{ Status: status, ID: id })
+	}
+}
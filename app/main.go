@@ -2,22 +2,52 @@ package main
 
 import (
 	apimethods "app/api/methods"
+	pkgbonuses "app/pkg/bonuses"
+	pkgevents "app/pkg/events"
+	pkgoutbox "app/pkg/outbox"
+	pkgoverdraft "app/pkg/overdraft"
+	pkgpending "app/pkg/pending"
 	pkgpostgres "app/pkg/postgres"
+	pkgrates "app/pkg/rates"
+	pkgscheduler "app/pkg/scheduler"
+	pkgsnapshots "app/pkg/snapshots"
+	pkgwebhooks "app/pkg/webhooks"
 	handlers "app/handlers"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultBatchLimit	= 100
+	defaultBulkLimit	= 1000
+	shutdownTimeout		= 10 * time.Second
+	defaultKafkaTopic	= "balance-events"
 )
 
 type Server struct {
 	Router		*chi.Mux
+	Broker		*pkgevents.Broker
+	BatchLimit	int
+	BulkLimit	int
 }
 
 func CreateNewServer() *Server {
-	s := &Server{ Router: chi.NewRouter() }
+	s := &Server{
+		Router:		chi.NewRouter(),
+		Broker:		pkgevents.NewBroker(),
+		BatchLimit:	defaultBatchLimit,
+		BulkLimit:	defaultBulkLimit,
+	}
 	return s
 }
 
@@ -25,10 +55,98 @@ func (s *Server) MountHandlers(api *apimethods.Methods) {
 	s.Router.Use(middleware.RequestID)
 	s.Router.Use(middleware.Logger)
 
-	s.Router.Get("/balance", handlers.GetBalanceHandler(api.GetBalance))
-	s.Router.Post("/refill", handlers.RefillAndWithdrawHandler(api.RefillAndWithdrawMoney))
-	s.Router.Post("/withdraw", handlers.RefillAndWithdrawHandler(api.RefillAndWithdrawMoney))
-	s.Router.Post("/transfer", handlers.TransferHandler(api.TransferMoney))
+	s.Router.Get("/balance", handlers.GetBalanceHandler(api.GetWallets, api.ConvertBalance))
+	s.Router.Post("/refill", handlers.RefillAndWithdrawHandler(api.RefillAndWithdrawMember))
+	s.Router.Post("/withdraw", handlers.RefillAndWithdrawHandler(api.RefillAndWithdrawMember))
+	s.Router.Post("/transfer", handlers.TransferHandler(api.TransferMember, api.HoldTransfer))
+	s.Router.Post("/services/pay", handlers.PayServiceHandler(api.PayService))
+	s.Router.Post("/vouchers/redeem", handlers.RedeemVoucherHandler(api.RedeemVoucher))
+	s.Router.Post("/pending-transfers/{id}/accept", handlers.ResolveTransferHandler(api.AcceptTransfer))
+	s.Router.Post("/pending-transfers/{id}/decline", handlers.ResolveTransferHandler(api.DeclineTransfer))
+	s.Router.Post("/pending-transfers/{id}/cancel", handlers.ResolveTransferHandler(api.CancelTransfer))
+	s.Router.Get("/accounts/{id}/pending-transfers", handlers.ListPendingTransfersHandler(api.ListPendingTransfers))
+	s.Router.Post("/payment-requests", handlers.CreatePaymentRequestHandler(api.CreatePaymentRequest))
+	s.Router.Post("/payment-requests/{id}/pay", handlers.ResolvePaymentRequestHandler(api.PayRequest))
+	s.Router.Post("/payment-requests/{id}/decline", handlers.ResolvePaymentRequestHandler(api.DeclineRequest))
+	s.Router.Get("/accounts/{id}/payment-requests", handlers.ListPaymentRequestsHandler(api.ListPaymentRequests))
+	s.Router.Post("/schedules", handlers.CreateScheduleHandler(api.CreateSchedule))
+	s.Router.Get("/schedules/{id}", handlers.GetScheduleHandler(api.GetSchedule))
+	s.Router.Delete("/schedules/{id}", handlers.CancelScheduleHandler(api.CancelSchedule))
+	s.Router.Get("/accounts/{id}/schedules", handlers.ListSchedulesHandler(api.ListSchedules))
+	s.Router.Post("/shared-accounts", handlers.CreateSharedAccountHandler(api.CreateSharedAccount))
+	s.Router.Get("/shared-accounts/{id}/members", handlers.ListMembersHandler(api.ListMembers))
+	s.Router.Put("/shared-accounts/{id}/members/{user_id}", handlers.SetMemberHandler(api.SetMember))
+	s.Router.Delete("/shared-accounts/{id}/members/{user_id}", handlers.RemoveMemberHandler(api.RemoveMember))
+	s.Router.Post("/accounts/{id}/sub-accounts", handlers.CreateSubAccountHandler(api.CreateSubAccount))
+	s.Router.Put("/accounts/{id}/sub-accounts/{child_id}", handlers.SetDrawLimitHandler(api.SetDrawLimit))
+	s.Router.Post("/accounts/{id}/allocate", handlers.AllocateHandler(api.Allocate))
+	s.Router.Post("/accounts/{id}/draw", handlers.DrawHandler(api.DrawFromParent))
+	s.Router.Get("/accounts/{id}/rollup", handlers.RollupHandler(api.Rollup))
+	s.Router.Get("/accounts/{id}/overdraft", handlers.OverdraftHandler(api.GetOverdraft))
+	s.Router.Post("/escrow/deals", handlers.CreateDealHandler(api.CreateDeal))
+	s.Router.Get("/escrow/deals/{id}", handlers.GetDealHandler(api.GetDeal))
+	s.Router.Post("/escrow/deals/{id}/release", handlers.DealActionHandler(api.ReleaseDeal))
+	s.Router.Post("/escrow/deals/{id}/refund", handlers.DealActionHandler(api.RefundDeal))
+	s.Router.Post("/escrow/deals/{id}/dispute", handlers.DealActionHandler(api.DisputeDeal))
+	s.Router.Post("/transfers:split", handlers.SplitTransferHandler(api.SplitTransfer))
+	s.Router.Post("/transfers:quote", handlers.QuoteTransferHandler(api.QuoteTransfer))
+	s.Router.Post("/exchange", handlers.QuoteExchangeHandler(api.QuoteExchange))
+	s.Router.Post("/exchange/{quote_id}/confirm", handlers.ConfirmExchangeHandler(api.ConfirmExchange))
+	s.Router.Post("/balances:batchGet", handlers.BatchGetBalanceHandler(api.GetBalances, s.BatchLimit))
+	s.Router.Post("/batch", handlers.BatchHandler(api.ExecuteBatch, s.BulkLimit))
+	s.Router.Get("/accounts/{id}/events", handlers.AccountEventsHandler(api.GetBalance, s.Broker.Subscribe))
+	s.Router.Get("/ledger/trial-balance", handlers.TrialBalanceHandler(api.TrialBalance))
+	s.Router.Post("/transactions/{id}/refund", handlers.RefundHandler(api.RefundTransaction, false))
+	s.Router.Get("/accounts/{id}/limits", handlers.GetLimitsHandler(api.GetLimits))
+	s.Router.Get("/accounts/{id}/balance", handlers.BalanceAtHandler(api.BalanceAt))
+	s.Router.Get("/accounts/{id}/statement", handlers.StatementHandler(api.WriteStatement))
+
+	s.Router.Post("/webhooks", handlers.CreateWebhookHandler(api.CreateWebhook))
+	s.Router.Get("/webhooks", handlers.ListWebhooksHandler(api.ListWebhooks))
+	s.Router.Delete("/webhooks/{id}", handlers.DeleteWebhookHandler(api.DeleteWebhook))
+
+	s.Router.Route("/admin", func(r chi.Router) {
+		r.Post("/transactions/{id}/refund", handlers.RefundHandler(api.RefundTransaction, true))
+		r.Post("/accounts/{id}/status", handlers.SetAccountStatusHandler(api.SetAccountStatus))
+		r.Put("/accounts/{id}/limits", handlers.SetLimitHandler(api.SetLimit))
+		r.Put("/limits", handlers.SetLimitHandler(api.SetLimit))
+		r.Put("/accounts/{id}/credit-limit", handlers.SetCreditLimitHandler(api.SetCreditLimit))
+		r.Post("/accounts/{id}/bonuses", handlers.GrantBonusHandler(api.GrantBonus))
+		r.Post("/voucher-batches", handlers.CreateVoucherBatchHandler(api.CreateVoucherBatch))
+		r.Get("/voucher-batches/{batch_id}", handlers.VoucherBatchStatsHandler(api.VoucherBatchStats))
+		r.Get("/voucher-batches/{batch_id}/codes", handlers.ExportVouchersHandler(api.ExportVouchers))
+		r.Put("/fees", handlers.SetFeeRuleHandler(api.SetFeeRule))
+		r.Post("/escrow/deals/{id}/resolve", handlers.ResolveDealHandler(api.ResolveDeal))
+		r.Get("/webhooks/dead-letters", handlers.ListDeadLettersHandler(api.ListDeadLetters))
+		r.Post("/webhooks/dead-letters/{id}/replay", handlers.ReplayDeadLetterHandler(api.ReplayDeadLetter))
+	})
+}
+
+// envInt returns the value of the environment variable key as an integer,
+// or fallback if the variable is not set or is not a valid positive number.
+func envInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || v <= 0 {
+		return fallback
+	}
+	return v
+}
+
+// outboxPublisher returns the publisher of the outbox relay configured by the environment:
+// a Kafka topic behind the REST proxy at KAFKA_REST_URL, or the file OUTBOX_FILE.
+// If neither is set, nil is returned.
+func outboxPublisher() pkgoutbox.Publisher {
+	if restURL := os.Getenv("KAFKA_REST_URL"); restURL != "" {
+		topic := os.Getenv("KAFKA_TOPIC")
+		if topic == "" {
+			topic = defaultKafkaTopic
+		}
+		return pkgoutbox.NewKafkaPublisher(restURL, topic)
+	}
+	if path := os.Getenv("OUTBOX_FILE"); path != "" {
+		return pkgoutbox.NewFilePublisher(path)
+	}
+	return nil
 }
 
 func main() {
@@ -40,10 +158,89 @@ func main() {
 	defer pool.Close()
 
 	api := apimethods.New(pool)
+	if ratesURL := os.Getenv("RATES_URL"); ratesURL != "" {
+		api.Rates = pkgrates.NewHTTPProvider(ratesURL, os.Getenv("RATES_API_KEY"))
+	}
+	api.Spread = float64(envInt("EXCHANGE_SPREAD_BP", int(api.Spread * 10000))) / 10000
+	if os.Getenv("BONUS_ORDER") == apimethods.BonusLast {
+		api.BonusOrder = apimethods.BonusLast
+	}
 
 	server := CreateNewServer()
+	server.BatchLimit = envInt("BATCH_LIMIT", defaultBatchLimit)
+	server.BulkLimit = envInt("BULK_LIMIT", defaultBulkLimit)
 
 	server.MountHandlers(api)
 
-	log.Fatal(http.ListenAndServe(":8080", server.Router))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go pkgevents.Listen(ctx, pool, server.Broker)
+
+	dispatcher := pkgwebhooks.NewDispatcher(api)
+	dispatcher.MaxAttempts = envInt("WEBHOOK_MAX_ATTEMPTS", dispatcher.MaxAttempts)
+	go dispatcher.Run(ctx)
+
+	refresher := pkgrates.NewRefresher(api.Rates, api, apimethods.BaseCurrency, apimethods.Currencies())
+	refresher.Interval = time.Duration(envInt("RATES_REFRESH_SECONDS", int(refresher.Interval / time.Second))) * time.Second
+	api.RateMaxAge = 2 * refresher.Interval
+	go refresher.Run(ctx)
+
+	snapshotter := pkgsnapshots.NewSnapshotter(api)
+	snapshotter.Interval = time.Duration(envInt("SNAPSHOT_INTERVAL_SECONDS", int(snapshotter.Interval / time.Second))) * time.Second
+	snapshotter.MinEntries = envInt("SNAPSHOT_MIN_ENTRIES", snapshotter.MinEntries)
+	go snapshotter.Run(ctx)
+
+	expirer := pkgbonuses.NewExpirer(api)
+	expirer.Interval = time.Duration(envInt("BONUS_EXPIRY_SECONDS", int(expirer.Interval / time.Second))) * time.Second
+	go expirer.Run(ctx)
+
+	api.ScheduleMaxAttempts = envInt("SCHEDULE_MAX_ATTEMPTS", api.ScheduleMaxAttempts)
+	api.ScheduleRetryDelay = time.Duration(envInt("SCHEDULE_RETRY_SECONDS", int(api.ScheduleRetryDelay / time.Second))) * time.Second
+	scheduler := pkgscheduler.NewWorker(api)
+	scheduler.Interval = time.Duration(envInt("SCHEDULER_INTERVAL_SECONDS", int(scheduler.Interval / time.Second))) * time.Second
+	go scheduler.Run(ctx)
+
+	api.PendingTimeout = time.Duration(envInt("PENDING_TRANSFER_TIMEOUT_SECONDS", int(api.PendingTimeout / time.Second))) * time.Second
+	transfers := pkgpending.NewExpirer(api)
+	transfers.Interval = time.Duration(envInt("PENDING_EXPIRY_SECONDS", int(transfers.Interval / time.Second))) * time.Second
+	go transfers.Run(ctx)
+
+	api.OverdraftDailyRate = float64(envInt("OVERDRAFT_RATE_BP", int(api.OverdraftDailyRate * 10000))) / 10000
+	api.OverdraftDailyFee = float64(envInt("OVERDRAFT_FEE_KOPECKS", int(api.OverdraftDailyFee * 100))) / 100
+	accruer := pkgoverdraft.NewAccruer(api)
+	accruer.Interval = time.Duration(envInt("OVERDRAFT_INTERVAL_SECONDS", int(accruer.Interval / time.Second))) * time.Second
+	go accruer.Run(ctx)
+
+	publisher := outboxPublisher()
+	if publisher != nil {
+		go pkgoutbox.NewRelay(api, publisher).Run(ctx)
+	} else {
+		log.Println("outbox relay is disabled: neither KAFKA_REST_URL nor OUTBOX_FILE is set")
+	}
+
+	srv := &http.Server{ Addr: ":8080", Handler: server.Router }
+	// Event streams never become idle, closing the broker ends them
+	srv.RegisterOnShutdown(server.Broker.Close)
+
+	idle := make(chan struct{})
+	go func() {
+		defer close(idle)
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		err := srv.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Println(fmt.Errorf("Shutdown: %w", err))
+		}
+	}()
+
+	err = srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(fmt.Errorf("ListenAndServe: %w", err))
+	}
+
+	<-idle
 }
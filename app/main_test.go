@@ -2,8 +2,14 @@ package main
 
 import (
 	apimethods "app/api/methods"
+	handlers "app/handlers"
+	pkgevents "app/pkg/events"
 	pkgpostgres "app/pkg/postgres"
+	pkgrates "app/pkg/rates"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"log"
@@ -12,7 +18,10 @@ import (
 	"net/http/httptest"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func executeRequest(req *http.Request, s *Server) *httptest.ResponseRecorder {
@@ -69,7 +78,7 @@ func TestBalance(t *testing.T) {
 		`/balance`,
 		`application/json`,
 		http.StatusOK,
-		`{"status":0,"id":1,"balance":56.99}`)
+		`{"status":0,"id":1,"balance":56.99,"currency":"RUB","bonus":0,"wallets":[{"currency":"RUB","balance":56.99}]}`)
 
 	// Negative user id
 	checkMethods(t, server,
@@ -275,7 +284,7 @@ func TestBalance(t *testing.T) {
 		to_id, math.Round((to_balance + sum) * 100) / 100 )
 
 	// Correct request
-	request := fmt.Sprintf(`{"from":%v,"to":%v,"sum":%.2f}`, from_id, to_id, sum)
+	request = fmt.Sprintf(`{"from":%v,"to":%v,"sum":%.2f}`, from_id, to_id, sum)
 
 	checkMethods(t, server,
 		request,
@@ -362,3 +371,2286 @@ func TestBalance(t *testing.T) {
 		http.StatusMethodNotAllowed,
 		``)
 }
+
+func TestBatchBalance(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+	server.BatchLimit = 3
+
+	server.MountHandlers(apimethods.New(pool))
+
+	// Correct request with found, missing and invalid ids
+	// User with ID=5 has balance=0.00
+	checkMethods(t, server,
+		`{"ids":[1,5,100]}`,
+		`POST`,
+		`/balances:batchGet`,
+		`application/json`,
+		http.StatusOK,
+		`{"status":0,"balances":[{"status":0,"id":1,"balance":56.99},{"status":0,"id":5,"balance":0},{"status":2,"id":100,"balance":0}]}`)
+
+	checkMethods(t, server,
+		`{"ids":[-1,1]}`,
+		`POST`,
+		`/balances:batchGet`,
+		`application/json`,
+		http.StatusOK,
+		`{"status":0,"balances":[{"status":1,"id":-1,"balance":0},{"status":0,"id":1,"balance":56.99}]}`)
+
+	// Too many ids
+	checkMethods(t, server,
+		`{"ids":[1,2,3,4]}`,
+		`POST`,
+		`/balances:batchGet`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"balances":[]}`)
+
+	// Empty list
+	checkMethods(t, server,
+		`{"ids":[]}`,
+		`POST`,
+		`/balances:batchGet`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"balances":[]}`)
+
+	// Incorrect content type (not application/json)
+	checkMethods(t, server,
+		`{"ids":[1]}`,
+		`POST`,
+		`/balances:batchGet`,
+		`blablabla`,
+		http.StatusBadRequest,
+		`{"status":1,"balances":[]}`)
+}
+
+func TestBatch(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+	server.BulkLimit = 3
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	_, balance, _ := api.GetBalance(4)
+	balance = math.Round((balance + 1) * 100) / 100
+	key := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	// Best effort: insufficient funds does not stop other operations,
+	// the repeated idempotency key returns the result of the first operation
+	// User with ID=5 has balance=0.00
+	request := fmt.Sprintf(`{"mode":"best_effort","operations":[`+
+		`{"type":"credit","id":4,"sum":1,"idempotency_key":"%v"},`+
+		`{"type":"debit","id":5,"sum":5},`+
+		`{"type":"credit","id":4,"sum":1,"idempotency_key":"%v"}]}`, key, key)
+
+	checkMethods(t, server,
+		request,
+		`POST`,
+		`/batch`,
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"results":[{"status":0,"id":4,"balance":%v},{"status":3,"id":0,"balance":0},{"status":0,"id":4,"balance":%v}]}`, balance, balance))
+
+	// Atomic: the failed operation rolls back the whole batch
+	checkMethods(t, server,
+		`{"mode":"atomic","operations":[{"type":"credit","id":4,"sum":1},{"type":"transfer","from":5,"to":4,"sum":5}]}`,
+		`POST`,
+		`/batch`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":3,"results":[{"status":5,"id":0,"balance":0},{"status":3,"id":0,"balance":0}]}`)
+
+	_, actual, _ := api.GetBalance(4)
+	require.Equal(t, balance, math.Round(actual * 100) / 100)
+
+	// The key belongs to the account: a retry with another sum is rejected,
+	// another account executes its own operation with the same key
+	results, err := api.ExecuteBatch([]apimethods.Operation{
+		{ Type: apimethods.OperationCredit, ID: 4, Sum: 2, IdempotencyKey: key },
+		{ Type: apimethods.OperationCredit, ID: 5, Sum: 1, IdempotencyKey: key },
+	}, false)
+	require.NoError(t, err)
+	require.ErrorIs(t, results[0].Err, apimethods.IdempotencyMismatch)
+	require.NoError(t, results[1].Err)
+	require.Equal(t, 5, results[1].ID)
+
+	// Unknown mode
+	checkMethods(t, server,
+		`{"mode":"blablabla","operations":[{"type":"credit","id":4,"sum":1}]}`,
+		`POST`,
+		`/batch`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"results":[]}`)
+
+	// Too many operations
+	checkMethods(t, server,
+		`{"mode":"atomic","operations":[{"type":"credit","id":4,"sum":1},{"type":"credit","id":4,"sum":1},{"type":"credit","id":4,"sum":1},{"type":"credit","id":4,"sum":1}]}`,
+		`POST`,
+		`/batch`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"results":[]}`)
+}
+
+func TestTrialBalance(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	// Every kind of posting touches the ledger
+	_, _, err = api.RefillAndWithdrawMoney(4, 10)
+	require.NoError(t, err)
+	_, _, err = api.RefillAndWithdrawMoney(4, -3)
+	require.NoError(t, err)
+	_, _, _, _, err = api.TransferMoney(4, 1, 2)
+	require.NoError(t, err)
+	_, _, _, _, err = api.TransferMoney(1, 4, 2)
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(`GET`, `/ledger/trial-balance`, nil)
+	response := executeRequest(req, server)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var tb handlers.ResponseTrialBalance
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &tb))
+
+	require.Equal(t, 0, tb.Status)
+	require.True(t, tb.Balanced)
+	require.Equal(t, 0.0, tb.Total)
+	require.Equal(t, 0, tb.MismatchedWallets)
+}
+
+func TestRefund(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	_, from_balance, _, to_balance, err := api.TransferMoney(4, 1, 3)
+	require.NoError(t, err)
+
+	var id int64
+	err = pool.QueryRow(context.Background(), `SELECT max(id) FROM transactions WHERE type = 'transfer' AND from_id = 4 AND to_id = 1`).Scan(&id)
+	require.NoError(t, err)
+
+	url := fmt.Sprintf(`/transactions/%v/refund`, id)
+
+	// Partial refund reverses both legs
+	req, _ := http.NewRequest(`POST`, url, bytes.NewBufferString(`{"sum":1,"reason":"mistake","initiator":"support"}`))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var refund handlers.ResponseRefund
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &refund))
+	require.Greater(t, refund.TransactionID, id)
+	require.Equal(t, handlers.ResponseRefund{
+		Status:			0,
+		TransactionID:	refund.TransactionID,
+		RefundOf:		id,
+		Sum:			1,
+		FromID:			1,
+		FromBalance:	math.Round((to_balance - 1) * 100) / 100,
+		ToID:			4,
+		ToBalance:		math.Round((from_balance + 1) * 100) / 100,
+	}, refund)
+
+	// Refund exceeds what is left
+	checkMethods(t, server,
+		`{"sum":5,"reason":"mistake","initiator":"support"}`,
+		`POST`,
+		url,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":6,"transaction_id":0,"refund_of":0,"sum":0,"from_id":0,"from_balance":0,"to_id":0,"to_balance":0}`)
+
+	// Sum = 0 refunds the rest
+	r, err := api.RefundTransaction(id, 0, "mistake", "support", false)
+	require.NoError(t, err)
+	require.Greater(t, r.TransactionID, refund.TransactionID)
+	require.Equal(t, apimethods.Refund{
+		TransactionID:	r.TransactionID,
+		RefundOf:		id,
+		Sum:			2,
+		FromID:			1,
+		FromBalance:	math.Round((to_balance - 3) * 100) / 100,
+		ToID:			4,
+		ToBalance:		math.Round((from_balance + 3) * 100) / 100,
+	}, apimethods.Refund{
+		TransactionID:	r.TransactionID,
+		RefundOf:		r.RefundOf,
+		Sum:			r.Sum,
+		FromID:			r.FromID,
+		FromBalance:	math.Round(r.FromBalance * 100) / 100,
+		ToID:			r.ToID,
+		ToBalance:		math.Round(r.ToBalance * 100) / 100,
+	})
+
+	checkMethods(t, server,
+		`{"reason":"mistake","initiator":"support"}`,
+		`POST`,
+		url,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":6,"transaction_id":0,"refund_of":0,"sum":0,"from_id":0,"from_balance":0,"to_id":0,"to_balance":0}`)
+
+	// Forced refunds are accepted only by the admin route
+	checkMethods(t, server,
+		`{"reason":"mistake","initiator":"support","force":true}`,
+		`POST`,
+		url,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"transaction_id":0,"refund_of":0,"sum":0,"from_id":0,"from_balance":0,"to_id":0,"to_balance":0}`)
+
+	// Missing reason
+	checkMethods(t, server,
+		`{"initiator":"support"}`,
+		`POST`,
+		url,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"transaction_id":0,"refund_of":0,"sum":0,"from_id":0,"from_balance":0,"to_id":0,"to_balance":0}`)
+
+	// Transaction doesn't exist
+	checkMethods(t, server,
+		`{"reason":"mistake","initiator":"support"}`,
+		`POST`,
+		`/transactions/999999999/refund`,
+		`application/json`,
+		http.StatusNotFound,
+		`{"status":2,"transaction_id":0,"refund_of":0,"sum":0,"from_id":0,"from_balance":0,"to_id":0,"to_balance":0}`)
+
+	// The refund that completes a transfer returns its fee
+	defer pool.Exec(context.Background(), `DELETE FROM fee_rules`)
+	require.NoError(t, api.SetFeeRule(apimethods.FeeRule{ Fixed: 5 }))
+
+	var sender, recipient int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance (balance) VALUES (100) RETURNING id`).Scan(&sender)
+	require.NoError(t, err)
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&recipient)
+	require.NoError(t, err)
+
+	_, balance, _, _, err := api.TransferMoney(sender, recipient, 10)
+	require.NoError(t, err)
+	require.Equal(t, 85.0, balance)
+	err = pool.QueryRow(context.Background(), `SELECT max(id) FROM transactions WHERE type = 'transfer' AND from_id = $1`, sender).Scan(&id)
+	require.NoError(t, err)
+
+	r, err = api.RefundTransaction(id, 4, "mistake", "support", false)
+	require.NoError(t, err)
+	require.Equal(t, 0.0, r.Fee)
+	require.Equal(t, 89.0, r.ToBalance)
+
+	r, err = api.RefundTransaction(id, 0, "mistake", "support", false)
+	require.NoError(t, err)
+	require.Equal(t, 5.0, r.Fee)
+	require.Equal(t, 100.0, r.ToBalance)
+	require.Equal(t, 0.0, r.FromBalance)
+}
+
+func TestAccountStatus(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	var id int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&id)
+	require.NoError(t, err)
+
+	_, _, err = api.RefillAndWithdrawMoney(id, 10)
+	require.NoError(t, err)
+
+	url := fmt.Sprintf(`/admin/accounts/%v/status`, id)
+
+	// Frozen account can receive but not send
+	checkMethods(t, server,
+		`{"status":"frozen","reason":"fraud check"}`,
+		`POST`,
+		url,
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v,"account_status":"frozen","balance":10}`, id))
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v,"sum":-5}`, id),
+		`POST`,
+		`/withdraw`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":7,"id":0,"balance":0}`)
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"from":%v,"to":1,"sum":5}`, id),
+		`POST`,
+		`/transfer`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":7,"from_id":0,"from_balance":0,"to_id":0,"to_balance":0}`)
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v,"sum":5}`, id),
+		`POST`,
+		`/refill`,
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v,"balance":15}`, id))
+
+	// Closing requires a zero balance or a payout
+	checkMethods(t, server,
+		`{"status":"closed","reason":"customer request"}`,
+		`POST`,
+		url,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":9,"id":0,"account_status":"","balance":0}`)
+
+	checkMethods(t, server,
+		`{"status":"closed","reason":"customer request","payout":true}`,
+		`POST`,
+		url,
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v,"account_status":"closed","balance":0}`, id))
+
+	// Closed account can do nothing
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v,"sum":5}`, id),
+		`POST`,
+		`/refill`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":8,"id":0,"balance":0}`)
+
+	checkMethods(t, server,
+		`{"status":"active","reason":"reopen"}`,
+		`POST`,
+		url,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":8,"id":0,"account_status":"","balance":0}`)
+
+	// Unknown status
+	checkMethods(t, server,
+		`{"status":"blablabla","reason":"reason"}`,
+		`POST`,
+		`/admin/accounts/1/status`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"id":0,"account_status":"","balance":0}`)
+}
+
+func TestLimits(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	var id int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&id)
+	require.NoError(t, err)
+
+	_, _, err = api.RefillAndWithdrawMoney(id, 20000)
+	require.NoError(t, err)
+
+	// Default limit of a single transfer
+	checkMethods(t, server,
+		fmt.Sprintf(`{"from":%v,"to":1,"sum":15000.01}`, id),
+		`POST`,
+		`/transfer`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":10,"from_id":0,"from_balance":0,"to_id":0,"to_balance":0,"remaining":15000}`)
+
+	// Override of the daily withdrawal limit
+	checkMethods(t, server,
+		`{"operation":"withdraw","period":"day","amount":100}`,
+		`PUT`,
+		fmt.Sprintf(`/admin/accounts/%v/limits`, id),
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v,"balance":0}`, id))
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v,"sum":-60}`, id),
+		`POST`,
+		`/withdraw`,
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v,"balance":19940}`, id))
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v,"sum":-50}`, id),
+		`POST`,
+		`/withdraw`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":10,"id":0,"balance":0,"remaining":40}`)
+
+	checkMethods(t, server,
+		``,
+		`GET`,
+		fmt.Sprintf(`/accounts/%v/limits`, id),
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v,"limits":[{"operation":"withdraw","period":"day","amount":100,"used":60,"remaining":40,"default":false},{"operation":"transfer","period":"single","amount":15000,"used":0,"remaining":15000,"default":true}]}`, id))
+
+	// Unknown period
+	checkMethods(t, server,
+		`{"operation":"withdraw","period":"year","amount":100}`,
+		`PUT`,
+		`/admin/limits`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"id":0,"balance":0}`)
+}
+
+func TestFees(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	defer pool.Exec(context.Background(), `DELETE FROM fee_rules`)
+
+	var id, to int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&id)
+	require.NoError(t, err)
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&to)
+	require.NoError(t, err)
+
+	_, _, err = api.RefillAndWithdrawMoney(id, 1000)
+	require.NoError(t, err)
+
+	checkMethods(t, server,
+		`{"fixed":5,"percent":1,"min_fee":10,"max_fee":50,"free_per_month":1}`,
+		`PUT`,
+		`/admin/fees`,
+		`application/json`,
+		http.StatusOK,
+		`{"status":0,"id":0,"balance":0}`)
+
+	// The first transfer of the month is free
+	checkMethods(t, server,
+		fmt.Sprintf(`{"from":%v,"to":%v,"sum":100}`, id, to),
+		`POST`,
+		`/transfers:quote`,
+		`application/json`,
+		http.StatusOK,
+		`{"status":0,"sum":100,"fee":0,"total":100,"currency":"RUB"}`)
+
+	_, balance, _, _, err := api.TransferMoney(id, to, 100)
+	require.NoError(t, err)
+	require.Equal(t, 900.0, balance)
+
+	// 5 + 1% of 100 is less than the minimum fee
+	checkMethods(t, server,
+		fmt.Sprintf(`{"from":%v,"to":%v,"sum":100}`, id, to),
+		`POST`,
+		`/transfers:quote`,
+		`application/json`,
+		http.StatusOK,
+		`{"status":0,"sum":100,"fee":10,"total":110,"currency":"RUB"}`)
+
+	// 5 + 1% of 10000 is more than the maximum fee
+	checkMethods(t, server,
+		fmt.Sprintf(`{"from":%v,"to":%v,"sum":10000}`, id, to),
+		`POST`,
+		`/transfers:quote`,
+		`application/json`,
+		http.StatusOK,
+		`{"status":0,"sum":10000,"fee":50,"total":10050,"currency":"RUB"}`)
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"from":%v,"to":%v,"sum":100}`, id, to),
+		`POST`,
+		`/transfer`,
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"from_id":%v,"from_balance":790,"to_id":%v,"to_balance":200}`, id, to))
+
+	checkMethods(t, server,
+		`{"percent":101}`,
+		`PUT`,
+		`/admin/fees`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"id":0,"balance":0}`)
+}
+
+func TestWallets(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	var id, to int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&id)
+	require.NoError(t, err)
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&to)
+	require.NoError(t, err)
+
+	// The USD wallet is opened by the first refill
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v,"sum":100,"currency":"USD"}`, id),
+		`POST`,
+		`/refill`,
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v,"balance":100}`, id))
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"from":%v,"to":%v,"sum":30,"currency":"USD"}`, id, to),
+		`POST`,
+		`/transfer`,
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"from_id":%v,"from_balance":70,"to_id":%v,"to_balance":30}`, id, to))
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v}`, id),
+		`GET`,
+		`/balance`,
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v,"balance":0,"currency":"RUB","bonus":0,"wallets":[{"currency":"RUB","balance":0},{"currency":"USD","balance":70}]}`, id))
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v,"currency":"USD"}`, to),
+		`GET`,
+		`/balance`,
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v,"balance":30,"currency":"USD"}`, to))
+
+	// Money is never converted by a transfer
+	checkMethods(t, server,
+		fmt.Sprintf(`{"from":%v,"to":%v,"sum":10,"currency":"USD","to_currency":"EUR"}`, id, to),
+		`POST`,
+		`/transfer`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":11,"from_id":0,"from_balance":0,"to_id":0,"to_balance":0}`)
+
+	// The EUR wallet is empty
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v,"sum":-1,"currency":"EUR"}`, id),
+		`POST`,
+		`/withdraw`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":3,"id":0,"balance":0}`)
+
+	// Unknown currency
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v,"sum":1,"currency":"GBP"}`, id),
+		`POST`,
+		`/refill`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"id":0,"balance":0}`)
+
+	tb, err := api.TrialBalance()
+	require.NoError(t, err)
+	require.Equal(t, 0.0, tb.Totals["USD"])
+	require.Equal(t, 0, tb.MismatchedWallets)
+}
+
+func TestExchange(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+	api.Rates = pkgrates.Static{ "RUB": 1, "USD": 100, "EUR": 110 }
+	api.Spread = 0.01
+
+	server.MountHandlers(api)
+
+	var id int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&id)
+	require.NoError(t, err)
+
+	_, _, err = api.RefillAndWithdrawMoney(id, 1000)
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(`POST`, `/exchange`, bytes.NewBufferString(fmt.Sprintf(`{"id":%v,"from":"RUB","to":"USD","sum":500}`, id)))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req, server)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var quote handlers.ResponseExchange
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &quote))
+	require.Equal(t, 0, quote.Status)
+	require.Equal(t, 0.0099, quote.Rate)
+	require.Equal(t, 4.95, quote.Amount)
+
+	url := fmt.Sprintf(`/exchange/%v/confirm`, quote.QuoteID)
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v}`, id),
+		`POST`,
+		url,
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"quote_id":"%v","id":%v,"from":"RUB","to":"USD","sum":500,"rate":0.0099,"amount":4.95,"from_balance":500,"to_balance":4.95}`, quote.QuoteID, id))
+
+	// A quote is used once
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v}`, id),
+		`POST`,
+		url,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":12,"quote_id":"","id":0,"from":"","to":"","sum":0,"rate":0,"amount":0}`)
+
+	// An expired quote can not be confirmed
+	api.QuoteTTL = 0
+	expired, err := api.QuoteExchange(id, "USD", "EUR", 1)
+	require.NoError(t, err)
+
+	_, err = api.ConfirmExchange(id, expired.ID)
+	require.True(t, errors.Is(err, apimethods.QuoteExpired))
+
+	// The spread is booked in USD: 500 RUB are 5.00 USD at the market rate
+	tb, err := api.TrialBalance()
+	require.NoError(t, err)
+	require.Equal(t, 0.0, tb.Totals["RUB"])
+	require.Equal(t, 0.0, tb.Totals["USD"])
+	require.Equal(t, 0, tb.MismatchedWallets)
+
+	var spread float64
+	err = pool.QueryRow(context.Background(), `SELECT amount FROM journal_entries WHERE account = 'fx_spread' AND transaction_id = (SELECT credit_tx FROM exchange_quotes WHERE id = $1)`, quote.QuoteID).Scan(&spread)
+	require.NoError(t, err)
+	require.Equal(t, 0.05, spread)
+}
+
+func TestConvertBalance(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+	api.Rates = pkgrates.Static{ "RUB": 1, "USD": 100, "EUR": 110 }
+
+	server.MountHandlers(api)
+
+	var id int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&id)
+	require.NoError(t, err)
+
+	_, _, err = api.RefillAndWithdrawMoney(id, 1000)
+	require.NoError(t, err)
+
+	january := time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+	february := time.Date(2001, time.February, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, api.SaveRate("RUB", "USD", 0.01, january))
+	// A rate of the reverse pair is inverted
+	require.NoError(t, api.SaveRate("USD", "RUB", 80, february))
+
+	convert := func(asOf string) handlers.ResponseConvertedBalance {
+		var c handlers.ResponseConvertedBalance
+
+		req, _ := http.NewRequest(`GET`, `/balance?currency=USD&as_of=` + asOf, bytes.NewBufferString(fmt.Sprintf(`{"id":%v}`, id)))
+		req.Header.Set("Content-Type", "application/json")
+		response := executeRequest(req, server)
+
+		checkResponseCode(t, http.StatusOK, response.Code)
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &c))
+		return c
+	}
+
+	c := convert("2001-01-15T00:00:00Z")
+	require.Equal(t, 0, c.Status)
+	require.Equal(t, 10.0, c.Balance)
+	require.Equal(t, 0.01, c.Rate)
+	require.True(t, c.RateAt.Equal(january))
+	require.True(t, c.Stale)
+
+	c = convert("2001-02-01T01:00:00Z")
+	require.Equal(t, 12.5, c.Balance)
+	require.Equal(t, 0.0125, c.Rate)
+	require.False(t, c.Stale)
+
+	// There were no rates before the first one was fetched
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v}`, id),
+		`GET`,
+		`/balance?currency=USD&as_of=2000-01-01T00:00:00Z`,
+		`application/json`,
+		http.StatusServiceUnavailable,
+		`{"status":13,"id":0,"balance":0}`)
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v}`, id),
+		`GET`,
+		`/balance?currency=USD&as_of=yesterday`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"id":0,"balance":0}`)
+
+	// Without as_of the last known rate is used
+	c = convert("")
+	require.Equal(t, 0, c.Status)
+	require.False(t, c.RateAt.Before(february))
+}
+
+func TestBalanceAt(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	var id int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&id)
+	require.NoError(t, err)
+
+	// lastEntry returns the time of the last journal entry of the user by the clock of the database
+	lastEntry := func() time.Time {
+		var at time.Time
+		err := pool.QueryRow(context.Background(), `SELECT MAX(created_at) FROM journal_entries WHERE account = $1`, fmt.Sprintf("user:%d", id)).Scan(&at)
+		require.NoError(t, err)
+		return at
+	}
+
+	_, _, err = api.RefillAndWithdrawMoney(id, 100)
+	require.NoError(t, err)
+	first := lastEntry()
+
+	_, _, err = api.RefillAndWithdrawMoney(id, 50)
+	require.NoError(t, err)
+	second := lastEntry()
+
+	_, _, err = api.RefillAndWithdrawMoney(id, -30)
+	require.NoError(t, err)
+
+	check := func() {
+		balance, err := api.BalanceAt(id, "", first.Add(-time.Microsecond))
+		require.NoError(t, err)
+		require.Equal(t, 0.0, balance)
+
+		balance, err = api.BalanceAt(id, "", first)
+		require.NoError(t, err)
+		require.Equal(t, 100.0, balance)
+
+		balance, err = api.BalanceAt(id, "RUB", second)
+		require.NoError(t, err)
+		require.Equal(t, 150.0, balance)
+
+		balance, err = api.BalanceAt(id, "USD", second)
+		require.NoError(t, err)
+		require.Equal(t, 0.0, balance)
+	}
+	check()
+
+	// The balances are the same when they are computed from the snapshots
+	n, err := api.TakeSnapshots(time.Now().Add(time.Hour), 1)
+	require.NoError(t, err)
+	require.Greater(t, n, 0)
+	check()
+
+	_, _, err = api.RefillAndWithdrawMoney(id, 10)
+	require.NoError(t, err)
+
+	balance, err := api.BalanceAt(id, "", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 130.0, balance)
+
+	asOf := second.UTC().Format(time.RFC3339Nano)
+	checkMethods(t, server,
+		``,
+		`GET`,
+		fmt.Sprintf(`/accounts/%v/balance?as_of=%v`, id, asOf),
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v,"balance":150,"currency":"RUB","as_of":"%v"}`, id, asOf))
+
+	checkMethods(t, server,
+		``,
+		`GET`,
+		fmt.Sprintf(`/accounts/%v/balance?as_of=yesterday`, id),
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"id":0,"balance":0}`)
+
+	checkMethods(t, server,
+		``,
+		`GET`,
+		`/accounts/2147483647/balance`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":2,"id":0,"balance":0}`)
+}
+
+func TestStatement(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	var id, other int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&id)
+	require.NoError(t, err)
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&other)
+	require.NoError(t, err)
+
+	_, _, err = api.RefillAndWithdrawMoney(id, 100)
+	require.NoError(t, err)
+
+	var from time.Time
+	err = pool.QueryRow(context.Background(), `SELECT MAX(created_at) + interval '1 microsecond' FROM journal_entries WHERE account = $1`, fmt.Sprintf("user:%d", id)).Scan(&from)
+	require.NoError(t, err)
+
+	_, _, _, _, err = api.TransferMoney(id, other, 30)
+	require.NoError(t, err)
+	_, _, err = api.RefillAndWithdrawMoney(id, 5)
+	require.NoError(t, err)
+
+	url := fmt.Sprintf(`/accounts/%v/statement?from=%v&to=%v`, id, from.UTC().Format(time.RFC3339Nano), time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+
+	req, _ := http.NewRequest(`GET`, url, nil)
+	response := executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var statement struct {
+		Status			int									`json:"status"`
+		Opening			float64								`json:"opening_balance"`
+		Closing			float64								`json:"closing_balance"`
+		Transactions	[]handlers.ResponseStatementLine	`json:"transactions"`
+	}
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &statement))
+	require.Equal(t, 0, statement.Status)
+	require.Equal(t, 100.0, statement.Opening)
+	require.Equal(t, 75.0, statement.Closing)
+	require.Len(t, statement.Transactions, 2)
+	require.Equal(t, -30.0, statement.Transactions[0].Amount)
+	require.Equal(t, other, statement.Transactions[0].Counterparty)
+	require.Equal(t, 70.0, statement.Transactions[0].Balance)
+	require.Equal(t, 5.0, statement.Transactions[1].Amount)
+	require.Equal(t, 0, statement.Transactions[1].Counterparty)
+
+	req, _ = http.NewRequest(`GET`, url + `&format=csv`, nil)
+	response = executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	require.Equal(t, "text/csv", response.Header().Get("Content-Type"))
+
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	require.Len(t, lines, 5)
+	require.Equal(t, "created_at,transaction_id,type,amount,balance,counterparty,comment", lines[0])
+	require.True(t, strings.HasSuffix(lines[1], ",,opening_balance,,100.00,,"))
+	require.True(t, strings.HasSuffix(lines[4], ",,closing_balance,,75.00,,"))
+
+	checkMethods(t, server,
+		``,
+		`GET`,
+		fmt.Sprintf(`/accounts/%v/statement?from=2022-10-01T00:00:00Z&to=2022-09-01T00:00:00Z`, id),
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"id":0,"balance":0}`)
+
+	checkMethods(t, server,
+		``,
+		`GET`,
+		fmt.Sprintf(`/accounts/%v/statement?from=2022-09-01T00:00:00Z&to=2022-10-01T00:00:00Z&format=xml`, id),
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"id":0,"balance":0}`)
+}
+
+func TestBonuses(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	var id int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&id)
+	require.NoError(t, err)
+
+	_, _, err = api.RefillAndWithdrawMoney(id, 100)
+	require.NoError(t, err)
+
+	_, err = api.GrantBonus(id, 30, time.Now().Add(time.Hour), []string{ "ads" }, "promo")
+	require.NoError(t, err)
+	_, err = api.GrantBonus(id, 20, time.Now().Add(2 * time.Hour), nil, "welcome")
+	require.NoError(t, err)
+
+	_, err = api.GrantBonus(id, 20, time.Now().Add(-time.Hour), nil, "expired")
+	require.True(t, errors.Is(err, apimethods.WrongData))
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v}`, id),
+		`GET`,
+		`/balance`,
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v,"balance":100,"currency":"RUB","bonus":50,"wallets":[{"currency":"RUB","balance":100}]}`, id))
+
+	// Bonuses go first, the grant expiring first is spent first
+	p, err := api.PayService(id, "ads", 40)
+	require.NoError(t, err)
+	require.Equal(t, 0.0, p.Real)
+	require.Equal(t, 40.0, p.Bonus)
+	require.Equal(t, 100.0, p.Balance)
+	require.Equal(t, 10.0, p.BonusBalance)
+
+	// The grant for ads only can not be spent on another service
+	req, _ := http.NewRequest(`POST`, `/services/pay`, bytes.NewBufferString(fmt.Sprintf(`{"id":%v,"service":"delivery","sum":30}`, id)))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req, server)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var payment handlers.ResponsePayment
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &payment))
+	require.Equal(t, handlers.ResponsePayment{ Status: 0, TransactionID: payment.TransactionID, ID: id, Service: "delivery", Sum: 30, Real: 20, Bonus: 10, Balance: 80, BonusBalance: 0 }, payment)
+
+	api.BonusOrder = apimethods.BonusLast
+	_, err = api.GrantBonus(id, 10, time.Now().Add(time.Hour), nil, "welcome")
+	require.NoError(t, err)
+
+	// Bonuses can not be withdrawn
+	_, _, err = api.RefillAndWithdrawMoney(id, -85)
+	require.True(t, errors.Is(err, apimethods.InsufficientFunds))
+
+	p, err = api.PayService(id, "ads", 85)
+	require.NoError(t, err)
+	require.Equal(t, 80.0, p.Real)
+	require.Equal(t, 5.0, p.Bonus)
+
+	_, err = api.PayService(id, "ads", 10)
+	require.True(t, errors.Is(err, apimethods.InsufficientFunds))
+
+	// The real money of payments counts against the withdraw limits
+	_, _, err = api.RefillAndWithdrawMoney(id, 100)
+	require.NoError(t, err)
+	require.NoError(t, api.SetLimit(id, apimethods.TransactionWithdraw, apimethods.PeriodDay, 130))
+
+	_, err = api.PayService(id, "delivery", 60)
+	require.True(t, errors.Is(err, apimethods.LimitExceeded))
+
+	limits, err := api.GetLimits(id)
+	require.NoError(t, err)
+	require.Equal(t, apimethods.TransactionWithdraw, limits[0].Operation)
+	require.Equal(t, 100.0, limits[0].Used)
+
+	_, err = api.PayService(id, "delivery", 30)
+	require.NoError(t, err)
+
+	// Expired bonuses are booked to the system account
+	_, err = api.ExpireBonuses(time.Now().Add(3 * time.Hour), 1000)
+	require.NoError(t, err)
+
+	var remaining float64
+	err = pool.QueryRow(context.Background(), `SELECT COALESCE(SUM(remaining), 0) FROM bonus_grants WHERE user_id = $1`, id).Scan(&remaining)
+	require.NoError(t, err)
+	require.Equal(t, 0.0, remaining)
+
+	var bonus float64
+	err = pool.QueryRow(context.Background(), `SELECT SUM(amount) FROM journal_entries WHERE account = $1`, fmt.Sprintf("bonus:%d", id)).Scan(&bonus)
+	require.NoError(t, err)
+	require.Equal(t, 0.0, bonus)
+
+	tb, err := api.TrialBalance()
+	require.NoError(t, err)
+	require.Equal(t, 0.0, tb.Totals["RUB"])
+
+	checkMethods(t, server,
+		`{"amount":10,"expires_at":"tomorrow"}`,
+		`POST`,
+		fmt.Sprintf(`/admin/accounts/%v/bonuses`, id),
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"grant_id":0,"id":0,"amount":0,"services":[],"expires_at":"0001-01-01T00:00:00Z"}`)
+}
+
+func TestVouchers(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	users := make([]int, 5)
+	for i := range users {
+		err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&users[i])
+		require.NoError(t, err)
+	}
+
+	batch, err := api.CreateVoucherBatch(apimethods.VoucherBatch{ Amount: 50, Count: 3, MaxRedemptions: 2, ValidUntil: time.Now().Add(time.Hour) })
+	require.NoError(t, err)
+	require.Equal(t, "RUB", batch.Currency)
+
+	req, _ := http.NewRequest(`GET`, fmt.Sprintf(`/admin/voucher-batches/%v/codes`, batch.ID), nil)
+	response := executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	require.Len(t, lines, 4)
+	require.Equal(t, "code,redemptions", lines[0])
+	code := strings.TrimSuffix(lines[1], ",0")
+	require.Len(t, code, 14)
+
+	// Concurrent redemptions of the same code never exceed max_redemptions
+	var wg sync.WaitGroup
+	errs := make([]error, len(users))
+	for i, id := range users {
+		wg.Add(1)
+		go func(i, id int) {
+			defer wg.Done()
+			_, errs[i] = api.RedeemVoucher(id, strings.ToLower(code))
+		}(i, id)
+	}
+	wg.Wait()
+
+	redeemed := 0
+	for _, err := range errs {
+		if err == nil {
+			redeemed++
+			continue
+		}
+		require.True(t, errors.Is(err, apimethods.VoucherUnavailable))
+	}
+	require.Equal(t, 2, redeemed)
+
+	req, _ = http.NewRequest(`GET`, fmt.Sprintf(`/admin/voucher-batches/%v`, batch.ID), nil)
+	response = executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var stats handlers.ResponseVoucherBatch
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &stats))
+	require.Equal(t, 0, stats.Status)
+	require.Equal(t, 3, stats.Count)
+	require.Equal(t, 1, stats.RedeemedCodes)
+	require.Equal(t, 2, stats.Redemptions)
+	require.Equal(t, 100.0, stats.RedeemedAmount)
+
+	// A user redeems a code once
+	other := strings.TrimSuffix(lines[2], ",0")
+	r, err := api.RedeemVoucher(users[0], other)
+	require.NoError(t, err)
+	require.Equal(t, 50.0, r.Amount)
+	_, err = api.RedeemVoucher(users[0], other)
+	require.True(t, errors.Is(err, apimethods.VoucherUnavailable))
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v,"code":"AAAA-AAAA-AAAA-AAAA"}`, users[0]),
+		`POST`,
+		`/vouchers/redeem`,
+		`application/json`,
+		http.StatusNotFound,
+		`{"status":2,"transaction_id":0,"id":0,"code":"","amount":0,"currency":"","balance":0}`)
+
+	expired, err := api.CreateVoucherBatch(apimethods.VoucherBatch{ Amount: 10, Currency: "USD", Count: 1, MaxRedemptions: 1,
+		ValidFrom: time.Now().Add(-2 * time.Hour), ValidUntil: time.Now().Add(-time.Hour) })
+	require.NoError(t, err)
+
+	var expiredCode string
+	require.NoError(t, api.ExportVouchers(expired.ID, func(v apimethods.Voucher) error {
+		expiredCode = v.Code
+		return nil
+	}))
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v,"code":"%v"}`, users[0], expiredCode),
+		`POST`,
+		`/vouchers/redeem`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":14,"transaction_id":0,"id":0,"code":"","amount":0,"currency":"","balance":0}`)
+
+	tb, err := api.TrialBalance()
+	require.NoError(t, err)
+	require.Equal(t, 0.0, tb.Totals["RUB"])
+}
+
+func TestSchedules(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	users := make([]int, 3)
+	for i := range users {
+		err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&users[i])
+		require.NoError(t, err)
+	}
+
+	_, _, err = api.RefillAndWithdrawMoney(users[0], 100)
+	require.NoError(t, err)
+
+	// A daily transfer that was due two and a half days ago runs once, the missed occurrences are skipped
+	start := time.Now().Add(-60 * time.Hour).Truncate(time.Second)
+	req, _ := http.NewRequest(`POST`, `/schedules`, bytes.NewBufferString(fmt.Sprintf(
+		`{"type":"transfer","from":%v,"to":%v,"sum":30,"comment":"rent","start_at":"%v","interval_seconds":86400}`,
+		users[0], users[1], start.Format(time.RFC3339))))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var transfer handlers.ResponseSchedule
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &transfer))
+	require.Equal(t, 0, transfer.Status)
+	require.Equal(t, "active", transfer.State)
+	require.True(t, transfer.DueAt.Equal(start))
+
+	// A one-off debit the user can not pay
+	debit, err := api.CreateSchedule(apimethods.Schedule{ Type: apimethods.ScheduleDebit, From: users[2], Sum: 10 }, time.Time{})
+	require.NoError(t, err)
+
+	_, err = api.RunSchedules(100)
+	require.NoError(t, err)
+
+	_, balance, err := api.GetBalance(users[0])
+	require.NoError(t, err)
+	require.Equal(t, 70.0, balance)
+	_, balance, err = api.GetBalance(users[1])
+	require.NoError(t, err)
+	require.Equal(t, 30.0, balance)
+
+	s, err := api.GetSchedule(transfer.ID)
+	require.NoError(t, err)
+	require.Equal(t, apimethods.ScheduleActive, s.Status)
+	require.True(t, s.DueAt.Equal(start.Add(72 * time.Hour)))
+	require.Len(t, s.Runs, 1)
+	require.Equal(t, apimethods.RunSucceeded, s.Runs[0].Status)
+	require.Equal(t, 70.0, s.Runs[0].Balance)
+
+	// Running again executes nothing: the next occurrence is in the future
+	_, err = api.RunSchedules(100)
+	require.NoError(t, err)
+	s, err = api.GetSchedule(transfer.ID)
+	require.NoError(t, err)
+	require.Len(t, s.Runs, 1)
+
+	s, err = api.GetSchedule(debit.ID)
+	require.NoError(t, err)
+	require.Equal(t, apimethods.ScheduleActive, s.Status)
+	require.Equal(t, 1, s.Attempts)
+	require.True(t, s.NextRunAt.After(time.Now()))
+	require.Len(t, s.Runs, 1)
+	require.Equal(t, apimethods.RunRetry, s.Runs[0].Status)
+
+	// The retry is due now and still fails: the last attempt fails the schedule
+	api.ScheduleMaxAttempts = 2
+	_, err = pool.Exec(context.Background(), `UPDATE schedules SET next_run_at = now() WHERE id = $1`, debit.ID)
+	require.NoError(t, err)
+	_, err = api.RunSchedules(100)
+	require.NoError(t, err)
+
+	s, err = api.GetSchedule(debit.ID)
+	require.NoError(t, err)
+	require.Equal(t, apimethods.ScheduleFailed, s.Status)
+	require.Len(t, s.Runs, 2)
+	require.Equal(t, apimethods.RunFailed, s.Runs[0].Status)
+	require.Equal(t, 2, s.Runs[0].Attempt)
+
+	// A run that can never succeed fails at once
+	var closed int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&closed)
+	require.NoError(t, err)
+	_, err = api.SetAccountStatus(closed, apimethods.StatusClosed, "moved away", false)
+	require.NoError(t, err)
+
+	once, err := api.CreateSchedule(apimethods.Schedule{ Type: apimethods.ScheduleTransfer, From: users[0], To: closed, Sum: 10 }, time.Time{})
+	require.NoError(t, err)
+	_, err = api.RunSchedules(100)
+	require.NoError(t, err)
+
+	s, err = api.GetSchedule(once.ID)
+	require.NoError(t, err)
+	require.Equal(t, apimethods.ScheduleFailed, s.Status)
+	require.Len(t, s.Runs, 1)
+	require.Equal(t, apimethods.RunFailed, s.Runs[0].Status)
+
+	// The runs of a shared account would have no member to spend it on behalf of
+	family, err := api.CreateSharedAccount(users[0])
+	require.NoError(t, err)
+	_, err = api.CreateSchedule(apimethods.Schedule{ Type: apimethods.ScheduleDebit, From: family, Sum: 10 }, time.Time{})
+	require.True(t, errors.Is(err, apimethods.MemberForbidden))
+
+	list, err := api.ListSchedules(users[0])
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+
+	checkMethods(t, server,
+		``,
+		`DELETE`,
+		fmt.Sprintf(`/schedules/%v`, transfer.ID),
+		``,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v}`, transfer.ID))
+
+	checkMethods(t, server,
+		``,
+		`DELETE`,
+		fmt.Sprintf(`/schedules/%v`, transfer.ID),
+		``,
+		http.StatusBadRequest,
+		`{"status":1,"id":0}`)
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"type":"transfer","from":%v,"to":%v,"sum":10,"interval_seconds":10}`, users[0], users[1]),
+		`POST`,
+		`/schedules`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"id":0,"type":"","from":0,"to":0,"sum":0,"currency":"","comment":"","interval_seconds":0,"day_of_month":0,"state":"","due_at":"0001-01-01T00:00:00Z","next_run_at":"0001-01-01T00:00:00Z","attempts":0}`)
+
+	tb, err := api.TrialBalance()
+	require.NoError(t, err)
+	require.Equal(t, 0.0, tb.Totals["RUB"])
+}
+
+func TestPendingTransfers(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	users := make([]int, 3)
+	for i := range users {
+		err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&users[i])
+		require.NoError(t, err)
+	}
+
+	_, _, err = api.RefillAndWithdrawMoney(users[0], 100)
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(`POST`, `/transfer`, bytes.NewBufferString(fmt.Sprintf(`{"from":%v,"to":%v,"sum":60,"pending":true}`, users[0], users[1])))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var held handlers.ResponsePendingTransfer
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &held))
+	require.Equal(t, 0, held.Status)
+	require.Equal(t, "pending", held.State)
+	require.Equal(t, 100.0, held.FromBalance)
+	require.Equal(t, 0.0, held.ToBalance)
+
+	// The hold is announced with the money held and left available
+	var hold pkgevents.Event
+	err = pool.QueryRow(context.Background(), `SELECT payload FROM outbox WHERE account_id = $1 AND type = $2 ORDER BY id DESC LIMIT 1`,
+		users[0], apimethods.TransactionHold).Scan(&hold)
+	require.NoError(t, err)
+	require.Equal(t, 100.0, hold.Balance)
+	require.Equal(t, 60.0, *hold.Held)
+	require.Equal(t, 40.0, *hold.Available)
+
+	// The held money stays in the balance, but can not be spent
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v}`, users[0]),
+		`GET`,
+		`/balance`,
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v,"balance":100,"held":60,"currency":"RUB","bonus":0,"wallets":[{"currency":"RUB","balance":100,"held":60}]}`, users[0]))
+
+	_, _, err = api.RefillAndWithdrawMoney(users[0], -50)
+	require.True(t, errors.Is(err, apimethods.InsufficientFunds))
+	_, err = api.HoldTransfer(users[0], users[2], "", "", 50)
+	require.True(t, errors.Is(err, apimethods.InsufficientFunds))
+
+	// Only the recipient accepts the transfer
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v}`, users[2]),
+		`POST`,
+		fmt.Sprintf(`/pending-transfers/%v/accept`, held.TransferID),
+		`application/json`,
+		http.StatusNotFound,
+		`{"status":2,"transfer_id":0,"from_id":0,"from_balance":0,"to_id":0,"to_balance":0,"sum":0,"fee":0,"currency":"","state":"","created_at":"0001-01-01T00:00:00Z","expires_at":"0001-01-01T00:00:00Z"}`)
+
+	list, err := api.ListPendingTransfers(users[1])
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+
+	p, err := api.AcceptTransfer(held.TransferID, users[1])
+	require.NoError(t, err)
+	require.Equal(t, apimethods.TransferAccepted, p.Status)
+	require.Equal(t, 40.0, p.FromBalance)
+	require.Equal(t, 60.0, p.ToBalance)
+
+	// A resolved transfer can not be cancelled
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v}`, users[0]),
+		`POST`,
+		fmt.Sprintf(`/pending-transfers/%v/cancel`, held.TransferID),
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":15,"transfer_id":0,"from_id":0,"from_balance":0,"to_id":0,"to_balance":0,"sum":0,"fee":0,"currency":"","state":"","created_at":"0001-01-01T00:00:00Z","expires_at":"0001-01-01T00:00:00Z"}`)
+
+	// Declined and cancelled transfers release the money
+	declined, err := api.HoldTransfer(users[0], users[2], "", "", 10)
+	require.NoError(t, err)
+	cancelled, err := api.HoldTransfer(users[0], users[2], "", "", 20)
+	require.NoError(t, err)
+
+	_, err = api.DeclineTransfer(declined.ID, users[0])
+	require.True(t, errors.Is(err, apimethods.NotFound))
+	p, err = api.DeclineTransfer(declined.ID, users[2])
+	require.NoError(t, err)
+	require.Equal(t, apimethods.TransferDeclined, p.Status)
+	p, err = api.CancelTransfer(cancelled.ID, users[0])
+	require.NoError(t, err)
+	require.Equal(t, apimethods.TransferCancelled, p.Status)
+
+	wallets, err := api.GetWallets(users[0], "")
+	require.NoError(t, err)
+	require.Equal(t, 40.0, wallets[0].Balance)
+	require.Equal(t, 0.0, wallets[0].Held)
+
+	var release pkgevents.Event
+	err = pool.QueryRow(context.Background(), `SELECT payload FROM outbox WHERE account_id = $1 AND type = $2 ORDER BY id DESC LIMIT 1`,
+		users[0], apimethods.TransactionHoldRelease).Scan(&release)
+	require.NoError(t, err)
+	require.Equal(t, 0.0, *release.Held)
+	require.Equal(t, 40.0, *release.Available)
+
+	// An unclaimed transfer goes back to the sender when it expires
+	api.PendingTimeout = 0
+	expired, err := api.HoldTransfer(users[0], users[2], "", "", 40)
+	require.NoError(t, err)
+
+	_, err = api.AcceptTransfer(expired.ID, users[2])
+	require.True(t, errors.Is(err, apimethods.TransferNotPending))
+
+	n, err := api.ExpireTransfers(time.Now(), 1000)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, n, 1)
+
+	list, err = api.ListPendingTransfers(users[0])
+	require.NoError(t, err)
+	require.Len(t, list, 0)
+
+	_, balance, err := api.RefillAndWithdrawMoney(users[0], -40)
+	require.NoError(t, err)
+	require.Equal(t, 0.0, balance)
+
+	_, balance, err = api.GetBalance(users[2])
+	require.NoError(t, err)
+	require.Equal(t, 0.0, balance)
+
+	tb, err := api.TrialBalance()
+	require.NoError(t, err)
+	require.Equal(t, 0.0, tb.Totals["RUB"])
+
+	// Held sums count toward the limits before they are accepted
+	_, _, err = api.RefillAndWithdrawMoney(users[2], 100)
+	require.NoError(t, err)
+	require.NoError(t, api.SetLimit(users[2], apimethods.TransactionTransfer, apimethods.PeriodDay, 50))
+
+	first, err := api.HoldTransfer(users[2], users[1], "", "", 30)
+	require.NoError(t, err)
+	_, err = api.HoldTransfer(users[2], users[1], "", "", 30)
+	require.True(t, errors.Is(err, apimethods.LimitExceeded))
+
+	// The fee held is charged on accept, whatever the rules are by then
+	defer pool.Exec(context.Background(), `DELETE FROM fee_rules`)
+	require.NoError(t, api.SetFeeRule(apimethods.FeeRule{ Fixed: 5 }))
+
+	p, err = api.AcceptTransfer(first.ID, users[1])
+	require.NoError(t, err)
+	require.Equal(t, 0.0, p.Fee)
+	require.Equal(t, 70.0, p.FromBalance)
+
+	// Held transfers use up the free tier
+	require.NoError(t, api.SetFeeRule(apimethods.FeeRule{ Fixed: 5, FreePerMonth: 2 }))
+
+	free, err := api.HoldTransfer(users[2], users[1], "", "", 10)
+	require.NoError(t, err)
+	require.Equal(t, 0.0, free.Fee)
+	charged, err := api.HoldTransfer(users[2], users[1], "", "", 5)
+	require.NoError(t, err)
+	require.Equal(t, 5.0, charged.Fee)
+}
+
+func TestPaymentRequests(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	users := make([]int, 3)
+	for i := range users {
+		err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&users[i])
+		require.NoError(t, err)
+	}
+
+	_, _, err = api.RefillAndWithdrawMoney(users[1], 100)
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(`POST`, `/payment-requests`, bytes.NewBufferString(fmt.Sprintf(
+		`{"requester":%v,"payer":%v,"amount":40,"comment":"dinner"}`, users[0], users[1])))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var dinner handlers.ResponsePaymentRequest
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &dinner))
+	require.Equal(t, 0, dinner.Status)
+	require.Equal(t, "pending", dinner.State)
+	require.True(t, dinner.ExpiresAt.After(time.Now().Add(6 * 24 * time.Hour)))
+
+	// Only the payer pays the request
+	_, err = api.PayRequest(dinner.RequestID, users[2])
+	require.True(t, errors.Is(err, apimethods.NotFound))
+
+	req, _ = http.NewRequest(`POST`, fmt.Sprintf(`/payment-requests/%v/pay`, dinner.RequestID), bytes.NewBufferString(fmt.Sprintf(`{"id":%v}`, users[1])))
+	req.Header.Set("Content-Type", "application/json")
+	response = executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var paid handlers.ResponsePaymentRequest
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &paid))
+	require.Equal(t, "paid", paid.State)
+	require.NotZero(t, paid.TransactionID)
+	require.Equal(t, 60.0, *paid.PayerBalance)
+	require.Equal(t, 40.0, *paid.RequesterBalance)
+
+	// The payment is a transfer linked to the request
+	var kind, comment string
+	err = pool.QueryRow(context.Background(), `SELECT type, comment FROM transactions WHERE id = $1`, paid.TransactionID).Scan(&kind, &comment)
+	require.NoError(t, err)
+	require.Equal(t, apimethods.TransactionTransfer, kind)
+	require.Equal(t, fmt.Sprintf("payment request %v: dinner", dinner.RequestID), comment)
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v}`, users[1]),
+		`POST`,
+		fmt.Sprintf(`/payment-requests/%v/decline`, dinner.RequestID),
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":16,"request_id":0,"requester":0,"payer":0,"amount":0,"currency":"","comment":"","state":"","created_at":"0001-01-01T00:00:00Z","expires_at":"0001-01-01T00:00:00Z","transaction_id":0}`)
+
+	// More requests: one declined, one unpaid for lack of money, one expired
+	declined, err := api.CreatePaymentRequest(apimethods.PaymentRequest{ Requester: users[0], Payer: users[1], Amount: 5 })
+	require.NoError(t, err)
+	_, err = api.DeclineRequest(declined.ID, users[1])
+	require.NoError(t, err)
+
+	large, err := api.CreatePaymentRequest(apimethods.PaymentRequest{ Requester: users[0], Payer: users[1], Amount: 500 })
+	require.NoError(t, err)
+	_, err = api.PayRequest(large.ID, users[1])
+	require.True(t, errors.Is(err, apimethods.InsufficientFunds))
+
+	expired, err := api.CreatePaymentRequest(apimethods.PaymentRequest{ Requester: users[2], Payer: users[1], Amount: 1,
+		ExpiresAt: time.Now().Add(time.Second) })
+	require.NoError(t, err)
+	_, err = pool.Exec(context.Background(), `UPDATE payment_requests SET expires_at = now() WHERE id = $1`, expired.ID)
+	require.NoError(t, err)
+	_, err = api.PayRequest(expired.ID, users[1])
+	require.True(t, errors.Is(err, apimethods.RequestNotPending))
+
+	// The requests of the payer page by page, the newest first
+	var ids []int64
+	cursor := ""
+	for page := 0; page < 3; page++ {
+		req, _ = http.NewRequest(`GET`, fmt.Sprintf(`/accounts/%v/payment-requests?role=payer&limit=3%v`, users[1], cursor), nil)
+		response = executeRequest(req, server)
+		checkResponseCode(t, http.StatusOK, response.Code)
+
+		var list handlers.ResponsePaymentRequests
+		require.NoError(t, json.Unmarshal(response.Body.Bytes(), &list))
+		for _, r := range list.Requests {
+			ids = append(ids, r.RequestID)
+		}
+		if list.NextCursor == 0 {
+			break
+		}
+		cursor = fmt.Sprintf(`&cursor=%v`, list.NextCursor)
+	}
+	require.Equal(t, []int64{ expired.ID, large.ID, declined.ID, dinner.RequestID }, ids)
+
+	requests, next, err := api.ListPaymentRequests(users[1], apimethods.RequestFilter{ Statuses: []string{ "pending", "expired" }, Limit: 10 })
+	require.NoError(t, err)
+	require.Zero(t, next)
+	require.Len(t, requests, 2)
+	require.Equal(t, apimethods.RequestExpired, requests[0].Status)
+	require.Equal(t, apimethods.RequestPending, requests[1].Status)
+
+	requests, _, err = api.ListPaymentRequests(users[0], apimethods.RequestFilter{ Role: apimethods.RoleRequester, Statuses: []string{ "paid" }, Limit: 10 })
+	require.NoError(t, err)
+	require.Len(t, requests, 1)
+	require.Equal(t, paid.TransactionID, requests[0].TransactionID)
+
+	checkMethods(t, server,
+		``,
+		`GET`,
+		fmt.Sprintf(`/accounts/%v/payment-requests?status=unknown`, users[1]),
+		``,
+		http.StatusBadRequest,
+		`{"status":1,"requests":[],"next_cursor":0}`)
+}
+
+func TestSplitTransfer(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	users := make([]int, 4)
+	for i := range users {
+		err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&users[i])
+		require.NoError(t, err)
+	}
+
+	_, _, err = api.RefillAndWithdrawMoney(users[0], 100)
+	require.NoError(t, err)
+
+	// A seller, a courier and the platform are paid by amounts
+	req, _ := http.NewRequest(`POST`, `/transfers:split`, bytes.NewBufferString(fmt.Sprintf(
+		`{"from":%v,"sum":60,"comment":"order","recipients":[{"to":%v,"amount":50},{"to":%v,"amount":7.5},{"to":%v,"amount":2.5}]}`,
+		users[0], users[1], users[2], users[3])))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var split handlers.ResponseSplit
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &split))
+	require.Equal(t, 0, split.Status)
+	require.Equal(t, 40.0, split.FromBalance)
+	require.Len(t, split.Recipients, 3)
+	for i, expected := range []float64{ 50, 7.5, 2.5 } {
+		require.Equal(t, users[i + 1], split.Recipients[i].ToID)
+		require.Equal(t, expected, split.Recipients[i].Amount)
+		require.Equal(t, expected, split.Recipients[i].ToBalance)
+	}
+	require.NotZero(t, split.TransactionID)
+
+	// 10 kopecks split in thirds: the kopeck left goes to the largest remainder
+	res, err := api.SplitTransfer(apimethods.Split{ From: users[0], Sum: 0.10, Parts: []apimethods.SplitPart{
+		{ To: users[1], Percent: 33.33 }, { To: users[2], Percent: 33.33 }, { To: users[3], Percent: 33.34 } } })
+	require.NoError(t, err)
+	require.Equal(t, 0.03, res.Shares[0].Amount)
+	require.Equal(t, 0.03, res.Shares[1].Amount)
+	require.Equal(t, 0.04, res.Shares[2].Amount)
+	require.Equal(t, 39.9, math.Round(res.FromBalance * 100) / 100)
+
+	// Every recipient must get at least a kopeck
+	_, err = api.SplitTransfer(apimethods.Split{ From: users[0], Sum: 0.02, Parts: []apimethods.SplitPart{
+		{ To: users[1], Percent: 33.33 }, { To: users[2], Percent: 33.33 }, { To: users[3], Percent: 33.34 } } })
+	require.True(t, errors.Is(err, apimethods.WrongData))
+
+	// Equal remainders: the first recipient gets the kopeck left
+	res, err = api.SplitTransfer(apimethods.Split{ From: users[0], Sum: 0.05, Parts: []apimethods.SplitPart{
+		{ To: users[1], Percent: 50 }, { To: users[2], Percent: 50 } } })
+	require.NoError(t, err)
+	require.Equal(t, 0.03, res.Shares[0].Amount)
+	require.Equal(t, 0.02, res.Shares[1].Amount)
+
+	// If one part fails, nobody gets the money
+	_, err = api.SplitTransfer(apimethods.Split{ From: users[0], Parts: []apimethods.SplitPart{
+		{ To: users[1], Amount: 30 }, { To: users[2], Amount: 30 } } })
+	require.True(t, errors.Is(err, apimethods.InsufficientFunds))
+
+	_, balance, err := api.GetBalance(users[1])
+	require.NoError(t, err)
+	require.Equal(t, 50.06, balance)
+
+	// The limits apply to the whole split, not to every share
+	var payer int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance (balance) VALUES (50000) RETURNING id`).Scan(&payer)
+	require.NoError(t, err)
+
+	_, err = api.SplitTransfer(apimethods.Split{ From: payer, Parts: []apimethods.SplitPart{
+		{ To: users[1], Amount: 10000 }, { To: users[2], Amount: 10000 }, { To: users[3], Amount: 10000 } } })
+	require.True(t, errors.Is(err, apimethods.LimitExceeded))
+
+	// The fee is charged once on the sum of the shares
+	defer pool.Exec(context.Background(), `DELETE FROM fee_rules`)
+	require.NoError(t, api.SetFeeRule(apimethods.FeeRule{ Fixed: 5 }))
+
+	res, err = api.SplitTransfer(apimethods.Split{ From: payer, Parts: []apimethods.SplitPart{
+		{ To: users[1], Amount: 5000 }, { To: users[2], Amount: 5000 }, { To: users[3], Amount: 5000 } } })
+	require.NoError(t, err)
+	require.Equal(t, 5.0, res.Fee)
+	require.Equal(t, 34995.0, res.FromBalance)
+
+	// A split has no single recipient to refund it from
+	_, err = api.RefundTransaction(res.TransactionID, 0, "mistake", "support", false)
+	require.True(t, errors.Is(err, apimethods.WrongData))
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"from":%v,"sum":10,"recipients":[{"to":%v,"percent":50},{"to":%v,"percent":40}]}`, users[0], users[1], users[2]),
+		`POST`,
+		`/transfers:split`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"from_id":0,"from_balance":0,"currency":"","fee":0,"transaction_id":0,"recipients":[]}`)
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"from":%v,"recipients":[{"to":%v,"amount":1},{"to":%v,"amount":1}]}`, users[0], users[1], users[1]),
+		`POST`,
+		`/transfers:split`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"from_id":0,"from_balance":0,"currency":"","fee":0,"transaction_id":0,"recipients":[]}`)
+
+	tb, err := api.TrialBalance()
+	require.NoError(t, err)
+	require.Equal(t, 0.0, tb.Totals["RUB"])
+}
+
+func TestEscrow(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	var buyer, seller int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&buyer)
+	require.NoError(t, err)
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&seller)
+	require.NoError(t, err)
+
+	_, _, err = api.RefillAndWithdrawMoney(buyer, 100)
+	require.NoError(t, err)
+
+	// The buyer funds the deal, the money leaves the wallet
+	req, _ := http.NewRequest(`POST`, `/escrow/deals`, bytes.NewBufferString(fmt.Sprintf(
+		`{"buyer":%v,"seller":%v,"amount":60,"comment":"bicycle"}`, buyer, seller)))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var deal handlers.ResponseDeal
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &deal))
+	require.Equal(t, 0, deal.Status)
+	require.Equal(t, apimethods.DealFunded, deal.State)
+	require.Equal(t, 60.0, deal.Amount)
+
+	_, balance, err := api.GetBalance(buyer)
+	require.NoError(t, err)
+	require.Equal(t, 40.0, balance)
+
+	_, err = api.CreateDeal(apimethods.Deal{ Buyer: buyer, Seller: seller, Amount: 50 })
+	require.True(t, errors.Is(err, apimethods.InsufficientFunds))
+
+	// Only the seller refunds and only the buyer releases
+	_, err = api.RefundDeal(deal.DealID, buyer, "")
+	require.True(t, errors.Is(err, apimethods.NotFound))
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v}`, seller),
+		`POST`,
+		fmt.Sprintf(`/escrow/deals/%v/release`, deal.DealID),
+		`application/json`,
+		http.StatusNotFound,
+		`{"status":2,"deal_id":0,"buyer":0,"seller":0,"amount":0,"currency":"","comment":"","state":"","created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z"}`)
+
+	// Only a disputed deal is resolved by an administrator
+	_, err = api.ResolveDeal(deal.DealID, 30, "too early")
+	require.True(t, errors.Is(err, apimethods.DealConflict))
+
+	released, err := api.ReleaseDeal(deal.DealID, buyer, "received")
+	require.NoError(t, err)
+	require.Equal(t, apimethods.DealReleased, released.Status)
+
+	_, balance, err = api.GetBalance(seller)
+	require.NoError(t, err)
+	require.Equal(t, 60.0, balance)
+
+	_, err = api.DisputeDeal(deal.DealID, buyer, "")
+	require.True(t, errors.Is(err, apimethods.DealConflict))
+
+	// A disputed deal split between the parties
+	disputed, err := api.CreateDeal(apimethods.Deal{ Buyer: buyer, Seller: seller, Amount: 30 })
+	require.NoError(t, err)
+	_, err = api.DisputeDeal(disputed.ID, seller, "buyer does not answer")
+	require.NoError(t, err)
+
+	req, _ = http.NewRequest(`POST`, fmt.Sprintf(`/admin/escrow/deals/%v/resolve`, disputed.ID),
+		bytes.NewBufferString(`{"to_seller":12.5,"reason":"half of the goods delivered"}`))
+	req.Header.Set("Content-Type", "application/json")
+	response = executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &deal))
+	require.Equal(t, apimethods.DealSplit, deal.State)
+
+	_, balance, err = api.GetBalance(seller)
+	require.NoError(t, err)
+	require.Equal(t, 72.5, balance)
+	_, balance, err = api.GetBalance(buyer)
+	require.NoError(t, err)
+	require.Equal(t, 27.5, balance)
+
+	d, err := api.GetDeal(disputed.ID)
+	require.NoError(t, err)
+	require.Len(t, d.History, 3)
+	require.Equal(t, apimethods.DealFunded, d.History[0].Status)
+	require.Equal(t, apimethods.DealSeller, d.History[1].Actor)
+	require.Equal(t, apimethods.DealAdmin, d.History[2].Actor)
+	require.Equal(t, 12.5, d.History[2].ToSeller)
+	require.Equal(t, 17.5, d.History[2].ToBuyer)
+	require.NotZero(t, d.History[2].SellerTransactionID)
+	require.NotZero(t, d.History[2].BuyerTransactionID)
+
+	// Nothing is left on the escrow accounts of the deals
+	var left float64
+	err = pool.QueryRow(context.Background(), `SELECT COALESCE(SUM(amount), 0) FROM journal_entries WHERE account = ANY($1)`,
+		[]string{ fmt.Sprintf("escrow:%v", released.ID), fmt.Sprintf("escrow:%v", disputed.ID) }).Scan(&left)
+	require.NoError(t, err)
+	require.Equal(t, 0.0, left)
+
+	// A deal is a transfer for the limits of the buyer
+	var rich int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance (balance) VALUES (20000) RETURNING id`).Scan(&rich)
+	require.NoError(t, err)
+
+	req, _ = http.NewRequest(`POST`, `/escrow/deals`, bytes.NewBufferString(fmt.Sprintf(
+		`{"buyer":%v,"seller":%v,"amount":15000.01}`, rich, seller)))
+	req.Header.Set("Content-Type", "application/json")
+	response = executeRequest(req, server)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	var limited handlers.ResponseDeal
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &limited))
+	require.Equal(t, 10, limited.Status)
+	require.Zero(t, limited.DealID)
+
+	_, err = api.CreateDeal(apimethods.Deal{ Buyer: rich, Seller: seller, Amount: 15000 })
+	require.NoError(t, err)
+
+	_, balance, err = api.GetBalance(rich)
+	require.NoError(t, err)
+	require.Equal(t, 5000.0, balance)
+
+	checkMethods(t, server,
+		``,
+		`GET`,
+		`/escrow/deals/0`,
+		``,
+		http.StatusBadRequest,
+		`{"status":1,"deal_id":0,"buyer":0,"seller":0,"amount":0,"currency":"","comment":"","state":"","created_at":"0001-01-01T00:00:00Z","updated_at":"0001-01-01T00:00:00Z"}`)
+}
+
+func TestSharedAccounts(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	users := make([]int, 4)
+	for i := range users {
+		err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&users[i])
+		require.NoError(t, err)
+	}
+	owner, spender, viewer, stranger := users[0], users[1], users[2], users[3]
+
+	req, _ := http.NewRequest(`POST`, `/shared-accounts`, bytes.NewBufferString(fmt.Sprintf(`{"owner":%v}`, owner)))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var created handlers.ResponseID
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &created))
+	require.Equal(t, 0, created.Status)
+	family := int(created.ID)
+
+	// Anyone can refill a shared account
+	_, _, err = api.RefillAndWithdrawMoney(family, 100)
+	require.NoError(t, err)
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"by":%v,"role":"spender","limit":30,"period":"day"}`, owner),
+		`PUT`,
+		fmt.Sprintf(`/shared-accounts/%v/members/%v`, family, spender),
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v}`, spender))
+
+	// Only owners manage the members
+	checkMethods(t, server,
+		fmt.Sprintf(`{"by":%v,"role":"viewer"}`, spender),
+		`PUT`,
+		fmt.Sprintf(`/shared-accounts/%v/members/%v`, family, viewer),
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":18,"id":0}`)
+
+	require.NoError(t, api.SetMember(owner, apimethods.Member{ AccountID: family, UserID: viewer, Role: apimethods.MemberViewer }))
+
+	// Without a member money does not leave a shared account
+	_, _, err = api.RefillAndWithdrawMoney(family, -10)
+	require.True(t, errors.Is(err, apimethods.MemberForbidden))
+	_, _, _, _, err = api.TransferMoney(family, stranger, 10)
+	require.True(t, errors.Is(err, apimethods.MemberForbidden))
+
+	for _, member := range []int{ viewer, stranger } {
+		_, _, _, _, err = api.TransferMember(family, member, stranger, "", "", 10)
+		require.True(t, errors.Is(err, apimethods.MemberForbidden))
+	}
+
+	// The spender spends up to their limit
+	checkMethods(t, server,
+		fmt.Sprintf(`{"from":%v,"to":%v,"sum":20,"member":%v}`, family, stranger, spender),
+		`POST`,
+		`/transfer`,
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"from_id":%v,"from_balance":80,"to_id":%v,"to_balance":20}`, family, stranger))
+
+	checkMethods(t, server,
+		fmt.Sprintf(`{"id":%v,"sum":-15,"member":%v}`, family, spender),
+		`POST`,
+		`/withdraw`,
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":10,"id":0,"balance":0,"remaining":10}`)
+
+	// The owner has no limit
+	_, balance, err := api.RefillAndWithdrawMember(family, owner, "", -50)
+	require.NoError(t, err)
+	require.Equal(t, 30.0, balance)
+
+	members, err := api.ListMembers(family)
+	require.NoError(t, err)
+	require.Len(t, members, 3)
+	require.Equal(t, apimethods.MemberOwner, members[0].Role)
+	require.Equal(t, 20.0, members[1].Used)
+	require.Equal(t, 10.0, members[1].Remaining)
+
+	// Every transaction records the member who made it
+	var attributed []int
+	rows, err := pool.Query(context.Background(), `SELECT member_id FROM transactions WHERE from_id = $1 ORDER BY id`, family)
+	require.NoError(t, err)
+	for rows.Next() {
+		var member int
+		require.NoError(t, rows.Scan(&member))
+		attributed = append(attributed, member)
+	}
+	rows.Close()
+	require.Equal(t, []int{ spender, owner }, attributed)
+
+	// The last owner can not leave, the spender can
+	require.True(t, errors.Is(api.RemoveMember(family, owner, owner), apimethods.WrongData))
+	checkMethods(t, server,
+		``,
+		`DELETE`,
+		fmt.Sprintf(`/shared-accounts/%v/members/%v?by=%v`, family, spender, spender),
+		``,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v}`, spender))
+
+	_, _, err = api.RefillAndWithdrawMember(family, spender, "", -1)
+	require.True(t, errors.Is(err, apimethods.MemberForbidden))
+
+	// A personal account is spent only by its holder
+	_, _, _, _, err = api.TransferMember(stranger, owner, family, "", "", 1)
+	require.True(t, errors.Is(err, apimethods.MemberForbidden))
+}
+
+func TestSubAccounts(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+
+	server.MountHandlers(api)
+
+	var company int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&company)
+	require.NoError(t, err)
+
+	_, _, err = api.RefillAndWithdrawMoney(company, 1000)
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(`POST`, fmt.Sprintf(`/accounts/%v/sub-accounts`, company),
+		bytes.NewBufferString(`{"draw_limit":100,"draw_period":"month"}`))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var created handlers.ResponseID
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &created))
+	require.Equal(t, 0, created.Status)
+	sales := int(created.ID)
+
+	marketing, err := api.CreateSubAccount(company, 0, "")
+	require.NoError(t, err)
+	team, err := api.CreateSubAccount(sales, 0, "")
+	require.NoError(t, err)
+
+	// The parent allocates money down the tree
+	req, _ = http.NewRequest(`POST`, fmt.Sprintf(`/accounts/%v/allocate`, company),
+		bytes.NewBufferString(fmt.Sprintf(`{"to":%v,"sum":300}`, sales)))
+	req.Header.Set("Content-Type", "application/json")
+	response = executeRequest(req, server)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var allocation handlers.ResponseAllocation
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &allocation))
+	require.Equal(t, 700.0, allocation.ParentBalance)
+	require.Equal(t, 300.0, allocation.ChildBalance)
+	require.NotZero(t, allocation.TransactionID)
+
+	_, err = api.Allocate(sales, team, "", 50)
+	require.NoError(t, err)
+	_, err = api.Allocate(company, marketing, "", 200)
+	require.NoError(t, err)
+
+	// Only direct sub-accounts are allocated to
+	_, err = api.Allocate(company, team, "", 10)
+	require.True(t, errors.Is(err, apimethods.NotFound))
+
+	// The parent takes money back
+	a, err := api.Allocate(company, marketing, "", -50)
+	require.NoError(t, err)
+	require.Equal(t, 550.0, a.ParentBalance)
+	require.Equal(t, 150.0, a.ChildBalance)
+
+	_, err = api.Allocate(company, marketing, "", -500)
+	require.True(t, errors.Is(err, apimethods.InsufficientFunds))
+
+	// Sales draws up to its limit, marketing can not draw
+	a, err = api.DrawFromParent(sales, 70)
+	require.NoError(t, err)
+	require.Equal(t, company, a.Parent)
+	require.Equal(t, 320.0, a.ChildBalance)
+
+	checkMethods(t, server,
+		`{"sum":40}`,
+		`POST`,
+		fmt.Sprintf(`/accounts/%v/draw`, sales),
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":10,"parent_id":0,"parent_balance":0,"child_id":0,"child_balance":0,"currency":"","transaction_id":0,"remaining":30}`)
+
+	_, err = api.DrawFromParent(marketing, 1)
+	require.True(t, errors.Is(err, apimethods.LimitExceeded))
+
+	_, err = api.DrawFromParent(company, 1)
+	require.True(t, errors.Is(err, apimethods.NotFound))
+
+	require.NoError(t, api.SetDrawLimit(company, marketing, 10, apimethods.PeriodSingle))
+	_, err = api.DrawFromParent(marketing, 10)
+	require.NoError(t, err)
+
+	// Totals per subtree, depth first
+	nodes, err := api.Rollup(company, "")
+	require.NoError(t, err)
+	require.Equal(t, []apimethods.RollupNode{
+		{ ID: company, ParentID: 0, Depth: 0, Balance: 470, Total: 1000 },
+		{ ID: sales, ParentID: company, Depth: 1, Balance: 320, Total: 370 },
+		{ ID: team, ParentID: sales, Depth: 2, Balance: 50, Total: 50 },
+		{ ID: marketing, ParentID: company, Depth: 1, Balance: 160, Total: 160 },
+	}, nodes)
+
+	checkMethods(t, server,
+		``,
+		`GET`,
+		fmt.Sprintf(`/accounts/%v/rollup`, team),
+		``,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"currency":"RUB","accounts":[{"id":%v,"parent_id":%v,"depth":0,"balance":50,"total":50}]}`, team, sales))
+}
+
+func TestOverdraft(t *testing.T) {
+	pool, err := pkgpostgres.NewPool(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		log.Fatal(fmt.Errorf("NewPool() error: %w", err))
+	}
+
+	defer pool.Close()
+
+	server := CreateNewServer()
+
+	api := apimethods.New(pool)
+	api.OverdraftDailyRate = 0.001
+	api.OverdraftDailyFee = 1
+
+	server.MountHandlers(api)
+
+	var partner int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&partner)
+	require.NoError(t, err)
+
+	_, _, err = api.RefillAndWithdrawMoney(partner, 100)
+	require.NoError(t, err)
+
+	// Without a credit line the balance can not go below zero
+	_, _, err = api.RefillAndWithdrawMoney(partner, -300)
+	require.True(t, errors.Is(err, apimethods.InsufficientFunds))
+
+	checkMethods(t, server,
+		`{"credit_limit":-1}`,
+		`PUT`,
+		fmt.Sprintf(`/admin/accounts/%v/credit-limit`, partner),
+		`application/json`,
+		http.StatusBadRequest,
+		`{"status":1,"id":0}`)
+
+	checkMethods(t, server,
+		`{"credit_limit":500}`,
+		`PUT`,
+		fmt.Sprintf(`/admin/accounts/%v/credit-limit`, partner),
+		`application/json`,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v}`, partner))
+
+	_, balance, err := api.RefillAndWithdrawMoney(partner, -400)
+	require.NoError(t, err)
+	require.Equal(t, -300.0, balance)
+
+	// The credit line is spent
+	_, _, err = api.RefillAndWithdrawMoney(partner, -250)
+	require.True(t, errors.Is(err, apimethods.InsufficientFunds))
+
+	checkMethods(t, server,
+		``,
+		`GET`,
+		fmt.Sprintf(`/accounts/%v/overdraft`, partner),
+		``,
+		http.StatusOK,
+		fmt.Sprintf(`{"status":0,"id":%v,"credit_limit":500,"balance":-300,"used":300,"available":200,"accrued":0}`, partner))
+
+	// Interest and the fee are charged once a day
+	day := time.Now()
+	_, err = api.AccrueOverdraft(day, 1000)
+	require.NoError(t, err)
+	_, err = api.AccrueOverdraft(day, 1000)
+	require.NoError(t, err)
+
+	o, err := api.GetOverdraft(partner)
+	require.NoError(t, err)
+	require.Equal(t, -301.3, o.Balance)
+	require.Equal(t, 301.3, o.Used)
+	require.Equal(t, 1.3, o.Accrued)
+
+	var amount, fee float64
+	err = pool.QueryRow(context.Background(), `SELECT amount, fee FROM transactions WHERE from_id = $1 AND type = $2`,
+		partner, apimethods.TransactionOverdraft).Scan(&amount, &fee)
+	require.NoError(t, err)
+	require.Equal(t, 0.3, amount)
+	require.Equal(t, 1.0, fee)
+
+	// Days missed while the accruer did not run are caught up, each on the debt at its end:
+	// the account has been overdrawn since three days ago and was charged only then
+	_, err = pool.Exec(context.Background(), `UPDATE journal_entries SET created_at = created_at - interval '3 days' WHERE account = $1`,
+		fmt.Sprintf("user:%v", partner))
+	require.NoError(t, err)
+	_, err = pool.Exec(context.Background(), `UPDATE overdraft_accruals SET day = day - 3 WHERE user_id = $1`, partner)
+	require.NoError(t, err)
+
+	_, err = api.AccrueOverdraft(day, 1000)
+	require.NoError(t, err)
+
+	o, err = api.GetOverdraft(partner)
+	require.NoError(t, err)
+	require.Equal(t, -305.2, o.Balance)
+	require.Equal(t, 5.2, o.Accrued)
+
+	var days int
+	err = pool.QueryRow(context.Background(), `SELECT count(*) FROM overdraft_accruals WHERE user_id = $1`, partner).Scan(&days)
+	require.NoError(t, err)
+	require.Equal(t, 4, days)
+
+	// The days an account was overdrawn are caught up even if it was repaid while the accruer did not run
+	var debtor int
+	err = pool.QueryRow(context.Background(), `INSERT INTO user_balance DEFAULT VALUES RETURNING id`).Scan(&debtor)
+	require.NoError(t, err)
+	require.NoError(t, api.SetCreditLimit(debtor, 500))
+	_, _, err = api.RefillAndWithdrawMoney(debtor, -300)
+	require.NoError(t, err)
+	_, err = api.AccrueOverdraft(day, 1000)
+	require.NoError(t, err)
+
+	_, err = pool.Exec(context.Background(), `UPDATE journal_entries SET created_at = created_at - interval '3 days' WHERE account = $1`,
+		fmt.Sprintf("user:%v", debtor))
+	require.NoError(t, err)
+	_, err = pool.Exec(context.Background(), `UPDATE overdraft_accruals SET day = day - 3 WHERE user_id = $1`, debtor)
+	require.NoError(t, err)
+
+	_, _, err = api.RefillAndWithdrawMoney(debtor, 400)
+	require.NoError(t, err)
+
+	_, err = api.AccrueOverdraft(day, 1000)
+	require.NoError(t, err)
+	_, err = api.AccrueOverdraft(day, 1000)
+	require.NoError(t, err)
+
+	o, err = api.GetOverdraft(debtor)
+	require.NoError(t, err)
+	require.Equal(t, 96.1, o.Balance)
+	require.Equal(t, 3.9, o.Accrued)
+
+	err = pool.QueryRow(context.Background(), `SELECT count(*) FROM overdraft_accruals WHERE user_id = $1`, debtor).Scan(&days)
+	require.NoError(t, err)
+	require.Equal(t, 4, days)
+
+	// An overdrawn account can not be closed
+	_, err = api.SetAccountStatus(partner, apimethods.StatusClosed, "contract ended", true)
+	require.True(t, errors.Is(err, apimethods.NonZeroBalance))
+
+	checkMethods(t, server,
+		``,
+		`GET`,
+		`/accounts/0/overdraft`,
+		``,
+		http.StatusBadRequest,
+		`{"status":1,"id":0,"credit_limit":0,"balance":0,"used":0,"available":0,"accrued":0}`)
+}
@@ -0,0 +1,21 @@
+package bonuses
+
+import (
+	"app/pkg/worker"
+	"time"
+)
+
+// Store expires bonuses
+type Store interface {
+	// ExpireBonuses expires up to limit grants whose time has come by now
+	// and returns the number of expired grants
+	ExpireBonuses(now time.Time, limit int) (int, error)
+}
+
+// NewExpirer returns the worker that books the remaining money of expired bonus grants
+// to the system account. Expired bonuses can not be spent even before it runs, it only settles the ledger.
+func NewExpirer(store Store) *worker.Worker {
+	return worker.New("bonuses", time.Minute, func(limit int) (int, error) {
+		return store.ExpireBonuses(time.Now(), limit)
+	})
+}
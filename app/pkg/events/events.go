@@ -0,0 +1,99 @@
+package events
+
+import (
+	"sync"
+)
+
+// Channel is the Postgres notification channel balance changes are sent to
+const Channel = "balance_events"
+
+// subscriberBuffer is the number of events a subscriber may lag behind,
+// newer events are dropped for a subscriber whose buffer is full
+const subscriberBuffer = 16
+
+// Event describes a change of the balance of an account
+type Event struct {
+	AccountID		int			`json:"account_id"`
+	Balance			float64		`json:"balance"`
+	Currency		string		`json:"currency"`
+	TransactionID	int64		`json:"transaction_id"`
+	Type			string		`json:"type"`
+	// Held and Available are set by the events of holds, which have no transaction
+	Held			*float64	`json:"held,omitempty"`
+	Available		*float64	`json:"available,omitempty"`
+}
+
+// Broker fans out events to the subscribers of the accounts in-process
+type Broker struct {
+	mu			sync.Mutex
+	subscribers	map[int]map[chan Event]struct{}
+	closed		bool
+}
+
+func NewBroker() *Broker {
+	return &Broker{ subscribers: make(map[int]map[chan Event]struct{}) }
+}
+
+// Subscribe returns a channel receiving the events of the account and a function to unsubscribe.
+// The channel is closed after unsubscribing or when the broker is closed.
+func (b *Broker) Subscribe(accountID int) (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+
+	if b.subscribers[accountID] == nil {
+		b.subscribers[accountID] = make(map[chan Event]struct{})
+	}
+	b.subscribers[accountID][ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscribers[accountID][ch]; !ok {
+			return
+		}
+		delete(b.subscribers[accountID], ch)
+		if len(b.subscribers[accountID]) == 0 {
+			delete(b.subscribers, accountID)
+		}
+		close(ch)
+	}
+}
+
+// Publish sends the event to all subscribers of its account without blocking
+func (b *Broker) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers[e.AccountID] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Close closes the channels of all subscribers, new subscribers get a closed channel
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+	b.closed = true
+
+	for _, subscribers := range b.subscribers {
+		for ch := range subscribers {
+			close(ch)
+		}
+	}
+	b.subscribers = nil
+}
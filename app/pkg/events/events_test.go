@@ -0,0 +1,49 @@
+package events
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestBroker(t *testing.T) {
+	broker := NewBroker()
+
+	first, unsubscribeFirst := broker.Subscribe(1)
+	second, unsubscribeSecond := broker.Subscribe(1)
+	other, unsubscribeOther := broker.Subscribe(2)
+	defer unsubscribeOther()
+
+	e := Event{ AccountID: 1, Balance: 10.5, TransactionID: 7, Type: "refill" }
+	broker.Publish(e)
+
+	// Every subscriber of the account receives the event
+	require.Equal(t, e, <-first)
+	require.Equal(t, e, <-second)
+
+	// Subscribers of other accounts receive nothing
+	require.Len(t, other, 0)
+
+	// Unsubscribing closes only the channel of the subscriber
+	unsubscribeFirst()
+	_, ok := <-first
+	require.False(t, ok)
+
+	broker.Publish(e)
+	require.Equal(t, e, <-second)
+
+	// A slow subscriber does not block publishing
+	for i := 0; i < subscriberBuffer * 2; i++ {
+		broker.Publish(e)
+	}
+	require.Len(t, second, subscriberBuffer)
+
+	// Closing the broker closes all channels, unsubscribing afterwards is safe
+	broker.Close()
+	for range second {
+	}
+	unsubscribeSecond()
+
+	closed, _ := broker.Subscribe(1)
+	_, ok = <-closed
+	require.False(t, ok)
+}
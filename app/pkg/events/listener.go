@@ -0,0 +1,60 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
+	"time"
+)
+
+// reconnectDelay is the pause before listening again after the connection is lost
+const reconnectDelay = time.Second
+
+// Listen receives the events sent to Channel by any replica of the service
+// and publishes them to the broker. It reconnects after errors and returns when ctx is done.
+func Listen(ctx context.Context, pool *pgxpool.Pool, broker *Broker) {
+	for {
+		err := listen(ctx, pool, broker)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println(fmt.Errorf("events.listen() error: %w", err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func listen(ctx context.Context, pool *pgxpool.Pool, broker *Broker) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("Acquire() error: %w", err)
+	}
+
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "LISTEN " + Channel)
+	if err != nil {
+		return fmt.Errorf("Exec() error: %w", err)
+	}
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("WaitForNotification() error: %w", err)
+		}
+
+		var e Event
+		err = json.Unmarshal([]byte(notification.Payload), &e)
+		if err != nil {
+			log.Println(fmt.Errorf("json.Unmarshal() error: %w", err))
+			continue
+		}
+		broker.Publish(e)
+	}
+}
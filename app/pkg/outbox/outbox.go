@@ -0,0 +1,93 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Message is a domain event waiting in the outbox.
+// Messages with the same Key are published in the order of their IDs.
+type Message struct {
+	ID			int64
+	Key			string
+	Type		string
+	Payload		[]byte
+	CreatedAt	time.Time
+}
+
+// Publisher sends messages to the event pipeline
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+}
+
+// Store keeps the outbox
+type Store interface {
+	// ProcessOutbox passes up to limit unsent messages, ordered by ID, to publish
+	// and marks the IDs it returns as sent. Only one relay processes the outbox at a time,
+	// publish is not called while another relay holds it. No database transaction is open
+	// while publish runs.
+	ProcessOutbox(limit int, publish func([]Message) []int64) error
+}
+
+// Relay moves messages from the outbox to the publisher.
+// Delivery is at-least-once: a message is marked as sent only after it has been published.
+type Relay struct {
+	store		Store
+	publisher	Publisher
+	Interval	time.Duration
+	BatchSize	int
+}
+
+func NewRelay(store Store, publisher Publisher) *Relay {
+	return &Relay{
+		store:		store,
+		publisher:	publisher,
+		Interval:	time.Second,
+		BatchSize:	100,
+	}
+}
+
+// Run relays the outbox every Interval until ctx is done
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := r.RelayOnce(ctx)
+			if err != nil {
+				log.Println(fmt.Errorf("outbox.RelayOnce() error: %w", err))
+			}
+		}
+	}
+}
+
+// RelayOnce publishes one batch of the outbox.
+// When a message fails, the later messages with the same key are held back
+// until the next batch, so the order per key is kept.
+func (r *Relay) RelayOnce(ctx context.Context) error {
+	return r.store.ProcessOutbox(r.BatchSize, func(messages []Message) []int64 {
+		blocked := make(map[string]bool)
+		sent := make([]int64, 0, len(messages))
+
+		for _, msg := range messages {
+			if blocked[msg.Key] {
+				continue
+			}
+
+			err := r.publisher.Publish(ctx, msg)
+			if err != nil {
+				log.Println(fmt.Errorf("Publish(%d) error: %w", msg.ID, err))
+				blocked[msg.Key] = true
+				continue
+			}
+			sent = append(sent, msg.ID)
+		}
+		return sent
+	})
+}
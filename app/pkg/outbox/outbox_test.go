@@ -0,0 +1,98 @@
+package outbox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// memoryStore is an outbox kept in memory
+type memoryStore struct {
+	messages	[]Message
+	sent		map[int64]bool
+}
+
+func (s *memoryStore) ProcessOutbox(limit int, publish func([]Message) []int64) error {
+	var unsent []Message
+	for _, msg := range s.messages {
+		if !s.sent[msg.ID] && len(unsent) < limit {
+			unsent = append(unsent, msg)
+		}
+	}
+	for _, id := range publish(unsent) {
+		s.sent[id] = true
+	}
+	return nil
+}
+
+// flakyPublisher fails the first attempt to publish every message of the key
+type flakyPublisher struct {
+	MemoryPublisher
+	key		string
+	failed	bool
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, msg Message) error {
+	if msg.Key == p.key && !p.failed {
+		p.failed = true
+		return errors.New("broker is not available")
+	}
+	return p.MemoryPublisher.Publish(ctx, msg)
+}
+
+func TestRelay(t *testing.T) {
+	store := &memoryStore{
+		messages: []Message{
+			{ ID: 1, Key: "1", Payload: []byte(`{}`) },
+			{ ID: 2, Key: "2", Payload: []byte(`{}`) },
+			{ ID: 3, Key: "1", Payload: []byte(`{}`) },
+			{ ID: 4, Key: "2", Payload: []byte(`{}`) },
+		},
+		sent: map[int64]bool{},
+	}
+	publisher := &flakyPublisher{ key: "1" }
+
+	relay := NewRelay(store, publisher)
+
+	// The failed message holds back the later messages of its key only
+	require.NoError(t, relay.RelayOnce(context.Background()))
+	require.Equal(t, map[int64]bool{ 2: true, 4: true }, store.sent)
+
+	// The next batch publishes the rest in order
+	require.NoError(t, relay.RelayOnce(context.Background()))
+	require.Len(t, store.sent, 4)
+
+	var order []int64
+	for _, msg := range publisher.Messages() {
+		if msg.Key == "1" {
+			order = append(order, msg.ID)
+		}
+	}
+	require.Equal(t, []int64{1, 3}, order)
+}
+
+func TestFilePublisher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	publisher := NewFilePublisher(path)
+
+	require.NoError(t, publisher.Publish(context.Background(), Message{ ID: 1, Key: "5", Type: "refill", Payload: []byte(`{"balance":1}`) }))
+	require.NoError(t, publisher.Publish(context.Background(), Message{ ID: 2, Key: "5", Type: "withdraw", Payload: []byte(`{"balance":0}`) }))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var ids []int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record fileRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		ids = append(ids, record.ID)
+	}
+	require.Equal(t, []int64{1, 2}, ids)
+}
@@ -0,0 +1,133 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// KafkaPublisher publishes messages to a Kafka topic through a Kafka REST Proxy
+// (Confluent REST Proxy API v2, also served by Redpanda). The message key selects
+// the partition, so messages of one account stay in order.
+type KafkaPublisher struct {
+	endpoint	string
+	client		*http.Client
+}
+
+func NewKafkaPublisher(restURL, topic string) *KafkaPublisher {
+	return &KafkaPublisher{
+		endpoint:	restURL + "/topics/" + url.PathEscape(topic),
+		client:		&http.Client{ Timeout: 10 * time.Second },
+	}
+}
+
+type kafkaRecord struct {
+	Key		string			`json:"key"`
+	Value	json.RawMessage	`json:"value"`
+}
+
+type kafkaRecords struct {
+	Records	[]kafkaRecord	`json:"records"`
+}
+
+func (p *KafkaPublisher) Publish(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(kafkaRecords{ Records: []kafkaRecord{{ Key: msg.Key, Value: msg.Payload }} })
+	if err != nil {
+		return fmt.Errorf("json.Marshal() error: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("NewRequest() error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Do() error: %w", err)
+	}
+
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// FilePublisher appends messages to a file, one JSON object per line
+type FilePublisher struct {
+	mu		sync.Mutex
+	path	string
+}
+
+func NewFilePublisher(path string) *FilePublisher {
+	return &FilePublisher{ path: path }
+}
+
+type fileRecord struct {
+	ID			int64			`json:"id"`
+	Key			string			`json:"key"`
+	Type		string			`json:"type"`
+	Payload		json.RawMessage	`json:"payload"`
+	CreatedAt	time.Time		`json:"created_at"`
+}
+
+func (p *FilePublisher) Publish(ctx context.Context, msg Message) error {
+	line, err := json.Marshal(fileRecord{
+		ID:			msg.ID,
+		Key:		msg.Key,
+		Type:		msg.Type,
+		Payload:	msg.Payload,
+		CreatedAt:	msg.CreatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("json.Marshal() error: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, err := os.OpenFile(p.path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile() error: %w", err)
+	}
+
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("Write() error: %w", err)
+	}
+	return f.Close()
+}
+
+// MemoryPublisher keeps published messages in memory
+type MemoryPublisher struct {
+	mu			sync.Mutex
+	messages	[]Message
+}
+
+func (p *MemoryPublisher) Publish(ctx context.Context, msg Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.messages = append(p.messages, msg)
+	return nil
+}
+
+// Messages returns the published messages in the order of publishing
+func (p *MemoryPublisher) Messages() []Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]Message(nil), p.messages...)
+}
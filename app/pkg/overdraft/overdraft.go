@@ -0,0 +1,23 @@
+package overdraft
+
+import (
+	"app/pkg/worker"
+	"time"
+)
+
+// Store charges overdrawn accounts
+type Store interface {
+	// AccrueOverdraft charges up to limit overdrawn accounts not charged for the day yet,
+	// together with the days they missed, also for the accounts topped up since,
+	// and returns the number of charged accounts
+	AccrueOverdraft(day time.Time, limit int) (int, error)
+}
+
+// NewAccruer returns the worker that charges interest and fees on negative balances once a day.
+// It runs more often than daily: the store charges every account once a day and catches up
+// the days missed since the last charge of the account.
+func NewAccruer(store Store) *worker.Worker {
+	return worker.New("overdraft", time.Hour, func(limit int) (int, error) {
+		return store.AccrueOverdraft(time.Now(), limit)
+	})
+}
@@ -0,0 +1,21 @@
+package pending
+
+import (
+	"app/pkg/worker"
+	"time"
+)
+
+// Store expires pending transfers
+type Store interface {
+	// ExpireTransfers returns up to limit pending transfers expired by now to their senders
+	// and returns the number of expired transfers
+	ExpireTransfers(now time.Time, limit int) (int, error)
+}
+
+// NewExpirer returns the worker that returns the money of the pending transfers the recipients
+// have not accepted in time to the senders. An expired transfer can not be accepted even before it runs.
+func NewExpirer(store Store) *worker.Worker {
+	return worker.New("pending", time.Minute, func(limit int) (int, error) {
+		return store.ExpireTransfers(time.Now(), limit)
+	})
+}
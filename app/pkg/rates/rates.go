@@ -0,0 +1,101 @@
+package rates
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	ErrUnknownCurrency = errors.New("unknown currency")
+)
+
+// Provider returns the market rate of the currency pair:
+// the amount of the currency "to" one unit of the currency "from" is worth
+type Provider interface {
+	Rate(ctx context.Context, from, to string) (float64, error)
+}
+
+// Static is a Provider with fixed prices of currencies in a common unit
+type Static map[string]float64
+
+// Default holds approximate prices of the supported currencies in RUB,
+// it is used when no rates service is configured
+var Default = Static{
+	"RUB":	1,
+	"USD":	90,
+	"EUR":	100,
+}
+
+func (s Static) Rate(_ context.Context, from, to string) (float64, error) {
+	pf, ok := s[from]
+	if !ok || pf <= 0 {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownCurrency, from)
+	}
+	pt, ok := s[to]
+	if !ok || pt <= 0 {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownCurrency, to)
+	}
+	return pf / pt, nil
+}
+
+// HTTPProvider loads rates from a service with the API of exchangeratesapi.io:
+// GET <endpoint>?base=<from>&symbols=<to> returns {"rates":{"<to>":rate}}
+type HTTPProvider struct {
+	endpoint	string
+	apiKey		string
+	client		*http.Client
+}
+
+func NewHTTPProvider(endpoint, apiKey string) *HTTPProvider {
+	return &HTTPProvider{
+		endpoint:	endpoint,
+		apiKey:		apiKey,
+		client:		&http.Client{ Timeout: 10 * time.Second },
+	}
+}
+
+type ratesResponse struct {
+	Rates	map[string]float64	`json:"rates"`
+}
+
+func (p *HTTPProvider) Rate(ctx context.Context, from, to string) (float64, error) {
+	query := url.Values{ "base": { from }, "symbols": { to } }
+	if p.apiKey != "" {
+		query.Set("access_key", p.apiKey)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.endpoint + "?" + query.Encode(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("NewRequest() error: %w", err)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("Do() error: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return 0, fmt.Errorf("rates service returned %d", resp.StatusCode)
+	}
+
+	var body ratesResponse
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return 0, fmt.Errorf("Decode() error: %w", err)
+	}
+
+	rate, ok := body.Rates[to]
+	if !ok || rate <= 0 {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownCurrency, to)
+	}
+	return rate, nil
+}
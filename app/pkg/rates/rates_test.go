@@ -0,0 +1,84 @@
+package rates
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatic(t *testing.T) {
+	rate, err := Default.Rate(context.Background(), "USD", "RUB")
+	require.NoError(t, err)
+	require.Equal(t, 90.0, rate)
+
+	rate, err = Default.Rate(context.Background(), "RUB", "EUR")
+	require.NoError(t, err)
+	require.Equal(t, 0.01, rate)
+
+	_, err = Default.Rate(context.Background(), "RUB", "GBP")
+	require.True(t, errors.Is(err, ErrUnknownCurrency))
+}
+
+func TestHTTPProvider(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "USD", r.URL.Query().Get("base"))
+		require.Equal(t, "key", r.URL.Query().Get("access_key"))
+
+		if r.URL.Query().Get("symbols") != "RUB" {
+			w.Write([]byte(`{"rates":{}}`))
+			return
+		}
+		w.Write([]byte(`{"base":"USD","rates":{"RUB":91.25}}`))
+	}))
+	defer receiver.Close()
+
+	p := NewHTTPProvider(receiver.URL, "key")
+
+	rate, err := p.Rate(context.Background(), "USD", "RUB")
+	require.NoError(t, err)
+	require.Equal(t, 91.25, rate)
+
+	_, err = p.Rate(context.Background(), "USD", "EUR")
+	require.True(t, errors.Is(err, ErrUnknownCurrency))
+
+	receiver.Close()
+	_, err = p.Rate(context.Background(), "USD", "RUB")
+	require.Error(t, err)
+}
+
+type memoryStore struct {
+	rates	map[string]float64
+}
+
+func (s *memoryStore) SaveRate(from, to string, rate float64, at time.Time) error {
+	s.rates[from + "/" + to] = rate
+	return nil
+}
+
+// failingProvider knows only some currencies, like a provider that is partly down
+type failingProvider struct {
+	Static
+}
+
+func (p failingProvider) Rate(ctx context.Context, from, to string) (float64, error) {
+	if to == "EUR" {
+		return 0, errors.New("service unavailable")
+	}
+	return p.Static.Rate(ctx, from, to)
+}
+
+func TestRefresher(t *testing.T) {
+	store := &memoryStore{ rates: map[string]float64{ "RUB/EUR": 0.009 } }
+
+	r := NewRefresher(failingProvider{ Default }, store, "RUB", []string{ "RUB", "USD", "EUR" })
+
+	err := r.RefreshOnce(context.Background())
+	require.Error(t, err)
+
+	// The rate of EUR could not be refreshed, the last known rate is kept
+	require.Equal(t, map[string]float64{ "RUB/USD": 1.0 / 90, "RUB/EUR": 0.009 }, store.rates)
+}
@@ -0,0 +1,75 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Store keeps the history of rates
+type Store interface {
+	// SaveRate records the rate of the currency pair fetched at the time
+	SaveRate(from, to string, rate float64, at time.Time) error
+}
+
+// Refresher pulls the rates of the currencies against the base currency
+// from the provider on a schedule and saves them to the store.
+// When the provider is down nothing is saved, so the last known rates stay in use.
+type Refresher struct {
+	provider	Provider
+	store		Store
+	base		string
+	currencies	[]string
+	Interval	time.Duration
+}
+
+func NewRefresher(provider Provider, store Store, base string, currencies []string) *Refresher {
+	return &Refresher{
+		provider:	provider,
+		store:		store,
+		base:		base,
+		currencies:	currencies,
+		Interval:	time.Hour,
+	}
+}
+
+// Run refreshes the rates right away and then every Interval until ctx is done
+func (r *Refresher) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		err := r.RefreshOnce(ctx)
+		if err != nil {
+			log.Println(fmt.Errorf("rates.RefreshOnce() error: %w", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RefreshOnce fetches and saves the rate of every currency.
+// A failed currency does not stop the others, the first error is returned.
+func (r *Refresher) RefreshOnce(ctx context.Context) error {
+	var first error
+
+	for _, currency := range r.currencies {
+		if currency == r.base {
+			continue
+		}
+
+		rate, err := r.provider.Rate(ctx, r.base, currency)
+		if err == nil {
+			err = r.store.SaveRate(r.base, currency, rate, time.Now())
+		}
+		if err != nil && first == nil {
+			first = fmt.Errorf("%s/%s: %w", r.base, currency, err)
+		}
+	}
+	return first
+}
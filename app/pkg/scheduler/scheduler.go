@@ -0,0 +1,19 @@
+package scheduler
+
+import (
+	"app/pkg/worker"
+	"time"
+)
+
+// Store executes due scheduled operations
+type Store interface {
+	// RunSchedules executes up to limit due operations and returns the number of runs.
+	// Concurrent callers never execute the same operation.
+	RunSchedules(limit int) (int, error)
+}
+
+// NewWorker returns the worker that executes scheduled operations.
+// Several workers, e.g. one per replica, can run at the same time.
+func NewWorker(store Store) *worker.Worker {
+	return worker.New("scheduler", 10 * time.Second, store.RunSchedules)
+}
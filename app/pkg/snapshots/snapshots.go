@@ -0,0 +1,43 @@
+package snapshots
+
+import (
+	"app/pkg/worker"
+	"time"
+)
+
+// Store takes snapshots of the balances of the accounts
+type Store interface {
+	// TakeSnapshots records the balance of every account with at least minEntries
+	// journal entries since its last snapshot, counting only entries created before the time.
+	// It returns the number of snapshots taken.
+	TakeSnapshots(before time.Time, minEntries int) (int, error)
+}
+
+// Snapshotter periodically snapshots the balances, so a balance at a moment in the past
+// is computed from the last snapshot before it instead of the whole history of the account.
+// All accounts are snapshotted in one call, the worker does not batch them.
+type Snapshotter struct {
+	*worker.Worker
+	store		Store
+	// Lag keeps the latest entries out of the snapshots, the store makes sure no uncommitted entry is cut off
+	Lag			time.Duration
+	MinEntries	int
+}
+
+func NewSnapshotter(store Store) *Snapshotter {
+	s := &Snapshotter{
+		store:		store,
+		Lag:		time.Minute,
+		MinEntries:	100,
+	}
+	s.Worker = worker.New("snapshots", time.Hour, func(int) (int, error) {
+		return s.SnapshotOnce()
+	})
+	s.BatchSize = 0
+	return s
+}
+
+// SnapshotOnce snapshots the accounts with enough new entries older than Lag
+func (s *Snapshotter) SnapshotOnce() (int, error) {
+	return s.store.TakeSnapshots(time.Now().Add(-s.Lag), s.MinEntries)
+}
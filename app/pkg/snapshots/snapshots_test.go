@@ -0,0 +1,42 @@
+package snapshots
+
+import (
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+type call struct {
+	before		time.Time
+	minEntries	int
+}
+
+type memoryStore struct {
+	mu		sync.Mutex
+	calls	[]call
+}
+
+func (s *memoryStore) TakeSnapshots(before time.Time, minEntries int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls = append(s.calls, call{ before: before, minEntries: minEntries })
+	return 1, nil
+}
+
+func TestSnapshotOnce(t *testing.T) {
+	store := &memoryStore{}
+	s := NewSnapshotter(store)
+	s.Lag = time.Hour
+	s.MinEntries = 10
+
+	n, err := s.SnapshotOnce()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// Entries of the last Lag are left for the next snapshot
+	require.Len(t, store.calls, 1)
+	require.Equal(t, 10, store.calls[0].minEntries)
+	require.WithinDuration(t, time.Now().Add(-time.Hour), store.calls[0].before, time.Second)
+}
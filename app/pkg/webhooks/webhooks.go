@@ -0,0 +1,178 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers of a delivery request
+const (
+	HeaderID		= "X-Webhook-ID"
+	HeaderTimestamp	= "X-Webhook-Timestamp"
+	HeaderSignature	= "X-Webhook-Signature"
+)
+
+// Delivery is a pending event for one subscription
+type Delivery struct {
+	ID			int64
+	URL			string
+	Secret		string
+	Payload		[]byte
+	Attempts	int
+}
+
+// Store keeps deliveries and their attempts
+type Store interface {
+	// ClaimDeliveries returns up to limit due deliveries and hides them from other
+	// dispatchers for the lease duration
+	ClaimDeliveries(limit int, lease time.Duration) ([]Delivery, error)
+	// CompleteDelivery records a successful attempt
+	CompleteDelivery(id int64, statusCode int) error
+	// FailDelivery records a failed attempt. The delivery is retried at retryAt,
+	// or moved to the dead letters if dead is true
+	FailDelivery(id int64, statusCode int, reason string, retryAt time.Time, dead bool) error
+}
+
+// Dispatcher delivers pending events to the subscribers
+type Dispatcher struct {
+	store		Store
+	client		*http.Client
+	MaxAttempts	int
+	BaseDelay	time.Duration
+	MaxDelay	time.Duration
+	Interval	time.Duration
+	BatchSize	int
+}
+
+func NewDispatcher(store Store) *Dispatcher {
+	return &Dispatcher{
+		store:			store,
+		client:			&http.Client{ Timeout: 10 * time.Second },
+		MaxAttempts:	8,
+		BaseDelay:		10 * time.Second,
+		MaxDelay:		time.Hour,
+		Interval:		time.Second,
+		BatchSize:		50,
+	}
+}
+
+// Sign returns the HMAC-SHA256 signature of the timestamp and the body
+// in the format of the X-Webhook-Signature header: sha256=<hex>.
+// The receiver computes the same value over "<X-Webhook-Timestamp>.<body>".
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff returns the delay before the next attempt after the given number of attempts
+func (d *Dispatcher) Backoff(attempts int) time.Duration {
+	delay := d.BaseDelay
+	for i := 1; i < attempts && delay < d.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxDelay {
+		delay = d.MaxDelay
+	}
+	return delay
+}
+
+// Run dispatches due deliveries every Interval until ctx is done
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := d.DispatchOnce(ctx)
+			if err != nil {
+				log.Println(fmt.Errorf("webhooks.DispatchOnce() error: %w", err))
+			}
+		}
+	}
+}
+
+// Lease is how long a claimed batch is hidden from other dispatchers:
+// long enough to send every delivery of the batch one after another, with one timeout to spare
+func (d *Dispatcher) Lease() time.Duration {
+	return time.Duration(d.BatchSize + 1) * d.client.Timeout
+}
+
+// DispatchOnce sends one batch of due deliveries.
+// The deliveries are sent one after another while their lease lasts, a delivery is never sent
+// once less than a request timeout of the lease is left, so it is never sent twice at once.
+// The deliveries not sent in time are claimed again when the lease ends.
+func (d *Dispatcher) DispatchOnce(ctx context.Context) error {
+	lease := d.Lease()
+	deadline := time.Now().Add(lease)
+
+	deliveries, err := d.store.ClaimDeliveries(d.BatchSize, lease)
+	if err != nil {
+		return fmt.Errorf("ClaimDeliveries() error: %w", err)
+	}
+
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil || time.Until(deadline) < d.client.Timeout {
+			return nil
+		}
+
+		code, err := d.send(ctx, delivery)
+		if err == nil {
+			err = d.store.CompleteDelivery(delivery.ID, code)
+			if err != nil {
+				return fmt.Errorf("CompleteDelivery() error: %w", err)
+			}
+			continue
+		}
+
+		attempts := delivery.Attempts + 1
+		dead := attempts >= d.MaxAttempts
+		err = d.store.FailDelivery(delivery.ID, code, err.Error(), time.Now().Add(d.Backoff(attempts)), dead)
+		if err != nil {
+			return fmt.Errorf("FailDelivery() error: %w", err)
+		}
+	}
+	return nil
+}
+
+// send posts the signed payload to the subscriber.
+// Any response other than 2xx is an error.
+func (d *Dispatcher) send(ctx context.Context, delivery Delivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("NewRequest() error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderID, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(delivery.Secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("Do() error: %w", err)
+	}
+
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
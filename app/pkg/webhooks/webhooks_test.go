@@ -0,0 +1,152 @@
+package webhooks
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore keeps deliveries in memory and records the outcome of every attempt
+type memoryStore struct {
+	mu			sync.Mutex
+	pending		map[int64]*Delivery
+	retryAt		map[int64]time.Time
+	delivered	[]int64
+	dead		[]int64
+	codes		[]int
+	lease		time.Duration
+}
+
+func newMemoryStore(deliveries ...Delivery) *memoryStore {
+	s := &memoryStore{ pending: map[int64]*Delivery{}, retryAt: map[int64]time.Time{} }
+	for i := range deliveries {
+		s.pending[deliveries[i].ID] = &deliveries[i]
+	}
+	return s
+}
+
+func (s *memoryStore) ClaimDeliveries(limit int, lease time.Duration) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lease = lease
+	var due []Delivery
+	for id, d := range s.pending {
+		if len(due) < limit && !s.retryAt[id].After(time.Now()) {
+			due = append(due, *d)
+		}
+	}
+	return due, nil
+}
+
+func (s *memoryStore) CompleteDelivery(id int64, statusCode int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.codes = append(s.codes, statusCode)
+	s.delivered = append(s.delivered, id)
+	delete(s.pending, id)
+	return nil
+}
+
+func (s *memoryStore) FailDelivery(id int64, statusCode int, reason string, retryAt time.Time, dead bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.codes = append(s.codes, statusCode)
+	if dead {
+		s.dead = append(s.dead, id)
+		delete(s.pending, id)
+		return nil
+	}
+	s.pending[id].Attempts++
+	s.retryAt[id] = retryAt
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	const secret = "secret"
+	payload := []byte(`{"account_id":1,"balance":10,"transaction_id":7,"type":"refill"}`)
+
+	// The receiver fails the first request and accepts the next ones
+	var mu sync.Mutex
+	requests := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		require.Equal(t, payload, body)
+		require.Equal(t, "1", r.Header.Get(HeaderID))
+		require.Equal(t, Sign(secret, r.Header.Get(HeaderTimestamp), body), r.Header.Get(HeaderSignature))
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	store := newMemoryStore(Delivery{ ID: 1, URL: receiver.URL, Secret: secret, Payload: payload })
+
+	dispatcher := NewDispatcher(store)
+	dispatcher.BaseDelay = 0
+
+	require.NoError(t, dispatcher.DispatchOnce(context.Background()))
+	require.Empty(t, store.delivered)
+	require.Equal(t, 1, store.pending[1].Attempts)
+
+	require.NoError(t, dispatcher.DispatchOnce(context.Background()))
+	require.Equal(t, []int64{1}, store.delivered)
+	require.Equal(t, []int{http.StatusInternalServerError, http.StatusNoContent}, store.codes)
+}
+
+func TestDispatcherDeadLetter(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer receiver.Close()
+
+	store := newMemoryStore(Delivery{ ID: 1, URL: receiver.URL, Secret: "secret", Payload: []byte(`{}`) })
+
+	dispatcher := NewDispatcher(store)
+	dispatcher.BaseDelay = 0
+	dispatcher.MaxAttempts = 3
+
+	for i := 0; i < dispatcher.MaxAttempts; i++ {
+		require.NoError(t, dispatcher.DispatchOnce(context.Background()))
+	}
+	require.Equal(t, []int64{1}, store.dead)
+	require.Empty(t, store.pending)
+	require.Empty(t, store.delivered)
+}
+
+func TestDispatcherLease(t *testing.T) {
+	store := newMemoryStore()
+	dispatcher := NewDispatcher(store)
+
+	// The lease covers a batch of requests that all time out
+	require.NoError(t, dispatcher.DispatchOnce(context.Background()))
+	require.Equal(t, dispatcher.Lease(), store.lease)
+	require.Greater(t, store.lease, time.Duration(dispatcher.BatchSize) * dispatcher.client.Timeout)
+}
+
+func TestBackoff(t *testing.T) {
+	dispatcher := NewDispatcher(nil)
+	dispatcher.BaseDelay = time.Second
+	dispatcher.MaxDelay = 10 * time.Second
+
+	require.Equal(t, time.Second, dispatcher.Backoff(1))
+	require.Equal(t, 2 * time.Second, dispatcher.Backoff(2))
+	require.Equal(t, 8 * time.Second, dispatcher.Backoff(4))
+	require.Equal(t, 10 * time.Second, dispatcher.Backoff(5))
+	require.Equal(t, 10 * time.Second, dispatcher.Backoff(100))
+}
@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Batch processes up to limit items of a background job and returns the number of processed items
+type Batch func(limit int) (int, error)
+
+// Worker runs a background job every Interval. The job is done in batches of BatchSize items,
+// one database transaction each, until a batch is not full. A BatchSize of 0 runs the job
+// once per tick without a limit. Several workers, e.g. one per replica, can run the same job
+// if its batches skip the items locked by the others.
+type Worker struct {
+	name		string
+	batch		Batch
+	Interval	time.Duration
+	BatchSize	int
+}
+
+// New returns the worker of the job called name, the name is used in the log
+func New(name string, interval time.Duration, batch Batch) *Worker {
+	return &Worker{
+		name:		name,
+		batch:		batch,
+		Interval:	interval,
+		BatchSize:	100,
+	}
+}
+
+// Run runs the job every Interval until ctx is done
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := w.RunOnce(ctx)
+			if err != nil {
+				log.Println(fmt.Errorf("%s.RunOnce() error: %w", w.name, err))
+			}
+		}
+	}
+}
+
+// RunOnce runs batches of the job until none is full and returns the number of processed items
+func (w *Worker) RunOnce(ctx context.Context) (int, error) {
+	total := 0
+
+	for ctx.Err() == nil {
+		n, err := w.batch(w.BatchSize)
+		total += n
+		if err != nil || w.BatchSize <= 0 || n < w.BatchSize {
+			return total, err
+		}
+	}
+	return total, ctx.Err()
+}
@@ -0,0 +1,129 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryJob processes the items due shared by all workers
+type memoryJob struct {
+	mu		sync.Mutex
+	due		int
+	done	int
+	calls	int
+	err		error
+}
+
+func (j *memoryJob) batch(limit int) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.calls++
+	if j.err != nil {
+		return 0, j.err
+	}
+	n := j.due
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	j.due -= n
+	j.done += n
+	return n, nil
+}
+
+func TestRunOnce(t *testing.T) {
+	job := &memoryJob{ due: 150 }
+	w := New("test", time.Minute, job.batch)
+
+	n, err := w.RunOnce(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 150, n)
+	require.Equal(t, 2, job.calls)
+
+	n, err = w.RunOnce(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestRunOnceUnbatched(t *testing.T) {
+	job := &memoryJob{ due: 150 }
+	w := New("test", time.Minute, job.batch)
+	w.BatchSize = 0
+
+	n, err := w.RunOnce(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 150, n)
+	require.Equal(t, 1, job.calls)
+}
+
+func TestRunOnceError(t *testing.T) {
+	job := &memoryJob{ due: 150, err: errors.New("database is down") }
+	w := New("test", time.Minute, job.batch)
+
+	_, err := w.RunOnce(context.Background())
+	require.Error(t, err)
+	require.Equal(t, 1, job.calls)
+}
+
+func TestRunOnceCancelled(t *testing.T) {
+	job := &memoryJob{ due: 150 }
+	w := New("test", time.Minute, job.batch)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	n, err := w.RunOnce(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 0, n)
+	require.Equal(t, 0, job.calls)
+}
+
+func TestConcurrentWorkers(t *testing.T) {
+	job := &memoryJob{ due: 1000 }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := New("test", time.Minute, job.batch)
+			w.BatchSize = 7
+			_, err := w.RunOnce(context.Background())
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// Every item is processed once whatever worker took it
+	require.Equal(t, 1000, job.done)
+	require.Equal(t, 0, job.due)
+}
+
+func TestRun(t *testing.T) {
+	job := &memoryJob{ due: 3 }
+	w := New("test", 10 * time.Millisecond, job.batch)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		return job.done == 3
+	}, time.Second, 5 * time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run() did not stop")
+	}
+}
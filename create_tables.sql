@@ -1,8 +1,50 @@
+DROP TABLE IF EXISTS overdraft_accruals;
+DROP TABLE IF EXISTS account_members;
+DROP TABLE IF EXISTS escrow_deal_history;
+DROP TABLE IF EXISTS escrow_deals;
+DROP TABLE IF EXISTS payment_requests;
+DROP TABLE IF EXISTS pending_transfers;
+DROP TABLE IF EXISTS schedule_runs;
+DROP TABLE IF EXISTS schedules;
+DROP TABLE IF EXISTS voucher_redemptions;
+DROP TABLE IF EXISTS vouchers;
+DROP TABLE IF EXISTS voucher_batches;
+DROP TABLE IF EXISTS bonus_grants;
+DROP TABLE IF EXISTS balance_snapshots;
+DROP TABLE IF EXISTS currency_rates;
+DROP TABLE IF EXISTS exchange_quotes;
+DROP TABLE IF EXISTS fee_rules;
+DROP TABLE IF EXISTS spending_limits;
+DROP TABLE IF EXISTS outbox;
+DROP TABLE IF EXISTS webhook_attempts;
+DROP TABLE IF EXISTS webhook_dead_letters;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhook_subscriptions;
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS account_status_history;
+DROP TABLE IF EXISTS journal_entries;
+DROP TABLE IF EXISTS transactions;
+DROP TABLE IF EXISTS wallets;
 DROP TABLE IF EXISTS user_balance;
 
 CREATE TABLE user_balance (
 	id			SERIAL PRIMARY KEY NOT NULL,
-	balance		DECIMAL(21,2) DEFAULT 0.00);
+	balance		DECIMAL(21,2) DEFAULT 0.00,
+	-- held is the part of the balance reserved by pending transfers
+	held		DECIMAL(21,2) NOT NULL DEFAULT 0.00 CHECK (held >= 0),
+	status		VARCHAR(8) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'frozen', 'closed')),
+	-- money leaves a shared account only on behalf of its members, see account_members
+	shared		BOOLEAN NOT NULL DEFAULT false,
+	-- a sub-account can draw draw_limit in RUB from its parent over draw_period, it can not draw without a period
+	parent_id	INT REFERENCES user_balance (id),
+	draw_limit	DECIMAL(21,2) CHECK (draw_limit >= 0),
+	draw_period	VARCHAR(8) CHECK (draw_period IN ('single', 'day', 'week', 'month')),
+	-- the balance in RUB can go below zero down to -credit_limit
+	credit_limit	DECIMAL(21,2) NOT NULL DEFAULT 0.00 CHECK (credit_limit >= 0),
+	CHECK ((draw_limit IS NULL) = (draw_period IS NULL)),
+	CHECK (parent_id IS NOT NULL OR draw_period IS NULL));
+
+CREATE INDEX user_balance_parent_id_idx ON user_balance (parent_id) WHERE parent_id IS NOT NULL;
 
 INSERT INTO user_balance (balance)
 VALUES
@@ -11,3 +53,351 @@ VALUES
 	(17.99),
 	(34.98),
 	(DEFAULT);
+
+-- Wallets of the users in other currencies than RUB, the RUB wallet is user_balance.balance
+CREATE TABLE wallets (
+	user_id		INT NOT NULL REFERENCES user_balance (id),
+	currency	VARCHAR(3) NOT NULL CHECK (currency IN ('USD', 'EUR')),
+	balance		DECIMAL(21,2) NOT NULL DEFAULT 0.00,
+	held		DECIMAL(21,2) NOT NULL DEFAULT 0.00 CHECK (held >= 0),
+	PRIMARY KEY (user_id, currency));
+
+CREATE TABLE transactions (
+	id			BIGSERIAL PRIMARY KEY NOT NULL,
+	type		VARCHAR(16) NOT NULL,
+	from_id		INT REFERENCES user_balance (id),
+	to_id		INT REFERENCES user_balance (id),
+	amount		DECIMAL(21,2) NOT NULL,
+	fee			DECIMAL(21,2) NOT NULL DEFAULT 0,
+	currency	VARCHAR(3) NOT NULL DEFAULT 'RUB',
+	rate		DECIMAL(18,8),
+	comment		TEXT NOT NULL DEFAULT '',
+	refund_of	BIGINT REFERENCES transactions (id),
+	initiator	VARCHAR(64) NOT NULL DEFAULT '',
+	-- member of the shared account from_id who made the transaction
+	member_id	INT REFERENCES user_balance (id),
+	created_at	TIMESTAMPTZ NOT NULL DEFAULT now());
+
+CREATE INDEX transactions_from_id_idx ON transactions (from_id, created_at);
+CREATE INDEX transactions_to_id_idx ON transactions (to_id, created_at);
+CREATE INDEX transactions_refund_of_idx ON transactions (refund_of) WHERE refund_of IS NOT NULL;
+
+CREATE TABLE journal_entries (
+	id				BIGSERIAL PRIMARY KEY NOT NULL,
+	transaction_id	BIGINT NOT NULL REFERENCES transactions (id),
+	account			VARCHAR(64) NOT NULL,
+	amount			DECIMAL(21,2) NOT NULL,
+	currency		VARCHAR(3) NOT NULL DEFAULT 'RUB',
+	created_at		TIMESTAMPTZ NOT NULL DEFAULT now());
+
+CREATE INDEX journal_entries_account_idx ON journal_entries (account, currency, id);
+
+-- Opening balances of the users are booked as refills
+INSERT INTO transactions (type, to_id, amount, comment)
+SELECT 'refill', id, balance, 'opening balance' FROM user_balance WHERE balance <> 0.00;
+
+INSERT INTO journal_entries (transaction_id, account, amount)
+SELECT id, 'user:' || to_id, amount FROM transactions
+UNION ALL
+SELECT id, 'external_cash_in', -amount FROM transactions;
+
+-- Idempotency keys belong to the account of the operation, request_hash identifies the operation
+CREATE TABLE idempotency_keys (
+	account_id		INT NOT NULL,
+	key				VARCHAR(255) NOT NULL,
+	request_hash	CHAR(64) NOT NULL,
+	id				INT NOT NULL DEFAULT 0,
+	balance			DECIMAL(21,2) NOT NULL DEFAULT 0.00,
+	to_id			INT NOT NULL DEFAULT 0,
+	to_balance		DECIMAL(21,2) NOT NULL DEFAULT 0.00,
+	created_at		TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (account_id, key));
+
+CREATE TABLE webhook_subscriptions (
+	id			SERIAL PRIMARY KEY NOT NULL,
+	url			TEXT NOT NULL,
+	event_types	VARCHAR(16)[] NOT NULL,
+	secret		TEXT NOT NULL,
+	created_at	TIMESTAMPTZ NOT NULL DEFAULT now());
+
+CREATE TABLE webhook_deliveries (
+	id				BIGSERIAL PRIMARY KEY NOT NULL,
+	subscription_id	INT NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+	event_key		VARCHAR(64) NOT NULL,
+	payload			JSONB NOT NULL,
+	attempts		INT NOT NULL DEFAULT 0,
+	next_attempt_at	TIMESTAMPTZ NOT NULL DEFAULT now(),
+	delivered_at	TIMESTAMPTZ,
+	last_error		TEXT NOT NULL DEFAULT '',
+	created_at		TIMESTAMPTZ NOT NULL DEFAULT now(),
+	UNIQUE (subscription_id, event_key));
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE delivered_at IS NULL;
+
+CREATE TABLE webhook_dead_letters (
+	id				BIGINT PRIMARY KEY NOT NULL,
+	subscription_id	INT NOT NULL REFERENCES webhook_subscriptions (id) ON DELETE CASCADE,
+	event_key		VARCHAR(64) NOT NULL,
+	payload			JSONB NOT NULL,
+	attempts		INT NOT NULL,
+	last_error		TEXT NOT NULL DEFAULT '',
+	failed_at		TIMESTAMPTZ NOT NULL DEFAULT now());
+
+CREATE TABLE webhook_attempts (
+	id				BIGSERIAL PRIMARY KEY NOT NULL,
+	delivery_id		BIGINT NOT NULL,
+	status_code		INT NOT NULL DEFAULT 0,
+	error			TEXT NOT NULL DEFAULT '',
+	attempted_at	TIMESTAMPTZ NOT NULL DEFAULT now());
+
+CREATE INDEX webhook_attempts_delivery_id_idx ON webhook_attempts (delivery_id);
+
+CREATE TABLE outbox (
+	id			BIGSERIAL PRIMARY KEY NOT NULL,
+	account_id	INT NOT NULL,
+	type		VARCHAR(16) NOT NULL,
+	payload		JSONB NOT NULL,
+	created_at	TIMESTAMPTZ NOT NULL DEFAULT now(),
+	sent_at		TIMESTAMPTZ);
+
+CREATE INDEX outbox_unsent_idx ON outbox (id) WHERE sent_at IS NULL;
+
+CREATE TABLE account_status_history (
+	id			BIGSERIAL PRIMARY KEY NOT NULL,
+	user_id		INT NOT NULL REFERENCES user_balance (id),
+	status		VARCHAR(8) NOT NULL,
+	reason		TEXT NOT NULL,
+	created_at	TIMESTAMPTZ NOT NULL DEFAULT now());
+
+CREATE INDEX account_status_history_user_id_idx ON account_status_history (user_id, created_at);
+
+-- Spending limits, rows without user_id are the defaults of all accounts
+CREATE TABLE spending_limits (
+	id			SERIAL PRIMARY KEY NOT NULL,
+	user_id		INT REFERENCES user_balance (id),
+	operation	VARCHAR(16) NOT NULL CHECK (operation IN ('withdraw', 'transfer')),
+	period		VARCHAR(8) NOT NULL CHECK (period IN ('single', 'day', 'week', 'month')),
+	amount		DECIMAL(21,2) NOT NULL CHECK (amount >= 0));
+
+CREATE UNIQUE INDEX spending_limits_key_idx ON spending_limits (COALESCE(user_id, 0), operation, period);
+CREATE INDEX transactions_limits_idx ON transactions (from_id, type, currency, created_at);
+
+INSERT INTO spending_limits (operation, period, amount) VALUES
+	('withdraw', 'day', 50000),
+	('transfer', 'single', 15000);
+
+-- Fees of transfers per currency, transfers in a currency without a rule are free
+CREATE TABLE fee_rules (
+	currency		VARCHAR(3) PRIMARY KEY NOT NULL,
+	fixed			DECIMAL(21,2) NOT NULL DEFAULT 0 CHECK (fixed >= 0),
+	percent			DECIMAL(5,2) NOT NULL DEFAULT 0 CHECK (percent BETWEEN 0 AND 100),
+	min_fee			DECIMAL(21,2) NOT NULL DEFAULT 0 CHECK (min_fee >= 0),
+	max_fee			DECIMAL(21,2) NOT NULL DEFAULT 0 CHECK (max_fee >= 0),
+	free_per_month	INT NOT NULL DEFAULT 0 CHECK (free_per_month >= 0));
+
+-- Quotes of exchanges between the wallets of a user, a quote is used once before it expires
+CREATE TABLE exchange_quotes (
+	id				VARCHAR(32) PRIMARY KEY NOT NULL,
+	user_id			INT NOT NULL REFERENCES user_balance (id),
+	from_currency	VARCHAR(3) NOT NULL,
+	to_currency		VARCHAR(3) NOT NULL,
+	sum				DECIMAL(21,2) NOT NULL,
+	market_rate		DECIMAL(18,8) NOT NULL,
+	rate			DECIMAL(18,8) NOT NULL,
+	amount			DECIMAL(21,2) NOT NULL,
+	expires_at		TIMESTAMPTZ NOT NULL,
+	used_at			TIMESTAMPTZ,
+	debit_tx		BIGINT REFERENCES transactions (id),
+	credit_tx		BIGINT REFERENCES transactions (id),
+	created_at		TIMESTAMPTZ NOT NULL DEFAULT now());
+
+-- Rates of currencies fetched from the rates provider, rate is the price of base in quote
+CREATE TABLE currency_rates (
+	id				BIGSERIAL PRIMARY KEY NOT NULL,
+	base			VARCHAR(3) NOT NULL,
+	quote			VARCHAR(3) NOT NULL,
+	rate			DECIMAL(18,8) NOT NULL CHECK (rate > 0),
+	fetched_at		TIMESTAMPTZ NOT NULL DEFAULT now());
+
+CREATE INDEX currency_rates_pair_idx ON currency_rates (base, quote, fetched_at);
+
+-- Balances of the user wallets after the journal entry last_entry_id, taken_at is the time of the latest entry.
+-- A balance at a moment is the last snapshot before it plus the entries after the snapshot.
+CREATE TABLE balance_snapshots (
+	id				BIGSERIAL PRIMARY KEY NOT NULL,
+	account			VARCHAR(64) NOT NULL,
+	currency		VARCHAR(3) NOT NULL,
+	balance			DECIMAL(21,2) NOT NULL,
+	last_entry_id	BIGINT NOT NULL REFERENCES journal_entries (id),
+	taken_at		TIMESTAMPTZ NOT NULL);
+
+CREATE INDEX balance_snapshots_account_idx ON balance_snapshots (account, currency, taken_at);
+
+-- Promotional bonuses of the users, they can be spent only on the services until they expire.
+-- An empty list of services means any service.
+CREATE TABLE bonus_grants (
+	id				BIGSERIAL PRIMARY KEY NOT NULL,
+	user_id			INT NOT NULL REFERENCES user_balance (id),
+	amount			DECIMAL(21,2) NOT NULL CHECK (amount > 0),
+	remaining		DECIMAL(21,2) NOT NULL CHECK (remaining >= 0),
+	services		TEXT[] NOT NULL DEFAULT '{}',
+	comment			TEXT NOT NULL DEFAULT '',
+	expires_at		TIMESTAMPTZ NOT NULL,
+	expired_at		TIMESTAMPTZ,
+	created_at		TIMESTAMPTZ NOT NULL DEFAULT now());
+
+CREATE INDEX bonus_grants_user_idx ON bonus_grants (user_id, expires_at) WHERE remaining > 0;
+CREATE INDEX bonus_grants_expires_at_idx ON bonus_grants (expires_at) WHERE remaining > 0;
+
+-- Batches of voucher codes, every code credits amount and can be redeemed
+-- max_redemptions times, once per user, between valid_from and valid_until
+CREATE TABLE voucher_batches (
+	id				BIGSERIAL PRIMARY KEY NOT NULL,
+	amount			DECIMAL(21,2) NOT NULL CHECK (amount > 0),
+	currency		VARCHAR(3) NOT NULL,
+	count			INT NOT NULL CHECK (count > 0),
+	max_redemptions	INT NOT NULL CHECK (max_redemptions > 0),
+	valid_from		TIMESTAMPTZ NOT NULL,
+	valid_until		TIMESTAMPTZ NOT NULL,
+	comment			TEXT NOT NULL DEFAULT '',
+	created_at		TIMESTAMPTZ NOT NULL DEFAULT now());
+
+CREATE TABLE vouchers (
+	code			VARCHAR(14) PRIMARY KEY NOT NULL,
+	batch_id		BIGINT NOT NULL REFERENCES voucher_batches (id),
+	redemptions		INT NOT NULL DEFAULT 0);
+
+CREATE INDEX vouchers_batch_id_idx ON vouchers (batch_id);
+
+CREATE TABLE voucher_redemptions (
+	code			VARCHAR(14) NOT NULL REFERENCES vouchers (code),
+	user_id			INT NOT NULL REFERENCES user_balance (id),
+	transaction_id	BIGINT REFERENCES transactions (id),
+	created_at		TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (code, user_id));
+
+-- Scheduled operations: executed at due_at and repeated every interval_seconds
+-- or every month on day_of_month, a schedule with neither runs once.
+-- A failed run is retried at next_run_at, due_at stays the same.
+CREATE TABLE schedules (
+	id					BIGSERIAL PRIMARY KEY NOT NULL,
+	type				VARCHAR(16) NOT NULL CHECK (type IN ('transfer', 'debit')),
+	from_id				INT NOT NULL REFERENCES user_balance (id),
+	to_id				INT REFERENCES user_balance (id),
+	amount				DECIMAL(21,2) NOT NULL CHECK (amount > 0),
+	currency			VARCHAR(3) NOT NULL DEFAULT 'RUB',
+	comment				TEXT NOT NULL DEFAULT '',
+	interval_seconds	INT NOT NULL DEFAULT 0,
+	day_of_month		INT NOT NULL DEFAULT 0 CHECK (day_of_month BETWEEN 0 AND 31),
+	status				VARCHAR(16) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'completed', 'cancelled', 'failed')),
+	due_at				TIMESTAMPTZ NOT NULL,
+	next_run_at			TIMESTAMPTZ NOT NULL,
+	attempts			INT NOT NULL DEFAULT 0,
+	created_at			TIMESTAMPTZ NOT NULL DEFAULT now());
+
+CREATE INDEX schedules_due_idx ON schedules (next_run_at) WHERE status = 'active';
+CREATE INDEX schedules_from_id_idx ON schedules (from_id);
+
+CREATE TABLE schedule_runs (
+	id				BIGSERIAL PRIMARY KEY NOT NULL,
+	schedule_id		BIGINT NOT NULL REFERENCES schedules (id),
+	attempt			INT NOT NULL,
+	due_at			TIMESTAMPTZ NOT NULL,
+	run_at			TIMESTAMPTZ NOT NULL DEFAULT now(),
+	status			VARCHAR(16) NOT NULL,
+	error			TEXT NOT NULL DEFAULT '',
+	balance			DECIMAL(21,2) NOT NULL DEFAULT 0);
+
+CREATE INDEX schedule_runs_schedule_id_idx ON schedule_runs (schedule_id, id);
+
+-- Transfers waiting for the recipient to accept them.
+-- amount and fee are held in the sender's wallet until the transfer is resolved.
+CREATE TABLE pending_transfers (
+	id				BIGSERIAL PRIMARY KEY NOT NULL,
+	from_id			INT NOT NULL REFERENCES user_balance (id),
+	to_id			INT NOT NULL REFERENCES user_balance (id),
+	amount			DECIMAL(21,2) NOT NULL CHECK (amount > 0),
+	fee				DECIMAL(21,2) NOT NULL DEFAULT 0,
+	currency		VARCHAR(3) NOT NULL DEFAULT 'RUB',
+	status			VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'accepted', 'declined', 'cancelled', 'expired')),
+	created_at		TIMESTAMPTZ NOT NULL DEFAULT now(),
+	expires_at		TIMESTAMPTZ NOT NULL,
+	resolved_at		TIMESTAMPTZ);
+
+CREATE INDEX pending_transfers_expires_at_idx ON pending_transfers (expires_at) WHERE status = 'pending';
+CREATE INDEX pending_transfers_from_id_idx ON pending_transfers (from_id) WHERE status = 'pending';
+CREATE INDEX pending_transfers_to_id_idx ON pending_transfers (to_id) WHERE status = 'pending';
+
+-- Requests of users to other users to pay them.
+-- A pending request is expired once expires_at has passed, the status is not updated.
+CREATE TABLE payment_requests (
+	id				BIGSERIAL PRIMARY KEY NOT NULL,
+	requester_id	INT NOT NULL REFERENCES user_balance (id),
+	payer_id		INT NOT NULL REFERENCES user_balance (id),
+	amount			DECIMAL(21,2) NOT NULL CHECK (amount > 0),
+	currency		VARCHAR(3) NOT NULL DEFAULT 'RUB',
+	comment			TEXT NOT NULL DEFAULT '',
+	status			VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'paid', 'declined')),
+	transaction_id	BIGINT REFERENCES transactions (id),
+	created_at		TIMESTAMPTZ NOT NULL DEFAULT now(),
+	expires_at		TIMESTAMPTZ NOT NULL,
+	resolved_at		TIMESTAMPTZ);
+
+CREATE INDEX payment_requests_requester_id_idx ON payment_requests (requester_id, id);
+CREATE INDEX payment_requests_payer_id_idx ON payment_requests (payer_id, id);
+
+-- Purchases whose money is held on the escrow account of the deal, "escrow:<id>" in the ledger,
+-- until it is released to the seller, refunded to the buyer or split between them.
+CREATE TABLE escrow_deals (
+	id				BIGSERIAL PRIMARY KEY NOT NULL,
+	buyer_id		INT NOT NULL REFERENCES user_balance (id),
+	seller_id		INT NOT NULL REFERENCES user_balance (id),
+	amount			DECIMAL(21,2) NOT NULL CHECK (amount > 0),
+	currency		VARCHAR(3) NOT NULL DEFAULT 'RUB',
+	comment			TEXT NOT NULL DEFAULT '',
+	status			VARCHAR(16) NOT NULL DEFAULT 'funded' CHECK (status IN ('funded', 'disputed', 'released', 'refunded', 'split')),
+	created_at		TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at		TIMESTAMPTZ NOT NULL DEFAULT now());
+
+-- Changes of the states of escrow deals.
+-- to_seller and to_buyer are paid out of escrow by the change with the transactions next to them.
+CREATE TABLE escrow_deal_history (
+	id						BIGSERIAL PRIMARY KEY NOT NULL,
+	deal_id					BIGINT NOT NULL REFERENCES escrow_deals (id),
+	status					VARCHAR(16) NOT NULL,
+	actor					VARCHAR(16) NOT NULL CHECK (actor IN ('buyer', 'seller', 'admin')),
+	reason					TEXT NOT NULL DEFAULT '',
+	to_seller				DECIMAL(21,2) NOT NULL DEFAULT 0,
+	to_buyer				DECIMAL(21,2) NOT NULL DEFAULT 0,
+	seller_transaction_id	BIGINT REFERENCES transactions (id),
+	buyer_transaction_id	BIGINT REFERENCES transactions (id),
+	created_at				TIMESTAMPTZ NOT NULL DEFAULT now());
+
+CREATE INDEX escrow_deal_history_deal_id_idx ON escrow_deal_history (deal_id, id);
+
+-- Members of shared accounts.
+-- A spender with a period can spend spend_limit in RUB over the period, without a period there is no limit.
+CREATE TABLE account_members (
+	account_id		INT NOT NULL REFERENCES user_balance (id),
+	user_id			INT NOT NULL REFERENCES user_balance (id),
+	role			VARCHAR(8) NOT NULL CHECK (role IN ('owner', 'spender', 'viewer')),
+	spend_limit		DECIMAL(21,2) CHECK (spend_limit >= 0),
+	period			VARCHAR(8) CHECK (period IN ('single', 'day', 'week', 'month')),
+	created_at		TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (account_id, user_id),
+	CHECK ((spend_limit IS NULL) = (period IS NULL)),
+	CHECK (period IS NULL OR role = 'spender'));
+
+CREATE INDEX transactions_member_id_idx ON transactions (from_id, member_id, created_at) WHERE member_id IS NOT NULL;
+
+-- Daily charges of overdrawn accounts: interest on the overdraft and a fixed fee.
+-- Every account is charged once a day, transaction_id is NULL if nothing was charged.
+CREATE TABLE overdraft_accruals (
+	user_id			INT NOT NULL REFERENCES user_balance (id),
+	day				DATE NOT NULL,
+	overdraft		DECIMAL(21,2) NOT NULL,
+	interest		DECIMAL(21,2) NOT NULL,
+	fee				DECIMAL(21,2) NOT NULL,
+	transaction_id	BIGINT REFERENCES transactions (id),
+	created_at		TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (user_id, day));